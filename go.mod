@@ -1,13 +1,19 @@
 module github.com/thingio/edge-device-manager
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/emicklei/go-restful-openapi/v2 v2.8.0
 	github.com/emicklei/go-restful/v3 v3.7.3
+	github.com/evanphx/json-patch v4.12.0+incompatible
 	github.com/go-openapi/spec v0.20.4
 	github.com/gobwas/ws v1.1.0
+	github.com/mitchellh/mapstructure v1.4.2
 	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2
+	github.com/spf13/viper v1.9.0
 	github.com/thingio/edge-device-std v0.2.1
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/yaml.v2 v2.4.0
 )
 
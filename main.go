@@ -1,14 +1,30 @@
 package main
 
 import (
+	"fmt"
+	"github.com/thingio/edge-device-manager/pkg/config"
 	"github.com/thingio/edge-device-manager/pkg/metastore"
 	"github.com/thingio/edge-device-manager/pkg/startup"
+	"os"
 )
 
 func main() {
-	metaStore, err := metastore.NewFileMetaStore(metastore.DefaultFileMetaStorePath)
+	cfg, e := config.NewConfiguration(os.Args[0], os.Args[1:])
+	if e != nil {
+		panic(e)
+	}
+	if cfg.PrintConfig {
+		data, err := cfg.YAML()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Print(string(data))
+		return
+	}
+
+	metaStore, err := metastore.NewMetaStore(&cfg.ManagerOptions.MetaStore)
 	if err != nil {
 		panic(err)
 	}
-	startup.Startup(metaStore)
+	startup.Startup(cfg, metaStore)
 }
@@ -1,25 +1,77 @@
 package http
 
 import (
+	"context"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thingio/edge-device-manager/pkg/api/http/device"
+	"github.com/thingio/edge-device-manager/pkg/api/http/group"
+	"github.com/thingio/edge-device-manager/pkg/api/http/health"
+	"github.com/thingio/edge-device-manager/pkg/api/http/metrics"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
 	"github.com/thingio/edge-device-manager/pkg/api/http/product"
 	"github.com/thingio/edge-device-manager/pkg/api/http/protocol"
+	"github.com/thingio/edge-device-manager/pkg/api/http/stream"
 	"github.com/thingio/edge-device-manager/pkg/api/http/swagger"
+	"github.com/thingio/edge-device-manager/pkg/api/http/webhook"
+	healthcheck "github.com/thingio/edge-device-manager/pkg/health"
 	"github.com/thingio/edge-device-manager/pkg/metastore"
+	observer "github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	dispatch "github.com/thingio/edge-device-manager/pkg/webhook"
 	"github.com/thingio/edge-device-std/operations"
+	"sync"
 )
 
 const (
 	ApiRoot = "/api/v1"
 )
 
-func MountAllModules(protocols *cache.Cache, metaStore metastore.MetaStore,
-	mc operations.ManagerClient, ms operations.ManagerService) {
-	restful.Add(swagger.Resource{}.WebService("/apidocs"))
+// Dependencies contains everything the web services depend on.
+type Dependencies struct {
+	// Context is used to close all WebSocket sessions once it is done,
+	// and Sessions will be done after that.
+	Context  context.Context
+	Sessions *sync.WaitGroup
 
-	restful.Add(protocol.Resource{ProtocolCache: protocols}.WebService(ApiRoot + "/protocols"))
-	restful.Add(product.Resource{ProtocolCache: protocols, MetaStore: metaStore, OperationClient: mc}.WebService(ApiRoot + "/products"))
-	restful.Add(device.Resource{MetaStore: metaStore, OperationClient: mc, OperationService: ms}.WebService(ApiRoot + "/devices"))
+	ProtocolCache   *cache.Cache
+	DeviceStates    *healthcheck.DeviceStates
+	MetaStore       metastore.MetaStore
+	OperationClient operations.ManagerClient
+	Subscriptions   *subscription.Hub
+	Webhooks        *dispatch.Dispatcher
+
+	HealthChecker   *healthcheck.Checker
+	MetricsGatherer prometheus.Gatherer
+	SwaggerUIRoot   string
+}
+
+// MountAllModules registers all web services into the default container.
+func MountAllModules(deps *Dependencies) {
+	restful.Filter(problem.RequestIDFilter)
+	restful.Filter(observer.HTTPFilter)
+	restful.DefaultContainer.ServiceErrorHandler(problem.ServiceErrorHandler)
+
+	restful.Add(swagger.Resource{UIRoot: deps.SwaggerUIRoot}.WebService("/apidocs"))
+	restful.Add(health.Resource{Checker: deps.HealthChecker}.ProbeWebService("/"))
+	restful.Add(metrics.Resource{Gatherer: deps.MetricsGatherer}.WebService("/metrics"))
+	restful.Add(health.Resource{Checker: deps.HealthChecker}.WebService(ApiRoot + "/health"))
+
+	restful.Add(protocol.Resource{ProtocolCache: deps.ProtocolCache}.WebService(ApiRoot + "/protocols"))
+	devices := device.Resource{Context: deps.Context, Sessions: deps.Sessions, ProtocolCache: deps.ProtocolCache,
+		DeviceStates: deps.DeviceStates, MetaStore: deps.MetaStore, OperationClient: deps.OperationClient,
+		Subscriptions: deps.Subscriptions}
+	products := product.Resource{ProtocolCache: deps.ProtocolCache, MetaStore: deps.MetaStore,
+		OperationClient: deps.OperationClient}.WebService(ApiRoot + "/products")
+	devices.ProvisioningRoutes(products)
+	restful.Add(products)
+	restful.Add(devices.WebService(ApiRoot + "/devices"))
+	restful.Add(devices.BatchWebService(ApiRoot + "/devices:batch"))
+	restful.Add(devices.DataReadWebService(ApiRoot + "/data:read"))
+	restful.Add(devices.DataWriteWebService(ApiRoot + "/data:write"))
+	restful.Add(group.Resource{MetaStore: deps.MetaStore}.WebService(ApiRoot + "/groups"))
+	restful.Add(stream.Resource{Context: deps.Context, Sessions: deps.Sessions, MetaStore: deps.MetaStore,
+		Subscriptions: deps.Subscriptions}.WebService(ApiRoot + "/stream"))
+	restful.Add(webhook.Resource{MetaStore: deps.MetaStore, Dispatcher: deps.Webhooks}.WebService(ApiRoot + "/webhooks"))
 }
@@ -0,0 +1,361 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+)
+
+const (
+	// BatchModeAtomic applies all operations of the batch or none of them.
+	BatchModeAtomic = "atomic"
+	// BatchModeBestEffort applies valid operations of the batch and skips the invalid ones.
+	BatchModeBestEffort = "best-effort"
+
+	BatchOperationCreate = "create"
+	BatchOperationUpdate = "update"
+	BatchOperationDelete = "delete"
+
+	// maxBatchSize limits the number of operations in a batch.
+	maxBatchSize = 1000
+)
+
+// BatchRequest contains operations to create, update or delete devices.
+type BatchRequest struct {
+	Mode       string            `json:"mode"`    // BatchModeAtomic by default
+	DryRun     bool              `json:"dry_run"` // only validate operations without applying them
+	Operations []*BatchOperation `json:"operations"`
+}
+
+type BatchOperation struct {
+	Op       string            `json:"op"`                  // one of create, update and delete
+	Device   *models.Device    `json:"device,omitempty"`    // required by create and update
+	DeviceID string            `json:"device_id,omitempty"` // required by delete
+	Labels   *metastore.Labels `json:"labels,omitempty"`    // replaces labels of the device if it is specified
+
+	invalid string // the reason why the operation is invalid before it is planned
+	line    int    // the line of the operation in the imported CSV
+}
+
+// BatchResult is the result of an operation, its status is the HTTP status code of the equivalent single request.
+type BatchResult struct {
+	Index    int    `json:"index"`
+	Op       string `json:"op"`
+	Line     int    `json:"line,omitempty"` // the line in the imported CSV, including the header
+	DeviceID string `json:"device_id"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Mode      string         `json:"mode"`
+	DryRun    bool           `json:"dry_run,omitempty"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []*BatchResult `json:"results"`
+	// DriverErrors are errors occurred while notifying drivers, keyed by protocol IDs,
+	// the devices are already changed even though their drivers are not notified.
+	DriverErrors map[string]string `json:"driver_errors,omitempty"`
+}
+
+// change is a validated operation which is ready to be applied into the meta store.
+type change struct {
+	result         *BatchResult
+	device         *models.Device    // the device to be created or updated
+	previous       *models.Device    // the device to be updated or deleted
+	labels         *metastore.Labels // the requested labels of the device to be created or updated
+	previousLabels *metastore.Labels
+	protocolID     string
+	applied        bool
+}
+
+func (r Resource) batchDevices(request *restful.Request, response *restful.Response) {
+	batch := new(BatchRequest)
+	if err := request.ReadEntity(batch); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if batch.Mode == "" {
+		batch.Mode = BatchModeAtomic
+	}
+	if batch.Mode != BatchModeAtomic && batch.Mode != BatchModeBestEffort {
+		problem.Write(response, problem.BadRequest(nil, "unsupported batch mode %s, only supporting %s and %s",
+			batch.Mode, BatchModeAtomic, BatchModeBestEffort))
+		return
+	}
+	if len(batch.Operations) == 0 || len(batch.Operations) > maxBatchSize {
+		problem.Write(response, problem.BadRequest(nil, "the batch should contain 1 to %d operations", maxBatchSize))
+		return
+	}
+
+	resp, status := r.batch(batch)
+	_ = response.WriteHeaderAndEntity(status, resp)
+}
+
+// batch validates and applies operations of the batch, and returns the HTTP status code of the whole batch.
+func (r Resource) batch(batch *BatchRequest) (*BatchResponse, int) {
+	resp := &BatchResponse{Mode: batch.Mode, DryRun: batch.DryRun, Results: make([]*BatchResult, len(batch.Operations))}
+	changes := r.plan(batch.Operations, resp.Results)
+	if batch.Mode == BatchModeAtomic && len(changes) != len(batch.Operations) {
+		for _, c := range changes {
+			c.result.Status = http.StatusFailedDependency
+			c.result.Error = "not applied because other operations of the batch are invalid"
+		}
+		resp.count()
+		return resp, http.StatusBadRequest
+	}
+	if batch.DryRun {
+		resp.count()
+		return resp, http.StatusOK
+	}
+
+	for _, c := range changes {
+		if err := r.apply(c); err != nil {
+			c.result.Status = problem.Wrap(err, "").Status
+			c.result.Error = err.Error()
+			if batch.Mode == BatchModeAtomic {
+				r.rollback(changes)
+				resp.count()
+				return resp, http.StatusInternalServerError
+			}
+			continue
+		}
+		c.applied = true
+	}
+
+	resp.DriverErrors = r.notify(changes)
+	resp.count()
+	return resp, http.StatusOK
+}
+
+// plan validates all operations, and returns changes of the valid ones.
+// Results of invalid operations are filled with their errors.
+func (r Resource) plan(operations []*BatchOperation, results []*BatchResult) []*change {
+	products := make(map[string]*models.Product)
+	getProduct := func(productID string) (*models.Product, error) {
+		if product, ok := products[productID]; ok {
+			return product, nil
+		}
+		product, err := r.MetaStore.GetProduct(productID)
+		if err != nil {
+			return nil, err
+		}
+		products[productID] = product
+		return product, nil
+	}
+	fail := func(result *BatchResult, status int, format string, args ...interface{}) {
+		result.Status, result.Error = status, fmt.Sprintf(format, args...)
+	}
+
+	changes := make([]*change, 0, len(operations))
+	seen := make(map[string]struct{}, len(operations))
+	for i, o := range operations {
+		result := &BatchResult{Index: i, Line: o.line, Op: o.Op, DeviceID: o.DeviceID}
+		results[i] = result
+		if o.Op == BatchOperationCreate || o.Op == BatchOperationUpdate {
+			if o.Device == nil {
+				fail(result, http.StatusBadRequest, "the device is required by the operation %s", o.Op)
+				continue
+			}
+			result.DeviceID = o.Device.ID
+		}
+		if o.invalid != "" {
+			fail(result, http.StatusBadRequest, "%s", o.invalid)
+			continue
+		}
+		if o.Labels != nil {
+			if err := o.Labels.Validate(); err != nil {
+				fail(result, http.StatusUnprocessableEntity, "%s", err.Error())
+				continue
+			}
+		}
+		deviceID := result.DeviceID
+		if deviceID == "" {
+			fail(result, http.StatusBadRequest, "the device's ID is required")
+			continue
+		}
+		if _, ok := seen[deviceID]; ok {
+			fail(result, http.StatusConflict, "the device[%s] is operated more than once in the batch", deviceID)
+			continue
+		}
+		seen[deviceID] = struct{}{}
+
+		c := &change{result: result, labels: o.Labels}
+		previous, err := r.MetaStore.GetDevice(deviceID)
+		if err != nil && !errors.Is(err, metastore.ErrNotFound) {
+			err = problem.Wrap(err, "fail to get the device[%s]", deviceID)
+			status, _ := problem.Of(err)
+			fail(result, status, "%s", err.Error())
+			continue
+		}
+		switch o.Op {
+		case BatchOperationCreate:
+			if err == nil {
+				fail(result, http.StatusConflict, "the device[%s] is already created", deviceID)
+				continue
+			}
+			c.device = o.Device
+			if c.device.Name == "" {
+				c.device.Name = deviceID
+			}
+			if c.device.DeviceStatus == "" {
+				c.device.DeviceStatus = models.DeviceStateDisconnected
+			}
+		case BatchOperationUpdate:
+			if err != nil {
+				fail(result, http.StatusNotFound, "the device[%s] is not found", deviceID)
+				continue
+			}
+			c.device, c.previous = o.Device, previous
+			if c.device.ProductID == "" {
+				c.device.ProductID = previous.ProductID
+			} else if c.device.ProductID != previous.ProductID {
+				fail(result, http.StatusUnprocessableEntity, "the product of the device[%s] could not be changed", deviceID)
+				continue
+			}
+			if c.device.DeviceStatus == "" {
+				c.device.DeviceStatus = previous.DeviceStatus
+			}
+			if c.previousLabels, err = r.MetaStore.GetDeviceLabels(deviceID); err != nil {
+				fail(result, http.StatusInternalServerError, "fail to get labels of the device[%s], got %s", deviceID, err.Error())
+				continue
+			}
+		case BatchOperationDelete:
+			if err != nil {
+				fail(result, http.StatusNotFound, "the device[%s] is not found", deviceID)
+				continue
+			}
+			c.previous, c.labels = previous, nil
+			if c.previousLabels, err = r.MetaStore.GetDeviceLabels(deviceID); err != nil {
+				fail(result, http.StatusInternalServerError, "fail to get labels of the device[%s], got %s", deviceID, err.Error())
+				continue
+			}
+		default:
+			fail(result, http.StatusBadRequest, "unsupported operation %s, only supporting %s, %s and %s",
+				o.Op, BatchOperationCreate, BatchOperationUpdate, BatchOperationDelete)
+			continue
+		}
+
+		var productID string
+		if c.device != nil {
+			productID = c.device.ProductID
+		} else {
+			productID = c.previous.ProductID
+		}
+		if productID == "" {
+			fail(result, http.StatusUnprocessableEntity, "the device[%s]'s product must be specified", deviceID)
+			continue
+		}
+		product, err := getProduct(productID)
+		if err != nil {
+			fail(result, http.StatusNotFound, "the product[%s] is not found", productID)
+			continue
+		}
+		if c.device != nil {
+			c.device.ProductName = product.Name
+		}
+		c.protocolID = product.Protocol
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// apply writes the change into the meta store.
+func (r Resource) apply(c *change) error {
+	var err error
+	switch c.result.Op {
+	case BatchOperationCreate:
+		err = r.MetaStore.CreateDevice(c.device)
+	case BatchOperationUpdate:
+		err = r.MetaStore.UpdateDevice(c.device)
+	default:
+		return r.MetaStore.DeleteDevice(c.result.DeviceID)
+	}
+	if err != nil || c.labels == nil {
+		return err
+	}
+	if err = r.MetaStore.UpdateDeviceLabels(c.result.DeviceID, c.labels); err != nil && c.result.Op == BatchOperationCreate {
+		_ = r.MetaStore.DeleteDevice(c.result.DeviceID) // the creation should be atomic
+	}
+	return err
+}
+
+// rollback reverts all applied changes in the reverse order, and marks them as failed.
+func (r Resource) rollback(changes []*change) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		if c.result.Status == 0 {
+			c.result.Status = http.StatusFailedDependency
+			c.result.Error = "not applied because another operation of the batch is failed"
+		}
+		if !c.applied {
+			continue
+		}
+		var err error
+		switch c.result.Op {
+		case BatchOperationCreate:
+			err = r.MetaStore.DeleteDevice(c.result.DeviceID)
+		case BatchOperationUpdate:
+			if err = r.MetaStore.UpdateDevice(c.previous); err == nil && c.labels != nil {
+				err = r.MetaStore.UpdateDeviceLabels(c.result.DeviceID, c.previousLabels)
+			}
+		default:
+			if err = r.MetaStore.CreateDevice(c.previous); err == nil {
+				err = r.MetaStore.UpdateDeviceLabels(c.result.DeviceID, c.previousLabels)
+			}
+		}
+		c.applied = false
+		c.result.Error = "rolled back because another operation of the batch is failed"
+		if err != nil {
+			c.result.Error = fmt.Sprintf("fail to roll back, got %s", err.Error())
+		}
+	}
+}
+
+// notify sends one message to the driver of each protocol changed by the batch, instead of one per device,
+// the message carries the products and the devices to connect of the protocol, the same as when the driver is
+// initialized, so the driver receives the whole set once. The driver won't be notified if nothing is applied.
+func (r Resource) notify(changes []*change) map[string]string {
+	protocolIDs := make([]string, 0)
+	touched := make(map[string]bool)
+	for _, c := range changes {
+		if !c.applied || touched[c.protocolID] {
+			continue
+		}
+		touched[c.protocolID] = true
+		protocolIDs = append(protocolIDs, c.protocolID)
+	}
+
+	driverErrors := make(map[string]string)
+	for _, protocolID := range protocolIDs {
+		products, devices, err := metastore.DriverMetas(r.MetaStore, protocolID)
+		if err == nil {
+			err = r.OperationClient.InitDriver(protocolID, products, devices)
+		}
+		if err != nil {
+			driverErrors[protocolID] = fmt.Sprintf("fail to send the devices to the driver, got %s", err.Error())
+		}
+	}
+	if len(driverErrors) == 0 {
+		return nil
+	}
+	return driverErrors
+}
+
+func (b *BatchResponse) count() {
+	b.Succeeded, b.Failed = 0, 0
+	for _, result := range b.Results {
+		if result.Status == 0 {
+			result.Status = http.StatusOK
+		}
+		if result.Status < http.StatusBadRequest {
+			b.Succeeded++
+		} else {
+			b.Failed++
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package device
+
+import (
+	"errors"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeClient records the devices sent to each driver by InitDriver.
+type fakeClient struct {
+	operations.ManagerClient
+
+	inits map[string][]string // protocol ID -> IDs of the devices sent
+}
+
+func (c *fakeClient) InitDriver(protocolID string, products []*models.Product, devices []*models.Device) error {
+	if c.inits == nil {
+		c.inits = make(map[string][]string)
+	}
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+	sort.Strings(ids)
+	c.inits[protocolID] = ids
+	return nil
+}
+
+// failingStore fails to create the device with the ID.
+type failingStore struct {
+	metastore.MetaStore
+
+	deviceID string
+}
+
+func (s *failingStore) CreateDevice(device *models.Device) error {
+	if device.ID == s.deviceID {
+		return errors.New("disk is full")
+	}
+	return s.MetaStore.CreateDevice(device)
+}
+
+// newTestResource returns a resource with the products p1 and p2 of the protocols modbus and opcua,
+// and the connected device d1 and the disconnected device d2 of the product p1.
+func newTestResource(t *testing.T) (Resource, *fakeClient) {
+	t.Helper()
+	store, err := metastore.NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, product := range []*models.Product{
+		{ID: "p1", Name: "P1", Protocol: "modbus"},
+		{ID: "p2", Name: "P2", Protocol: "opcua"},
+	} {
+		if err = store.CreateProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, device := range []*models.Device{
+		{ID: "d1", Name: "D1", ProductID: "p1", ProductName: "P1", DeviceStatus: models.DeviceStateConnected},
+		{ID: "d2", Name: "D2", ProductID: "p1", ProductName: "P1", DeviceStatus: models.DeviceStateDisconnected},
+	} {
+		if err = store.CreateDevice(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := new(fakeClient)
+	return Resource{MetaStore: store, OperationClient: client}, client
+}
+
+func statuses(resp *BatchResponse) []int {
+	s := make([]int, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		s = append(s, result.Status)
+	}
+	return s
+}
+
+func TestBatchAtomicRejectsInvalidOperations(t *testing.T) {
+	r, client := newTestResource(t)
+	resp, status := r.batch(&BatchRequest{Mode: BatchModeAtomic, Operations: []*BatchOperation{
+		{Op: BatchOperationCreate, Device: &models.Device{ID: "d3", ProductID: "p1"}},
+		{Op: BatchOperationDelete, DeviceID: "missing"},
+	}})
+
+	if status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if got, want := statuses(resp), []int{http.StatusFailedDependency, http.StatusNotFound}; !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if _, err := r.MetaStore.GetDevice("d3"); !errors.Is(err, metastore.ErrNotFound) {
+		t.Errorf("the device d3 should not be created, got %v", err)
+	}
+	if client.inits != nil {
+		t.Errorf("drivers are notified with %v, want none", client.inits)
+	}
+}
+
+func TestBatchBestEffortAppliesValidOperations(t *testing.T) {
+	r, client := newTestResource(t)
+	resp, status := r.batch(&BatchRequest{Mode: BatchModeBestEffort, Operations: []*BatchOperation{
+		{Op: BatchOperationCreate, Device: &models.Device{ID: "d3", ProductID: "p1", DeviceStatus: models.DeviceStateReconnecting}},
+		{Op: BatchOperationDelete, DeviceID: "missing"},
+		{Op: BatchOperationUpdate, Device: &models.Device{ID: "d2", Name: "renamed"}},
+	}})
+
+	if status != http.StatusOK {
+		t.Errorf("status = %d, want %d", status, http.StatusOK)
+	}
+	if got, want := statuses(resp), []int{http.StatusOK, http.StatusNotFound, http.StatusOK}; !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if resp.Succeeded != 2 || resp.Failed != 1 {
+		t.Errorf("succeeded %d and failed %d, want 2 and 1", resp.Succeeded, resp.Failed)
+	}
+	d2, err := r.MetaStore.GetDevice("d2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.Name != "renamed" || d2.DeviceStatus != models.DeviceStateDisconnected || d2.ProductName != "P1" {
+		t.Errorf("the updated device = %+v, want its status and product kept", d2)
+	}
+
+	// the driver of modbus is notified once with all devices to connect, the disconnected d2 is excluded
+	if want := map[string][]string{"modbus": {"d1", "d3"}}; !reflect.DeepEqual(client.inits, want) {
+		t.Errorf("drivers are notified with %v, want %v", client.inits, want)
+	}
+}
+
+func TestBatchDryRun(t *testing.T) {
+	r, client := newTestResource(t)
+	resp, status := r.batch(&BatchRequest{Mode: BatchModeAtomic, DryRun: true, Operations: []*BatchOperation{
+		{Op: BatchOperationDelete, DeviceID: "d1"},
+	}})
+
+	if status != http.StatusOK || resp.Succeeded != 1 {
+		t.Errorf("status = %d and succeeded %d, want %d and 1", status, resp.Succeeded, http.StatusOK)
+	}
+	if _, err := r.MetaStore.GetDevice("d1"); err != nil {
+		t.Errorf("the device d1 should not be deleted by a dry run, got %v", err)
+	}
+	if client.inits != nil {
+		t.Errorf("drivers are notified with %v, want none", client.inits)
+	}
+}
+
+func TestBatchAtomicRollsBack(t *testing.T) {
+	r, client := newTestResource(t)
+	r.MetaStore = &failingStore{MetaStore: r.MetaStore, deviceID: "d4"}
+	resp, status := r.batch(&BatchRequest{Mode: BatchModeAtomic, Operations: []*BatchOperation{
+		{Op: BatchOperationDelete, DeviceID: "d1"},
+		{Op: BatchOperationCreate, Device: &models.Device{ID: "d3", ProductID: "p2"},
+			Labels: &metastore.Labels{Labels: map[string]string{"site": "a"}}},
+		{Op: BatchOperationCreate, Device: &models.Device{ID: "d4", ProductID: "p1"}},
+	}})
+
+	if status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+	want := []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusInternalServerError}
+	if got := statuses(resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if _, err := r.MetaStore.GetDevice("d1"); err != nil {
+		t.Errorf("the deleted device d1 should be restored, got %v", err)
+	}
+	if _, err := r.MetaStore.GetDevice("d3"); !errors.Is(err, metastore.ErrNotFound) {
+		t.Errorf("the created device d3 should be removed, got %v", err)
+	}
+	if client.inits != nil {
+		t.Errorf("drivers are notified with %v, want none", client.inits)
+	}
+}
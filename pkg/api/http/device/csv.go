@@ -0,0 +1,439 @@
+package device
+
+import (
+	"encoding/csv"
+	"fmt"
+	restfulspec "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MIME_CSV = "text/csv"
+
+	PathParamProductID     = "product-id"
+	PathParamProductIDDesc = "the identifier of the product which the devices belong to"
+	PathParamProductIDType = "string"
+
+	QueryParamMode     = "mode"
+	QueryParamModeDesc = "whether to import all rows or none of them(atomic), or only the valid rows(best-effort)"
+	QueryParamModeType = "string"
+
+	QueryParamUpsert     = "upsert"
+	QueryParamUpsertDesc = "whether to update the existing devices, otherwise they are reported as conflicts"
+	QueryParamUpsertType = "boolean"
+
+	QueryParamDryRun     = "dry-run"
+	QueryParamDryRunDesc = "only validate rows and return the report without importing them"
+	QueryParamDryRunType = "boolean"
+
+	ColumnID     = "id"
+	ColumnName   = "name"
+	ColumnDesc   = "desc"
+	ColumnLabels = "labels" // e.g. "site=shanghai;line=l1"
+	ColumnTags   = "tags"   // e.g. "critical;outdoor"
+	// ColumnPropPrefix prefixes the columns of protocol-specific device properties, e.g. "prop:ip".
+	ColumnPropPrefix = "prop:"
+
+	cellSeparator     = ";"
+	labelKVSeparator  = "="
+	provisioningTitle = "DEVICE PROVISIONING"
+)
+
+var fixedColumns = []string{ColumnID, ColumnName, ColumnDesc, ColumnLabels, ColumnTags}
+
+// ProvisioningRoutes adds routes of the CSV provisioning into the web service of products,
+// because they are sub-resources of products, e.g. "/api/v1/products/{product-id}/devices:import".
+func (r Resource) ProvisioningRoutes(ws *restful.WebService) {
+	tags := []string{provisioningTitle}
+
+	ws.Route(ws.POST(fmt.Sprintf("/{%s}/devices:import", PathParamProductID)).To(r.importDevices).
+		// docs
+		Doc("import devices of a product from CSV").
+		Notes("The first row is the header, and the columns are '"+strings.Join(fixedColumns, "', '")+"' and "+
+			"'"+ColumnPropPrefix+"<property>' for each device property of the protocol, only 'id' is required. "+
+			"Labels and tags are separated by '"+cellSeparator+"', e.g. 'site=shanghai;line=l1'. "+
+			"The validation report contains the result of each row, and the line of each row includes the header.").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Consumes(MIME_CSV).
+		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
+		Param(ws.QueryParameter(QueryParamMode, QueryParamModeDesc).DataType(QueryParamModeType).
+			PossibleValues([]string{BatchModeAtomic, BatchModeBestEffort}).DefaultValue(BatchModeAtomic)).
+		Param(ws.QueryParameter(QueryParamUpsert, QueryParamUpsertDesc).DataType(QueryParamUpsertType).
+			DefaultValue("false")).
+		Param(ws.QueryParameter(QueryParamDryRun, QueryParamDryRunDesc).DataType(QueryParamDryRunType).
+			DefaultValue("false")).
+		Writes(BatchResponse{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), BatchResponse{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), BatchResponse{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), BatchResponse{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/devices:export", PathParamProductID)).To(r.exportDevices).
+		// docs
+		Doc("export devices of a product as CSV, which could be imported again").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Produces(MIME_CSV).
+		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/devices:template", PathParamProductID)).To(r.exportTemplate).
+		// docs
+		Doc("download the CSV template to import devices of a product").
+		Notes("The columns of device properties are generated from the protocol of the product, "+
+			"so the driver of the protocol should be online.").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Produces(MIME_CSV).
+		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}))
+}
+
+func (r Resource) importDevices(request *restful.Request, response *restful.Response) {
+	productID := request.PathParameter(PathParamProductID)
+	if productID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
+		return
+	}
+	batch := &BatchRequest{Mode: request.QueryParameter(QueryParamMode)}
+	if batch.Mode == "" {
+		batch.Mode = BatchModeAtomic
+	}
+	if batch.Mode != BatchModeAtomic && batch.Mode != BatchModeBestEffort {
+		problem.Write(response, problem.BadRequest(nil, "unsupported mode %s, only supporting %s and %s",
+			batch.Mode, BatchModeAtomic, BatchModeBestEffort))
+		return
+	}
+	var upsert bool
+	for param, value := range map[string]*bool{QueryParamUpsert: &upsert, QueryParamDryRun: &batch.DryRun} {
+		if v := request.QueryParameter(param); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				problem.Write(response, problem.BadRequest(nil, "the query parameter[%s] must be a boolean", param))
+				return
+			}
+			*value = b
+		}
+	}
+	product, err := r.MetaStore.GetProduct(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
+		return
+	}
+
+	reader := csv.NewReader(request.Request.Body)
+	reader.FieldsPerRecord = -1 // the number of fields is verified by the header
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the CSV"))
+		return
+	}
+	if len(records) < 2 || len(records)-1 > maxBatchSize {
+		problem.Write(response, problem.BadRequest(nil,
+			"the CSV should contain a header and 1 to %d rows", maxBatchSize))
+		return
+	}
+	header, err := r.parseHeader(product, records[0])
+	if err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the header of the CSV"))
+		return
+	}
+	for i, record := range records[1:] {
+		o := header.operation(record)
+		o.line = i + 2
+		o.Op = BatchOperationCreate
+		if existing, err := r.MetaStore.GetDevice(o.Device.ID); err == nil && upsert {
+			o.Op, o.Device = BatchOperationUpdate, header.merge(existing, o.Device)
+		}
+		header.complete(o)
+		o.Device.ProductID = productID // the device of another product will be rejected
+		batch.Operations = append(batch.Operations, o)
+	}
+
+	resp, status := r.batch(batch)
+	_ = response.WriteHeaderAndEntity(status, resp)
+}
+
+func (r Resource) exportDevices(request *restful.Request, response *restful.Response) {
+	productID := request.PathParameter(PathParamProductID)
+	if productID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
+		return
+	}
+	product, err := r.MetaStore.GetProduct(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
+		return
+	}
+	devices, err := r.MetaStore.ListDevices(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to list devices of the product[%s]", productID))
+		return
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+
+	// the properties defined by the protocol come first, and then the others found in devices
+	props := r.protocolProps(product)
+	for _, device := range devices {
+		extra := make([]string, 0)
+		for prop := range device.DeviceProps {
+			if !containsString(props, prop) {
+				extra = append(extra, prop)
+			}
+		}
+		sort.Strings(extra)
+		props = append(props, extra...)
+	}
+
+	rows := make([][]string, 0, len(devices))
+	for _, device := range devices {
+		labels, err := r.MetaStore.GetDeviceLabels(device.ID)
+		if err != nil {
+			problem.Write(response, problem.Wrap(err, "fail to get labels of the device[%s]", device.ID))
+			return
+		}
+		row := []string{device.ID, device.Name, device.Desc, formatLabels(labels.Labels),
+			strings.Join(labels.Tags, cellSeparator)}
+		for _, prop := range props {
+			row = append(row, device.DeviceProps[prop])
+		}
+		rows = append(rows, row)
+	}
+	writeCSV(response, fmt.Sprintf("%s-devices.csv", productID), header(props), rows)
+}
+
+func (r Resource) exportTemplate(request *restful.Request, response *restful.Response) {
+	productID := request.PathParameter(PathParamProductID)
+	if productID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
+		return
+	}
+	product, err := r.MetaStore.GetProduct(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
+		return
+	}
+	if _, ok := r.protocol(product); !ok {
+		problem.Write(response, problem.Unavailable(nil,
+			"the protocol[%s] of the product[%s] is not registered by any driver",
+			product.Protocol, productID))
+		return
+	}
+	writeCSV(response, fmt.Sprintf("%s-devices-template.csv", productID), header(r.protocolProps(product)), nil)
+}
+
+// csvHeader maps columns of the CSV into fields of the device.
+type csvHeader struct {
+	columns  []string
+	props    map[string]*models.Property // property name -> definition, nil if the protocol is unknown
+	required []string
+}
+
+func (r Resource) parseHeader(product *models.Product, record []string) (*csvHeader, error) {
+	h := &csvHeader{columns: make([]string, len(record))}
+	if protocol, ok := r.protocol(product); ok {
+		h.props = make(map[string]*models.Property)
+		for _, prop := range protocol.DeviceProps {
+			h.props[prop.Name] = prop
+			if prop.Required && prop.Default == "" {
+				h.required = append(h.required, prop.Name)
+			}
+		}
+	}
+
+	seen := make(map[string]struct{}, len(record))
+	for i, column := range record {
+		column = strings.TrimSpace(column)
+		if _, ok := seen[column]; ok {
+			return nil, fmt.Errorf("the column '%s' is duplicated", column)
+		}
+		seen[column] = struct{}{}
+		h.columns[i] = column
+
+		if containsString(fixedColumns, column) {
+			continue
+		}
+		if !strings.HasPrefix(column, ColumnPropPrefix) {
+			return nil, fmt.Errorf("unknown column '%s', the column of a device property should be prefixed by '%s'",
+				column, ColumnPropPrefix)
+		}
+		if prop := strings.TrimPrefix(column, ColumnPropPrefix); h.props != nil && h.props[prop] == nil {
+			return nil, fmt.Errorf("the device property '%s' is not defined by the protocol[%s]", prop, product.Protocol)
+		}
+	}
+	if _, ok := seen[ColumnID]; !ok {
+		return nil, fmt.Errorf("the column '%s' is required", ColumnID)
+	}
+	return h, nil
+}
+
+// operation converts the record into an operation, the reason is recorded if the record is invalid.
+func (h *csvHeader) operation(record []string) *BatchOperation {
+	device := &models.Device{DeviceProps: make(map[string]string)}
+	o := &BatchOperation{Device: device}
+	if len(record) != len(h.columns) {
+		o.invalid = fmt.Sprintf("the row has %d columns, but the header has %d", len(record), len(h.columns))
+	}
+	var labels *metastore.Labels
+	for i, column := range h.columns {
+		if i >= len(record) {
+			break
+		}
+		value := strings.TrimSpace(record[i])
+		switch column {
+		case ColumnID:
+			device.ID = value
+		case ColumnName:
+			device.Name = value
+		case ColumnDesc:
+			device.Desc = value
+		case ColumnLabels, ColumnTags:
+			if labels == nil {
+				labels = new(metastore.Labels)
+			}
+			if column == ColumnTags {
+				labels.Tags = splitCell(value)
+				break
+			}
+			parsed, err := parseLabels(value)
+			if err != nil && o.invalid == "" {
+				o.invalid = err.Error()
+			}
+			labels.Labels = parsed
+		default:
+			if value != "" {
+				device.DeviceProps[strings.TrimPrefix(column, ColumnPropPrefix)] = value
+			}
+		}
+	}
+	o.Labels = labels
+	return o
+}
+
+// complete fills the defaults of the device properties absent, and verifies the required ones are present.
+// It is applied to the device to create, or the existing one merged with the row, so that the properties
+// of the existing device are neither overridden by defaults nor reported as missing.
+func (h *csvHeader) complete(o *BatchOperation) {
+	device := o.Device
+	if device.DeviceProps == nil {
+		device.DeviceProps = make(map[string]string)
+	}
+	for name, prop := range h.props {
+		if _, ok := device.DeviceProps[name]; !ok && prop.Default != "" {
+			device.DeviceProps[name] = prop.Default
+		}
+	}
+	for _, name := range h.required {
+		if _, ok := device.DeviceProps[name]; !ok && o.invalid == "" {
+			o.invalid = fmt.Sprintf("the device property '%s' is required", name)
+		}
+	}
+}
+
+// merge overrides the existing device by the columns present in the CSV, and keeps the other fields.
+func (h *csvHeader) merge(existing, device *models.Device) *models.Device {
+	merged := *existing
+	if containsString(h.columns, ColumnName) {
+		merged.Name = device.Name
+	}
+	if containsString(h.columns, ColumnDesc) {
+		merged.Desc = device.Desc
+	}
+	merged.DeviceProps = make(map[string]string, len(existing.DeviceProps)+len(device.DeviceProps))
+	for k, v := range existing.DeviceProps {
+		merged.DeviceProps[k] = v
+	}
+	for k, v := range device.DeviceProps {
+		merged.DeviceProps[k] = v
+	}
+	return &merged
+}
+
+func (r Resource) protocol(product *models.Product) (*models.Protocol, bool) {
+	if r.ProtocolCache == nil {
+		return nil, false
+	}
+	v, ok := r.ProtocolCache.Get(product.Protocol)
+	if !ok {
+		return nil, false
+	}
+	protocol, ok := v.(*models.Protocol)
+	return protocol, ok
+}
+
+// protocolProps returns names of device properties defined by the protocol of the product.
+func (r Resource) protocolProps(product *models.Product) []string {
+	props := make([]string, 0)
+	if protocol, ok := r.protocol(product); ok {
+		for _, prop := range protocol.DeviceProps {
+			props = append(props, prop.Name)
+		}
+	}
+	return props
+}
+
+func header(props []string) []string {
+	columns := append([]string{}, fixedColumns...)
+	for _, prop := range props {
+		columns = append(columns, ColumnPropPrefix+prop)
+	}
+	return columns
+}
+
+func writeCSV(response *restful.Response, filename string, header []string, rows [][]string) {
+	response.AddHeader("Content-Type", MIME_CSV)
+	response.AddHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	response.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(response)
+	_ = writer.Write(header)
+	_ = writer.WriteAll(rows) // WriteAll flushes the writer
+}
+
+func parseLabels(cell string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range splitCell(cell) {
+		idx := strings.Index(kv, labelKVSeparator)
+		if idx <= 0 {
+			return nil, fmt.Errorf("the label '%s' should be like 'key=value'", kv)
+		}
+		labels[strings.TrimSpace(kv[:idx])] = strings.TrimSpace(kv[idx+1:])
+	}
+	return labels, nil
+}
+
+func formatLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, k+labelKVSeparator+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, cellSeparator)
+}
+
+func splitCell(cell string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(cell, cellSeparator) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
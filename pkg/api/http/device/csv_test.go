@@ -0,0 +1,156 @@
+package device
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newProvisioningResource returns the test resource whose protocol modbus requires the device property 'ip',
+// and defaults the 'port' to 502.
+func newProvisioningResource(t *testing.T) Resource {
+	t.Helper()
+	r, _ := newTestResource(t)
+	r.ProtocolCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	r.ProtocolCache.Set("modbus", &models.Protocol{ID: "modbus", DeviceProps: []*models.Property{
+		{Name: "ip", Required: true},
+		{Name: "port", Default: "502"},
+	}}, cache.NoExpiration)
+	return r
+}
+
+func serveProvisioning(r Resource, method, path, body string) *httptest.ResponseRecorder {
+	ws := new(restful.WebService)
+	ws.Path("/api/v1/products").Produces(restful.MIME_JSON)
+	r.ProvisioningRoutes(ws)
+	container := restful.NewContainer()
+	container.Add(ws)
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(restful.HEADER_ContentType, MIME_CSV)
+	recorder := httptest.NewRecorder()
+	container.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func importDevices(t *testing.T, r Resource, query, body string) (int, *BatchResponse) {
+	t.Helper()
+	recorder := serveProvisioning(r, http.MethodPost, "/api/v1/products/p1/devices:import"+query, body)
+	resp := new(BatchResponse)
+	if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	return recorder.Code, resp
+}
+
+const importCSV = `id,name,labels,tags,prop:ip
+d3,pump,site=a;line=l1,critical,10.0.0.3
+d4,valve,,,
+`
+
+func TestImportDevicesAtomic(t *testing.T) {
+	r := newProvisioningResource(t)
+	status, resp := importDevices(t, r, "", importCSV)
+	if status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if len(resp.Results) != 2 || resp.Results[1].Line != 3 || resp.Results[1].Status != http.StatusBadRequest {
+		t.Fatalf("results = %+v, want the line 3 reported as missing the ip", resp.Results)
+	}
+	if _, err := r.MetaStore.GetDevice("d3"); err == nil {
+		t.Error("the valid row should not be imported in the atomic mode")
+	}
+}
+
+func TestImportDevicesBestEffort(t *testing.T) {
+	r := newProvisioningResource(t)
+	status, resp := importDevices(t, r, "?mode=best-effort", importCSV)
+	if status != http.StatusOK || resp.Succeeded != 1 || resp.Failed != 1 {
+		t.Fatalf("status = %d and results = %+v, want one row imported", status, resp.Results)
+	}
+	device, err := r.MetaStore.GetDevice("d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ip": "10.0.0.3", "port": "502"}
+	if device.Name != "pump" || device.ProductName != "P1" || !reflect.DeepEqual(device.DeviceProps, want) {
+		t.Errorf("device = %+v, want the default port", device)
+	}
+	labels, err := r.MetaStore.GetDeviceLabels("d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels.Labels["line"] != "l1" || !labels.HasTags("critical") {
+		t.Errorf("labels = %+v, want the ones of the row", labels)
+	}
+}
+
+func TestImportDevicesUpsert(t *testing.T) {
+	r := newProvisioningResource(t)
+	d1, err := r.MetaStore.GetDevice("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1.DeviceProps = map[string]string{"ip": "10.0.0.1", "port": "1502"}
+	if err = r.MetaStore.UpdateDevice(d1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing device is a conflict unless upserting
+	if status, resp := importDevices(t, r, "", "id,name,prop:ip\nd1,renamed,10.0.0.9\n"); status != http.StatusBadRequest ||
+		resp.Results[0].Status != http.StatusConflict {
+		t.Fatalf("status = %d and results = %+v, want a conflict", status, resp.Results)
+	}
+	// the columns absent are kept, and the required ip is neither reported nor the port overridden by the default
+	if status, resp := importDevices(t, r, "?upsert=true", "id,name\nd1,renamed\n"); status != http.StatusOK {
+		t.Fatalf("status = %d and results = %+v", status, resp.Results)
+	}
+	device, err := r.MetaStore.GetDevice("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ip": "10.0.0.1", "port": "1502"}
+	if device.Name != "renamed" || device.DeviceStatus != models.DeviceStateConnected ||
+		!reflect.DeepEqual(device.DeviceProps, want) {
+		t.Errorf("device = %+v, want the name updated only", device)
+	}
+}
+
+func TestImportDevicesRejectsHeader(t *testing.T) {
+	r := newProvisioningResource(t)
+	for _, body := range []string{"name\npump\n", "id,color\nd3,red\n", "id,prop:baud\nd3,9600\n", "id,id\nd3,d3\n", "id\n"} {
+		if recorder := serveProvisioning(r, http.MethodPost, "/api/v1/products/p1/devices:import", body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestExportDevices(t *testing.T) {
+	r := newProvisioningResource(t)
+	if status, resp := importDevices(t, r, "?mode=best-effort", importCSV); status != http.StatusOK {
+		t.Fatalf("status = %d and results = %+v", status, resp.Results)
+	}
+	recorder := serveProvisioning(r, http.MethodGet, "/api/v1/products/p1/devices:export", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "name", "desc", "labels", "tags", "prop:ip", "prop:port"},
+		{"d1", "D1", "", "", "", "", ""},
+		{"d2", "D2", "", "", "", "", ""},
+		{"d3", "pump", "", "line=l1;site=a", "critical", "10.0.0.3", "502"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("exported = %v, want %v", records, want)
+	}
+}
@@ -1,16 +1,20 @@
 package device
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
-	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-manager/pkg/api/http/listing"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/api/http/session"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
 	"github.com/thingio/edge-device-std/models"
-	"net/http"
-	"os"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -37,19 +41,37 @@ const (
 	PathParamEventID     = "event-id"
 	PathParamEventIDDesc = "the identifier of the device event"
 	PathParamEventIDType = "string"
+
+	QueryParamForce     = "force"
+	QueryParamForceDesc = "whether to send the operation even though the driver is offline or the device is not connected"
+	QueryParamForceType = "boolean"
+
+	// maxConcurrentCalls limits the number of the concurrent calls to devices selected by labels.
+	maxConcurrentCalls = 16
 )
 
+// DeviceMessage is a message from one of the devices selected by labels.
+type DeviceMessage struct {
+	DeviceID string      `json:"device_id"`
+	Data     interface{} `json:"data"`
+}
+
+// MethodResult is the result of calling the method of one of the devices selected by labels.
+type MethodResult struct {
+	DeviceID string                                          `json:"device_id"`
+	Outs     map[models.ProductPropertyID]*models.DeviceData `json:"outs,omitempty"`
+	Error    string                                          `json:"error,omitempty"`
+}
+
 func (r Resource) createDevice(request *restful.Request, response *restful.Response) {
 	device := new(models.Device)
 	if err := request.ReadEntity(device); err != nil {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Cause(err, "fail to parse the request body"))
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
 		return
 	}
 	deviceID := device.ID
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the device's ID is required"))
+		problem.Write(response, problem.BadRequest(nil, "the device's ID is required"))
 		return
 	} else if device.Name == "" {
 		device.Name = deviceID
@@ -58,24 +80,17 @@ func (r Resource) createDevice(request *restful.Request, response *restful.Respo
 	var protocolID string
 	productID := device.ProductID
 	if productID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.Internal.Error("the device[%s]'s product must be specified", deviceID))
+		problem.Write(response, problem.Unprocessable(nil, "the device[%s]'s product must be specified", deviceID))
 		return
 	} else {
 		if product, err := r.MetaStore.GetProduct(productID); err != nil {
-			_ = response.WriteError(http.StatusNotFound,
-				errors.Internal.Error("the product[%s] is not found", productID))
+			problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
 			return
 		} else {
 			device.ProductName = product.Name
 			protocolID = product.Protocol
 		}
 	}
-	if _, err := r.MetaStore.GetDevice(deviceID); err == nil { // verify the duplication of the device
-		_ = response.WriteError(http.StatusConflict,
-			errors.Internal.Error("the device[%s] is already created", deviceID))
-		return
-	}
 
 	// set the device's status
 	if device.DeviceStatus == "" {
@@ -83,12 +98,11 @@ func (r Resource) createDevice(request *restful.Request, response *restful.Respo
 	}
 
 	if err := r.MetaStore.CreateDevice(device); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to create the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to create the device[%s]", deviceID))
 		return
 	} else if err = r.OperationClient.UpdateDevice(protocolID, device); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send message about creating device[%s] to the driver[%s]", deviceID, protocolID))
+		problem.Write(response, problem.Wrap(err,
+			"fail to send message about creating device[%s] to the driver[%s]", deviceID, protocolID))
 		return
 	}
 	_ = response.WriteEntity(device)
@@ -96,142 +110,280 @@ func (r Resource) createDevice(request *restful.Request, response *restful.Respo
 func (r Resource) deleteDevice(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 
 	protocolID, _, err := r.trace(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", deviceID))
+		return
 	}
 	if err := r.MetaStore.DeleteDevice(deviceID); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to delete the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to delete the device[%s]", deviceID))
 		return
 	} else if err := r.OperationClient.DeleteDevice(protocolID, deviceID); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send message about deleting device to the driver[%s]", protocolID))
+		problem.Write(response, problem.Wrap(err,
+			"fail to send message about deleting device to the driver[%s]", protocolID))
 		return
 	}
 }
 func (r Resource) updateDevice(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 	device := new(models.Device)
 	if err := request.ReadEntity(device); err != nil {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("fail to parse the request body"))
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	existing, err := r.MetaStore.GetDevice(deviceID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the device[%s]", deviceID))
+		return
+	}
+	// the immutable fields could be omitted in the body
+	if device.ID == "" {
+		device.ID = deviceID
 	}
+	if device.ProductID == "" {
+		device.ProductID = existing.ProductID
+	}
+	r.replaceDevice(response, existing, device)
+}
+func (r Resource) patchDevice(request *restful.Request, response *restful.Response) {
+	deviceID := request.PathParameter(PathParamDeviceID)
+	if deviceID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
+		return
+	}
+	existing, err := r.MetaStore.GetDevice(deviceID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the device[%s]", deviceID))
+		return
+	}
+	device := new(models.Device)
+	if err = patch.Apply(request, existing, device); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to patch the device[%s]", deviceID))
+		return
+	}
+	r.replaceDevice(response, existing, device)
+}
 
-	protocolID, _, err := r.trace(deviceID)
+// replaceDevice replaces the existing device by the updated one, and then notifies the driver.
+func (r Resource) replaceDevice(response *restful.Response, existing, device *models.Device) {
+	for field, values := range map[string][2]string{
+		"id":         {existing.ID, device.ID},
+		"product_id": {existing.ProductID, device.ProductID},
+	} {
+		if err := patch.Immutable(field, values[0], values[1]); err != nil {
+			problem.Write(response, problem.Wrap(err, "fail to update the device[%s]", existing.ID))
+			return
+		}
+	}
+	// the status is reported by the driver rather than updated by users
+	device.ProductName, device.DeviceStatus = existing.ProductName, existing.DeviceStatus
+
+	protocolID, _, err := r.trace(device.ID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", device.ID))
+		return
 	}
 	if err := r.MetaStore.UpdateDevice(device); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to update the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to update the device[%s]", device.ID))
 		return
 	} else if err := r.OperationClient.UpdateDevice(protocolID, device); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send message about updating device to the driver[%s]", protocolID))
+		problem.Write(response, problem.Wrap(err,
+			"fail to send message about updating device to the driver[%s]", protocolID))
 		return
 	}
+	_ = response.WriteEntity(device)
 }
 func (r Resource) findAllDevices(request *restful.Request, response *restful.Response) {
-	productID := request.QueryParameter(QueryParamProductID)
-	if productID == "" {
-		_ = response.WriteError(http.StatusBadRequest, fmt.Errorf("the query parameter[%s] is required", QueryParamProductID))
+	query, err := listing.ParseQuery(request)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to parse the query"))
+		return
+	}
+	if productID := request.QueryParameter(QueryParamProductID); productID != "" {
+		query.And(metastore.FieldProduct, metastore.OperatorEqual, productID)
+	}
+	opts, err := listing.ParseListOptions(request)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to parse the list options"))
 		return
 	}
-	devices, err := r.MetaStore.ListDevices(productID)
+	devices, next, err := r.MetaStore.SearchDevices(query, opts)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError, err)
+		problem.Write(response, problem.Wrap(err, "fail to search devices"))
 		return
 	}
-	_ = response.WriteEntity(devices)
+	_ = listing.WriteList(request, response, devices, next)
 }
 func (r Resource) findDevice(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest, fmt.Errorf("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 	device, err := r.MetaStore.GetDevice(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError, err)
+		problem.Write(response, problem.Wrap(err, "fail to find the device[%s]", deviceID))
 		return
 	}
 	_ = response.WriteEntity(device)
 }
+func (r Resource) findDeviceLabels(request *restful.Request, response *restful.Response) {
+	deviceID := request.PathParameter(PathParamDeviceID)
+	if deviceID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
+		return
+	}
+	labels, err := r.MetaStore.GetDeviceLabels(deviceID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to get labels of the device[%s]", deviceID))
+		return
+	}
+	_ = response.WriteEntity(labels)
+}
+func (r Resource) updateDeviceLabels(request *restful.Request, response *restful.Response) {
+	deviceID := request.PathParameter(PathParamDeviceID)
+	if deviceID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
+		return
+	}
+	labels := new(metastore.Labels)
+	if err := request.ReadEntity(labels); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if err := labels.Validate(); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to validate labels of the device[%s]", deviceID))
+		return
+	}
+	if _, err := r.MetaStore.GetDevice(deviceID); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the device[%s]", deviceID))
+		return
+	}
+	if err := r.MetaStore.UpdateDeviceLabels(deviceID, labels); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to update labels of the device[%s]", deviceID))
+		return
+	}
+	_ = response.WriteEntity(labels)
+}
 
 func (r Resource) watchProperties(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 
 	protocolID, productID, err := r.trace(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", deviceID))
 		return
 	}
-	bus, stop, err := r.OperationService.SubscribeDeviceProps(protocolID, productID, deviceID, models.DeviceDataMultiPropsID)
+	topic := subscription.Topic{DeviceID: deviceID, Kind: subscription.KindProperties}
+	if err := r.stream(request, response, topic, protocolID, productID, nil); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to watch the properties of the device[%s]", deviceID))
+	}
+}
+func (r Resource) watchSelectedProperties(request *restful.Request, response *restful.Response) {
+	devices, protocols, err := r.selectDevices(request)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to watch the properties of the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to select devices"))
 		return
 	}
-	if err := sendWSMessage(request, response, bus, stop); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send messages to the device[%s] in a WebSocket connection", deviceID))
+
+	merged, done := make(chan interface{}), make(chan struct{})
+	stops := make([]func(), 0, len(devices))
+	stop := func() {
+		close(done)
+		for _, stop := range stops {
+			stop()
+		}
+	}
+	for _, device := range devices {
+		bus, stopDevice, err := r.Subscriptions.Subscribe(
+			subscription.Topic{DeviceID: device.ID, Kind: subscription.KindProperties},
+			protocols[device.ProductID], device.ProductID)
+		if err != nil {
+			stop()
+			problem.Write(response, problem.Wrap(err, "fail to watch the properties of the device[%s]", device.ID))
+			return
+		}
+		stops = append(stops, stopDevice)
+		go func(deviceID string, bus <-chan interface{}) {
+			for {
+				select {
+				case data, ok := <-bus:
+					if !ok {
+						return
+					}
+					select {
+					case merged <- &DeviceMessage{DeviceID: deviceID, Data: data}:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}(device.ID, bus)
+	}
+	if err := r.sendWSMessage(request, response, merged, stop); err != nil {
+		problem.Write(response, problem.Wrap(err,
+			"fail to send messages of the selected devices in a WebSocket connection"))
 	}
 }
 func (r Resource) readProperties(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 	propertyID := request.PathParameter(PathParamPropertyID)
 	if propertyID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamPropertyID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamPropertyID))
 		return
 	}
 	readType := request.QueryParameter(QueryParamPropertyReadType)
 	if readType == "" {
 		readType = QueryParamPropertyReadTypeSoft
 	}
+	force, err := forced(request)
+	if err != nil {
+		problem.Write(response, err)
+		return
+	}
 
-	protocolID, productID, err := r.trace(deviceID)
+	device, protocolID, err := r.traceDevice(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", deviceID))
 		return
 	}
+	if !force {
+		if err = r.ready(protocolID, device); err != nil {
+			problem.Write(response, err)
+			return
+		}
+	}
+	productID := device.ProductID
 	var props map[models.ProductPropertyID]*models.DeviceData
 	switch readType {
 	case QueryParamPropertyReadTypeSoft:
 		if props, err = r.OperationClient.Read(protocolID, productID, deviceID, propertyID); err != nil {
-			_ = response.WriteError(http.StatusInternalServerError,
-				errors.Internal.Cause(err, "fail to read softly the properties[%s] of the device[%s]", propertyID, deviceID))
+			problem.Write(response, problem.Wrap(err,
+				"fail to read softly the properties[%s] of the device[%s]", propertyID, deviceID))
 			return
 		}
 	case QueryParamPropertyReadTypeHard:
 		if props, err = r.OperationClient.HardRead(protocolID, productID, deviceID, propertyID); err != nil {
-			_ = response.WriteError(http.StatusInternalServerError,
-				errors.Internal.Cause(err, "fail to read hardly the properties[%s] of the device[%s]", propertyID, deviceID))
+			problem.Write(response, problem.Wrap(err,
+				"fail to read hardly the properties[%s] of the device[%s]", propertyID, deviceID))
 			return
 		}
 	}
@@ -240,156 +392,283 @@ func (r Resource) readProperties(request *restful.Request, response *restful.Res
 func (r Resource) writeProperties(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 	propertyID := request.PathParameter(PathParamPropertyID)
 	if propertyID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamPropertyID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamPropertyID))
 		return
 	}
 	props := make(map[models.ProductPropertyID]*models.DeviceData)
 	if err := request.ReadEntity(&props); err != nil {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Cause(err, "fail to parse the request body"))
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	force, err := forced(request)
+	if err != nil {
+		problem.Write(response, err)
 		return
 	}
 
-	protocolID, productID, err := r.trace(deviceID)
+	device, protocolID, err := r.traceDevice(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", deviceID))
 		return
 	}
+	if !force {
+		if err = r.ready(protocolID, device); err != nil {
+			problem.Write(response, err)
+			return
+		}
+	}
+	productID := device.ProductID
 	if err := r.OperationClient.Write(protocolID, productID, deviceID, propertyID, props); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to write the properties[%s] of the device[%s]", propertyID, deviceID))
+		problem.Write(response, problem.Wrap(err,
+			"fail to write the properties[%s] of the device[%s]", propertyID, deviceID))
 		return
 	}
 }
 func (r Resource) callMethod(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 	methodID := request.PathParameter(PathParamMethodID)
 	if methodID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamMethodID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamMethodID))
 		return
 	}
 	ins := make(map[models.ProductPropertyID]*models.DeviceData)
 	if err := request.ReadEntity(&ins); err != nil {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Cause(err, "fail to parse the request body"))
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	force, err := forced(request)
+	if err != nil {
+		problem.Write(response, err)
 		return
 	}
 
-	protocolID, productID, err := r.trace(deviceID)
+	device, protocolID, err := r.traceDevice(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", deviceID))
 		return
 	}
+	if !force {
+		if err = r.ready(protocolID, device); err != nil {
+			problem.Write(response, err)
+			return
+		}
+	}
+	productID := device.ProductID
 	outs, err := r.OperationClient.Call(protocolID, productID, deviceID, methodID, ins)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to call the method[%s] of the device[%s]", methodID, deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to call the method[%s] of the device[%s]", methodID, deviceID))
 		return
 	}
 	_ = response.WriteEntity(outs)
 }
+func (r Resource) callSelectedMethods(request *restful.Request, response *restful.Response) {
+	methodID := request.PathParameter(PathParamMethodID)
+	if methodID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamMethodID))
+		return
+	}
+	ins := make(map[models.ProductPropertyID]*models.DeviceData)
+	if err := request.ReadEntity(&ins); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	force, err := forced(request)
+	if err != nil {
+		problem.Write(response, err)
+		return
+	}
+	devices, protocols, err := r.selectDevices(request)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to select devices"))
+		return
+	}
+
+	results := make([]*MethodResult, len(devices))
+	sem := make(chan struct{}, maxConcurrentCalls)
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, device *models.Device) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result := &MethodResult{DeviceID: device.ID}
+			results[i] = result
+			protocolID := protocols[device.ProductID]
+			if !force {
+				if err := r.ready(protocolID, device); err != nil {
+					result.Error = err.Error()
+					return
+				}
+			}
+			outs, err := r.OperationClient.Call(protocolID, device.ProductID, device.ID, methodID, ins)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Outs = outs
+			}
+		}(i, device)
+	}
+	wg.Wait()
+	_ = response.WriteEntity(results)
+}
 func (r Resource) subscribeEvent(request *restful.Request, response *restful.Response) {
 	deviceID := request.PathParameter(PathParamDeviceID)
 	if deviceID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamDeviceID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamDeviceID))
 		return
 	}
 	eventID := request.PathParameter(PathParamEventID)
 	if eventID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamEventID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamEventID))
 		return
 	}
 
 	protocolID, productID, err := r.trace(deviceID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to trace the device[%s]", deviceID))
-		return
-	}
-	bus, stop, err := r.OperationService.SubscribeDeviceEvent(protocolID, productID, deviceID, eventID)
-	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to subscribe the event[%s] of the device[%s]", eventID, deviceID))
+		problem.Write(response, problem.Wrap(err, "fail to trace the device[%s]", deviceID))
 		return
 	}
-	if err := sendWSMessage(request, response, bus, stop); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send messages to the device[%s] in a WebSocket connection", deviceID))
-		return
+	topic := subscription.Topic{DeviceID: deviceID, Kind: subscription.KindEvents, EventID: eventID}
+	if err := r.stream(request, response, topic, protocolID, productID, nil); err != nil {
+		problem.Write(response, problem.Wrap(err,
+			"fail to subscribe the event[%s] of the device[%s]", eventID, deviceID))
 	}
 }
 
-// sendWSMessage will upgrade an HTTP connection to a WebSocket connection,
-// and then sends message from the bus into this connection until it is closed
-func sendWSMessage(request *restful.Request, response *restful.Response, bus <-chan interface{}, stop func()) error {
-	conn, _, _, err := ws.UpgradeHTTP(request.Request, response.ResponseWriter)
+// sendWSMessage will upgrade an HTTP connection to a WebSocket session, and then sends messages
+// from the bus into this session until it is closed by the client, e.g. by sending "stop",
+// or the server is shutting down. The messages are filtered and sampled by the query parameters.
+func (r Resource) sendWSMessage(request *restful.Request, response *restful.Response, bus <-chan interface{}, stop func()) error {
+	defer stop()
+	opts, err := session.ParseOptions(request)
 	if err != nil {
-		return errors.Internal.Cause(err, "fail to upgrade HTTP as WebSocket")
+		return problem.BadRequest(err, "")
 	}
+	filter, err := parseMessageFilter(request)
+	if err != nil {
+		return problem.BadRequest(err, "")
+	}
+	s, err := session.Upgrade(r.Context, request, response, opts)
+	if err != nil {
+		return problem.BadRequest(err, "fail to upgrade HTTP as WebSocket")
+	}
+	r.Sessions.Add(1)
+	defer r.Sessions.Done()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		defer func() {
-			cancel()
-			_ = conn.Close()
-		}()
-		for {
-			data, _, err := wsutil.ReadClientData(conn)
-			if err != nil {
-				if err.Error() == "EOF" { // the connection is already disconnected
-					return
-				}
-				continue
-			}
-			if string(data) == "stop" {
-				return
-			}
-		}
-	}()
+	var sampling <-chan time.Time
+	if filter.minInterval > 0 {
+		// the postponed messages are sent at most a quarter of the interval later than due
+		ticker := time.NewTicker(filter.minInterval/4 + time.Millisecond)
+		defer ticker.Stop()
+		sampling = ticker.C
+	}
+	messages := s.Messages()
 	for {
 		select {
-		case event := <-bus:
-			if data, err := json.Marshal(event); err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, err.Error())
+		case message, ok := <-bus:
+			if !ok {
+				s.Close(ws.StatusNormalClosure, "the subscription is stopped")
+				bus = nil
 				break
-			} else {
-				_ = wsutil.WriteServerMessage(conn, ws.OpText, data)
 			}
-		case <-ctx.Done():
-			stop()
+			if message = filter.offer(message, time.Now()); message != nil {
+				s.Send(message)
+			}
+		case now := <-sampling:
+			for _, message := range filter.due(now) {
+				s.Send(message)
+			}
+		case data, ok := <-messages:
+			if !ok {
+				messages = nil
+				break
+			}
+			if string(data) == "stop" {
+				s.Close(ws.StatusNormalClosure, "stopped by the client")
+			}
+		case <-s.Done():
 			return nil
 		}
 	}
 }
 
+// selectDevices returns devices selected by the query parameters 'q', 'selector' and 'tags',
+// and the protocols of their products. At least one of these parameters is required, so that
+// all devices of the fleet will not be operated by accident.
+func (r Resource) selectDevices(request *restful.Request) ([]*models.Device, map[string]string, error) {
+	query, err := listing.ParseQuery(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if query.Empty() {
+		return nil, nil, fmt.Errorf("%w: at least one of the query parameters[%s, %s, %s] is required",
+			metastore.ErrInvalidSelector, listing.QueryParamQuery, listing.QueryParamSelector, listing.QueryParamTags)
+	}
+	devices, _, err := r.MetaStore.SearchDevices(query, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	protocols := make(map[string]string) // product ID -> protocol ID
+	for _, device := range devices {
+		if _, ok := protocols[device.ProductID]; ok {
+			continue
+		}
+		product, err := r.MetaStore.GetProduct(device.ProductID)
+		if err != nil {
+			return nil, nil, err
+		}
+		protocols[device.ProductID] = product.Protocol
+	}
+	return devices, protocols, nil
+}
+
 func (r Resource) trace(deviceID string) (protocolID, productID string, err error) {
-	if device, err := r.MetaStore.GetDevice(deviceID); err != nil {
+	device, protocolID, err := r.traceDevice(deviceID)
+	if err != nil {
 		return "", "", err
-	} else {
-		productID = device.ProductID
 	}
+	return protocolID, device.ProductID, nil
+}
 
-	if product, err := r.MetaStore.GetProduct(productID); err != nil {
-		return "", "", err
-	} else {
-		protocolID = product.Protocol
+// traceDevice returns the device and the protocol of its product.
+func (r Resource) traceDevice(deviceID string) (*models.Device, string, error) {
+	device, err := r.MetaStore.GetDevice(deviceID)
+	if err != nil {
+		return nil, "", err
+	}
+	product, err := r.MetaStore.GetProduct(device.ProductID)
+	if err != nil {
+		return nil, "", err
+	}
+	return device, product.Protocol, nil
+}
+
+// ready verifies that the device is able to serve data operations, see health.Ready.
+func (r Resource) ready(protocolID string, device *models.Device) error {
+	return health.Ready(r.ProtocolCache, r.DeviceStates, protocolID, device)
+}
+
+// forced returns true if the query parameter 'force' asks to skip the readiness check.
+func forced(request *restful.Request) (bool, error) {
+	value := request.QueryParameter(QueryParamForce)
+	if value == "" {
+		return false, nil
+	}
+	force, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, problem.BadRequest(nil, "the query parameter[%s] must be a boolean", QueryParamForce)
 	}
-	return protocolID, productID, nil
+	return force, nil
 }
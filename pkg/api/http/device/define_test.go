@@ -0,0 +1,209 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/api/http/listing"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func (c *fakeClient) UpdateDevice(protocolID string, device *models.Device) error {
+	return nil
+}
+
+// fakeDriver keeps the properties of devices in memory, and records the data operations sent to it.
+type fakeDriver struct {
+	operations.ManagerClient
+
+	mu       sync.Mutex
+	values   map[string]map[models.ProductPropertyID]interface{} // device ID -> property ID -> value
+	failures map[string]error                                    // operation -> error, e.g. "write d1/speed"
+	calls    []string                                            // operations in the order they are sent
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{
+		values: map[string]map[models.ProductPropertyID]interface{}{
+			"d1": {"speed": 10, "temp": 20.5},
+			"d2": {"speed": 30},
+			"d3": {"speed": 40},
+		},
+		failures: make(map[string]error),
+	}
+}
+
+func (d *fakeDriver) Read(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	return d.read("read", deviceID, propertyID)
+}
+
+func (d *fakeDriver) HardRead(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	return d.read("hard-read", deviceID, propertyID)
+}
+
+func (d *fakeDriver) read(operation, deviceID string,
+	propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	operation = fmt.Sprintf("%s %s/%s", operation, deviceID, propertyID)
+	d.calls = append(d.calls, operation)
+	if err := d.failures[operation]; err != nil {
+		return nil, err
+	}
+	props := make(map[models.ProductPropertyID]*models.DeviceData)
+	for id, value := range d.values[deviceID] {
+		if propertyID == models.DeviceDataMultiPropsID || propertyID == id {
+			props[id] = &models.DeviceData{Name: id, Value: value}
+		}
+	}
+	return props, nil
+}
+
+func (d *fakeDriver) Write(protocolID, productID, deviceID string, propertyID models.ProductPropertyID,
+	props map[models.ProductPropertyID]*models.DeviceData) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	operation := fmt.Sprintf("write %s/%s", deviceID, propertyID)
+	d.calls = append(d.calls, operation)
+	if err := d.failures[operation]; err != nil {
+		return err
+	}
+	d.values[deviceID][propertyID] = props[propertyID].Value
+	return nil
+}
+
+func (d *fakeDriver) value(deviceID string, propertyID models.ProductPropertyID) interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.values[deviceID][propertyID]
+}
+
+// newDataResource returns the resource of newTestResource served by a fake driver of modbus,
+// the device d3 of the product p1 is reconnecting.
+func newDataResource(t *testing.T) (Resource, *fakeDriver) {
+	t.Helper()
+	r, _ := newTestResource(t)
+	if err := r.MetaStore.CreateDevice(&models.Device{ID: "d3", Name: "D3", ProductID: "p1", ProductName: "P1",
+		DeviceStatus: models.DeviceStateReconnecting}); err != nil {
+		t.Fatal(err)
+	}
+	r.ProtocolCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	r.ProtocolCache.Set("modbus", struct{}{}, cache.NoExpiration)
+	r.DeviceStates = health.NewDeviceStates()
+	driver := newFakeDriver()
+	r.OperationClient = driver
+	return r, driver
+}
+
+// serve sends the request to the device web service of the resource, and returns the recorded response.
+func serve(r Resource, method, path, contentType, body string) *httptest.ResponseRecorder {
+	container := restful.NewContainer()
+	container.Add(r.WebService("/api/v1/devices"))
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(restful.HEADER_ContentType, contentType)
+	recorder := httptest.NewRecorder()
+	container.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestUpdateDeviceKeepsStatus(t *testing.T) {
+	for _, c := range []struct {
+		method      string
+		contentType string
+		body        string
+	}{
+		{http.MethodPut, restful.MIME_JSON, `{"name": "renamed"}`},
+		{http.MethodPatch, patch.MIME_MERGE_PATCH, `{"name": "renamed", "device_status": "disconnected"}`},
+	} {
+		r, _ := newTestResource(t)
+		recorder := serve(r, c.method, "/api/v1/devices/d1", c.contentType, c.body)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", c.method, recorder.Code, recorder.Body.String())
+		}
+
+		returned := new(models.Device)
+		if err := json.Unmarshal(recorder.Body.Bytes(), returned); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := r.MetaStore.GetDevice("d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, device := range []*models.Device{returned, stored} {
+			if device.Name != "renamed" || device.DeviceStatus != models.DeviceStateConnected || device.ProductName != "P1" {
+				t.Errorf("%s: device = %+v, want the name updated with the status and product kept", c.method, device)
+			}
+		}
+	}
+}
+
+func TestFindAllDevicesRejectsInvalidListOptions(t *testing.T) {
+	r, _ := newTestResource(t)
+	for _, target := range []string{"/api/v1/devices?limit=abc", "/api/v1/devices?continue=abc", "/api/v1/devices?sort=unknown"} {
+		if recorder := serve(r, http.MethodGet, target, restful.MIME_JSON, ""); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", target, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	recorder := serve(r, http.MethodGet, "/api/v1/devices?limit=1&fields=id", restful.MIME_JSON, "")
+	if recorder.Code != http.StatusOK || recorder.Header().Get(listing.HeaderContinue) == "" {
+		t.Errorf("status = %d and continue = %q, want %d and the token of the next page",
+			recorder.Code, recorder.Header().Get(listing.HeaderContinue), http.StatusOK)
+	}
+}
+
+func TestReadPropertiesFailsFast(t *testing.T) {
+	r, driver := newDataResource(t)
+	for _, c := range []struct {
+		target string
+		status int
+		code   string
+	}{
+		{"/api/v1/devices/d2/properties/speed", http.StatusConflict, problem.CodeDeviceDisconnected},
+		{"/api/v1/devices/d2/properties/speed?force=yes", http.StatusBadRequest, problem.CodeBadRequest},
+		{"/api/v1/devices/missing/properties/speed", http.StatusNotFound, problem.CodeNotFound},
+	} {
+		recorder := serve(r, http.MethodGet, c.target, restful.MIME_JSON, "")
+		p := new(problem.Problem)
+		if err := json.Unmarshal(recorder.Body.Bytes(), p); err != nil {
+			t.Fatalf("%s: %v", c.target, err)
+		}
+		if recorder.Code != c.status || p.Code != c.code {
+			t.Errorf("%s: status = %d and code = %s, want %d and %s", c.target, recorder.Code, p.Code, c.status, c.code)
+		}
+	}
+	if len(driver.calls) != 0 {
+		t.Errorf("the driver is called with %v, want none", driver.calls)
+	}
+
+	recorder := serve(r, http.MethodGet, "/api/v1/devices/d2/properties/speed?force=true", restful.MIME_JSON, "")
+	props := make(map[models.ProductPropertyID]*models.DeviceData)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &props); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK || props["speed"] == nil || props["speed"].Value != float64(30) {
+		t.Errorf("forced: status = %d and props = %v, want the property read", recorder.Code, props)
+	}
+
+	r.ProtocolCache.Delete("modbus")
+	recorder = serve(r, http.MethodPut, "/api/v1/devices/d1/properties/speed", restful.MIME_JSON, `{"speed": {"value": 1}}`)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("offline driver: status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if want := []string{"read d2/speed"}; !reflect.DeepEqual(driver.calls, want) {
+		t.Errorf("the driver is called with %v, want %v", driver.calls, want)
+	}
+}
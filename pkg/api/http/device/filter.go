@@ -0,0 +1,130 @@
+package device
+
+import (
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-std/models"
+	"strings"
+	"time"
+)
+
+const (
+	QueryParamProps     = "props"
+	QueryParamPropsDesc = "the properties to be sent, separated by commas, e.g. 'a,b', all properties are sent if it is empty"
+	QueryParamPropsType = "string"
+
+	QueryParamMinInterval     = "min-interval"
+	QueryParamMinIntervalDesc = "the minimum interval between messages of a device, e.g. '1s', the messages " +
+		"in the interval are merged into one, which is sent at the end of the interval"
+	QueryParamMinIntervalType = "string"
+)
+
+// messageFilter selects the properties of messages, and samples messages of each device
+// so that at most one message is sent in each interval.
+type messageFilter struct {
+	props       map[models.ProductPropertyID]bool // nil means all properties
+	minInterval time.Duration
+
+	sent    map[string]time.Time   // device ID -> the time the last message is sent
+	pending map[string]interface{} // device ID -> the message merged, which will be sent at the end of the interval
+}
+
+func parseMessageFilter(request *restful.Request) (*messageFilter, error) {
+	f := &messageFilter{sent: make(map[string]time.Time), pending: make(map[string]interface{})}
+	if props := request.QueryParameter(QueryParamProps); props != "" {
+		f.props = make(map[models.ProductPropertyID]bool)
+		for _, prop := range strings.Split(props, ",") {
+			if prop = strings.TrimSpace(prop); prop != "" {
+				f.props[prop] = true
+			}
+		}
+	}
+	if interval := request.QueryParameter(QueryParamMinInterval); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("the %s should be a non-negative duration, e.g. 1s", QueryParamMinInterval)
+		}
+		f.minInterval = d
+	}
+	return f, nil
+}
+
+// offer returns the message to be sent right now, or nil if it is filtered out or postponed by sampling.
+func (f *messageFilter) offer(message interface{}, now time.Time) interface{} {
+	deviceID, props, ok := propsOf(message)
+	if !ok {
+		return message
+	}
+	if f.props != nil {
+		selected := make(map[models.ProductPropertyID]*models.DeviceData)
+		for id, value := range props {
+			if f.props[id] {
+				selected[id] = value
+			}
+		}
+		if len(selected) == 0 {
+			return nil
+		}
+		message = withProps(message, selected)
+	}
+	if f.minInterval <= 0 {
+		return message
+	}
+
+	if last, ok := f.sent[deviceID]; ok && now.Sub(last) < f.minInterval {
+		f.pending[deviceID] = merge(f.pending[deviceID], message)
+		return nil
+	}
+	f.sent[deviceID] = now
+	return message
+}
+
+// due returns the postponed messages whose intervals are elapsed.
+func (f *messageFilter) due(now time.Time) []interface{} {
+	messages := make([]interface{}, 0)
+	for deviceID, message := range f.pending {
+		if now.Sub(f.sent[deviceID]) >= f.minInterval {
+			messages = append(messages, message)
+			f.sent[deviceID] = now
+			delete(f.pending, deviceID)
+		}
+	}
+	return messages
+}
+
+// propsOf returns the properties of the message of a device, or the message of devices selected by labels.
+func propsOf(message interface{}) (string, map[models.ProductPropertyID]*models.DeviceData, bool) {
+	switch m := message.(type) {
+	case map[models.ProductPropertyID]*models.DeviceData:
+		return "", m, true
+	case *DeviceMessage:
+		props, ok := m.Data.(map[models.ProductPropertyID]*models.DeviceData)
+		return m.DeviceID, props, ok
+	default:
+		return "", nil, false
+	}
+}
+
+func withProps(message interface{}, props map[models.ProductPropertyID]*models.DeviceData) interface{} {
+	if m, ok := message.(*DeviceMessage); ok {
+		return &DeviceMessage{DeviceID: m.DeviceID, Data: props}
+	}
+	return props
+}
+
+// merge merges the properties of the later message into the earlier one, so that no property is lost by sampling.
+func merge(earlier, later interface{}) interface{} {
+	if earlier == nil {
+		return later
+	}
+	_, before, _ := propsOf(earlier)
+	_, after, _ := propsOf(later)
+	merged := make(map[models.ProductPropertyID]*models.DeviceData, len(before)+len(after))
+	for id, value := range before {
+		merged[id] = value
+	}
+	for id, value := range after {
+		merged[id] = value
+	}
+	return withProps(later, merged)
+}
@@ -0,0 +1,106 @@
+package device
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newMessageFilter(t *testing.T, query string) *messageFilter {
+	t.Helper()
+	f, err := parseMessageFilter(restful.NewRequest(httptest.NewRequest(http.MethodGet, "/?"+query, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func propsMessage(deviceID string, values map[models.ProductPropertyID]interface{}) *DeviceMessage {
+	props := make(map[models.ProductPropertyID]*models.DeviceData)
+	for id, value := range values {
+		props[id] = &models.DeviceData{Name: id, Value: value}
+	}
+	return &DeviceMessage{DeviceID: deviceID, Data: props}
+}
+
+// valuesOf returns the values of the properties of the message, or nil if it is not sent.
+func valuesOf(message interface{}) map[models.ProductPropertyID]interface{} {
+	if message == nil {
+		return nil
+	}
+	_, props, _ := propsOf(message)
+	values := make(map[models.ProductPropertyID]interface{})
+	for id, value := range props {
+		values[id] = value.Value
+	}
+	return values
+}
+
+func TestMessageFilterSelectsProperties(t *testing.T) {
+	f := newMessageFilter(t, "props=speed,%20temp,")
+	now := time.Now()
+
+	got := valuesOf(f.offer(propsMessage("d1", map[models.ProductPropertyID]interface{}{"speed": 1, "temp": 2, "mode": 3}), now))
+	if want := map[models.ProductPropertyID]interface{}{"speed": 1, "temp": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if m := f.offer(propsMessage("d1", map[models.ProductPropertyID]interface{}{"mode": 4}), now); m != nil {
+		t.Errorf("sent %v, want the message without selected properties filtered out", m)
+	}
+	if m := f.offer("not properties", now); m != "not properties" {
+		t.Errorf("sent %v, want other messages passed through", m)
+	}
+}
+
+func TestMessageFilterSamples(t *testing.T) {
+	f := newMessageFilter(t, "min-interval=1s")
+	start := time.Now()
+	offer := func(deviceID string, values map[models.ProductPropertyID]interface{}, elapsed time.Duration) interface{} {
+		return f.offer(propsMessage(deviceID, values), start.Add(elapsed))
+	}
+
+	if m := offer("d1", map[models.ProductPropertyID]interface{}{"speed": 1}, 0); m == nil {
+		t.Error("the first message of a device should be sent right now")
+	}
+	if m := offer("d2", map[models.ProductPropertyID]interface{}{"speed": 1}, 100*time.Millisecond); m == nil {
+		t.Error("the devices should be sampled independently")
+	}
+	for i, values := range []map[models.ProductPropertyID]interface{}{{"speed": 2, "temp": 1}, {"speed": 3}} {
+		if m := offer("d1", values, time.Duration(200+i*100)*time.Millisecond); m != nil {
+			t.Errorf("the message %v in the interval should be postponed", valuesOf(m))
+		}
+	}
+
+	if due := f.due(start.Add(500 * time.Millisecond)); len(due) != 0 {
+		t.Errorf("%d messages are due before the interval is elapsed", len(due))
+	}
+	due := f.due(start.Add(time.Second))
+	if len(due) != 1 {
+		t.Fatalf("%d messages are due, want the merged one of d1", len(due))
+	}
+	if got, want := valuesOf(due[0]), map[models.ProductPropertyID]interface{}{"speed": 3, "temp": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the merged message = %v, want %v", got, want)
+	}
+	// the interval restarts once the postponed message is sent
+	if m := offer("d1", map[models.ProductPropertyID]interface{}{"speed": 4}, 1500*time.Millisecond); m != nil {
+		t.Error("the message right after the postponed one should be postponed as well")
+	}
+}
+
+func TestParseMessageFilterErrors(t *testing.T) {
+	var invalid []string
+	for _, query := range []string{"min-interval=abc", "min-interval=-1s", "min-interval=1s", "props="} {
+		if _, err := parseMessageFilter(restful.NewRequest(httptest.NewRequest(http.MethodGet, "/?"+query, nil))); err != nil {
+			invalid = append(invalid, query)
+		}
+	}
+	sort.Strings(invalid)
+	if want := []string{"min-interval=-1s", "min-interval=abc"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("invalid queries = %v, want %v", invalid, want)
+	}
+}
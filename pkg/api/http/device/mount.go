@@ -1,19 +1,51 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	restfulspec "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/api/http/listing"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/api/http/session"
+	"github.com/thingio/edge-device-manager/pkg/health"
 	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
 	"github.com/thingio/edge-device-std/models"
 	"github.com/thingio/edge-device-std/operations"
 	"net/http"
+	"sync"
 )
 
+// readinessNotes describes how data operations verify the driver and the device before sending.
+const readinessNotes = "The operation fails fast if the driver of the protocol is offline(503), or the device is " +
+	"disconnected or in exception(409) with the detail reported by the driver, unless the query parameter '" +
+	QueryParamForce + "' is true."
+
+// wsNotes describes how WebSocket sessions are kept alive and closed.
+const wsNotes = "The server sends a ping every 30s, and closes the session with 1001 if nothing, including pongs, is " +
+	"received in 90s. The messages are buffered for a client reading slowly, and the oldest one is dropped if the " +
+	"buffer is full, or the session is closed with 1008 if '" + session.QueryParamOverflow + "' is '" +
+	session.OverflowDisconnect + "'. The session is closed with 1000 if the client sends 'stop'.\n"
+
+// sseNotes describes how to stream messages as Server-Sent Events rather than WebSocket.
+const sseNotes = "If the header 'Accept' contains '" + MIME_EVENT_STREAM + "', the messages are sent as Server-Sent " +
+	"Events rather than WebSocket, and the identifier of the last event received could be sent in the header '" +
+	HeaderLastEventID + "' to resume the stream, the events kept for a few minutes after it are sent first."
+
 type Resource struct {
-	MetaStore        metastore.MetaStore
-	OperationClient  operations.ManagerClient
-	OperationService operations.ManagerService
+	// Context is used to close all WebSocket sessions when the server is shutting down,
+	// and Sessions tracks these sessions to wait for them to be closed.
+	Context  context.Context
+	Sessions *sync.WaitGroup
+
+	ProtocolCache   *cache.Cache
+	DeviceStates    *health.DeviceStates
+	MetaStore       metastore.MetaStore
+	OperationClient operations.ManagerClient
+	Subscriptions   *subscription.Hub
 }
 
 func (r Resource) WebService(root string) *restful.WebService {
@@ -32,34 +64,77 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Metadata(restfulspec.KeyOpenAPITags, metaTags).
 		Reads(models.Device{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Device{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.DELETE(fmt.Sprintf("/{%s}", PathParamDeviceID)).To(r.deleteDevice).
 		// docs
 		Doc("delete a device by its ID").
 		Metadata(restfulspec.KeyOpenAPITags, metaTags).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.PUT(fmt.Sprintf("/{%s}", PathParamDeviceID)).To(r.updateDevice).
 		// docs
 		Doc("update a device by its ID").
+		Notes("The device is replaced by the body, and the immutable fields 'id' and 'product_id' could be omitted, "+
+			"but they must be the same as the stored ones if specified.").
 		Metadata(restfulspec.KeyOpenAPITags, metaTags).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Reads(models.Device{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Device{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
-	ws.Route(ws.GET("/").To(r.findAllDevices).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.PATCH(fmt.Sprintf("/{%s}", PathParamDeviceID)).To(r.patchDevice).
 		// docs
-		Doc("get all available devices").
+		Doc("partially update a device by its ID").
+		Notes("The body is a JSON merge patch(RFC 7386) if the Content-Type is '"+patch.MIME_MERGE_PATCH+"' or '"+
+			restful.MIME_JSON+"', or a JSON patch(RFC 6902) if it is '"+patch.MIME_JSON_PATCH+"'. "+
+			"The patch is merged with the stored device, and the immutable fields 'id' and 'product_id' could not be changed.").
+		Metadata(restfulspec.KeyOpenAPITags, metaTags).
+		Consumes(patch.MIMETypes...).
+		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
+		Reads(models.Device{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Device{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	findAllDevices := ws.GET("/").To(r.findAllDevices).
+		// docs
+		Doc("get all available devices, or search devices across the fleet").
+		Notes("The devices can be filtered by 'q', and be paged by 'limit' and 'continue', "+
+			"the token of the next page is returned in the header '"+listing.HeaderContinue+"'.").
 		Metadata(restfulspec.KeyOpenAPITags, metaTags).
 		Param(ws.QueryParameter(QueryParamProductID, QueryParamProductIDDesc).DataType(QueryParamProductIDType)).
+		Param(listing.QueryParam(ws, metastore.DeviceFields...))
+	for _, param := range listing.LabelParams(ws) {
+		findAllDevices.Param(param)
+	}
+	for _, param := range listing.Params(ws, metastore.SortByID, metastore.SortByName,
+		metastore.SortByStatus, metastore.SortByCreated) {
+		findAllDevices.Param(param)
+	}
+	ws.Route(findAllDevices.
 		Writes([]models.Device{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), []models.Device{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.GET(fmt.Sprintf("/{%s}", PathParamDeviceID)).To(r.findDevice).
 		// docs
 		Doc("get an available device by its ID").
@@ -67,8 +142,31 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Writes(models.Device{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Device{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/labels", PathParamDeviceID)).To(r.findDeviceLabels).
+		// docs
+		Doc("get labels and tags of a device").
+		Metadata(restfulspec.KeyOpenAPITags, metaTags).
+		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
+		Writes(metastore.Labels{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Labels{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.PUT(fmt.Sprintf("/{%s}/labels", PathParamDeviceID)).To(r.updateDeviceLabels).
+		// docs
+		Doc("replace labels and tags of a device").
+		Metadata(restfulspec.KeyOpenAPITags, metaTags).
+		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
+		Reads(metastore.Labels{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Labels{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 
 	// DEVICE DATA OPERATIONS
 
@@ -86,14 +184,67 @@ func (r Resource) WebService(root string) *restful.WebService {
 			"  3. the textbox will prompt '连接成功，现在你可以发送信息进行测试了！';\n"+
 			"  4. the textbox will prompt if the device push an event:\n服务端回应 2022-01-11 17:34:25\n{\"float\":{\"name\":\"float\",\"type\":\"float\",\"value\":0.3038871248932524,\"ts\":\"2022-01-11T17:34:25.031244879+08:00\"},\"int\":{\"name\":\"int\",\"type\":\"int\",\"value\":8,\"ts\":\"2022-01-11T17:34:25.031231535+08:00\"}}\n"+
 			"  5. input 'stop' to replace '请输入测试消息', if you want to unsubscribe the event;\n"+
-			"  6. the textbox will prompt:\n你发送的信息 2022-01-11 17:34:40\nstop\nWebsocket连接已断开！",
+			"  6. the textbox will prompt:\n你发送的信息 2022-01-11 17:34:40\nstop\nWebsocket连接已断开！\n"+
+			wsNotes+sseNotes,
 		).
 		Metadata(restfulspec.KeyOpenAPITags, dataTags).
+		Produces(restful.MIME_JSON, MIME_EVENT_STREAM).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
-		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil))
+		Param(ws.HeaderParameter(HeaderLastEventID, HeaderLastEventIDDesc).DataType("string")).
+		Param(ws.QueryParameter(QueryParamProps, QueryParamPropsDesc).DataType(QueryParamPropsType)).
+		Param(ws.QueryParameter(QueryParamMinInterval, QueryParamMinIntervalDesc).DataType(QueryParamMinIntervalType)).
+		Param(ws.QueryParameter(session.QueryParamOverflow, session.QueryParamOverflowDesc).
+			DataType(session.QueryParamOverflowType).DefaultValue(session.OverflowDropOldest)).
+		Param(ws.QueryParameter(session.QueryParamBufferSize, session.QueryParamBufferSizeDesc).
+			DataType(session.QueryParamBufferSizeType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}))
+	watchSelectedProperties := ws.GET("/properties").To(r.watchSelectedProperties).
+		// docs
+		Doc("watch the properties of devices selected by labels").
+		Notes("It is the same as watching the properties of a device, but each message is wrapped with the ID "+
+			"of the device it comes from. At least one of 'q', 'selector' and 'tags' is required. "+wsNotes).
+		Metadata(restfulspec.KeyOpenAPITags, dataTags).
+		Param(listing.QueryParam(ws, metastore.DeviceFields...)).
+		Param(ws.QueryParameter(QueryParamProps, QueryParamPropsDesc).DataType(QueryParamPropsType)).
+		Param(ws.QueryParameter(QueryParamMinInterval, QueryParamMinIntervalDesc).DataType(QueryParamMinIntervalType))
+	for _, param := range listing.LabelParams(ws) {
+		watchSelectedProperties.Param(param)
+	}
+	for _, param := range session.Params(ws) {
+		watchSelectedProperties.Param(param)
+	}
+	ws.Route(watchSelectedProperties.
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), DeviceMessage{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	watchStatuses := ws.GET("/status/stream").To(r.watchStatuses).
+		// docs
+		Doc("watch the statuses of devices").
+		Notes("Each change of the status of a device, i.e. its state or the detail of the state, is sent with the "+
+			"previous state. The statuses of all devices are sent unless they are filtered by '"+QueryParamProductID+
+			"', '"+QueryParamStates+"', or 'q', 'selector' and 'tags', the devices matched by the latter are resolved "+
+			"once the stream starts. "+wsNotes+sseNotes).
+		Metadata(restfulspec.KeyOpenAPITags, dataTags).
+		Produces(restful.MIME_JSON, MIME_EVENT_STREAM).
+		Param(ws.HeaderParameter(HeaderLastEventID, HeaderLastEventIDDesc).DataType("string")).
+		Param(ws.QueryParameter(QueryParamProductID, QueryParamProductIDDesc).DataType(QueryParamProductIDType)).
+		Param(ws.QueryParameter(QueryParamStates, QueryParamStatesDesc).DataType(QueryParamStatesType)).
+		Param(listing.QueryParam(ws, metastore.DeviceFields...))
+	for _, param := range listing.LabelParams(ws) {
+		watchStatuses.Param(param)
+	}
+	for _, param := range session.Params(ws) {
+		watchStatuses.Param(param)
+	}
+	ws.Route(watchStatuses.
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), health.DeviceStateChange{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.GET(fmt.Sprintf("/{%s}/properties/{%s}", PathParamDeviceID, PathParamPropertyID)).To(r.readProperties).
 		// docs
 		Doc("read the device properties").
+		Notes(readinessNotes).
 		Metadata(restfulspec.KeyOpenAPITags, dataTags).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Param(ws.PathParameter(PathParamPropertyID, PathParamPropertyIDDesc).DataType(PathParamPropertyIDType)).
@@ -102,28 +253,71 @@ func (r Resource) WebService(root string) *restful.WebService {
 			Required(false).
 			PossibleValues([]string{QueryParamPropertyReadTypeSoft, QueryParamPropertyReadTypeHard}).
 			DefaultValue(QueryParamPropertyReadTypeSoft)).
+		Param(ws.QueryParameter(QueryParamForce, QueryParamForceDesc).DataType(QueryParamForceType).DefaultValue("false")).
 		Writes(map[models.ProductPropertyID]models.DeviceData{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), map[models.ProductPropertyID]models.DeviceData{}).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusBadGateway, http.StatusText(http.StatusBadGateway), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.PUT(fmt.Sprintf("/{%s}/properties/{%s}", PathParamDeviceID, PathParamPropertyID)).To(r.writeProperties).
 		// docs
 		Doc("write the device properties").
+		Notes(readinessNotes).
 		Metadata(restfulspec.KeyOpenAPITags, dataTags).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Param(ws.PathParameter(PathParamPropertyID, PathParamPropertyIDDesc).DataType(PathParamPropertyIDType)).
+		Param(ws.QueryParameter(QueryParamForce, QueryParamForceDesc).DataType(QueryParamForceType).DefaultValue("false")).
 		Reads(map[models.ProductPropertyID]models.DeviceData{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusBadGateway, http.StatusText(http.StatusBadGateway), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.POST(fmt.Sprintf("/{%s}/methods/{%s}", PathParamDeviceID, PathParamMethodID)).To(r.callMethod).
 		// docs
 		Doc("call the device method").
+		Notes(readinessNotes).
 		Metadata(restfulspec.KeyOpenAPITags, dataTags).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Param(ws.PathParameter(PathParamMethodID, PathParamMethodIDDesc).DataType(PathParamMethodIDType)).
+		Param(ws.QueryParameter(QueryParamForce, QueryParamForceDesc).DataType(QueryParamForceType).DefaultValue("false")).
 		Reads(map[models.ProductPropertyID]models.DeviceData{}).
 		Writes(map[models.ProductPropertyID]models.DeviceData{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), map[models.ProductPropertyID]models.DeviceData{}).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusBadGateway, http.StatusText(http.StatusBadGateway), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	callSelectedMethods := ws.POST(fmt.Sprintf("/methods/{%s}", PathParamMethodID)).To(r.callSelectedMethods).
+		// docs
+		Doc("call the method of devices selected by labels").
+		Notes("The method is called on each selected device concurrently, and the result of each device is returned "+
+			"even though some of them are failed. At least one of 'q', 'selector' and 'tags' is required. "+
+			"The devices whose driver is offline, or which are disconnected or in exception are skipped with "+
+			"their errors, unless the query parameter '"+QueryParamForce+"' is true.").
+		Metadata(restfulspec.KeyOpenAPITags, dataTags).
+		Param(ws.PathParameter(PathParamMethodID, PathParamMethodIDDesc).DataType(PathParamMethodIDType)).
+		Param(ws.QueryParameter(QueryParamForce, QueryParamForceDesc).DataType(QueryParamForceType).DefaultValue("false")).
+		Param(listing.QueryParam(ws, metastore.DeviceFields...))
+	for _, param := range listing.LabelParams(ws) {
+		callSelectedMethods.Param(param)
+	}
+	ws.Route(callSelectedMethods.
+		Reads(map[models.ProductPropertyID]models.DeviceData{}).
+		Writes([]MethodResult{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), []MethodResult{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 	ws.Route(ws.GET(fmt.Sprintf("/{%s}/events/{%s}", PathParamDeviceID, PathParamEventID)).To(r.subscribeEvent).
 		// docs
 		Doc("subscribe the device event").
@@ -135,12 +329,95 @@ func (r Resource) WebService(root string) *restful.WebService {
 			"  3. the textbox will prompt '连接成功，现在你可以发送信息进行测试了！';\n"+
 			"  4. the textbox will prompt if the device push an event:\n服务端回应 2022-01-11 17:34:25\n{\"float\":{\"name\":\"float\",\"type\":\"float\",\"value\":0.3038871248932524,\"ts\":\"2022-01-11T17:34:25.031244879+08:00\"},\"int\":{\"name\":\"int\",\"type\":\"int\",\"value\":8,\"ts\":\"2022-01-11T17:34:25.031231535+08:00\"}}\n"+
 			"  5. input 'stop' to replace '请输入测试消息', if you want to unsubscribe the event;\n"+
-			"  6. the textbox will prompt:\n你发送的信息 2022-01-11 17:34:40\nstop\nWebsocket连接已断开！",
+			"  6. the textbox will prompt:\n你发送的信息 2022-01-11 17:34:40\nstop\nWebsocket连接已断开！\n"+
+			wsNotes+sseNotes,
 		).
 		Metadata(restfulspec.KeyOpenAPITags, dataTags).
+		Produces(restful.MIME_JSON, MIME_EVENT_STREAM).
 		Param(ws.PathParameter(PathParamDeviceID, PathParamDeviceIDDesc).DataType(PathParamDeviceIDType)).
 		Param(ws.PathParameter(PathParamEventID, PathParamEventIDDesc).DataType(PathParamEventIDType)).
-		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil))
+		Param(ws.HeaderParameter(HeaderLastEventID, HeaderLastEventIDDesc).DataType("string")).
+		Param(ws.QueryParameter(QueryParamProps, QueryParamPropsDesc).DataType(QueryParamPropsType)).
+		Param(ws.QueryParameter(QueryParamMinInterval, QueryParamMinIntervalDesc).DataType(QueryParamMinIntervalType)).
+		Param(ws.QueryParameter(session.QueryParamOverflow, session.QueryParamOverflowDesc).
+			DataType(session.QueryParamOverflowType).DefaultValue(session.OverflowDropOldest)).
+		Param(ws.QueryParameter(session.QueryParamBufferSize, session.QueryParamBufferSizeDesc).
+			DataType(session.QueryParamBufferSizeType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}))
+
+	return ws
+}
+
+// BatchWebService is mounted separately, because the path of the batch operation
+// is a custom method of the collection, e.g. "/api/v1/devices:batch".
+func (r Resource) BatchWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.POST("").To(r.batchDevices).
+		// docs
+		Doc("create, update and delete devices in a batch").
+		Notes("In the mode 'atomic', all operations are applied or none of them, "+
+			"and in the mode 'best-effort', the valid operations are applied and the invalid ones are skipped. "+
+			"The result of each operation is returned, and the driver of each protocol changed by the batch "+
+			"receives one message with all products and devices to connect of the protocol, "+
+			"instead of one message per device.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"DEVICE META OPERATION"}).
+		Reads(BatchRequest{}).
+		Writes(BatchResponse{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), BatchResponse{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), BatchResponse{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), BatchResponse{}))
+
+	return ws
+}
+
+func (r Resource) DataReadWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.POST("").To(r.readData).
+		// docs
+		Doc("read properties of several devices at once").
+		Notes("Items are read concurrently across drivers with a bounded parallelism, and the properties of an item "+
+			"are read one by one, all properties are read if they are not specified. The result of each item is "+
+			"returned even though some of them are failed or timed out, and the error of an item is the same as "+
+			"the one of reading the device alone. "+readinessNotes).
+		Metadata(restfulspec.KeyOpenAPITags, []string{"DEVICE DATA OPERATION"}).
+		Param(ws.QueryParameter(QueryParamForce, QueryParamForceDesc).DataType(QueryParamForceType).DefaultValue("false")).
+		Reads(ReadRequest{}).
+		Writes(ReadResponse{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), ReadResponse{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}))
+
+	return ws
+}
+
+func (r Resource) DataWriteWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.POST("").To(r.writeData).
+		// docs
+		Doc("write properties of several devices at once").
+		Notes("Items are written concurrently across drivers with a bounded parallelism, and the properties of an "+
+			"item are written one by one in the order of their IDs. With 'verify', each written property is read "+
+			"back from the device and compared with the written value. With 'rollback', the previous values are "+
+			"read before writing, and they are restored on all devices if any item fails, the batch is aborted "+
+			"before writing if any item is invalid. The result of each item and property is returned. "+readinessNotes).
+		Metadata(restfulspec.KeyOpenAPITags, []string{"DEVICE DATA OPERATION"}).
+		Param(ws.QueryParameter(QueryParamForce, QueryParamForceDesc).DataType(QueryParamForceType).DefaultValue("false")).
+		Reads(WriteRequest{}).
+		Writes(WriteResponse{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), WriteResponse{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}))
 
 	return ws
 }
@@ -0,0 +1,183 @@
+package device
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxReadItems limits the number of items in a batch read.
+	maxReadItems = 500
+	// maxConcurrentReads limits the number of the concurrent reads of a batch across all drivers.
+	maxConcurrentReads = 32
+
+	defaultReadTimeout = 5 * time.Second
+	maxReadTimeout     = 60 * time.Second
+)
+
+// ReadRequest reads properties of several devices at once.
+type ReadRequest struct {
+	Items []*ReadItem `json:"items"`
+	// TimeoutMillis limits the duration of reading each item, 5s by default and 60s at most.
+	TimeoutMillis int `json:"timeout_ms,omitempty"`
+}
+
+type ReadItem struct {
+	DeviceID   string   `json:"device_id"`
+	Properties []string `json:"properties,omitempty"` // all properties will be read if it is empty
+	Type       string   `json:"type,omitempty"`       // soft by default, or hard
+}
+
+// ReadResult is the result of an item, its status is the HTTP status code of the equivalent single request,
+// the properties read before the failure are returned along with the error.
+type ReadResult struct {
+	Index    int                                             `json:"index"`
+	DeviceID string                                          `json:"device_id"`
+	Status   int                                             `json:"status"`
+	Props    map[models.ProductPropertyID]*models.DeviceData `json:"props,omitempty"`
+	Error    *problem.Problem                                `json:"error,omitempty"`
+}
+
+type ReadResponse struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []*ReadResult `json:"results"`
+}
+
+func (r Resource) readData(request *restful.Request, response *restful.Response) {
+	read := new(ReadRequest)
+	if err := request.ReadEntity(read); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if len(read.Items) == 0 || len(read.Items) > maxReadItems {
+		problem.Write(response, problem.BadRequest(nil, "the request should contain 1 to %d items", maxReadItems))
+		return
+	}
+	timeout := defaultReadTimeout
+	if read.TimeoutMillis < 0 {
+		problem.Write(response, problem.BadRequest(nil, "the timeout should not be negative"))
+		return
+	} else if read.TimeoutMillis > 0 {
+		timeout = time.Duration(read.TimeoutMillis) * time.Millisecond
+		if timeout > maxReadTimeout {
+			timeout = maxReadTimeout
+		}
+	}
+	force, err := forced(request)
+	if err != nil {
+		problem.Write(response, err)
+		return
+	}
+
+	resp := &ReadResponse{Results: make([]*ReadResult, len(read.Items))}
+	sem := make(chan struct{}, maxConcurrentReads)
+	var wg sync.WaitGroup
+	for i, item := range read.Items {
+		wg.Add(1)
+		go func(i int, item *ReadItem) {
+			defer wg.Done()
+			result := &ReadResult{Index: i, DeviceID: item.DeviceID, Status: http.StatusOK}
+			props, err := r.readItem(item, force, timeout, sem)
+			if len(props) != 0 {
+				result.Props = props
+			}
+			if err != nil {
+				result.Status, result.Error = problem.Of(err)
+			}
+			resp.Results[i] = result
+		}(i, item)
+	}
+	wg.Wait()
+
+	for _, result := range resp.Results {
+		if result.Error == nil {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+	_ = response.WriteEntity(resp)
+}
+
+// readItem reads the properties of the item one by one, and gives up if they are not read in the timeout.
+func (r Resource) readItem(item *ReadItem, force bool, timeout time.Duration,
+	sem chan struct{}) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	if item.DeviceID == "" {
+		return nil, problem.BadRequest(nil, "the device's ID is required")
+	}
+	readType := item.Type
+	if readType == "" {
+		readType = QueryParamPropertyReadTypeSoft
+	}
+	if readType != QueryParamPropertyReadTypeSoft && readType != QueryParamPropertyReadTypeHard {
+		return nil, problem.BadRequest(nil, "unsupported read type %s, only supporting %s and %s",
+			readType, QueryParamPropertyReadTypeSoft, QueryParamPropertyReadTypeHard)
+	}
+	propertyIDs := item.Properties
+	if len(propertyIDs) == 0 {
+		propertyIDs = []string{models.DeviceDataMultiPropsID}
+	}
+
+	device, protocolID, err := r.traceDevice(item.DeviceID)
+	if err != nil {
+		return nil, problem.Wrap(err, "fail to trace the device[%s]", item.DeviceID)
+	}
+	if !force {
+		if err = r.ready(protocolID, device); err != nil {
+			return nil, err
+		}
+	}
+
+	props := make(map[models.ProductPropertyID]*models.DeviceData)
+	finished, err := bounded(sem, timeout, func() error {
+		for _, propertyID := range propertyIDs {
+			var values map[models.ProductPropertyID]*models.DeviceData
+			var err error
+			if readType == QueryParamPropertyReadTypeHard {
+				values, err = r.OperationClient.HardRead(protocolID, device.ProductID, device.ID, propertyID)
+			} else {
+				values, err = r.OperationClient.Read(protocolID, device.ProductID, device.ID, propertyID)
+			}
+			if err != nil {
+				return problem.Wrap(err, "fail to read the properties[%s] of the device[%s]", propertyID, device.ID)
+			}
+			for id, value := range values {
+				props[id] = value
+			}
+		}
+		return nil
+	})
+	if !finished {
+		// the properties are still being read in the background
+		return nil, problem.Wrap(err, "fail to read the properties of the device[%s]", device.ID)
+	}
+	return props, err
+}
+
+// bounded runs the operation with a slot of the semaphore, and gives up waiting for it if it is not finished
+// in the timeout, which starts once the slot is acquired. The slot is held until the driver responds
+// even though the operation has timed out, so that the drivers are never flooded by a batch.
+func bounded(sem chan struct{}, timeout time.Duration, operation func() error) (finished bool, err error) {
+	sem <- struct{}{}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			<-sem
+		}()
+		done <- operation()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+		return true, err
+	case <-timer.C:
+		return false, problem.Timeout(nil, "the driver doesn't respond in %s", timeout)
+	}
+}
@@ -0,0 +1,182 @@
+package device
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	edgeerrors "github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowDriver responds to reads after the delay.
+type slowDriver struct {
+	*fakeDriver
+
+	delay time.Duration
+}
+
+func (d *slowDriver) Read(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	time.Sleep(d.delay)
+	return d.fakeDriver.Read(protocolID, productID, deviceID, propertyID)
+}
+
+// postData sends the body to the web service, and decodes the response into the entity if it succeeds.
+func postData(t *testing.T, ws *restful.WebService, target, body string, entity interface{}) int {
+	t.Helper()
+	container := restful.NewContainer()
+	container.Add(ws)
+	request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	request.Header.Set(restful.HEADER_ContentType, restful.MIME_JSON)
+	recorder := httptest.NewRecorder()
+	container.ServeHTTP(recorder, request)
+	if recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), entity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestReadData(t *testing.T) {
+	r, driver := newDataResource(t)
+	driver.failures["read d3/temp"] = edgeerrors.NewCommonEdgeError(edgeerrors.Driver, "no such register", nil)
+	resp := new(ReadResponse)
+	status := postData(t, r.DataReadWebService("/api/v1/data:read"), "/api/v1/data:read", `{"items": [
+		{"device_id": "d1"},
+		{"device_id": "d1", "properties": ["temp"], "type": "hard"},
+		{"device_id": "d2"},
+		{"device_id": "missing"},
+		{"device_id": "d3", "properties": ["speed", "temp"]},
+		{"device_id": "d1", "type": "cold"}
+	]}`, resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+
+	want := []struct {
+		status int
+		code   string
+		props  map[models.ProductPropertyID]interface{}
+	}{
+		{http.StatusOK, "", map[models.ProductPropertyID]interface{}{"speed": float64(10), "temp": 20.5}},
+		{http.StatusOK, "", map[models.ProductPropertyID]interface{}{"temp": 20.5}},
+		{http.StatusConflict, problem.CodeDeviceDisconnected, nil},
+		{http.StatusNotFound, problem.CodeNotFound, nil},
+		// the properties read before the failure are returned along with the error
+		{http.StatusBadGateway, problem.CodeDriverError, map[models.ProductPropertyID]interface{}{"speed": float64(40)}},
+		{http.StatusBadRequest, problem.CodeBadRequest, nil},
+	}
+	if len(resp.Results) != len(want) || resp.Succeeded != 2 || resp.Failed != 4 {
+		t.Fatalf("got %d results with %d succeeded and %d failed, want %d with 2 and 4",
+			len(resp.Results), resp.Succeeded, resp.Failed, len(want))
+	}
+	for i, result := range resp.Results {
+		code := ""
+		if result.Error != nil {
+			code = result.Error.Code
+		}
+		var props map[models.ProductPropertyID]interface{}
+		for id, value := range result.Props {
+			if props == nil {
+				props = make(map[models.ProductPropertyID]interface{})
+			}
+			props[id] = value.Value
+		}
+		if result.Index != i || result.Status != want[i].status || code != want[i].code || !reflect.DeepEqual(props, want[i].props) {
+			t.Errorf("result[%d] = %d %s %v, want %d %s %v", i, result.Status, code, props,
+				want[i].status, want[i].code, want[i].props)
+		}
+	}
+	for _, call := range driver.calls {
+		if strings.Contains(call, "d2") {
+			t.Errorf("the disconnected device is read by %s", call)
+		}
+	}
+}
+
+func TestReadDataTimeout(t *testing.T) {
+	r, driver := newDataResource(t)
+	r.OperationClient = &slowDriver{fakeDriver: driver, delay: 200 * time.Millisecond}
+	resp := new(ReadResponse)
+	start := time.Now()
+	status := postData(t, r.DataReadWebService("/api/v1/data:read"), "/api/v1/data:read",
+		`{"items": [{"device_id": "d1"}, {"device_id": "d2"}], "timeout_ms": 20}`, resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("the batch takes %s, want it given up in the timeout", elapsed)
+	}
+	if got := []int{resp.Results[0].Status, resp.Results[1].Status}; !reflect.DeepEqual(got, []int{http.StatusGatewayTimeout, http.StatusConflict}) {
+		t.Errorf("statuses = %v, want the slow item timed out", got)
+	}
+}
+
+func TestReadDataRejectsInvalidRequests(t *testing.T) {
+	r, driver := newDataResource(t)
+	ws := r.DataReadWebService("/api/v1/data:read")
+	for _, body := range []string{
+		`{"items": []}`,
+		`{"items": [{"device_id": "d1"}], "timeout_ms": -1}`,
+		`{"items": {}}`,
+	} {
+		if status := postData(t, ws, "/api/v1/data:read", body, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, status, http.StatusBadRequest)
+		}
+	}
+	if status := postData(t, ws, "/api/v1/data:read?force=maybe", `{"items": [{"device_id": "d1"}]}`, nil); status != http.StatusBadRequest {
+		t.Errorf("an invalid force: status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if len(driver.calls) != 0 {
+		t.Errorf("the driver is called with %v, want none", driver.calls)
+	}
+}
+
+func TestBoundedLimitsConcurrency(t *testing.T) {
+	sem := make(chan struct{}, 2)
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = bounded(sem, time.Second, func() error {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("%d operations run concurrently, want 2", peak)
+	}
+
+	// the slot is held by the timed out operation until it returns
+	release := make(chan struct{})
+	finished, err := bounded(sem, 10*time.Millisecond, func() error {
+		<-release
+		return nil
+	})
+	if finished || err == nil || len(sem) != 1 {
+		t.Errorf("finished = %t, err = %v and %d slots held, want a timeout with the slot held", finished, err, len(sem))
+	}
+	close(release)
+}
@@ -0,0 +1,139 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MIME_EVENT_STREAM = "text/event-stream"
+
+	HeaderLastEventID     = "Last-Event-ID"
+	HeaderLastEventIDDesc = "the identifier of the last event received, to resume the stream of Server-Sent Events"
+
+	// sseKeepAliveInterval is the interval of comments sent to keep the stream alive through proxies.
+	sseKeepAliveInterval = 15 * time.Second
+)
+
+// acceptsEventStream returns true if the client prefers Server-Sent Events to WebSocket.
+func acceptsEventStream(request *restful.Request) bool {
+	return strings.Contains(request.HeaderParameter("Accept"), MIME_EVENT_STREAM)
+}
+
+// stream sends messages of the topic as Server-Sent Events if the client accepts them,
+// otherwise it upgrades the connection to WebSocket as before. Only the messages matched
+// are sent if match is not nil.
+func (r Resource) stream(request *restful.Request, response *restful.Response,
+	topic subscription.Topic, protocolID, productID string, match func(data interface{}) bool) error {
+	sse := acceptsEventStream(request)
+	var bus <-chan interface{}
+	var stop func()
+	var err error
+	if sse {
+		lastEventID := request.HeaderParameter(HeaderLastEventID)
+		bus, stop, err = r.Subscriptions.Resume(topic, protocolID, productID, lastEventID)
+	} else {
+		bus, stop, err = r.Subscriptions.Subscribe(topic, protocolID, productID)
+	}
+	if err != nil {
+		return problem.Wrap(err, "fail to subscribe the topic[%s]", topic)
+	}
+	if match != nil {
+		bus, stop = filterBus(bus, stop, match)
+	}
+
+	if sse {
+		return r.sendSSEMessage(request, response, bus, stop)
+	}
+	return r.sendWSMessage(request, response, bus, stop)
+}
+
+// filterBus returns a bus of the messages matched, the data of *subscription.Message is matched
+// rather than the message itself. The bus is closed once the source is closed or it is stopped.
+func filterBus(source <-chan interface{}, stopSource func(),
+	match func(data interface{}) bool) (<-chan interface{}, func()) {
+	bus, done := make(chan interface{}), make(chan struct{})
+	go func() {
+		defer close(bus)
+		for message := range source {
+			data := message
+			if m, ok := message.(*subscription.Message); ok {
+				data = m.Data
+			}
+			if !match(data) {
+				continue
+			}
+			select {
+			case bus <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return bus, func() {
+		once.Do(func() {
+			close(done)
+			stopSource()
+		})
+	}
+}
+
+// sendSSEMessage sends messages from the bus as Server-Sent Events, until the client goes away
+// or the server is shutting down. The identifier of each event could be sent back in the header
+// Last-Event-ID to resume the stream from it.
+func (r Resource) sendSSEMessage(request *restful.Request, response *restful.Response,
+	bus <-chan interface{}, stop func()) error {
+	defer stop()
+	flusher, ok := response.ResponseWriter.(http.Flusher)
+	if !ok {
+		return problem.BadRequest(nil, "the connection doesn't support streaming")
+	}
+	r.Sessions.Add(1)
+	defer r.Sessions.Done()
+
+	header := response.Header()
+	header.Set("Content-Type", MIME_EVENT_STREAM)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // disable the buffering of nginx
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case m, ok := <-bus:
+			if !ok {
+				return nil
+			}
+			message := m.(*subscription.Message)
+			data, err := json.Marshal(message.Data)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(response, "id: %s\nevent: %s\ndata: %s\n\n",
+				message.ID, message.Topic.Kind, data); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(response, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case <-request.Request.Context().Done():
+			return nil
+		case <-r.Context.Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
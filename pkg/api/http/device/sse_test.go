@@ -0,0 +1,141 @@
+package device
+
+import (
+	"bufio"
+	"context"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService hands out a bus of the properties for each subscription of the message bus.
+type fakeService struct {
+	operations.ManagerService
+
+	buses chan chan interface{}
+}
+
+func (s *fakeService) SubscribeDeviceProps(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (<-chan interface{}, func(), error) {
+	bus := make(chan interface{}, 10)
+	s.buses <- bus
+	return bus, func() { close(bus) }, nil
+}
+
+// readEvent reads the next event of the stream, and returns its lines except the empty one ending it.
+func readEvent(t *testing.T, reader *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("fail to read the event, got %v", err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestWatchPropertiesAsServerSentEvents(t *testing.T) {
+	r, _ := newTestResource(t)
+	service := &fakeService{buses: make(chan chan interface{}, 2)}
+	r.Subscriptions = subscription.NewHub(service)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Context, r.Sessions = ctx, new(sync.WaitGroup)
+	container := restful.NewContainer()
+	container.Add(r.WebService("/api/v1/devices"))
+	server := httptest.NewServer(container)
+	defer server.Close()
+
+	// the messages received by an earlier subscriber are kept in the hub
+	topic := subscription.Topic{DeviceID: "d1", Kind: subscription.KindProperties}
+	earlier, stop, err := r.Subscriptions.Resume(topic, "modbus", "p1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := <-service.buses
+	bus <- map[string]int{"speed": 1}
+	bus <- map[string]int{"speed": 2}
+	first := (<-earlier).(*subscription.Message)
+	<-earlier
+	stop()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/devices/d1/properties", nil)
+	request.Header.Set("Accept", MIME_EVENT_STREAM)
+	request.Header.Set(HeaderLastEventID, first.ID)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != MIME_EVENT_STREAM {
+		t.Fatalf("status = %d and content type = %s, want a stream of events",
+			resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	// the message after the last one received is replayed before the live ones
+	replayed := readEvent(t, reader)
+	if len(replayed) != 3 || !strings.HasPrefix(replayed[0], "id: ") || replayed[1] != "event: properties" ||
+		replayed[2] != `data: {"speed":2}` {
+		t.Errorf("the replayed event = %q, want the second message", replayed)
+	}
+	select {
+	case bus = <-service.buses:
+	case <-time.After(time.Second):
+		t.Fatal("the message bus is not subscribed again")
+	}
+	bus <- map[string]int{"speed": 3}
+	if live := readEvent(t, reader); len(live) != 3 || live[0] == replayed[0] || live[2] != `data: {"speed":3}` {
+		t.Errorf("the live event = %q, want the third message", live)
+	}
+
+	// the stream is closed once the server is shutting down
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		r.Sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the session is not closed when the server is shutting down")
+	}
+}
+
+func TestFilterBus(t *testing.T) {
+	source := make(chan interface{}, 3)
+	stopped := false
+	bus, stop := filterBus(source, func() { stopped = true }, func(data interface{}) bool {
+		return data.(int)%2 == 0
+	})
+	source <- 1
+	source <- &subscription.Message{ID: "e-1", Data: 2}
+	source <- 4
+	if m := (<-bus).(*subscription.Message); m.ID != "e-1" {
+		t.Errorf("received %+v, want the tagged message kept", m)
+	}
+	if m := <-bus; m != 4 {
+		t.Errorf("received %v, want 4", m)
+	}
+	stop()
+	stop()
+	if !stopped {
+		t.Error("the source is not stopped")
+	}
+	close(source)
+	if _, ok := <-bus; ok {
+		t.Error("the bus should be closed once the source is closed")
+	}
+}
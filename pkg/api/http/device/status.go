@@ -0,0 +1,85 @@
+package device
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/listing"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"strings"
+)
+
+const (
+	QueryParamStates     = "states"
+	QueryParamStatesDesc = "the states to be sent, separated by commas, e.g. 'disconnected,exception', " +
+		"all states are sent if it is empty"
+	QueryParamStatesType = "string"
+)
+
+// statusFilter selects the changes of statuses by devices, products and states. The devices selected
+// by 'q', 'selector' and 'tags' are resolved once the stream starts, the devices created later are
+// not selected even though they match.
+type statusFilter struct {
+	devices   map[string]bool // nil means all devices
+	productID string
+	states    map[string]bool // nil means all states
+}
+
+func (r Resource) parseStatusFilter(request *restful.Request) (*statusFilter, error) {
+	f := &statusFilter{productID: request.QueryParameter(QueryParamProductID)}
+	if states := request.QueryParameter(QueryParamStates); states != "" {
+		f.states = make(map[string]bool)
+		for _, state := range strings.Split(states, ",") {
+			if state = strings.TrimSpace(state); state != "" {
+				f.states[state] = true
+			}
+		}
+	}
+
+	query, err := listing.ParseQuery(request)
+	if err != nil {
+		return nil, err
+	}
+	if query.Empty() {
+		return f, nil
+	}
+	devices, _, err := r.MetaStore.SearchDevices(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	f.devices = make(map[string]bool, len(devices))
+	for _, device := range devices {
+		f.devices[device.ID] = true
+	}
+	return f, nil
+}
+
+func (f *statusFilter) match(data interface{}) bool {
+	change, ok := data.(*health.DeviceStateChange)
+	if !ok {
+		return false
+	}
+	if f.devices != nil && !f.devices[change.DeviceID] {
+		return false
+	}
+	if f.productID != "" && f.productID != change.ProductID {
+		return false
+	}
+	return f.states == nil || f.states[change.State]
+}
+
+// watchStatuses streams the changes of the statuses of all devices, or the ones selected, from the single
+// subscription of the hub which the manager publishes the statuses into, rather than a subscription of
+// the message bus for each client.
+func (r Resource) watchStatuses(request *restful.Request, response *restful.Response) {
+	f, err := r.parseStatusFilter(request)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to select devices"))
+		return
+	}
+
+	topic := subscription.Topic{DeviceID: subscription.AllDevices, Kind: subscription.KindStatus}
+	if err := r.stream(request, response, topic, "", "", f.match); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to watch the statuses of devices"))
+	}
+}
@@ -0,0 +1,111 @@
+package device
+
+import (
+	"bufio"
+	"context"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseStatusFilter(t *testing.T) {
+	r, _ := newTestResource(t)
+	for _, c := range []struct {
+		query   string
+		matched []string
+	}{
+		{"", []string{"d1 p1 connected", "d2 p1 exception", "d9 p2 exception"}},
+		{"states=exception,%20disconnected", []string{"d2 p1 exception", "d9 p2 exception"}},
+		{"product-id=p1&states=exception", []string{"d2 p1 exception"}},
+		// the devices are resolved once, so the device d9 which doesn't exist is never selected
+		{"q=" + url.QueryEscape("name=D2"), []string{"d2 p1 exception"}},
+	} {
+		f, err := r.parseStatusFilter(restful.NewRequest(httptest.NewRequest(http.MethodGet, "/?"+c.query, nil)))
+		if err != nil {
+			t.Fatalf("%q: %v", c.query, err)
+		}
+		var matched []string
+		for _, change := range []*health.DeviceStateChange{
+			{DeviceID: "d1", ProductID: "p1", State: models.DeviceStateConnected},
+			{DeviceID: "d2", ProductID: "p1", State: models.DeviceStateException},
+			{DeviceID: "d9", ProductID: "p2", State: models.DeviceStateException},
+		} {
+			if f.match(change) {
+				matched = append(matched, strings.Join([]string{change.DeviceID, change.ProductID, change.State}, " "))
+			}
+		}
+		if strings.Join(matched, ",") != strings.Join(c.matched, ",") {
+			t.Errorf("%q: matched %v, want %v", c.query, matched, c.matched)
+		}
+	}
+
+	if _, err := r.parseStatusFilter(restful.NewRequest(httptest.NewRequest(http.MethodGet, "/?q=unknown", nil))); err == nil {
+		t.Error("an invalid query should be rejected")
+	}
+}
+
+func TestWatchStatusesSharesHub(t *testing.T) {
+	r, _ := newTestResource(t)
+	r.Subscriptions = subscription.NewHub(&fakeService{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Context, r.Sessions = ctx, new(sync.WaitGroup)
+	container := restful.NewContainer()
+	container.Add(r.WebService("/api/v1/devices"))
+	server := httptest.NewServer(container)
+	defer server.Close()
+
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/devices/status/stream?states=exception", nil)
+		request.Header.Set("Accept", MIME_EVENT_STREAM)
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		readers = append(readers, bufio.NewReader(resp.Body))
+	}
+	// all clients share the single topic of the statuses of all devices
+	if n := r.Subscriptions.Active(); n != 1 {
+		t.Fatalf("%d topics are active, want 1", n)
+	}
+
+	r.Subscriptions.Publish(subscription.Topic{DeviceID: "d1", Kind: subscription.KindStatus},
+		&health.DeviceStateChange{DeviceID: "d1", ProductID: "p1", State: models.DeviceStateConnected})
+	r.Subscriptions.Publish(subscription.Topic{DeviceID: "d2", Kind: subscription.KindStatus},
+		&health.DeviceStateChange{DeviceID: "d2", ProductID: "p1", State: models.DeviceStateException, Detail: "timeout"})
+	for i, reader := range readers {
+		event := readEvent(t, reader)
+		if len(event) != 3 || event[1] != "event: status" || !strings.Contains(event[2], `"device_id":"d2"`) ||
+			!strings.Contains(event[2], `"detail":"timeout"`) {
+			t.Errorf("client %d receives %q, want the exception of d2 with its detail", i, event)
+		}
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		r.Sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the sessions are not closed when the server is shutting down")
+	}
+	// the subscription is stopped right after the session is done
+	for deadline := time.Now().Add(time.Second); r.Subscriptions.Active() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d topics are active after all clients are gone, want 0", r.Subscriptions.Active())
+		}
+	}
+}
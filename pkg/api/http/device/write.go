@@ -0,0 +1,352 @@
+package device
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxWriteItems limits the number of items in a batch write.
+	maxWriteItems = 100
+	// maxConcurrentWrites limits the number of the concurrent writes of a batch across all drivers.
+	maxConcurrentWrites = 32
+
+	defaultWriteTimeout = 5 * time.Second
+	maxWriteTimeout     = 60 * time.Second
+
+	PropertyStateWritten        = "written"
+	PropertyStateVerified       = "verified"
+	PropertyStateFailed         = "failed"
+	PropertyStateSkipped        = "skipped"
+	PropertyStateRolledBack     = "rolled-back"
+	PropertyStateRollbackFailed = "rollback-failed"
+)
+
+// WriteRequest writes properties of several devices at once, e.g. the setpoints of a recipe.
+type WriteRequest struct {
+	Items []*WriteItem `json:"items"`
+	// Verify reads back the written properties from the devices and compares them with the written values.
+	Verify bool `json:"verify"`
+	// Rollback reads the previous values from the devices before writing, and restores them on all devices
+	// if any item fails, the batch is aborted before writing if any item is invalid or not ready.
+	Rollback bool `json:"rollback"`
+	// TimeoutMillis limits the duration of each read or write of a property, 5s by default and 60s at most.
+	TimeoutMillis int `json:"timeout_ms,omitempty"`
+}
+
+type WriteItem struct {
+	DeviceID string                                          `json:"device_id"`
+	Props    map[models.ProductPropertyID]*models.DeviceData `json:"props"`
+}
+
+// PropertyResult is the result of writing a property, the properties of a device are written in the order
+// of their IDs, and the ones after the failed property are skipped.
+type PropertyResult struct {
+	PropertyID    models.ProductPropertyID `json:"property_id"`
+	State         string                   `json:"state"`
+	Previous      *models.DeviceData       `json:"previous,omitempty"` // read before writing if rollback is required
+	Error         *problem.Problem         `json:"error,omitempty"`
+	RollbackError *problem.Problem         `json:"rollback_error,omitempty"`
+}
+
+// WriteResult is the result of an item, its status is the HTTP status code of the equivalent single request,
+// or 424 if the item is aborted or rolled back because of the others.
+type WriteResult struct {
+	Index    int               `json:"index"`
+	DeviceID string            `json:"device_id"`
+	Status   int               `json:"status"`
+	Error    *problem.Problem  `json:"error,omitempty"`
+	Props    []*PropertyResult `json:"props,omitempty"`
+}
+
+type WriteResponse struct {
+	Verify     bool           `json:"verify,omitempty"`
+	Rollback   bool           `json:"rollback,omitempty"`
+	RolledBack bool           `json:"rolled_back,omitempty"` // the previous values are restored on all devices
+	Succeeded  int            `json:"succeeded"`
+	Failed     int            `json:"failed"`
+	Results    []*WriteResult `json:"results"`
+}
+
+// setpoint is a validated item which is ready to be written to the device.
+type setpoint struct {
+	result     *WriteResult
+	device     *models.Device
+	protocolID string
+	values     map[models.ProductPropertyID]*models.DeviceData
+	attempted  int // the number of properties which may have been changed on the device
+}
+
+func (s *setpoint) fail(err error) {
+	s.result.Status, s.result.Error = problem.Of(err)
+}
+
+func (r Resource) writeData(request *restful.Request, response *restful.Response) {
+	write := new(WriteRequest)
+	if err := request.ReadEntity(write); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if len(write.Items) == 0 || len(write.Items) > maxWriteItems {
+		problem.Write(response, problem.BadRequest(nil, "the request should contain 1 to %d items", maxWriteItems))
+		return
+	}
+	timeout := defaultWriteTimeout
+	if write.TimeoutMillis < 0 {
+		problem.Write(response, problem.BadRequest(nil, "the timeout should not be negative"))
+		return
+	} else if write.TimeoutMillis > 0 {
+		timeout = time.Duration(write.TimeoutMillis) * time.Millisecond
+		if timeout > maxWriteTimeout {
+			timeout = maxWriteTimeout
+		}
+	}
+	force, err := forced(request)
+	if err != nil {
+		problem.Write(response, err)
+		return
+	}
+
+	resp := &WriteResponse{Verify: write.Verify, Rollback: write.Rollback, Results: make([]*WriteResult, len(write.Items))}
+	setpoints := make([]*setpoint, len(write.Items))
+	for i, item := range write.Items {
+		setpoints[i] = r.prepareSetpoint(i, item, force)
+		resp.Results[i] = setpoints[i].result
+	}
+	defer func() {
+		for _, result := range resp.Results {
+			if result.Error == nil {
+				resp.Succeeded++
+			} else {
+				resp.Failed++
+			}
+		}
+		_ = response.WriteEntity(resp)
+	}()
+
+	sem := make(chan struct{}, maxConcurrentWrites)
+	if write.Rollback {
+		if failed := firstFailed(setpoints); failed >= 0 {
+			abort(setpoints, "the batch is aborted because the item[%d] is invalid", failed)
+			return
+		}
+		forEachSetpoint(setpoints, func(s *setpoint) {
+			r.snapshotSetpoint(s, sem, timeout)
+		})
+		if failed := firstFailed(setpoints); failed >= 0 {
+			abort(setpoints, "the batch is aborted because the item[%d] could not be read", failed)
+			return
+		}
+	}
+
+	forEachSetpoint(setpoints, func(s *setpoint) {
+		if s.result.Error == nil {
+			r.writeSetpoint(s, write.Verify, sem, timeout)
+		}
+	})
+	if !write.Rollback {
+		return
+	}
+	failed := firstFailed(setpoints)
+	if failed < 0 {
+		return
+	}
+	forEachSetpoint(setpoints, func(s *setpoint) {
+		r.restoreSetpoint(s, sem, timeout)
+	})
+	for _, s := range setpoints {
+		if s.result.Error == nil {
+			s.fail(problem.Aborted(nil, "the properties are rolled back because the item[%d] failed", failed))
+		}
+	}
+	resp.RolledBack = true
+}
+
+// prepareSetpoint validates the item and verifies that its device is ready.
+func (r Resource) prepareSetpoint(index int, item *WriteItem, force bool) *setpoint {
+	s := &setpoint{
+		result: &WriteResult{Index: index, DeviceID: item.DeviceID, Status: http.StatusOK},
+		values: item.Props,
+	}
+	propertyIDs := make([]models.ProductPropertyID, 0, len(item.Props))
+	for propertyID := range item.Props {
+		propertyIDs = append(propertyIDs, propertyID)
+	}
+	sort.Strings(propertyIDs)
+	for _, propertyID := range propertyIDs {
+		s.result.Props = append(s.result.Props, &PropertyResult{PropertyID: propertyID, State: PropertyStateSkipped})
+	}
+
+	if item.DeviceID == "" {
+		s.fail(problem.BadRequest(nil, "the device's ID is required"))
+		return s
+	}
+	if len(item.Props) == 0 {
+		s.fail(problem.BadRequest(nil, "the properties to write are required"))
+		return s
+	}
+	for _, propertyID := range propertyIDs {
+		if propertyID == models.DeviceDataMultiPropsID || item.Props[propertyID] == nil {
+			s.fail(problem.BadRequest(nil, "the value of the property[%s] is invalid", propertyID))
+			return s
+		}
+	}
+	device, protocolID, err := r.traceDevice(item.DeviceID)
+	if err != nil {
+		s.fail(problem.Wrap(err, "fail to trace the device[%s]", item.DeviceID))
+		return s
+	}
+	if !force {
+		if err = r.ready(protocolID, device); err != nil {
+			s.fail(err)
+			return s
+		}
+	}
+	s.device, s.protocolID = device, protocolID
+	return s
+}
+
+// snapshotSetpoint reads the previous values of the properties from the device, so that they could be restored.
+func (r Resource) snapshotSetpoint(s *setpoint, sem chan struct{}, timeout time.Duration) {
+	for _, prop := range s.result.Props {
+		var values map[models.ProductPropertyID]*models.DeviceData
+		_, err := bounded(sem, timeout, func() (err error) {
+			values, err = r.OperationClient.HardRead(s.protocolID, s.device.ProductID, s.device.ID, prop.PropertyID)
+			return err
+		})
+		if err == nil && values[prop.PropertyID] == nil {
+			err = problem.Unverified(nil, "the property[%s] is absent in the values read", prop.PropertyID)
+		}
+		if err != nil {
+			err = problem.Wrap(err, "fail to read the property[%s] of the device[%s]", prop.PropertyID, s.device.ID)
+			_, prop.Error = problem.Of(err)
+			s.fail(err)
+			return
+		}
+		prop.Previous = values[prop.PropertyID]
+	}
+}
+
+// writeSetpoint writes the properties to the device one by one, and stops at the first failure.
+func (r Resource) writeSetpoint(s *setpoint, verify bool, sem chan struct{}, timeout time.Duration) {
+	for _, prop := range s.result.Props {
+		s.attempted++
+		err := r.writeProperty(s, prop.PropertyID, s.values[prop.PropertyID], sem, timeout)
+		if err == nil {
+			prop.State = PropertyStateWritten
+			if !verify {
+				continue
+			}
+			if err = r.verifyProperty(s, prop.PropertyID, sem, timeout); err == nil {
+				prop.State = PropertyStateVerified
+				continue
+			}
+		}
+		prop.State = PropertyStateFailed
+		_, prop.Error = problem.Of(err)
+		s.fail(err)
+		return
+	}
+}
+
+// restoreSetpoint writes the previous values back for the properties which may have been changed.
+func (r Resource) restoreSetpoint(s *setpoint, sem chan struct{}, timeout time.Duration) {
+	for _, prop := range s.result.Props[:s.attempted] {
+		if err := r.writeProperty(s, prop.PropertyID, prop.Previous, sem, timeout); err != nil {
+			prop.State = PropertyStateRollbackFailed
+			_, prop.RollbackError = problem.Of(err)
+			continue
+		}
+		prop.State = PropertyStateRolledBack
+	}
+}
+
+func (r Resource) writeProperty(s *setpoint, propertyID models.ProductPropertyID, value *models.DeviceData,
+	sem chan struct{}, timeout time.Duration) error {
+	_, err := bounded(sem, timeout, func() error {
+		return r.OperationClient.Write(s.protocolID, s.device.ProductID, s.device.ID, propertyID,
+			map[models.ProductPropertyID]*models.DeviceData{propertyID: value})
+	})
+	if err != nil {
+		return problem.Wrap(err, "fail to write the property[%s] of the device[%s]", propertyID, s.device.ID)
+	}
+	return nil
+}
+
+func (r Resource) verifyProperty(s *setpoint, propertyID models.ProductPropertyID,
+	sem chan struct{}, timeout time.Duration) error {
+	var values map[models.ProductPropertyID]*models.DeviceData
+	_, err := bounded(sem, timeout, func() (err error) {
+		values, err = r.OperationClient.HardRead(s.protocolID, s.device.ProductID, s.device.ID, propertyID)
+		return err
+	})
+	if err != nil {
+		return problem.Wrap(err, "fail to read back the property[%s] of the device[%s]", propertyID, s.device.ID)
+	}
+	if actual := values[propertyID]; actual == nil || !sameValue(actual.Value, s.values[propertyID].Value) {
+		return problem.Unverified(nil, "the property[%s] of the device[%s] is %v rather than the written %v",
+			propertyID, s.device.ID, valueOf(actual), s.values[propertyID].Value)
+	}
+	return nil
+}
+
+// sameValue compares values after normalizing them by JSON, so that e.g. int64(1) equals float64(1).
+func sameValue(a, b interface{}) bool {
+	normalize := func(v interface{}) interface{} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return v
+		}
+		var normalized interface{}
+		if err = json.Unmarshal(data, &normalized); err != nil {
+			return v
+		}
+		return normalized
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func valueOf(data *models.DeviceData) interface{} {
+	if data == nil {
+		return nil
+	}
+	return data.Value
+}
+
+func forEachSetpoint(setpoints []*setpoint, f func(s *setpoint)) {
+	var wg sync.WaitGroup
+	for _, s := range setpoints {
+		wg.Add(1)
+		go func(s *setpoint) {
+			defer wg.Done()
+			f(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// firstFailed returns the index of the first failed setpoint, or -1 if all of them are fine.
+func firstFailed(setpoints []*setpoint) int {
+	for i, s := range setpoints {
+		if s.result.Error != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// abort marks the setpoints which are fine as aborted, nothing has been written to the devices yet.
+func abort(setpoints []*setpoint, format string, failed int) {
+	for _, s := range setpoints {
+		if s.result.Error == nil {
+			s.fail(problem.Aborted(nil, format, failed))
+		}
+	}
+}
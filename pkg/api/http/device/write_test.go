@@ -0,0 +1,175 @@
+package device
+
+import (
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	edgeerrors "github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stuckDriver accepts writes without changing the properties of devices.
+type stuckDriver struct {
+	*fakeDriver
+}
+
+func (d *stuckDriver) Write(protocolID, productID, deviceID string, propertyID models.ProductPropertyID,
+	props map[models.ProductPropertyID]*models.DeviceData) error {
+	return nil
+}
+
+func writeData(t *testing.T, r Resource, body string) *WriteResponse {
+	t.Helper()
+	resp := new(WriteResponse)
+	if status := postData(t, r.DataWriteWebService("/api/v1/data:write"), "/api/v1/data:write", body, resp); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	return resp
+}
+
+// states returns the status of each item and the states of its properties, e.g. "OK verified,verified".
+func states(resp *WriteResponse) []string {
+	s := make([]string, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		props := make([]string, 0, len(result.Props))
+		for _, prop := range result.Props {
+			props = append(props, prop.State)
+		}
+		s = append(s, strings.TrimSpace(http.StatusText(result.Status)+" "+strings.Join(props, ",")))
+	}
+	return s
+}
+
+func writes(driver *fakeDriver) []string {
+	var w []string
+	for _, call := range driver.calls {
+		if strings.HasPrefix(call, "write ") {
+			w = append(w, call)
+		}
+	}
+	return w
+}
+
+func TestWriteDataVerify(t *testing.T) {
+	r, driver := newDataResource(t)
+	resp := writeData(t, r, `{"verify": true, "items": [
+		{"device_id": "d1", "props": {"temp": {"value": 21}, "speed": {"value": 11}}},
+		{"device_id": "d3", "props": {"speed": {"value": 41}}}
+	]}`)
+
+	want := []string{"OK verified,verified", "OK verified"}
+	if got := states(resp); !reflect.DeepEqual(got, want) || resp.Succeeded != 2 || resp.RolledBack {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+	// the properties are written in the order of their IDs
+	if props := resp.Results[0].Props; props[0].PropertyID != "speed" || props[1].PropertyID != "temp" {
+		t.Errorf("the properties are reported in the order %s and %s", props[0].PropertyID, props[1].PropertyID)
+	}
+	if !sameValue(driver.value("d1", "speed"), 11) || !sameValue(driver.value("d3", "speed"), 41) {
+		t.Errorf("the properties are not written, got %v", driver.values)
+	}
+}
+
+func TestWriteDataUnverified(t *testing.T) {
+	r, driver := newDataResource(t)
+	r.OperationClient = &stuckDriver{fakeDriver: driver}
+	resp := writeData(t, r, `{"verify": true, "items": [{"device_id": "d1", "props": {"speed": {"value": 11}, "temp": {"value": 21}}}]}`)
+
+	result := resp.Results[0]
+	if result.Status != http.StatusBadGateway || result.Error.Code != problem.CodeUnverified {
+		t.Errorf("status = %d and error = %+v, want the write unverified", result.Status, result.Error)
+	}
+	if got, want := states(resp), []string{"Bad Gateway failed,skipped"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+}
+
+func TestWriteDataBestEffort(t *testing.T) {
+	r, driver := newDataResource(t)
+	driver.failures["write d1/temp"] = edgeerrors.NewCommonEdgeError(edgeerrors.Driver, "read-only register", nil)
+	resp := writeData(t, r, `{"items": [
+		{"device_id": "d1", "props": {"speed": {"value": 11}, "temp": {"value": 21}}},
+		{"device_id": "d2", "props": {"speed": {"value": 31}}},
+		{"device_id": "d3", "props": {"speed": {"value": 41}}},
+		{"device_id": "d3", "props": {"*": {"value": 1}}}
+	]}`)
+
+	want := []string{"Bad Gateway written,failed", "Conflict skipped", "OK written", "Bad Request skipped"}
+	if got := states(resp); !reflect.DeepEqual(got, want) || resp.Succeeded != 1 || resp.Failed != 3 {
+		t.Errorf("states = %v with %d succeeded, want %v with 1", got, resp.Succeeded, want)
+	}
+	if !sameValue(driver.value("d1", "speed"), 11) || !sameValue(driver.value("d3", "speed"), 41) {
+		t.Errorf("the written properties should be kept without rollback, got %v", driver.values)
+	}
+}
+
+func TestWriteDataRollback(t *testing.T) {
+	r, driver := newDataResource(t)
+	driver.failures["write d1/temp"] = edgeerrors.NewCommonEdgeError(edgeerrors.Driver, "read-only register", nil)
+	resp := writeData(t, r, `{"rollback": true, "items": [
+		{"device_id": "d1", "props": {"speed": {"value": 11}, "temp": {"value": 21}}},
+		{"device_id": "d3", "props": {"speed": {"value": 41}}}
+	]}`)
+
+	// the failed property may have been changed, so it is restored as well, which fails again
+	want := []string{"Bad Gateway rolled-back,rollback-failed", "Failed Dependency rolled-back"}
+	if got := states(resp); !reflect.DeepEqual(got, want) || !resp.RolledBack {
+		t.Errorf("states = %v and rolled back %t, want %v and true", got, resp.RolledBack, want)
+	}
+	if code := resp.Results[1].Error.Code; code != problem.CodeAborted {
+		t.Errorf("the code of the rolled back item = %s, want %s", code, problem.CodeAborted)
+	}
+	if previous := resp.Results[0].Props[0].Previous; previous == nil || previous.Value != float64(10) {
+		t.Errorf("the previous value = %+v, want 10", previous)
+	}
+	if driver.value("d1", "speed") != 10 || driver.value("d3", "speed") != 40 {
+		t.Errorf("the previous values should be restored, got %v", driver.values)
+	}
+}
+
+func TestWriteDataRollbackAbortsBeforeWriting(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		failure string
+		items   string
+		want    []string
+	}{
+		{"not ready", "", `{"device_id": "d2", "props": {"speed": {"value": 31}}}`,
+			[]string{"Failed Dependency skipped", "Conflict skipped"}},
+		{"unreadable", "hard-read d3/speed", `{"device_id": "d3", "props": {"speed": {"value": 41}}}`,
+			[]string{"Failed Dependency skipped", "Bad Gateway skipped"}},
+	} {
+		r, driver := newDataResource(t)
+		if c.failure != "" {
+			driver.failures[c.failure] = edgeerrors.NewCommonEdgeError(edgeerrors.Driver, "no response", nil)
+		}
+		resp := writeData(t, r, `{"rollback": true, "items": [
+			{"device_id": "d1", "props": {"speed": {"value": 11}}}, `+c.items+`]}`)
+
+		if got := states(resp); !reflect.DeepEqual(got, c.want) || resp.RolledBack {
+			t.Errorf("%s: states = %v, want %v", c.name, got, c.want)
+		}
+		if w := writes(driver); len(w) != 0 {
+			t.Errorf("%s: the driver is written with %v, want none", c.name, w)
+		}
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	for _, c := range []struct {
+		a, b interface{}
+		want bool
+	}{
+		{int64(1), float64(1), true},
+		{[]int{1, 2}, []interface{}{1.0, 2.0}, true},
+		{map[string]int{"a": 1}, map[string]interface{}{"a": 1.0}, true},
+		{"1", 1, false},
+		{true, 1, false},
+	} {
+		if got := sameValue(c.a, c.b); got != c.want {
+			t.Errorf("sameValue(%#v, %#v) = %t, want %t", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package group
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"sort"
+	"strconv"
+)
+
+const (
+	PathParamGroupID     = "group-id"
+	PathParamGroupIDDesc = "the identifier of the group"
+	PathParamGroupIDType = "string"
+
+	QueryParamParentID     = "parent-id"
+	QueryParamParentIDDesc = "the identifier of the parent group, only root groups will be returned if it is '-'"
+	QueryParamParentIDType = "string"
+	QueryParamParentIDRoot = "-"
+
+	QueryParamRecursive     = "recursive"
+	QueryParamRecursiveDesc = "whether to include devices of all descendant groups"
+	QueryParamRecursiveType = "boolean"
+)
+
+// GroupStatus aggregates statuses of devices in a group, each device is counted once
+// even though it is a member of several groups in the subtree.
+type GroupStatus struct {
+	Total    int            `json:"total"`
+	Statuses map[string]int `json:"statuses"` // device status -> the number of devices
+}
+
+// GroupNode is a node of the group tree, its status includes devices of all its descendants.
+type GroupNode struct {
+	*metastore.Group
+	Status   *GroupStatus `json:"status"`
+	Children []*GroupNode `json:"children"`
+}
+
+func (r Resource) createGroup(request *restful.Request, response *restful.Response) {
+	group := new(metastore.Group)
+	if err := request.ReadEntity(group); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if err := group.Validate(); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to validate the group"))
+		return
+	} else if group.Name == "" {
+		group.Name = group.ID
+	}
+	f, err := r.loadForest()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to load groups"))
+		return
+	}
+	if err = f.verify(group); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to verify the group[%s]", group.ID))
+		return
+	}
+
+	if err = r.MetaStore.CreateGroup(group); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to create the group[%s]", group.ID))
+		return
+	}
+	_ = response.WriteEntity(group)
+}
+func (r Resource) deleteGroup(request *restful.Request, response *restful.Response) {
+	groupID := request.PathParameter(PathParamGroupID)
+	if groupID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamGroupID))
+		return
+	}
+	f, err := r.loadForest()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to load groups"))
+		return
+	}
+	if _, ok := f.groups[groupID]; !ok {
+		problem.Write(response, problem.NotFound(nil, "the group[%s] is not found", groupID))
+		return
+	}
+	if children := f.children[groupID]; len(children) != 0 {
+		problem.Write(response, problem.Conflict(nil,
+			"the group[%s] still has children %v, delete or move them first", groupID, children))
+		return
+	}
+	if err = r.MetaStore.DeleteGroup(groupID); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to delete the group[%s]", groupID))
+		return
+	}
+}
+func (r Resource) updateGroup(request *restful.Request, response *restful.Response) {
+	groupID := request.PathParameter(PathParamGroupID)
+	if groupID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamGroupID))
+		return
+	}
+	group := new(metastore.Group)
+	if err := request.ReadEntity(group); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	group.ID = groupID
+	if err := group.Validate(); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to validate the group"))
+		return
+	} else if group.Name == "" {
+		group.Name = group.ID
+	}
+	f, err := r.loadForest()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to load groups"))
+		return
+	}
+	if _, ok := f.groups[groupID]; !ok {
+		problem.Write(response, problem.NotFound(nil, "the group[%s] is not found", groupID))
+		return
+	}
+	if err = f.verify(group); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to verify the group[%s]", groupID))
+		return
+	}
+
+	if err = r.MetaStore.UpdateGroup(group); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to update the group[%s]", groupID))
+		return
+	}
+	_ = response.WriteEntity(group)
+}
+func (r Resource) findAllGroups(request *restful.Request, response *restful.Response) {
+	groups, err := r.MetaStore.ListGroups()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to list groups"))
+		return
+	}
+	parentID, ok := request.Request.URL.Query()[QueryParamParentID]
+	if !ok {
+		_ = response.WriteEntity(groups)
+		return
+	}
+	if parentID[0] == QueryParamParentIDRoot {
+		parentID[0] = ""
+	}
+	children := make([]*metastore.Group, 0)
+	for _, group := range groups {
+		if group.ParentID == parentID[0] {
+			children = append(children, group)
+		}
+	}
+	_ = response.WriteEntity(children)
+}
+func (r Resource) findGroup(request *restful.Request, response *restful.Response) {
+	groupID := request.PathParameter(PathParamGroupID)
+	if groupID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamGroupID))
+		return
+	}
+	group, err := r.MetaStore.GetGroup(groupID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the group[%s]", groupID))
+		return
+	}
+	_ = response.WriteEntity(group)
+}
+
+func (r Resource) findForest(request *restful.Request, response *restful.Response) {
+	f, err := r.loadForest()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to load groups"))
+		return
+	}
+	roots := make([]*GroupNode, 0)
+	for _, id := range f.children[""] {
+		node, err := f.node(id)
+		if err != nil {
+			problem.Write(response, problem.Wrap(err, "fail to build the tree of the group[%s]", id))
+			return
+		}
+		roots = append(roots, node)
+	}
+	_ = response.WriteEntity(roots)
+}
+func (r Resource) findTree(request *restful.Request, response *restful.Response) {
+	groupID := request.PathParameter(PathParamGroupID)
+	if groupID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamGroupID))
+		return
+	}
+	f, err := r.loadForest()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to load groups"))
+		return
+	}
+	if _, ok := f.groups[groupID]; !ok {
+		problem.Write(response, problem.NotFound(nil, "the group[%s] is not found", groupID))
+		return
+	}
+	node, err := f.node(groupID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to build the tree of the group[%s]", groupID))
+		return
+	}
+	_ = response.WriteEntity(node)
+}
+func (r Resource) findDevices(request *restful.Request, response *restful.Response) {
+	r.withMembers(request, response, func(devices []*models.Device) {
+		_ = response.WriteEntity(devices)
+	})
+}
+func (r Resource) findStatus(request *restful.Request, response *restful.Response) {
+	r.withMembers(request, response, func(devices []*models.Device) {
+		_ = response.WriteEntity(aggregate(devices))
+	})
+}
+
+// withMembers resolves the members of the group specified by the request, and then handles them.
+func (r Resource) withMembers(request *restful.Request, response *restful.Response, handle func([]*models.Device)) {
+	groupID := request.PathParameter(PathParamGroupID)
+	if groupID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamGroupID))
+		return
+	}
+	recursive := true
+	if value := request.QueryParameter(QueryParamRecursive); value != "" {
+		var err error
+		if recursive, err = strconv.ParseBool(value); err != nil {
+			problem.Write(response, problem.BadRequest(nil,
+				"the query parameter[%s] must be a boolean", QueryParamRecursive))
+			return
+		}
+	}
+	f, err := r.loadForest()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to load groups"))
+		return
+	}
+	if _, ok := f.groups[groupID]; !ok {
+		problem.Write(response, problem.NotFound(nil, "the group[%s] is not found", groupID))
+		return
+	}
+	groups := []string{groupID}
+	if recursive {
+		groups = f.descendants(groupID)
+	}
+	devices, err := f.members(groups...)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to resolve members of the group[%s]", groupID))
+		return
+	}
+	handle(devices)
+}
+
+// forest is a snapshot of all groups and devices, it is used to traverse groups and resolve their members.
+type forest struct {
+	metaStore metastore.MetaStore
+	groups    map[string]*metastore.Group
+	children  map[string][]string // parent ID -> IDs of children, "" for root groups
+	devices   map[string]*models.Device
+	direct    map[string]map[string]*models.Device // group ID -> its own members, resolved at most once
+}
+
+func (r Resource) loadForest() (*forest, error) {
+	groups, err := r.MetaStore.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	devices, _, err := r.MetaStore.SearchDevices(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	f := &forest{
+		metaStore: r.MetaStore,
+		groups:    make(map[string]*metastore.Group, len(groups)),
+		children:  make(map[string][]string),
+		devices:   make(map[string]*models.Device, len(devices)),
+		direct:    make(map[string]map[string]*models.Device, len(groups)),
+	}
+	for _, group := range groups {
+		f.groups[group.ID] = group
+		f.children[group.ParentID] = append(f.children[group.ParentID], group.ID)
+	}
+	for _, device := range devices {
+		f.devices[device.ID] = device
+	}
+	return f, nil
+}
+
+// verify checks whether the parent and static members of the group exist,
+// and the group will not be an ancestor of itself.
+func (f *forest) verify(group *metastore.Group) error {
+	if group.ParentID != "" {
+		if _, ok := f.groups[group.ParentID]; !ok {
+			return problem.Unprocessable(nil, "the parent group[%s] is not found", group.ParentID)
+		}
+		for _, id := range f.descendants(group.ID) {
+			if id == group.ParentID {
+				return problem.Unprocessable(nil, "the group[%s] could not be moved into its descendant[%s]",
+					group.ID, group.ParentID)
+			}
+		}
+	}
+	for _, deviceID := range group.Devices {
+		if _, ok := f.devices[deviceID]; !ok {
+			return problem.Unprocessable(nil, "the device[%s] is not found", deviceID)
+		}
+	}
+	return nil
+}
+
+// descendants returns IDs of the group and all its descendants.
+func (f *forest) descendants(groupID string) []string {
+	ids := []string{groupID}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, f.children[ids[i]]...)
+	}
+	return ids
+}
+
+// members returns devices which are members of any of the groups, the deleted devices are ignored.
+func (f *forest) members(groupIDs ...string) ([]*models.Device, error) {
+	members := make(map[string]*models.Device)
+	for _, groupID := range groupIDs {
+		direct, err := f.resolve(groupID)
+		if err != nil {
+			return nil, err
+		}
+		for id, device := range direct {
+			members[id] = device
+		}
+	}
+	return sorted(members), nil
+}
+
+// resolve returns the static members and the ones selected by the selector of the group itself, excluding
+// the members of its descendants. The selector is searched only once for each forest.
+func (f *forest) resolve(groupID string) (map[string]*models.Device, error) {
+	if direct, ok := f.direct[groupID]; ok {
+		return direct, nil
+	}
+	direct := make(map[string]*models.Device)
+	group, ok := f.groups[groupID]
+	if !ok {
+		return direct, nil
+	}
+	for _, deviceID := range group.Devices {
+		if device, ok := f.devices[deviceID]; ok {
+			direct[deviceID] = device
+		}
+	}
+	if query := group.MemberQuery(); query != nil {
+		devices, _, err := f.metaStore.SearchDevices(query, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range devices {
+			direct[device.ID] = device
+		}
+	}
+	f.direct[groupID] = direct
+	return direct, nil
+}
+
+// node builds the subtree rooted at the group.
+func (f *forest) node(groupID string) (*GroupNode, error) {
+	node, _, err := f.subtree(groupID)
+	return node, err
+}
+
+// subtree builds the subtree bottom-up, and returns the members of the whole subtree along with it,
+// so that the members of each group are resolved only once.
+func (f *forest) subtree(groupID string) (*GroupNode, map[string]*models.Device, error) {
+	direct, err := f.resolve(groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	members := make(map[string]*models.Device, len(direct))
+	for id, device := range direct {
+		members[id] = device
+	}
+	node := &GroupNode{
+		Group:    f.groups[groupID],
+		Children: make([]*GroupNode, 0, len(f.children[groupID])),
+	}
+	for _, childID := range f.children[groupID] {
+		child, descendants, err := f.subtree(childID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for id, device := range descendants {
+			members[id] = device
+		}
+		node.Children = append(node.Children, child)
+	}
+	node.Status = aggregate(sorted(members))
+	return node, members, nil
+}
+
+func sorted(members map[string]*models.Device) []*models.Device {
+	devices := make([]*models.Device, 0, len(members))
+	for _, device := range members {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices
+}
+
+func aggregate(devices []*models.Device) *GroupStatus {
+	status := &GroupStatus{Total: len(devices), Statuses: make(map[string]int)}
+	for _, device := range devices {
+		status.Statuses[device.DeviceStatus]++
+	}
+	return status
+}
@@ -0,0 +1,129 @@
+package group
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestResource returns a resource with the tree site -> {line-1, line-2}, the line-1 has the static member d1,
+// and the line-2 selects the devices on the line l2, i.e. d2 and d3, the d4 is not a member of any group.
+func newTestResource(t *testing.T) Resource {
+	t.Helper()
+	store, err := metastore.NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []*models.Device{
+		{ID: "d1", DeviceStatus: models.DeviceStateConnected},
+		{ID: "d2", DeviceStatus: models.DeviceStateConnected},
+		{ID: "d3", DeviceStatus: models.DeviceStateDisconnected},
+		{ID: "d4", DeviceStatus: models.DeviceStateConnected},
+	} {
+		if err = store.CreateDevice(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"d2", "d3"} {
+		if err = store.UpdateDeviceLabels(id, &metastore.Labels{Labels: map[string]string{"line": "l2"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, group := range []*metastore.Group{
+		{ID: "site"},
+		{ID: "line-1", ParentID: "site", Devices: []string{"d1"}},
+		{ID: "line-2", ParentID: "site", Devices: []string{"d2"}, Selector: "line=l2"},
+	} {
+		if err = store.CreateGroup(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Resource{MetaStore: store}
+}
+
+func serve(r Resource, method, path, body string) *httptest.ResponseRecorder {
+	container := restful.NewContainer()
+	container.Add(r.WebService("/api/v1/groups"))
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(restful.HEADER_ContentType, restful.MIME_JSON)
+	recorder := httptest.NewRecorder()
+	container.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestFindDevices(t *testing.T) {
+	r := newTestResource(t)
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{"/api/v1/groups/site/devices", []string{"d1", "d2", "d3"}},
+		{"/api/v1/groups/site/devices?recursive=false", []string{}},
+		{"/api/v1/groups/line-2/devices", []string{"d2", "d3"}},
+	} {
+		recorder := serve(r, http.MethodGet, c.path, "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", c.path, recorder.Code, recorder.Body.String())
+		}
+		devices := make([]*models.Device, 0)
+		if err := json.Unmarshal(recorder.Body.Bytes(), &devices); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(devices))
+		for i, device := range devices {
+			got[i] = device.ID
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: devices = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+func TestTreeAggregatesStatuses(t *testing.T) {
+	f, err := newTestResource(t).loadForest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := f.node("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the d2 is a static and a dynamic member of the line-2, but it is counted once
+	want := &GroupStatus{Total: 3, Statuses: map[string]int{models.DeviceStateConnected: 2, models.DeviceStateDisconnected: 1}}
+	if !reflect.DeepEqual(node.Status, want) {
+		t.Errorf("status of the site = %+v, want %+v", node.Status, want)
+	}
+	if len(node.Children) != 2 || node.Children[1].Status.Total != 2 {
+		t.Errorf("children = %+v, want the line-2 with 2 devices", node.Children)
+	}
+}
+
+func TestVerifyGroups(t *testing.T) {
+	r := newTestResource(t)
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodPost, "/api/v1/groups", `{"id": "line-3", "parent_id": "site", "devices": ["d4"]}`, http.StatusOK},
+		{http.MethodPost, "/api/v1/groups", `{"id": "line-1"}`, http.StatusConflict},
+		{http.MethodPost, "/api/v1/groups", `{"id": "line-4", "parent_id": "missing"}`, http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/v1/groups", `{"id": "line-4", "devices": ["missing"]}`, http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/v1/groups", `{"id": "line-4", "selector": "line in l2"}`, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/api/v1/groups/site", `{"parent_id": "line-1"}`, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/api/v1/groups/site", `{"parent_id": "site"}`, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/api/v1/groups/missing", `{}`, http.StatusNotFound},
+	} {
+		if recorder := serve(r, c.method, c.path, c.body); recorder.Code != c.want {
+			t.Errorf("%s %s %s: status = %d, want %d, body = %s",
+				c.method, c.path, c.body, recorder.Code, c.want, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package group
+
+import (
+	"fmt"
+	restfulspec "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"net/http"
+)
+
+type Resource struct {
+	MetaStore metastore.MetaStore
+}
+
+func (r Resource) WebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"GROUP META OPERATION"}
+
+	ws.Route(ws.POST("").To(r.createGroup).
+		// docs
+		Doc("create a new group").
+		Notes("A device is a member of the group if it is listed in 'devices', or its labels satisfy the 'selector'.").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(metastore.Group{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Group{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.DELETE(fmt.Sprintf("/{%s}", PathParamGroupID)).To(r.deleteGroup).
+		// docs
+		Doc("delete a group by its ID, the group must have no children").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamGroupID, PathParamGroupIDDesc).DataType(PathParamGroupIDType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.PUT(fmt.Sprintf("/{%s}", PathParamGroupID)).To(r.updateGroup).
+		// docs
+		Doc("update a group by its ID, it could be moved into another parent").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamGroupID, PathParamGroupIDDesc).DataType(PathParamGroupIDType)).
+		Reads(metastore.Group{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Group{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET("/").To(r.findAllGroups).
+		// docs
+		Doc("get all groups, or children of a group").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.QueryParameter(QueryParamParentID, QueryParamParentIDDesc).DataType(QueryParamParentIDType)).
+		Writes([]metastore.Group{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), []metastore.Group{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}", PathParamGroupID)).To(r.findGroup).
+		// docs
+		Doc("get a group by its ID").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamGroupID, PathParamGroupIDDesc).DataType(PathParamGroupIDType)).
+		Writes(metastore.Group{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Group{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}))
+
+	ws.Route(ws.GET("/tree").To(r.findForest).
+		// docs
+		Doc("get trees of all root groups, along with the aggregate status of each group").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]GroupNode{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), []GroupNode{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/tree", PathParamGroupID)).To(r.findTree).
+		// docs
+		Doc("get the tree of a group, along with the aggregate status of each group").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamGroupID, PathParamGroupIDDesc).DataType(PathParamGroupIDType)).
+		Writes(GroupNode{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), GroupNode{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/devices", PathParamGroupID)).To(r.findDevices).
+		// docs
+		Doc("get static and dynamic members of a group").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamGroupID, PathParamGroupIDDesc).DataType(PathParamGroupIDType)).
+		Param(ws.QueryParameter(QueryParamRecursive, QueryParamRecursiveDesc).DataType(QueryParamRecursiveType).
+			DefaultValue("true")).
+		Writes([]models.Device{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), []models.Device{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/status", PathParamGroupID)).To(r.findStatus).
+		// docs
+		Doc("get the number of devices in each status of a group").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamGroupID, PathParamGroupIDDesc).DataType(PathParamGroupIDType)).
+		Param(ws.QueryParameter(QueryParamRecursive, QueryParamRecursiveDesc).DataType(QueryParamRecursiveType).
+			DefaultValue("true")).
+		Writes(GroupStatus{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), GroupStatus{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+
+	return ws
+}
@@ -0,0 +1,38 @@
+package health
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"net/http"
+)
+
+const (
+	ProbeStatusOK       = "ok"
+	ProbeStatusNotReady = "not ready"
+)
+
+type Probe struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (r Resource) live(request *restful.Request, response *restful.Response) {
+	_ = response.WriteEntity(Probe{Status: ProbeStatusOK})
+}
+
+func (r Resource) ready(request *restful.Request, response *restful.Response) {
+	if ok, detail := r.Checker.Ready(); !ok {
+		_ = response.WriteHeaderAndEntity(http.StatusServiceUnavailable, Probe{Status: ProbeStatusNotReady, Detail: detail})
+		return
+	}
+	_ = response.WriteEntity(Probe{Status: ProbeStatusOK})
+}
+
+func (r Resource) report(request *restful.Request, response *restful.Response) {
+	report := r.Checker.Check()
+	if report.Status == health.StatusUnhealthy {
+		_ = response.WriteHeaderAndEntity(http.StatusServiceUnavailable, report)
+		return
+	}
+	_ = response.WriteEntity(report)
+}
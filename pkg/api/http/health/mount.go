@@ -0,0 +1,57 @@
+package health
+
+import (
+	restfulspec "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"net/http"
+)
+
+type Resource struct {
+	Checker *health.Checker
+}
+
+// ProbeWebService serves the liveness and readiness probes for the orchestrator.
+func (r Resource) ProbeWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"HEALTH"}
+
+	ws.Route(ws.GET("/healthz").To(r.live).
+		// docs
+		Doc("check whether the manager is alive").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Probe{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), Probe{}))
+	ws.Route(ws.GET("/readyz").To(r.ready).
+		// docs
+		Doc("check whether the manager is ready to serve requests").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(Probe{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), Probe{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), Probe{}))
+
+	return ws
+}
+
+func (r Resource) WebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"HEALTH"}
+
+	ws.Route(ws.GET("").To(r.report).
+		// docs
+		Doc("get the detailed health report of the manager and its dependencies").
+		Notes("The status is one of 'healthy', 'degraded' and 'unhealthy', "+
+			"and the response code will be 503 if the manager is unhealthy.").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(health.Report{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), health.Report{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), health.Report{}))
+
+	return ws
+}
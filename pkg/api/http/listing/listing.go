@@ -0,0 +1,147 @@
+package listing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"strconv"
+	"strings"
+)
+
+const (
+	QueryParamLimit     = "limit"
+	QueryParamLimitDesc = "the maximum number of items in a page, all items will be returned if it is not specified"
+	QueryParamLimitType = "integer"
+
+	QueryParamContinue     = "continue"
+	QueryParamContinueDesc = "the token returned in the header '" + HeaderContinue + "' of the last page"
+	QueryParamContinueType = "string"
+
+	QueryParamSort     = "sort"
+	QueryParamSortDesc = "the field to sort by, prefix it with '-' to sort descending, e.g. '-created'"
+	QueryParamSortType = "string"
+
+	QueryParamFields     = "fields"
+	QueryParamFieldsDesc = "the comma separated fields to return, e.g. 'id,name', all fields will be returned if it is not specified"
+	QueryParamFieldsType = "string"
+
+	QueryParamQuery     = "q"
+	QueryParamQueryDesc = "the comma separated conditions to filter by, '|' separates alternative values, " +
+		"e.g. 'status=connected|reconnecting,name~=pump*', the operators are '=', '!=' and '~=' (wildcards)"
+	QueryParamQueryType = "string"
+
+	QueryParamSelector     = "selector"
+	QueryParamSelectorDesc = "the label selector to filter by, e.g. 'site=shanghai,line in (l1,l2),env!=test,!deprecated'"
+	QueryParamSelectorType = "string"
+
+	QueryParamTags     = "tags"
+	QueryParamTagsDesc = "the comma separated tags, only items tagged by all of them will be returned"
+	QueryParamTagsType = "string"
+
+	// HeaderContinue carries the continue token of the next page, it will be absent if there are no more items.
+	HeaderContinue = "X-Continue"
+
+	sortDescendingPrefix = "-"
+	fieldsSeparator      = ","
+)
+
+// Params documents the query parameters of a list route, sortable are the available fields to sort by.
+func Params(ws *restful.WebService, sortable ...string) []*restful.Parameter {
+	return []*restful.Parameter{
+		ws.QueryParameter(QueryParamLimit, QueryParamLimitDesc).DataType(QueryParamLimitType),
+		ws.QueryParameter(QueryParamContinue, QueryParamContinueDesc).DataType(QueryParamContinueType),
+		ws.QueryParameter(QueryParamSort, QueryParamSortDesc).DataType(QueryParamSortType).
+			PossibleValues(sortable).DefaultValue(metastore.SortByID),
+		ws.QueryParameter(QueryParamFields, QueryParamFieldsDesc).DataType(QueryParamFieldsType),
+	}
+}
+
+// QueryParam documents the query parameter of a search route, fields are the available fields to filter by.
+func QueryParam(ws *restful.WebService, fields ...string) *restful.Parameter {
+	return ws.QueryParameter(QueryParamQuery, QueryParamQueryDesc+fmt.Sprintf(", only supporting %v", fields)).
+		DataType(QueryParamQueryType)
+}
+
+// LabelParams documents the query parameters to filter items by their labels and tags.
+func LabelParams(ws *restful.WebService) []*restful.Parameter {
+	return []*restful.Parameter{
+		ws.QueryParameter(QueryParamSelector, QueryParamSelectorDesc).DataType(QueryParamSelectorType),
+		ws.QueryParameter(QueryParamTags, QueryParamTagsDesc).DataType(QueryParamTagsType),
+	}
+}
+
+// ParseQuery parses the query parameters 'q', 'selector' and 'tags' of the request into the query of the meta store.
+func ParseQuery(request *restful.Request) (*metastore.Query, error) {
+	query, err := metastore.ParseQuery(request.QueryParameter(QueryParamQuery))
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metastore.ParseSelector(request.QueryParameter(QueryParamSelector))
+	if err != nil {
+		return nil, err
+	}
+	return query.WithLabels(selector, metastore.ParseTags(request.QueryParameter(QueryParamTags))...), nil
+}
+
+// ParseListOptions parses the query parameters of the request into the options of the meta store,
+// the errors returned wrap metastore.ErrInvalidListOptions.
+func ParseListOptions(request *restful.Request) (*metastore.ListOptions, error) {
+	opts := &metastore.ListOptions{
+		Continue: request.QueryParameter(QueryParamContinue),
+	}
+	if limit := request.QueryParameter(QueryParamLimit); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 0 {
+			return nil, fmt.Errorf("%w: the query parameter[%s] must be a non-negative integer",
+				metastore.ErrInvalidListOptions, QueryParamLimit)
+		}
+		opts.Limit = l
+	}
+	if sortBy := request.QueryParameter(QueryParamSort); sortBy != "" {
+		opts.Descending = strings.HasPrefix(sortBy, sortDescendingPrefix)
+		opts.SortBy = strings.TrimPrefix(sortBy, sortDescendingPrefix)
+	}
+	return opts, nil
+}
+
+// WriteList writes the items projected by the query parameter 'fields' and the continue token of the next page.
+func WriteList(request *restful.Request, response *restful.Response, items interface{}, next string) error {
+	if next != "" {
+		response.AddHeader(HeaderContinue, next)
+	}
+	fields := request.QueryParameter(QueryParamFields)
+	if fields == "" {
+		return response.WriteEntity(items)
+	}
+
+	projected, err := Project(items, strings.Split(fields, fieldsSeparator))
+	if err != nil {
+		return err
+	}
+	return response.WriteEntity(projected)
+}
+
+// Project keeps the specified fields of each item only, the fields are named by their JSON keys.
+func Project(items interface{}, fields []string) ([]map[string]json.RawMessage, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]map[string]json.RawMessage, 0)
+	if err = json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make([]map[string]json.RawMessage, len(all))
+	for i, item := range all {
+		projected[i] = make(map[string]json.RawMessage)
+		for _, field := range fields {
+			field = strings.TrimSpace(field)
+			if value, ok := item[field]; ok {
+				projected[i][field] = value
+			}
+		}
+	}
+	return projected, nil
+}
@@ -0,0 +1,50 @@
+package listing
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func newRequest(target string) *restful.Request {
+	return restful.NewRequest(httptest.NewRequest("GET", target, nil))
+}
+
+func TestParseListOptions(t *testing.T) {
+	opts, err := ParseListOptions(newRequest("/devices?limit=10&continue=abc&sort=-created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &metastore.ListOptions{Limit: 10, Continue: "abc", SortBy: metastore.SortByCreated, Descending: true}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("opts = %+v, want %+v", opts, want)
+	}
+
+	for _, limit := range []string{"abc", "-1", "1.5"} {
+		if _, err = ParseListOptions(newRequest("/devices?limit=" + limit)); !errors.Is(err, metastore.ErrInvalidListOptions) {
+			t.Errorf("limit %s: got %v, want %v", limit, err, metastore.ErrInvalidListOptions)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	items := []map[string]interface{}{
+		{"id": "d1", "name": "pump", "desc": "the first pump"},
+		{"id": "d2", "desc": "the second pump"},
+	}
+	projected, err := Project(items, []string{"id", " name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(projected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `[{"id":"d1","name":"pump"},{"id":"d2"}]`; got != want {
+		t.Errorf("projected = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,10 @@
+package metrics
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func (r Resource) scrape(request *restful.Request, response *restful.Response) {
+	promhttp.HandlerFor(r.Gatherer, promhttp.HandlerOpts{}).ServeHTTP(response.ResponseWriter, request.Request)
+}
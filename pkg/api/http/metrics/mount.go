@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	restfulspec "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+)
+
+type Resource struct {
+	Gatherer prometheus.Gatherer
+}
+
+func (r Resource) WebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Produces("text/plain", "application/openmetrics-text")
+
+	tags := []string{"METRICS"}
+
+	ws.Route(ws.GET("").To(r.scrape).
+		// docs
+		Doc("get metrics in the Prometheus exposition format").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil))
+
+	return ws
+}
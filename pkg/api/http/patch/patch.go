@@ -0,0 +1,74 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	jsonpatch "github.com/evanphx/json-patch"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// MIME_MERGE_PATCH is the media type of RFC 7386, the body is a partial object to be merged,
+	// and the fields with null values will be removed.
+	MIME_MERGE_PATCH = "application/merge-patch+json"
+	// MIME_JSON_PATCH is the media type of RFC 6902, the body is an array of operations,
+	// e.g. [{"op": "replace", "path": "/name", "value": "pump"}].
+	MIME_JSON_PATCH = "application/json-patch+json"
+)
+
+var (
+	// MIMETypes are media types supported by PATCH, application/json is regarded as the merge patch.
+	MIMETypes = []string{MIME_MERGE_PATCH, MIME_JSON_PATCH, restful.MIME_JSON}
+
+	ErrInvalidPatch = errors.New("invalid patch")
+	ErrTestFailed   = errors.New("the test operation of the patch is failed")
+	ErrImmutable    = errors.New("immutable field")
+)
+
+// Apply applies the patch in the request body to the original, and unmarshals the result into the patched.
+func Apply(request *restful.Request, original, patched interface{}) error {
+	body, err := ioutil.ReadAll(request.Request.Body)
+	if err != nil {
+		return fmt.Errorf("%w: fail to read the request body, got %s", ErrInvalidPatch, err.Error())
+	}
+	doc, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+
+	contentType := strings.TrimSpace(strings.Split(request.HeaderParameter(restful.HEADER_ContentType), ";")[0])
+	switch contentType {
+	case MIME_JSON_PATCH:
+		p, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidPatch, err.Error())
+		}
+		if doc, err = p.Apply(doc); err != nil {
+			if errors.Is(err, jsonpatch.ErrTestFailed) {
+				return fmt.Errorf("%w: %s", ErrTestFailed, err.Error())
+			}
+			return fmt.Errorf("%w: %s", ErrInvalidPatch, err.Error())
+		}
+	default:
+		if doc, err = jsonpatch.MergePatch(doc, body); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidPatch, err.Error())
+		}
+	}
+
+	if err = json.Unmarshal(doc, patched); err != nil {
+		return fmt.Errorf("%w: the patched object is malformed, got %s", ErrInvalidPatch, err.Error())
+	}
+	return nil
+}
+
+// Immutable verifies the field is not changed, the field is named by its JSON key.
+func Immutable(field, original, updated string) error {
+	if original != updated {
+		return fmt.Errorf("%w: the field '%s' could not be changed from '%s' to '%s'",
+			ErrImmutable, field, original, updated)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package patch
+
+import (
+	"errors"
+	"github.com/emicklei/go-restful/v3"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type meta struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Desc   string            `json:"desc,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func apply(contentType, body string) (*meta, error) {
+	r := httptest.NewRequest("PATCH", "/metas/m1", strings.NewReader(body))
+	r.Header.Set(restful.HEADER_ContentType, contentType)
+	original := &meta{ID: "m1", Name: "pump", Desc: "the first pump", Labels: map[string]string{"site": "a"}}
+	patched := new(meta)
+	return patched, Apply(restful.NewRequest(r), original, patched)
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	for _, contentType := range []string{MIME_MERGE_PATCH, restful.MIME_JSON, ""} {
+		patched, err := apply(contentType, `{"name": "valve", "desc": null, "labels": {"line": "1"}}`)
+		if err != nil {
+			t.Fatalf("%q: %v", contentType, err)
+		}
+		if patched.ID != "m1" || patched.Name != "valve" || patched.Desc != "" {
+			t.Errorf("%q: patched = %+v, want the name replaced and the desc removed", contentType, patched)
+		}
+		if len(patched.Labels) != 2 || patched.Labels["site"] != "a" || patched.Labels["line"] != "1" {
+			t.Errorf("%q: labels = %v, want them merged", contentType, patched.Labels)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	patched, err := apply(MIME_JSON_PATCH+"; charset=utf-8",
+		`[{"op": "test", "path": "/name", "value": "pump"}, {"op": "replace", "path": "/name", "value": "valve"},
+		{"op": "remove", "path": "/labels/site"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Name != "valve" || len(patched.Labels) != 0 {
+		t.Errorf("patched = %+v, want the name replaced and the label removed", patched)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        error
+	}{
+		{"malformed merge patch", MIME_MERGE_PATCH, `{"name": `, ErrInvalidPatch},
+		{"malformed JSON patch", MIME_JSON_PATCH, `{"op": "replace"}`, ErrInvalidPatch},
+		{"missing path", MIME_JSON_PATCH, `[{"op": "remove", "path": "/missing"}]`, ErrInvalidPatch},
+		{"failed test", MIME_JSON_PATCH, `[{"op": "test", "path": "/name", "value": "valve"}]`, ErrTestFailed},
+		{"malformed result", MIME_MERGE_PATCH, `{"name": 1}`, ErrInvalidPatch},
+	} {
+		if _, err := apply(c.contentType, c.body); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	if err := Immutable("id", "m1", "m1"); err != nil {
+		t.Errorf("an unchanged field got %v", err)
+	}
+	if err := Immutable("id", "m1", "m2"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("a changed field got %v, want %v", err, ErrImmutable)
+	}
+}
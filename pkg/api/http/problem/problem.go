@@ -0,0 +1,267 @@
+package problem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	edgeerrors "github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/operations"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// HeaderRequestID carries the identifier of the request, it is generated if the client doesn't specify it,
+	// and it is always echoed in the response, so the problem could be correlated with the logs.
+	HeaderRequestID = "X-Request-ID"
+
+	CodeBadRequest         = "BadRequest"
+	CodeNotFound           = "NotFound"
+	CodeForbidden          = "Forbidden"
+	CodeConflict           = "Conflict"
+	CodeUnprocessable      = "Unprocessable"
+	CodeInternal           = "Internal"
+	CodeDriverError        = "DriverError"
+	CodeDriverUnavailable  = "DriverUnavailable"
+	CodeDriverTimeout      = "DriverTimeout"
+	CodeDeviceDisconnected = "DeviceDisconnected"
+	CodeDeviceException    = "DeviceException"
+	CodeUnverified         = "Unverified"
+	CodeAborted            = "Aborted"
+
+	// edgeErrorSeparator separates the levels of messages of an error of edge-device-std.
+	edgeErrorSeparator = "\n\t -> "
+)
+
+// Problem is the body of all error responses.
+type Problem struct {
+	// Code is a stable and machine-readable identifier of the kind of the problem, e.g. NotFound.
+	Code string `json:"code"`
+	// Message is a human-readable summary of the problem.
+	Message string `json:"message"`
+	// Details are the messages of the errors causing the problem, from the outermost to the innermost.
+	Details   []string `json:"details,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+}
+
+// Error is an error carrying the HTTP status and the code of the problem it leads to.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	cause   error
+}
+
+func (e *Error) Error() string {
+	if e.cause == nil {
+		return e.Message
+	}
+	if e.Message == "" {
+		return e.cause.Error()
+	}
+	return e.Message + ": " + e.cause.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+func newError(status int, code string, cause error, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...), cause: cause}
+}
+
+// BadRequest means the request is malformed, e.g. an unparsable body or a missing parameter.
+func BadRequest(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusBadRequest, CodeBadRequest, cause, format, args...)
+}
+
+// NotFound means the requested meta or protocol doesn't exist.
+func NotFound(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusNotFound, CodeNotFound, cause, format, args...)
+}
+
+// Forbidden means the operation is not allowed, e.g. a northbound command not in the allow-list.
+func Forbidden(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusForbidden, CodeForbidden, cause, format, args...)
+}
+
+// Conflict means the request conflicts with the current state, e.g. the meta to create already exists.
+func Conflict(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusConflict, CodeConflict, cause, format, args...)
+}
+
+// Unprocessable means the request is well-formed but semantically invalid, e.g. a required field is absent.
+func Unprocessable(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusUnprocessableEntity, CodeUnprocessable, cause, format, args...)
+}
+
+// Unavailable means the driver serving the protocol is not registered or could not be reached.
+func Unavailable(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusServiceUnavailable, CodeDriverUnavailable, cause, format, args...)
+}
+
+// Timeout means the driver doesn't respond in time.
+func Timeout(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusGatewayTimeout, CodeDriverTimeout, cause, format, args...)
+}
+
+// DeviceDisconnected means the device is disconnected from its driver, so it could not serve data operations.
+func DeviceDisconnected(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusConflict, CodeDeviceDisconnected, cause, format, args...)
+}
+
+// DeviceException means the device is in exception, the cause is expected to be the detail reported by the driver.
+func DeviceException(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusConflict, CodeDeviceException, cause, format, args...)
+}
+
+// Unverified means the value read back from the device differs from the written one.
+func Unverified(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusBadGateway, CodeUnverified, cause, format, args...)
+}
+
+// Aborted means the operation is not applied, or is reverted, because another one of the same batch failed.
+func Aborted(cause error, format string, args ...interface{}) *Error {
+	return newError(http.StatusFailedDependency, CodeAborted, cause, format, args...)
+}
+
+// Wrap classifies the cause by the errors it wraps, and the problem will be Internal if it is unknown.
+func Wrap(cause error, format string, args ...interface{}) *Error {
+	var e *Error
+	if errors.As(cause, &e) {
+		return newError(e.Status, e.Code, cause, format, args...)
+	}
+	status, code := classify(cause)
+	return newError(status, code, cause, format, args...)
+}
+
+func classify(err error) (int, string) {
+	switch {
+	case errors.Is(err, metastore.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound
+	case errors.Is(err, metastore.ErrConflict), errors.Is(err, patch.ErrTestFailed):
+		return http.StatusConflict, CodeConflict
+	case errors.Is(err, metastore.ErrInvalidListOptions), errors.Is(err, metastore.ErrInvalidQuery),
+		errors.Is(err, metastore.ErrInvalidSelector), errors.Is(err, patch.ErrInvalidPatch):
+		return http.StatusBadRequest, CodeBadRequest
+	case errors.Is(err, metastore.ErrInvalidLabels), errors.Is(err, metastore.ErrInvalidGroup),
+		errors.Is(err, metastore.ErrInvalidWebhook), errors.Is(err, patch.ErrImmutable):
+		return http.StatusUnprocessableEntity, CodeUnprocessable
+	case errors.Is(err, health.ErrDriverOffline):
+		return http.StatusServiceUnavailable, CodeDriverUnavailable
+	case errors.Is(err, health.ErrDeviceDisconnected):
+		return http.StatusConflict, CodeDeviceDisconnected
+	case errors.Is(err, health.ErrDeviceException):
+		return http.StatusConflict, CodeDeviceException
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, CodeDriverTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout, CodeDriverTimeout
+	}
+
+	// errors returned by the ManagerClient, the ones of the message bus mean that the driver
+	// is not reachable, and the others are replied by the driver.
+	var ee edgeerrors.EdgeError
+	if !errors.As(err, &ee) {
+		return http.StatusInternalServerError, CodeInternal
+	}
+	switch edgeerrors.TypeOf(err).Code {
+	case edgeerrors.MessageBus.Code:
+		if strings.Contains(strings.ToLower(ee.Message()), "timeout") {
+			return http.StatusGatewayTimeout, CodeDriverTimeout
+		}
+		return http.StatusServiceUnavailable, CodeDriverUnavailable
+	case edgeerrors.Driver.Code, edgeerrors.DeviceTwin.Code:
+		return http.StatusBadGateway, CodeDriverError
+	case edgeerrors.BadRequest.Code:
+		return http.StatusBadRequest, CodeBadRequest
+	case edgeerrors.NotFound.Code:
+		return http.StatusNotFound, CodeNotFound
+	default:
+		return http.StatusInternalServerError, CodeInternal
+	}
+}
+
+// Write writes the error as a problem, the error is classified by Wrap if it is not an Error.
+func Write(response *restful.Response, err error) {
+	status, p := Of(err)
+	p.RequestID = response.Header().Get(HeaderRequestID)
+	_ = response.WriteHeaderAndJson(status, p, restful.MIME_JSON)
+}
+
+// Of returns the HTTP status and the problem of the error, it is used to report errors of items in a batch.
+func Of(err error) (int, *Problem) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = Wrap(err, "")
+	}
+	p := &Problem{Code: e.Code, Message: http.StatusText(e.Status)}
+	if messages := details(err); len(messages) > 0 {
+		p.Message, p.Details = messages[0], messages[1:]
+	}
+	return e.Status, p
+}
+
+// details flattens the messages of the error chain from the outermost to the innermost.
+func details(err error) []string {
+	messages := make([]string, 0)
+	for err != nil {
+		if nr, ok := err.(*health.NotReadyError); ok {
+			// the detail reported by the driver is the cause of the problem
+			messages = append(messages, nr.Message)
+			if nr.Detail != "" {
+				messages = append(messages, nr.Detail)
+			}
+			break
+		}
+		e, ok := err.(*Error)
+		if !ok {
+			for _, message := range strings.Split(err.Error(), edgeErrorSeparator) {
+				// the wrapper of edge-device-std repeats the message of the wrapped error
+				message = strings.TrimSpace(message)
+				if message != "" && (len(messages) == 0 || messages[len(messages)-1] != message) {
+					messages = append(messages, message)
+				}
+			}
+			break
+		}
+		if e.Message != "" {
+			messages = append(messages, e.Message)
+		}
+		err = e.cause
+	}
+	return messages
+}
+
+// RequestIDFilter makes sure that every request has an identifier and echoes it in the response.
+func RequestIDFilter(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	requestID := request.HeaderParameter(HeaderRequestID)
+	if requestID == "" {
+		requestID = operations.NewReqID()
+		request.Request.Header.Set(HeaderRequestID, requestID)
+	}
+	response.Header().Set(HeaderRequestID, requestID)
+	chain.ProcessFilter(request, response)
+}
+
+// ServiceErrorHandler writes the errors detected by the container, e.g. no route matched, as problems.
+func ServiceErrorHandler(serviceError restful.ServiceError, request *restful.Request, response *restful.Response) {
+	for header, values := range serviceError.Header {
+		for _, value := range values {
+			response.Header().Add(header, value)
+		}
+	}
+	p := &Problem{
+		Code:      strings.ReplaceAll(http.StatusText(serviceError.Code), " ", ""),
+		Message:   serviceError.Message,
+		RequestID: response.Header().Get(HeaderRequestID),
+	}
+	_ = response.WriteHeaderAndJson(serviceError.Code, p, restful.MIME_JSON)
+}
@@ -0,0 +1,74 @@
+package problem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	edgeerrors "github.com/thingio/edge-device-std/errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestWrapClassifies(t *testing.T) {
+	for _, c := range []struct {
+		cause  error
+		status int
+		code   string
+	}{
+		{metastore.ErrNotFound, http.StatusNotFound, CodeNotFound},
+		{metastore.ErrConflict, http.StatusConflict, CodeConflict},
+		{patch.ErrTestFailed, http.StatusConflict, CodeConflict},
+		{metastore.ErrInvalidListOptions, http.StatusBadRequest, CodeBadRequest},
+		{metastore.ErrInvalidQuery, http.StatusBadRequest, CodeBadRequest},
+		{metastore.ErrInvalidSelector, http.StatusBadRequest, CodeBadRequest},
+		{patch.ErrInvalidPatch, http.StatusBadRequest, CodeBadRequest},
+		{metastore.ErrInvalidLabels, http.StatusUnprocessableEntity, CodeUnprocessable},
+		{patch.ErrImmutable, http.StatusUnprocessableEntity, CodeUnprocessable},
+		{health.ErrDriverOffline, http.StatusServiceUnavailable, CodeDriverUnavailable},
+		{health.ErrDeviceDisconnected, http.StatusConflict, CodeDeviceDisconnected},
+		{health.ErrDeviceException, http.StatusConflict, CodeDeviceException},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, CodeDriverTimeout},
+		{edgeerrors.NewCommonEdgeError(edgeerrors.MessageBus, "request timeout", nil),
+			http.StatusGatewayTimeout, CodeDriverTimeout},
+		{edgeerrors.NewCommonEdgeError(edgeerrors.MessageBus, "fail to publish", nil),
+			http.StatusServiceUnavailable, CodeDriverUnavailable},
+		{edgeerrors.NewCommonEdgeError(edgeerrors.Driver, "fail to read", nil), http.StatusBadGateway, CodeDriverError},
+		{edgeerrors.NewCommonEdgeError(edgeerrors.NotFound, "no such property", nil), http.StatusNotFound, CodeNotFound},
+		{errors.New("unknown"), http.StatusInternalServerError, CodeInternal},
+		{Forbidden(nil, "not allowed"), http.StatusForbidden, CodeForbidden},
+	} {
+		err := Wrap(fmt.Errorf("wrapped: %w", c.cause), "fail to do something")
+		if err.Status != c.status || err.Code != c.code {
+			t.Errorf("%v: got %d %s, want %d %s", c.cause, err.Status, err.Code, c.status, c.code)
+		}
+	}
+}
+
+func TestOf(t *testing.T) {
+	err := Wrap(BadRequest(errors.New("invalid character"), "fail to parse the body"), "fail to create the device[%s]", "d1")
+	status, p := Of(err)
+	if status != http.StatusBadRequest || p.Code != CodeBadRequest {
+		t.Errorf("got %d %s, want %d %s", status, p.Code, http.StatusBadRequest, CodeBadRequest)
+	}
+	if p.Message != "fail to create the device[d1]" ||
+		!reflect.DeepEqual(p.Details, []string{"fail to parse the body", "invalid character"}) {
+		t.Errorf("problem = %+v, want the messages from the outermost to the innermost", p)
+	}
+
+	err = Wrap(&health.NotReadyError{Reason: health.ErrDeviceException, Message: "the device[d1] is in exception",
+		Detail: "timeout"}, "fail to read the device[%s]", "d1")
+	status, p = Of(err)
+	if status != http.StatusConflict || p.Code != CodeDeviceException ||
+		!reflect.DeepEqual(p.Details, []string{"the device[d1] is in exception", "timeout"}) {
+		t.Errorf("got %d %+v, want the detail reported by the driver", status, p)
+	}
+
+	status, p = Of(errors.New("unknown"))
+	if status != http.StatusInternalServerError || p.Message != "unknown" || len(p.Details) != 0 {
+		t.Errorf("got %d %+v, want an internal problem", status, p)
+	}
+}
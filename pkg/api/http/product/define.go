@@ -2,9 +2,11 @@ package product
 
 import (
 	"github.com/emicklei/go-restful/v3"
-	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-manager/pkg/api/http/listing"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
 	"github.com/thingio/edge-device-std/models"
-	"net/http"
 )
 
 const (
@@ -20,40 +22,30 @@ const (
 func (r Resource) createProduct(request *restful.Request, response *restful.Response) {
 	product := new(models.Product)
 	if err := request.ReadEntity(product); err != nil {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Cause(err, "fail to parse the request body"))
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
 		return
 	}
 	productID := product.ID
 	if productID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the product's ID is required"))
+		problem.Write(response, problem.BadRequest(nil, "the product's ID is required"))
 		return
 	} else if product.Name == "" {
 		product.Name = productID
 	}
 	protocolID := product.Protocol
 	if protocolID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.Internal.Error("the product[%s]'s protocol must be specified", productID))
+		problem.Write(response, problem.Unprocessable(nil, "the product[%s]'s protocol must be specified", productID))
 		return
 	} else {
 		_, ok := r.ProtocolCache.Get(protocolID)
 		if !ok {
-			_ = response.WriteError(http.StatusNotFound,
-				errors.Internal.Error("the protocol[%s] is not available yet", protocolID))
+			problem.Write(response, problem.Unavailable(nil, "the protocol[%s] is not available yet", protocolID))
 			return
 		}
 	}
-	if _, err := r.MetaStore.GetProduct(productID); err == nil { // verify the duplication of the product
-		_ = response.WriteError(http.StatusConflict,
-			errors.Internal.Error("the product[%s] is already created", productID))
-		return
-	}
 
 	if err := r.MetaStore.CreateProduct(product); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to create the product[%s]", productID))
+		problem.Write(response, problem.Wrap(err, "fail to create the product[%s]", productID))
 		return
 	}
 	_ = response.WriteEntity(product)
@@ -62,29 +54,25 @@ func (r Resource) createProduct(request *restful.Request, response *restful.Resp
 func (r Resource) deleteProduct(request *restful.Request, response *restful.Response) {
 	productID := request.PathParameter(PathParamProductID)
 	if productID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamProductID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
 		return
 	}
 
 	var protocolID string
 	if product, err := r.MetaStore.GetProduct(productID); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to find the product[%s]", productID))
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
 		return
 	} else {
 		protocolID = product.Protocol
 	}
 
 	if err := r.MetaStore.DeleteProduct(productID); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to delete the product[%s]", productID))
+		problem.Write(response, problem.Wrap(err, "fail to delete the product[%s]", productID))
 		return
 	} else {
 		devices, err := r.MetaStore.ListDevices(productID)
 		if err != nil {
-			_ = response.WriteError(http.StatusInternalServerError,
-				errors.Internal.Cause(err, "fail to get devices derived from the product[%s]", productID))
+			problem.Write(response, problem.Wrap(err, "fail to get devices derived from the product[%s]", productID))
 			return
 		}
 		for _, device := range devices {
@@ -92,8 +80,8 @@ func (r Resource) deleteProduct(request *restful.Request, response *restful.Resp
 		}
 	}
 	if err := r.OperationClient.DeleteProduct(protocolID, productID); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send message about deleting product to the driver[%s]", protocolID))
+		problem.Write(response, problem.Wrap(err,
+			"fail to send message about deleting product to the driver[%s]", protocolID))
 		return
 	}
 }
@@ -101,61 +89,145 @@ func (r Resource) deleteProduct(request *restful.Request, response *restful.Resp
 func (r Resource) updateProduct(request *restful.Request, response *restful.Response) {
 	productID := request.PathParameter(PathParamProductID)
 	if productID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamProductID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
 		return
 	}
 	product := new(models.Product)
 	if err := request.ReadEntity(product); err != nil {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("fail to parse the request body"))
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
 		return
 	}
-	protocolID := product.Protocol
-	if protocolID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the product[%s]'s protocol must be specified", productID))
+	existing, err := r.MetaStore.GetProduct(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
 		return
 	}
+	// the immutable fields could be omitted in the body
+	if product.ID == "" {
+		product.ID = productID
+	}
+	if product.Protocol == "" {
+		product.Protocol = existing.Protocol
+	}
+	r.replaceProduct(response, existing, product)
+}
 
+func (r Resource) patchProduct(request *restful.Request, response *restful.Response) {
+	productID := request.PathParameter(PathParamProductID)
+	if productID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
+		return
+	}
+	existing, err := r.MetaStore.GetProduct(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
+		return
+	}
+	product := new(models.Product)
+	if err = patch.Apply(request, existing, product); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to patch the product[%s]", productID))
+		return
+	}
+	r.replaceProduct(response, existing, product)
+}
+
+// replaceProduct replaces the existing product by the updated one, and then notifies the driver.
+func (r Resource) replaceProduct(response *restful.Response, existing, product *models.Product) {
+	for field, values := range map[string][2]string{
+		"id":       {existing.ID, product.ID},
+		"protocol": {existing.Protocol, product.Protocol},
+	} {
+		if err := patch.Immutable(field, values[0], values[1]); err != nil {
+			problem.Write(response, problem.Wrap(err, "fail to update the product[%s]", existing.ID))
+			return
+		}
+	}
+	if product.Name == "" {
+		product.Name = product.ID
+	}
+
+	protocolID := product.Protocol
 	if err := r.MetaStore.UpdateProduct(product); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to update the product[%s]", productID))
+		problem.Write(response, problem.Wrap(err, "fail to update the product[%s]", product.ID))
 		return
 	} else if err = r.OperationClient.UpdateProduct(protocolID, product); err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to send message about updating product to the driver[%s]", protocolID))
+		problem.Write(response, problem.Wrap(err,
+			"fail to send message about updating product to the driver[%s]", protocolID))
 		return
 	}
+	_ = response.WriteEntity(product)
 }
 
 func (r Resource) findAllProducts(request *restful.Request, response *restful.Response) {
-	protocolID := request.QueryParameter(QueryParamProtocolID)
-	if protocolID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the query parameter[%s] is required", QueryParamProtocolID))
+	query, err := listing.ParseQuery(request)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to parse the query"))
 		return
 	}
-	products, err := r.MetaStore.ListProducts(protocolID)
+	if protocolID := request.QueryParameter(QueryParamProtocolID); protocolID != "" {
+		query.And(metastore.FieldProtocol, metastore.OperatorEqual, protocolID)
+	}
+	opts, err := listing.ParseListOptions(request)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError,
-			errors.Internal.Cause(err, "fail to get products classified as the protocol[%s]", protocolID))
+		problem.Write(response, problem.Wrap(err, "fail to parse the list options"))
 		return
 	}
-	_ = response.WriteEntity(products)
+	products, next, err := r.MetaStore.SearchProducts(query, opts)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to search products"))
+		return
+	}
+	_ = listing.WriteList(request, response, products, next)
 }
 
 func (r Resource) findProduct(request *restful.Request, response *restful.Response) {
 	productID := request.PathParameter(PathParamProductID)
 	if productID == "" {
-		_ = response.WriteError(http.StatusBadRequest,
-			errors.BadRequest.Error("the path parameter[%s] is required", PathParamProductID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
 		return
 	}
 	product, err := r.MetaStore.GetProduct(productID)
 	if err != nil {
-		_ = response.WriteError(http.StatusInternalServerError, err)
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
 		return
 	}
 	_ = response.WriteEntity(product)
 }
+func (r Resource) findProductLabels(request *restful.Request, response *restful.Response) {
+	productID := request.PathParameter(PathParamProductID)
+	if productID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
+		return
+	}
+	labels, err := r.MetaStore.GetProductLabels(productID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to get labels of the product[%s]", productID))
+		return
+	}
+	_ = response.WriteEntity(labels)
+}
+func (r Resource) updateProductLabels(request *restful.Request, response *restful.Response) {
+	productID := request.PathParameter(PathParamProductID)
+	if productID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProductID))
+		return
+	}
+	labels := new(metastore.Labels)
+	if err := request.ReadEntity(labels); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if err := labels.Validate(); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to validate labels of the product[%s]", productID))
+		return
+	}
+	if _, err := r.MetaStore.GetProduct(productID); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the product[%s]", productID))
+		return
+	}
+	if err := r.MetaStore.UpdateProductLabels(productID, labels); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to update labels of the product[%s]", productID))
+		return
+	}
+	_ = response.WriteEntity(labels)
+}
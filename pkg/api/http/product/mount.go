@@ -5,6 +5,9 @@ import (
 	restfulspec "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/api/http/listing"
+	"github.com/thingio/edge-device-manager/pkg/api/http/patch"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
 	"github.com/thingio/edge-device-manager/pkg/metastore"
 	"github.com/thingio/edge-device-std/models"
 	"github.com/thingio/edge-device-std/operations"
@@ -31,9 +34,12 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Metadata(restfulspec.KeyOpenAPITags, tags).
 		Reads(models.Product{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Product{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 
 	ws.Route(ws.DELETE(fmt.Sprintf("/{%s}", PathParamProductID)).To(r.deleteProduct).
 		// docs
@@ -41,29 +47,65 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Metadata(restfulspec.KeyOpenAPITags, tags).
 		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 
 	ws.Route(ws.PUT(fmt.Sprintf("/{%s}", PathParamProductID)).To(r.updateProduct).
 		// docs
 		Doc("update a product by its ID").
+		Notes("The product is replaced by the body, and the immutable fields 'id' and 'protocol' could be omitted, "+
+			"but they must be the same as the stored ones if specified.").
 		Metadata(restfulspec.KeyOpenAPITags, tags).
 		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
 		Reads(models.Product{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Product{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.PATCH(fmt.Sprintf("/{%s}", PathParamProductID)).To(r.patchProduct).
+		// docs
+		Doc("partially update a product by its ID").
+		Notes("The body is a JSON merge patch(RFC 7386) if the Content-Type is '"+patch.MIME_MERGE_PATCH+"' or '"+
+			restful.MIME_JSON+"', or a JSON patch(RFC 6902) if it is '"+patch.MIME_JSON_PATCH+"'. "+
+			"The patch is merged with the stored product, and the immutable fields 'id' and 'protocol' could not be changed.").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Consumes(patch.MIMETypes...).
+		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
+		Reads(models.Product{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Product{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), problem.Problem{}).
+		Returns(http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 
-	ws.Route(ws.GET("/").To(r.findAllProducts).
+	findAllProducts := ws.GET("/").To(r.findAllProducts).
 		// docs
-		Doc("get all available products").
+		Doc("get all available products, or search products across all protocols").
+		Notes("The products can be filtered by 'q', and be paged by 'limit' and 'continue', "+
+			"the token of the next page is returned in the header '"+listing.HeaderContinue+"'.").
 		Metadata(restfulspec.KeyOpenAPITags, tags).
-		Param(ws.QueryParameter(QueryParamProtocolID, QueryParamProtocolIDDesc).DataType(QueryParamProtocolIDType).Required(true)).
+		Param(ws.QueryParameter(QueryParamProtocolID, QueryParamProtocolIDDesc).DataType(QueryParamProtocolIDType)).
+		Param(listing.QueryParam(ws, metastore.ProductFields...))
+	for _, param := range listing.LabelParams(ws) {
+		findAllProducts.Param(param)
+	}
+	for _, param := range listing.Params(ws, metastore.SortByID, metastore.SortByName, metastore.SortByCreated) {
+		findAllProducts.Param(param)
+	}
+	ws.Route(findAllProducts.
 		Writes([]models.Product{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), []models.Product{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 
 	ws.Route(ws.GET(fmt.Sprintf("/{%s}", PathParamProductID)).To(r.findProduct).
 		// docs
@@ -72,8 +114,31 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
 		Writes(models.Product{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Product{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/labels", PathParamProductID)).To(r.findProductLabels).
+		// docs
+		Doc("get labels and tags of a product").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
+		Writes(metastore.Labels{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Labels{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.PUT(fmt.Sprintf("/{%s}/labels", PathParamProductID)).To(r.updateProductLabels).
+		// docs
+		Doc("replace labels and tags of a product").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamProductID, PathParamProductIDDesc).DataType(PathParamProductIDType)).
+		Reads(metastore.Labels{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Labels{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
 
 	return ws
 }
@@ -1,10 +1,9 @@
 package protocol
 
 import (
-	"fmt"
 	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
 	"github.com/thingio/edge-device-std/models"
-	"net/http"
 )
 
 const (
@@ -24,13 +23,13 @@ func (r Resource) findAllProtocols(request *restful.Request, response *restful.R
 func (r Resource) findProtocol(request *restful.Request, response *restful.Response) {
 	protocolID := request.PathParameter(PathParamProtocolID)
 	if protocolID == "" {
-		_ = response.WriteError(http.StatusBadRequest, fmt.Errorf("the path parameter[%s] is required", PathParamProtocolID))
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamProtocolID))
 		return
 	}
 
 	v, ok := r.ProtocolCache.Get(protocolID)
 	if !ok {
-		_ = response.WriteError(http.StatusNotFound, fmt.Errorf("the protocol[%s] is not found", protocolID))
+		problem.Write(response, problem.NotFound(nil, "the protocol[%s] is not found", protocolID))
 		return
 	}
 	_ = response.WriteEntity(v)
@@ -5,6 +5,7 @@ import (
 	restfulspec "github.com/emicklei/go-restful-openapi/v2"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
 	"github.com/thingio/edge-device-std/models"
 	"net/http"
 )
@@ -36,8 +37,8 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Param(ws.PathParameter(PathParamProtocolID, PathParamProtocolIDDesc).DataType(PathParamProtocolIDType)).
 		Writes(models.Protocol{}).
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), models.Protocol{}).
-		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), nil).
-		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), nil))
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}))
 
 	return ws
 }
@@ -0,0 +1,291 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// OverflowDropOldest drops the oldest message buffered if the client doesn't read messages in time.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDisconnect closes the session if the client doesn't read messages in time.
+	OverflowDisconnect = "disconnect"
+
+	QueryParamOverflow     = "overflow"
+	QueryParamOverflowDesc = "what to do if the client doesn't read messages in time, " +
+		OverflowDropOldest + " or " + OverflowDisconnect
+	QueryParamOverflowType = "string"
+
+	QueryParamBufferSize     = "buffer-size"
+	QueryParamBufferSizeDesc = "the number of messages buffered for the client"
+	QueryParamBufferSizeType = "integer"
+
+	defaultPingInterval = 30 * time.Second
+	defaultIdleTimeout  = 90 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	defaultBufferSize   = 256
+	maxBufferSize       = 4096
+	// maxMessageSize limits the size of the messages sent by the client.
+	maxMessageSize = 64 * 1024
+)
+
+// Options controls the liveness and the backpressure of a session.
+type Options struct {
+	// PingInterval is the interval of pings sent to the client.
+	PingInterval time.Duration
+	// IdleTimeout closes the session if nothing, including pongs, is received from the client in it.
+	IdleTimeout time.Duration
+	// WriteTimeout closes the session if a message could not be written in it.
+	WriteTimeout time.Duration
+	// BufferSize is the number of messages buffered for the client.
+	BufferSize int
+	// Overflow is OverflowDropOldest or OverflowDisconnect.
+	Overflow string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		PingInterval: defaultPingInterval,
+		IdleTimeout:  defaultIdleTimeout,
+		WriteTimeout: defaultWriteTimeout,
+		BufferSize:   defaultBufferSize,
+		Overflow:     OverflowDropOldest,
+	}
+}
+
+// ParseOptions returns the default options overridden by the query parameters.
+func ParseOptions(request *restful.Request) (Options, error) {
+	opts := DefaultOptions()
+	if overflow := request.QueryParameter(QueryParamOverflow); overflow != "" {
+		if overflow != OverflowDropOldest && overflow != OverflowDisconnect {
+			return opts, fmt.Errorf("unsupported %s %s, only supporting %s and %s",
+				QueryParamOverflow, overflow, OverflowDropOldest, OverflowDisconnect)
+		}
+		opts.Overflow = overflow
+	}
+	if size := request.QueryParameter(QueryParamBufferSize); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 || n > maxBufferSize {
+			return opts, fmt.Errorf("the %s should be an integer in [1, %d]", QueryParamBufferSize, maxBufferSize)
+		}
+		opts.BufferSize = n
+	}
+	return opts, nil
+}
+
+// Params returns the query parameters parsed by ParseOptions, for the docs of routes.
+func Params(ws *restful.WebService) []*restful.Parameter {
+	return []*restful.Parameter{
+		ws.QueryParameter(QueryParamOverflow, QueryParamOverflowDesc).
+			DataType(QueryParamOverflowType).DefaultValue(OverflowDropOldest),
+		ws.QueryParameter(QueryParamBufferSize, QueryParamBufferSizeDesc).
+			DataType(QueryParamBufferSizeType).DefaultValue(strconv.Itoa(defaultBufferSize)),
+	}
+}
+
+// Session is a WebSocket connection which keeps the client alive by pings, and never blocks the sender
+// even though the client reads slowly. It is closed with a proper close code when:
+//   - the client closes it, and its close code is echoed;
+//   - the client sends nothing, including pongs, in the idle timeout (1001);
+//   - the server is shutting down (1001);
+//   - the client reads messages too slowly with OverflowDisconnect (1008);
+//   - the server closes it by Close.
+type Session struct {
+	conn net.Conn
+	opts Options
+
+	wmu      sync.Mutex // serializes the frames written by the reader and the writer
+	out      chan []byte
+	messages chan []byte
+
+	ctx     context.Context // the context of the server
+	done    chan struct{}
+	closing chan closure
+}
+
+type closure struct {
+	code   ws.StatusCode // no close frame will be sent if it is 0, e.g. the close frame of the client is echoed
+	reason string
+}
+
+// Upgrade upgrades the HTTP connection to a WebSocket session, which is closed once ctx is done.
+func Upgrade(ctx context.Context, request *restful.Request, response *restful.Response, opts Options) (*Session, error) {
+	conn, _, _, err := ws.UpgradeHTTP(request.Request, response.ResponseWriter)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		conn:     conn,
+		opts:     opts,
+		out:      make(chan []byte, opts.BufferSize),
+		messages: make(chan []byte),
+		ctx:      ctx,
+		done:     make(chan struct{}),
+		closing:  make(chan closure, 1),
+	}
+	metrics.WebSocketSessions.Inc()
+	go s.read()
+	go s.write()
+	return s, nil
+}
+
+// Messages returns the text messages sent by the client, it is closed once the session is closed.
+func (s *Session) Messages() <-chan []byte {
+	return s.messages
+}
+
+// Done is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send marshals the value as JSON and buffers it to be written, it returns false if the session is closed.
+func (s *Session) Send(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return true // the message is skipped
+	}
+	return s.SendText(data)
+}
+
+// SendText buffers the message to be written, and applies the overflow policy if the buffer is full.
+func (s *Session) SendText(data []byte) bool {
+	for {
+		select {
+		case <-s.done:
+			return false
+		case s.out <- data:
+			return true
+		default:
+		}
+		metrics.StreamDroppedMessages.Inc()
+		if s.opts.Overflow == OverflowDisconnect {
+			s.Close(ws.StatusPolicyViolation, "the client reads messages too slowly")
+			return false
+		}
+		select {
+		case <-s.out:
+		default:
+		}
+	}
+}
+
+// Close closes the session with the code and the reason, it is safe to be called several times.
+func (s *Session) Close(code ws.StatusCode, reason string) {
+	select {
+	case s.closing <- closure{code: code, reason: reason}:
+	default: // the session is already closing
+	}
+}
+
+// read reads the messages of the client until the connection is closed or it is idle for too long.
+func (s *Session) read() {
+	defer close(s.messages)
+	defer s.Close(ws.StatusGoingAway, "")
+
+	handler := wsutil.ControlFrameHandler(lockedWriter{s}, ws.StateServerSide)
+	rd := &wsutil.Reader{
+		Source:         s.conn,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		MaxFrameSize:   maxMessageSize,
+		OnIntermediate: handler,
+	}
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(s.opts.IdleTimeout))
+		header, err := rd.NextFrame()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				s.Close(ws.StatusGoingAway, "idle timeout")
+			}
+			return
+		}
+		if header.OpCode.IsControl() {
+			if err = handler(header, rd); err != nil {
+				if _, ok := err.(wsutil.ClosedError); ok { // the close frame is echoed by the handler
+					s.Close(0, "")
+				}
+				return
+			}
+			continue
+		}
+		if header.OpCode != ws.OpText {
+			if err = rd.Discard(); err != nil {
+				return
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return
+		}
+		select {
+		case s.messages <- data:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// write writes the buffered messages and pings until the session is closed.
+func (s *Session) write() {
+	ticker := time.NewTicker(s.opts.PingInterval)
+	defer func() {
+		ticker.Stop()
+		close(s.done)
+		_ = s.conn.Close()
+		metrics.WebSocketSessions.Dec()
+	}()
+
+	for {
+		select {
+		case data := <-s.out:
+			if err := s.writeFrame(ws.OpText, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := s.writeFrame(ws.OpPing, nil); err != nil {
+				return
+			}
+		case c := <-s.closing:
+			if c.code != 0 {
+				_ = s.writeFrame(ws.OpClose, ws.NewCloseFrameBody(c.code, c.reason))
+			}
+			return
+		case <-s.ctx.Done():
+			_ = s.writeFrame(ws.OpClose, ws.NewCloseFrameBody(ws.StatusGoingAway, "the server is shutting down"))
+			return
+		}
+	}
+}
+
+func (s *Session) writeFrame(op ws.OpCode, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	return wsutil.WriteServerMessage(s.conn, op, data)
+}
+
+// lockedWriter writes the responses of control frames, e.g. pongs, exclusively with the messages.
+type lockedWriter struct {
+	s *Session
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.s.wmu.Lock()
+	defer w.s.wmu.Unlock()
+
+	_ = w.s.conn.SetWriteDeadline(time.Now().Add(w.s.opts.WriteTimeout))
+	return w.s.conn.Write(p)
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/gobwas/ws"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dial serves a session with the options, which is handled by handle until it is closed,
+// and returns the connection of the client.
+func dial(t *testing.T, ctx context.Context, opts Options, handle func(s *Session)) net.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := Upgrade(ctx, restful.NewRequest(r), restful.NewResponse(w), opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handle(s)
+		<-s.Done()
+	}))
+	t.Cleanup(server.Close)
+
+	conn, br, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if br != nil {
+		// the frames sent right after the handshake may have been buffered by the dialer
+		return bufferedConn{Conn: conn, br: br}
+	}
+	return conn
+}
+
+type bufferedConn struct {
+	net.Conn
+
+	br *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+func readFrame(t *testing.T, conn net.Conn) ws.Frame {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := ws.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("fail to read a frame, got %v", err)
+	}
+	return frame
+}
+
+func expectClose(t *testing.T, conn net.Conn, code ws.StatusCode) {
+	t.Helper()
+	frame := readFrame(t, conn)
+	if frame.Header.OpCode != ws.OpClose {
+		t.Fatalf("received the frame %v, want a close frame", frame.Header.OpCode)
+	}
+	if got, reason := ws.ParseCloseFrameData(frame.Payload); got != code {
+		t.Errorf("the close code = %d (%s), want %d", got, reason, code)
+	}
+}
+
+func TestSessionSendsMessagesAndPings(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PingInterval = 20 * time.Millisecond
+	received := make(chan []byte, 1)
+	conn := dial(t, context.Background(), opts, func(s *Session) {
+		s.Send(map[string]int{"speed": 1})
+		received <- <-s.Messages()
+	})
+
+	if frame := readFrame(t, conn); frame.Header.OpCode != ws.OpText || string(frame.Payload) != `{"speed":1}` {
+		t.Errorf("received %v %s, want the message as JSON", frame.Header.OpCode, frame.Payload)
+	}
+	if frame := readFrame(t, conn); frame.Header.OpCode != ws.OpPing {
+		t.Errorf("received %v, want a ping", frame.Header.OpCode)
+	}
+
+	if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewTextFrame([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if string(data) != "hello" {
+			t.Errorf("the server receives %s, want hello", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("the message of the client is not received")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	t.Run("idle timeout", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.IdleTimeout = 50 * time.Millisecond
+		conn := dial(t, context.Background(), opts, func(s *Session) {})
+		expectClose(t, conn, ws.StatusGoingAway)
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		conn := dial(t, ctx, DefaultOptions(), func(s *Session) {
+			cancel()
+		})
+		expectClose(t, conn, ws.StatusGoingAway)
+	})
+
+	t.Run("closed by the client", func(t *testing.T) {
+		closed := make(chan struct{})
+		conn := dial(t, context.Background(), DefaultOptions(), func(s *Session) {
+			go func() {
+				for range s.Messages() {
+				}
+				close(closed)
+			}()
+		})
+		body := ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye")
+		if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(body))); err != nil {
+			t.Fatal(err)
+		}
+		expectClose(t, conn, ws.StatusNormalClosure)
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Error("the messages are not closed with the session")
+		}
+	})
+}
+
+func TestSessionOverflow(t *testing.T) {
+	newSession := func(overflow string) *Session {
+		opts := DefaultOptions()
+		opts.BufferSize, opts.Overflow = 2, overflow
+		return &Session{opts: opts, out: make(chan []byte, opts.BufferSize),
+			done: make(chan struct{}), closing: make(chan closure, 1)}
+	}
+
+	s := newSession(OverflowDropOldest)
+	for _, message := range []string{"1", "2", "3"} {
+		if !s.SendText([]byte(message)) {
+			t.Fatalf("fail to send %s", message)
+		}
+	}
+	if first, second := <-s.out, <-s.out; string(first) != "2" || string(second) != "3" {
+		t.Errorf("buffered %s and %s, want the oldest dropped", first, second)
+	}
+
+	s = newSession(OverflowDisconnect)
+	sent := []bool{s.SendText([]byte("1")), s.SendText([]byte("2")), s.SendText([]byte("3"))}
+	if !sent[0] || !sent[1] || sent[2] {
+		t.Errorf("sent = %v, want the overflowing message refused", sent)
+	}
+	select {
+	case c := <-s.closing:
+		if c.code != ws.StatusPolicyViolation {
+			t.Errorf("the close code = %d, want %d", c.code, ws.StatusPolicyViolation)
+		}
+	default:
+		t.Error("the session is not closed")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  Options
+		valid bool
+	}{
+		{"", DefaultOptions(), true},
+		{"overflow=disconnect&buffer-size=10", Options{PingInterval: defaultPingInterval, IdleTimeout: defaultIdleTimeout,
+			WriteTimeout: defaultWriteTimeout, BufferSize: 10, Overflow: OverflowDisconnect}, true},
+		{"overflow=block", Options{}, false},
+		{"buffer-size=0", Options{}, false},
+		{"buffer-size=100000", Options{}, false},
+	} {
+		request := restful.NewRequest(httptest.NewRequest(http.MethodGet, "/?"+c.query, nil))
+		opts, err := ParseOptions(request)
+		if (err == nil) != c.valid || (c.valid && opts != c.want) {
+			t.Errorf("%q: got %+v and %v", c.query, opts, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package stream
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/api/http/session"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"sync"
+)
+
+const (
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+
+	FrameTypeData         = "data"
+	FrameTypeSubscribed   = "subscribed"
+	FrameTypeUnsubscribed = "unsubscribed"
+	FrameTypeError        = "error"
+
+	// maxTopics limits the number of topics subscribed by a session.
+	maxTopics = 1000
+)
+
+// Request is sent by the client to subscribe or unsubscribe topics,
+// e.g. {"op": "subscribe", "id": "1", "topics": ["devices/d1/properties", "devices/d1/status"]}.
+type Request struct {
+	Op     string   `json:"op"`
+	ID     string   `json:"id,omitempty"` // echoed in the reply, so the client could correlate them
+	Topics []string `json:"topics"`
+}
+
+// Frame is sent by the server, the data frames are tagged by their topics.
+type Frame struct {
+	Type   string           `json:"type"`
+	ID     string           `json:"id,omitempty"`
+	Topic  string           `json:"topic,omitempty"`
+	Topics []string         `json:"topics,omitempty"`
+	Data   interface{}      `json:"data,omitempty"`
+	Error  *problem.Problem `json:"error,omitempty"`
+}
+
+// mux multiplexes the topics subscribed by the client in a WebSocket session.
+type mux struct {
+	r       Resource
+	session *session.Session
+
+	stops map[string]func() // topic -> stop, only accessed by the goroutine handling requests
+	wg    sync.WaitGroup    // goroutines forwarding messages of topics
+}
+
+func (r Resource) stream(request *restful.Request, response *restful.Response) {
+	opts, err := session.ParseOptions(request)
+	if err != nil {
+		problem.Write(response, problem.BadRequest(err, ""))
+		return
+	}
+	s, err := session.Upgrade(r.Context, request, response, opts)
+	if err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to upgrade HTTP as WebSocket"))
+		return
+	}
+	r.Sessions.Add(1)
+	defer r.Sessions.Done()
+
+	m := &mux{r: r, session: s, stops: make(map[string]func())}
+	defer m.stopAll()
+	for data := range s.Messages() {
+		m.handle(data)
+	}
+}
+
+func (m *mux) handle(data []byte) {
+	req := new(Request)
+	if err := json.Unmarshal(data, req); err != nil {
+		m.reply(&Frame{Type: FrameTypeError, Error: problemOf(problem.BadRequest(err, "fail to parse the request"))})
+		return
+	}
+	switch req.Op {
+	case OpSubscribe:
+		m.subscribe(req)
+	case OpUnsubscribe:
+		m.unsubscribe(req)
+	default:
+		m.reply(&Frame{Type: FrameTypeError, ID: req.ID, Error: problemOf(problem.BadRequest(nil,
+			"unsupported operation %s, only supporting %s and %s", req.Op, OpSubscribe, OpUnsubscribe))})
+	}
+}
+
+// subscribe subscribes the topics one by one, the topics failed are replied with errors separately.
+func (m *mux) subscribe(req *Request) {
+	subscribed := make([]string, 0, len(req.Topics))
+	for _, name := range req.Topics {
+		topic, err := subscription.ParseTopic(name)
+		if err != nil {
+			m.reply(&Frame{Type: FrameTypeError, ID: req.ID, Topic: name, Error: problemOf(problem.BadRequest(err, ""))})
+			continue
+		}
+		name = topic.String()
+		if _, ok := m.stops[name]; ok {
+			subscribed = append(subscribed, name)
+			continue
+		}
+		if len(m.stops) >= maxTopics {
+			m.reply(&Frame{Type: FrameTypeError, ID: req.ID, Topic: name, Error: problemOf(problem.Unprocessable(nil,
+				"a session could subscribe %d topics at most", maxTopics))})
+			continue
+		}
+		stop, err := m.forward(topic)
+		if err != nil {
+			m.reply(&Frame{Type: FrameTypeError, ID: req.ID, Topic: name,
+				Error: problemOf(problem.Wrap(err, "fail to subscribe the topic[%s]", name))})
+			continue
+		}
+		m.stops[name] = stop
+		subscribed = append(subscribed, name)
+	}
+	if len(subscribed) != 0 {
+		m.reply(&Frame{Type: FrameTypeSubscribed, ID: req.ID, Topics: subscribed})
+	}
+}
+
+func (m *mux) unsubscribe(req *Request) {
+	unsubscribed := make([]string, 0, len(req.Topics))
+	for _, name := range req.Topics {
+		topic, err := subscription.ParseTopic(name)
+		if err != nil {
+			m.reply(&Frame{Type: FrameTypeError, ID: req.ID, Topic: name, Error: problemOf(problem.BadRequest(err, ""))})
+			continue
+		}
+		name = topic.String()
+		if stop, ok := m.stops[name]; ok {
+			stop()
+			delete(m.stops, name)
+		}
+		unsubscribed = append(unsubscribed, name)
+	}
+	if len(unsubscribed) != 0 {
+		m.reply(&Frame{Type: FrameTypeUnsubscribed, ID: req.ID, Topics: unsubscribed})
+	}
+}
+
+// forward subscribes the topic from the hub, and forwards its messages into the session as data frames.
+func (m *mux) forward(topic subscription.Topic) (func(), error) {
+	var protocolID, productID string
+	if topic.DeviceID != subscription.AllDevices {
+		device, err := m.r.MetaStore.GetDevice(topic.DeviceID)
+		if err != nil {
+			return nil, err
+		}
+		product, err := m.r.MetaStore.GetProduct(device.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		protocolID, productID = product.Protocol, product.ID
+	}
+	bus, stop, err := m.r.Subscriptions.Subscribe(topic, protocolID, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := topic.String()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for message := range bus {
+			m.session.Send(&Frame{Type: FrameTypeData, Topic: name, Data: message})
+		}
+	}()
+	return stop, nil
+}
+
+func (m *mux) reply(frame *Frame) {
+	m.session.Send(frame)
+}
+
+// stopAll stops all topics of the session, and waits for the goroutines forwarding them.
+func (m *mux) stopAll() {
+	for name, stop := range m.stops {
+		stop()
+		delete(m.stops, name)
+	}
+	m.wg.Wait()
+}
+
+func problemOf(err error) *problem.Problem {
+	_, p := problem.Of(err)
+	return p
+}
@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"context"
+	restfulspec "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/api/http/session"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"net/http"
+	"sync"
+)
+
+type Resource struct {
+	// Context is used to close all WebSocket sessions when the server is shutting down,
+	// and Sessions tracks these sessions to wait for them to be closed.
+	Context  context.Context
+	Sessions *sync.WaitGroup
+
+	MetaStore     metastore.MetaStore
+	Subscriptions *subscription.Hub
+}
+
+func (r Resource) WebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.GET("").To(r.stream).
+		// docs
+		Doc("stream properties, events and statuses of many devices in a single WebSocket connection").
+		Notes("The client sends {\"op\": \"subscribe\"|\"unsubscribe\", \"id\": \"...\", \"topics\": [...]} to "+
+			"subscribe or unsubscribe topics, which are 'devices/{device-id}/properties', "+
+			"'devices/{device-id}/events/{event-id}' and 'devices/{device-id}/status', or 'devices/*/status' for "+
+			"the statuses of all devices. The server replies "+
+			"{\"type\": \"subscribed\"|\"unsubscribed\", \"id\": \"...\", \"topics\": [...]} or "+
+			"{\"type\": \"error\", \"id\": \"...\", \"topic\": \"...\", \"error\": {...}} for each request, and sends "+
+			"{\"type\": \"data\", \"topic\": \"...\", \"data\": ...} for each message of the subscribed topics. "+
+			"The subscriptions of the message bus are shared by all clients subscribing the same topic. "+
+			"The server sends a ping every 30s, and closes the session with 1001 if nothing is received in 90s.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"DEVICE DATA OPERATION"}).
+		Param(ws.QueryParameter(session.QueryParamOverflow, session.QueryParamOverflowDesc).
+			DataType(session.QueryParamOverflowType).DefaultValue(session.OverflowDropOldest)).
+		Param(ws.QueryParameter(session.QueryParamBufferSize, session.QueryParamBufferSizeDesc).
+			DataType(session.QueryParamBufferSizeType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), Frame{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}))
+
+	return ws
+}
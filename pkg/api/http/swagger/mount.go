@@ -8,7 +8,10 @@ import (
 	"path"
 )
 
-type Resource struct{}
+type Resource struct {
+	// UIRoot is the directory of static files of the Swagger UI.
+	UIRoot string
+}
 
 func (r Resource) WebService(root string) *restful.WebService {
 	ws := new(restful.WebService)
@@ -16,24 +19,20 @@ func (r Resource) WebService(root string) *restful.WebService {
 		Path(root).
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON, restful.MIME_OCTET)
-	ws.Route(ws.GET("/").To(getSwaggerUI))
-	ws.Route(ws.GET("/{subpath:*}").To(getSwaggerUIResources))
+	ws.Route(ws.GET("/").To(r.getSwaggerUI))
+	ws.Route(ws.GET("/{subpath:*}").To(r.getSwaggerUIResources))
 	ws.Route(ws.GET("/swagger.json").To(getSwaggerJson))
 
 	return ws
 }
 
-func swaggerUIRoot() string {
-	return "public/swagger-ui"
-}
-
-func getSwaggerUI(request *restful.Request, response *restful.Response) {
-	indexPath := path.Join(swaggerUIRoot(), "index.html")
+func (r Resource) getSwaggerUI(request *restful.Request, response *restful.Response) {
+	indexPath := path.Join(r.UIRoot, "index.html")
 	http.ServeFile(response.ResponseWriter, request.Request, indexPath)
 }
 
-func getSwaggerUIResources(request *restful.Request, response *restful.Response) {
-	subPath := path.Join(swaggerUIRoot(), request.PathParameter("subpath"))
+func (r Resource) getSwaggerUIResources(request *restful.Request, response *restful.Response) {
+	subPath := path.Join(r.UIRoot, request.PathParameter("subpath"))
 	http.ServeFile(response.ResponseWriter, request.Request, subPath)
 }
 
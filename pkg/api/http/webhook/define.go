@@ -0,0 +1,160 @@
+package webhook
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+)
+
+const (
+	PathParamWebhookID     = "webhook-id"
+	PathParamWebhookIDDesc = "the identifier of the webhook"
+	PathParamWebhookIDType = "string"
+
+	// redactedSecret replaces the secret in responses, and keeps the secret unchanged if it is sent back by updates.
+	redactedSecret = "******"
+)
+
+// RedeliverResult is the number of dead letters enqueued again.
+type RedeliverResult struct {
+	Redelivered int `json:"redelivered"`
+}
+
+func (r Resource) createWebhook(request *restful.Request, response *restful.Response) {
+	webhook := new(metastore.Webhook)
+	if err := request.ReadEntity(webhook); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	if err := webhook.Validate(); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to validate the webhook"))
+		return
+	}
+
+	if err := r.MetaStore.CreateWebhook(webhook); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to create the webhook[%s]", webhook.ID))
+		return
+	}
+	r.reload()
+	_ = response.WriteEntity(redact(webhook))
+}
+func (r Resource) deleteWebhook(request *restful.Request, response *restful.Response) {
+	webhookID := request.PathParameter(PathParamWebhookID)
+	if webhookID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamWebhookID))
+		return
+	}
+	if err := r.MetaStore.DeleteWebhook(webhookID); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to delete the webhook[%s]", webhookID))
+		return
+	}
+	r.reload()
+}
+func (r Resource) updateWebhook(request *restful.Request, response *restful.Response) {
+	webhookID := request.PathParameter(PathParamWebhookID)
+	if webhookID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamWebhookID))
+		return
+	}
+	webhook := new(metastore.Webhook)
+	if err := request.ReadEntity(webhook); err != nil {
+		problem.Write(response, problem.BadRequest(err, "fail to parse the request body"))
+		return
+	}
+	webhook.ID = webhookID
+	if err := webhook.Validate(); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to validate the webhook"))
+		return
+	}
+	old, err := r.MetaStore.GetWebhook(webhookID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the webhook[%s]", webhookID))
+		return
+	}
+	if webhook.Secret == redactedSecret {
+		webhook.Secret = old.Secret
+	}
+
+	if err = r.MetaStore.UpdateWebhook(webhook); err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to update the webhook[%s]", webhookID))
+		return
+	}
+	r.reload()
+	_ = response.WriteEntity(redact(webhook))
+}
+func (r Resource) findAllWebhooks(request *restful.Request, response *restful.Response) {
+	webhooks, err := r.MetaStore.ListWebhooks()
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to list webhooks"))
+		return
+	}
+	for i, webhook := range webhooks {
+		webhooks[i] = redact(webhook)
+	}
+	_ = response.WriteEntity(webhooks)
+}
+func (r Resource) findWebhook(request *restful.Request, response *restful.Response) {
+	webhookID := request.PathParameter(PathParamWebhookID)
+	if webhookID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamWebhookID))
+		return
+	}
+	webhook, err := r.MetaStore.GetWebhook(webhookID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the webhook[%s]", webhookID))
+		return
+	}
+	_ = response.WriteEntity(redact(webhook))
+}
+
+func (r Resource) findDeadLetters(request *restful.Request, response *restful.Response) {
+	r.withWebhook(request, response, func(webhook *metastore.Webhook) {
+		_ = response.WriteEntity(r.Dispatcher.DeadLetters(webhook.ID))
+	})
+}
+func (r Resource) clearDeadLetters(request *restful.Request, response *restful.Response) {
+	r.withWebhook(request, response, func(webhook *metastore.Webhook) {
+		r.Dispatcher.ClearDeadLetters(webhook.ID)
+	})
+}
+func (r Resource) redeliverDeadLetters(request *restful.Request, response *restful.Response) {
+	r.withWebhook(request, response, func(webhook *metastore.Webhook) {
+		n, ok := r.Dispatcher.Redeliver(webhook.ID)
+		if !ok {
+			problem.Write(response, problem.Conflict(nil, "the webhook[%s] is disabled", webhook.ID))
+			return
+		}
+		_ = response.WriteEntity(&RedeliverResult{Redelivered: n})
+	})
+}
+
+// withWebhook finds the webhook specified by the request, and then handles it.
+func (r Resource) withWebhook(request *restful.Request, response *restful.Response,
+	handle func(webhook *metastore.Webhook)) {
+	webhookID := request.PathParameter(PathParamWebhookID)
+	if webhookID == "" {
+		problem.Write(response, problem.BadRequest(nil, "the path parameter[%s] is required", PathParamWebhookID))
+		return
+	}
+	webhook, err := r.MetaStore.GetWebhook(webhookID)
+	if err != nil {
+		problem.Write(response, problem.Wrap(err, "fail to find the webhook[%s]", webhookID))
+		return
+	}
+	handle(webhook)
+}
+
+// reload applies the change of webhooks, the change is still applied by the next resync if it fails,
+// so the failure doesn't fail the request.
+func (r Resource) reload() {
+	_ = r.Dispatcher.Reload()
+}
+
+func redact(webhook *metastore.Webhook) *metastore.Webhook {
+	if webhook.Secret == "" {
+		return webhook
+	}
+	redacted := *webhook
+	redacted.Secret = redactedSecret
+	return &redacted
+}
@@ -0,0 +1,111 @@
+package webhook
+
+import (
+	"fmt"
+	restfulspec "github.com/emicklei/go-restful-openapi/v2"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	dispatch "github.com/thingio/edge-device-manager/pkg/webhook"
+	"net/http"
+)
+
+const webhookNotes = "The webhook is called back by POST when a device matching the 'filter' reports an event, " +
+	"including alarms, or changes its status. The payload is the delivery as JSON, or rendered by the Go " +
+	"'template' from the delivery, e.g. '{\"device\": \"{{.DeviceID}}\", \"data\": {{json .Data}}}'. If the " +
+	"'secret' is set, the header '" + dispatch.HeaderSignature + "' is 'sha256=' followed by the hex of " +
+	"HMAC-SHA256('{" + dispatch.HeaderTimestamp + "}.{payload}'). The delivery is retried with exponential " +
+	"backoff if the webhook doesn't respond, or responds 408, 429 or 5xx, and it is kept as a dead letter " +
+	"in memory after 'max_attempts'. The secret is returned as '" + redactedSecret + "', which keeps the " +
+	"secret unchanged if it is sent back by updates."
+
+type Resource struct {
+	MetaStore  metastore.MetaStore
+	Dispatcher *dispatch.Dispatcher
+}
+
+func (r Resource) WebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path(root).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"WEBHOOK OPERATION"}
+
+	ws.Route(ws.POST("").To(r.createWebhook).
+		// docs
+		Doc("create a new webhook").
+		Notes(webhookNotes).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(metastore.Webhook{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Webhook{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.DELETE(fmt.Sprintf("/{%s}", PathParamWebhookID)).To(r.deleteWebhook).
+		// docs
+		Doc("delete a webhook by its ID, its dead letters are dropped as well").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamWebhookID, PathParamWebhookIDDesc).DataType(PathParamWebhookIDType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.PUT(fmt.Sprintf("/{%s}", PathParamWebhookID)).To(r.updateWebhook).
+		// docs
+		Doc("update a webhook by its ID").
+		Notes(webhookNotes).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamWebhookID, PathParamWebhookIDDesc).DataType(PathParamWebhookIDType)).
+		Reads(metastore.Webhook{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Webhook{}).
+		Returns(http.StatusBadRequest, http.StatusText(http.StatusBadRequest), problem.Problem{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusUnprocessableEntity, http.StatusText(http.StatusUnprocessableEntity), problem.Problem{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET("/").To(r.findAllWebhooks).
+		// docs
+		Doc("get all webhooks").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]metastore.Webhook{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), []metastore.Webhook{}).
+		Returns(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), problem.Problem{}))
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}", PathParamWebhookID)).To(r.findWebhook).
+		// docs
+		Doc("get a webhook by its ID").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamWebhookID, PathParamWebhookIDDesc).DataType(PathParamWebhookIDType)).
+		Writes(metastore.Webhook{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), metastore.Webhook{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}))
+
+	ws.Route(ws.GET(fmt.Sprintf("/{%s}/dead-letters", PathParamWebhookID)).To(r.findDeadLetters).
+		// docs
+		Doc("get the deliveries failed after all attempts, from the oldest to the latest").
+		Notes("The latest 1000 dead letters of each webhook are kept in memory, they are lost once the manager restarts.").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamWebhookID, PathParamWebhookIDDesc).DataType(PathParamWebhookIDType)).
+		Writes([]dispatch.DeadLetter{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), []dispatch.DeadLetter{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}))
+	ws.Route(ws.DELETE(fmt.Sprintf("/{%s}/dead-letters", PathParamWebhookID)).To(r.clearDeadLetters).
+		// docs
+		Doc("drop the dead letters of a webhook").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamWebhookID, PathParamWebhookIDDesc).DataType(PathParamWebhookIDType)).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), nil).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}))
+	ws.Route(ws.POST(fmt.Sprintf("/{%s}/dead-letters/redeliver", PathParamWebhookID)).To(r.redeliverDeadLetters).
+		// docs
+		Doc("deliver the dead letters of a webhook again").
+		Notes("The dead letters are enqueued again with their original identifiers, the ones failed again are "+
+			"kept as dead letters. The webhook must be enabled(409).").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Param(ws.PathParameter(PathParamWebhookID, PathParamWebhookIDDesc).DataType(PathParamWebhookIDType)).
+		Writes(RedeliverResult{}).
+		Returns(http.StatusOK, http.StatusText(http.StatusOK), RedeliverResult{}).
+		Returns(http.StatusNotFound, http.StatusText(http.StatusNotFound), problem.Problem{}).
+		Returns(http.StatusConflict, http.StatusText(http.StatusConflict), problem.Problem{}))
+
+	return ws
+}
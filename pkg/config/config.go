@@ -0,0 +1,179 @@
+package config
+
+import (
+	"github.com/thingio/edge-device-std/config"
+)
+
+// Configuration consists of the standard configuration shared with device drivers,
+// and the options only used by the device manager.
+type Configuration struct {
+	*config.Configuration
+
+	// ManagerOptions shadows the standard one, which only supports the HTTP port.
+	ManagerOptions ManagerOptions `json:"manager" yaml:"manager"`
+
+	// PrintConfig indicates to print the effective configuration and exit, instead of serving.
+	PrintConfig bool `json:"-" yaml:"-"`
+}
+
+type ManagerOptions struct {
+	HTTP  HTTPOptions  `json:"http" yaml:"http"`
+	HTTPS HTTPSOptions `json:"https" yaml:"https"`
+	Unix  UnixOptions  `json:"unix" yaml:"unix"`
+
+	Health HealthOptions `json:"health" yaml:"health"`
+
+	MetaStore MetaStoreOptions `json:"metastore" yaml:"metastore"`
+	Swagger   SwaggerOptions   `json:"swagger" yaml:"swagger"`
+
+	Northbound NorthboundOptions `json:"northbound" yaml:"northbound"`
+}
+
+type HTTPOptions struct {
+	// Port is the port of the HTTP listener, it will be disabled if the port is 0.
+	Port int `json:"port" yaml:"port"`
+}
+
+type HTTPSOptions struct {
+	// Port is the port of the HTTPS listener, it will be disabled if the port is 0.
+	Port     int    `json:"port" yaml:"port"`
+	CertPath string `json:"cert_path" yaml:"cert_path"`
+	KeyPath  string `json:"key_path" yaml:"key_path"`
+}
+
+type UnixOptions struct {
+	// Path is the path of the Unix domain socket, it will be disabled if the path is empty.
+	Path string `json:"path" yaml:"path"`
+}
+
+type MetaStoreOptions struct {
+	// Backend is the type of the meta store, only "file" is supported now.
+	Backend string `json:"backend" yaml:"backend"`
+	// Path is where the meta store stores products and devices.
+	Path string `json:"path" yaml:"path"`
+}
+
+type SwaggerOptions struct {
+	// UIPath is the directory of static files of the Swagger UI.
+	UIPath string `json:"ui_path" yaml:"ui_path"`
+}
+
+// HealthOptions describes thresholds to judge whether a component is degraded or unhealthy,
+// the default value will be used if a threshold is 0.
+type HealthOptions struct {
+	DriverHeartbeatDegradedSecond       int `json:"driver_heartbeat_degraded_second" yaml:"driver_heartbeat_degraded_second"`
+	DriverHeartbeatUnhealthySecond      int `json:"driver_heartbeat_unhealthy_second" yaml:"driver_heartbeat_unhealthy_second"`
+	MetaStoreLatencyDegradedMillisecond int `json:"meta_store_latency_degraded_millisecond" yaml:"meta_store_latency_degraded_millisecond"`
+	GoroutinesDegraded                  int `json:"goroutines_degraded" yaml:"goroutines_degraded"`
+	GoroutinesUnhealthy                 int `json:"goroutines_unhealthy" yaml:"goroutines_unhealthy"`
+}
+
+func (o *HealthOptions) setDefaults() {
+	if o.DriverHeartbeatDegradedSecond == 0 {
+		o.DriverHeartbeatDegradedSecond = 30
+	}
+	if o.DriverHeartbeatUnhealthySecond == 0 {
+		o.DriverHeartbeatUnhealthySecond = 120
+	}
+	if o.MetaStoreLatencyDegradedMillisecond == 0 {
+		o.MetaStoreLatencyDegradedMillisecond = 500
+	}
+	if o.GoroutinesDegraded == 0 {
+		o.GoroutinesDegraded = 10000
+	}
+	if o.GoroutinesUnhealthy == 0 {
+		o.GoroutinesUnhealthy = 50000
+	}
+}
+
+// NorthboundOptions connects the manager to an external MQTT broker, e.g. the one of the cloud,
+// which is independent of the message bus shared with drivers. It is disabled if the host is empty.
+type NorthboundOptions struct {
+	MQTT config.MQTTMessageBusOptions `json:"mqtt" yaml:"mqtt"`
+	// ClientID is the client ID of the connection, which should be unique on the broker.
+	ClientID string `json:"client_id" yaml:"client_id"`
+
+	Forward   ForwardOptions   `json:"forward" yaml:"forward"`
+	Commands  CommandOptions   `json:"commands" yaml:"commands"`
+	Sparkplug SparkplugOptions `json:"sparkplug" yaml:"sparkplug"`
+}
+
+// Enabled returns true if the external broker is configured.
+func (o *NorthboundOptions) Enabled() bool {
+	return o.MQTT.Host != ""
+}
+
+// ForwardOptions describes how to republish the data of devices to the external broker.
+type ForwardOptions struct {
+	Routes []ForwardRoute `json:"routes" yaml:"routes"`
+	// BufferPath is the directory to buffer messages while the broker is unreachable, the messages
+	// are replayed once it is reconnected. They are dropped if the path is empty.
+	BufferPath string `json:"buffer_path" yaml:"buffer_path"`
+	// BufferMaxMegabytes limits the size of the buffer, the oldest messages are dropped if it is exceeded.
+	BufferMaxMegabytes int `json:"buffer_max_megabytes" yaml:"buffer_max_megabytes"`
+}
+
+// ForwardRoute republishes a source of devices, i.e. properties, events or status, to the topic.
+type ForwardRoute struct {
+	Source string `json:"source" yaml:"source"`
+	// Topic is the template of the topic, e.g. "site/{product}/{device}/{property}", the placeholders are
+	// {protocol}, {product}, {device}, {source}, {property} and {event}. Each property is published
+	// separately if {property} is present, otherwise all properties of a message are published together.
+	Topic string `json:"topic" yaml:"topic"`
+	// Format is "json", the message with the device and the timestamp, or "value", only the value.
+	Format string `json:"format" yaml:"format"`
+	QoS    int    `json:"qos" yaml:"qos"`
+	Retain bool   `json:"retain" yaml:"retain"`
+
+	// Products and Devices select the devices to be forwarded, all devices are selected if both are empty.
+	Products []string `json:"products" yaml:"products"`
+	Devices  []string `json:"devices" yaml:"devices"`
+}
+
+// CommandOptions describes how to accept the commands to devices from the external broker.
+// It is disabled if the topic is empty.
+type CommandOptions struct {
+	// Topic is the topic filter subscribed for commands, wildcards are allowed, e.g. "site/commands/+".
+	Topic string `json:"topic" yaml:"topic"`
+	// ReplyTopic is the template of the topic to publish the replies, e.g. "site/replies/{device}",
+	// the placeholders are {product} and {device}. It is required if the commands are enabled.
+	ReplyTopic string `json:"reply_topic" yaml:"reply_topic"`
+	QoS        int    `json:"qos" yaml:"qos"`
+	// MaxConcurrent is the maximum number of commands executed at the same time.
+	MaxConcurrent int `json:"max_concurrent" yaml:"max_concurrent"`
+	// Allow lists the commands accepted, a command is rejected unless any of the rules matches it.
+	// The rules also apply to the DCMD of the Sparkplug edge node, even if the topic is empty.
+	Allow []CommandRule `json:"allow" yaml:"allow"`
+}
+
+// Enabled returns true if the commands are subscribed.
+func (o *CommandOptions) Enabled() bool {
+	return o.Topic != ""
+}
+
+// CommandRule allows the commands matching all of its fields, an empty field matches anything.
+type CommandRule struct {
+	Products []string `json:"products" yaml:"products"`
+	Devices  []string `json:"devices" yaml:"devices"`
+	// Operations are the operations allowed, i.e. read, hard-read, write and call.
+	Operations []string `json:"operations" yaml:"operations"`
+	// Properties are the properties allowed to read or write, and Methods are the methods allowed to call.
+	Properties []string `json:"properties" yaml:"properties"`
+	Methods    []string `json:"methods" yaml:"methods"`
+}
+
+// SparkplugOptions makes the manager a Sparkplug B edge node, whose devices are the devices of the manager.
+// It is disabled if either the group ID or the edge node ID is empty.
+type SparkplugOptions struct {
+	GroupID    string `json:"group_id" yaml:"group_id"`
+	EdgeNodeID string `json:"edge_node_id" yaml:"edge_node_id"`
+
+	// Products and Devices select the devices of the edge node, all devices are selected if both are empty.
+	Products []string `json:"products" yaml:"products"`
+	Devices  []string `json:"devices" yaml:"devices"`
+}
+
+// Enabled returns true if the edge node is identified.
+func (o *SparkplugOptions) Enabled() bool {
+	return o.GroupID != "" && o.EdgeNodeID != ""
+}
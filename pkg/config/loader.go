@@ -0,0 +1,133 @@
+package config
+
+import (
+	"flag"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/errors"
+	"gopkg.in/yaml.v2"
+	"strings"
+)
+
+const (
+	MetaStoreBackendFile = "file"
+
+	maskedPassword = "******"
+)
+
+// defaults are used when the keys are specified by neither the configuration file nor flags,
+// they also make these keys could be overridden by environment variables, e.g. EDS_MANAGER_HTTP_PORT.
+var defaults = map[string]interface{}{
+	"manager.http.port":                                      10996,
+	"manager.https.port":                                     0,
+	"manager.https.cert_path":                                "",
+	"manager.https.key_path":                                 "",
+	"manager.unix.path":                                      "",
+	"manager.health.driver_heartbeat_degraded_second":        0,
+	"manager.health.driver_heartbeat_unhealthy_second":       0,
+	"manager.health.meta_store_latency_degraded_millisecond": 0,
+	"manager.health.goroutines_degraded":                     0,
+	"manager.health.goroutines_unhealthy":                    0,
+	"manager.metastore.backend":                              MetaStoreBackendFile,
+	"manager.metastore.path":                                 "etc/resources",
+	"manager.swagger.ui_path":                                "public/swagger-ui",
+	"manager.northbound.mqtt.host":                           "",
+	"manager.northbound.mqtt.port":                           1883,
+	"manager.northbound.mqtt.username":                       "",
+	"manager.northbound.mqtt.password":                       "",
+	"manager.northbound.client_id":                           "",
+	"manager.northbound.forward.buffer_path":                 "",
+	"manager.northbound.forward.buffer_max_megabytes":        256,
+	"manager.northbound.commands.topic":                      "",
+	"manager.northbound.commands.reply_topic":                "",
+	"manager.northbound.commands.qos":                        1,
+	"manager.northbound.commands.max_concurrent":             16,
+	"manager.northbound.sparkplug.group_id":                  "",
+	"manager.northbound.sparkplug.edge_node_id":              "",
+
+	"log.level": "info",
+}
+
+// flagKeys maps flags to the keys of the configuration they override.
+var flagKeys = map[string]string{
+	"metastore-backend": "manager.metastore.backend",
+	"metastore-path":    "manager.metastore.path",
+	"http-port":         "manager.http.port",
+	"log-level":         "log.level",
+	"swagger-ui-path":   "manager.swagger.ui_path",
+}
+
+// NewConfiguration loads the configuration with the following precedence:
+// command-line flags > environment variables > the configuration file > defaults.
+func NewConfiguration(name string, args []string) (*Configuration, errors.EdgeError) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var configPath, configName string
+	fs.StringVar(&configPath, "cp", config.FilePath, "config file path, e.g. \"/etc\"")
+	fs.StringVar(&configPath, "config-path", config.FilePath, "alias of -cp")
+	fs.StringVar(&configName, "cn", config.FileName, "config file name, e.g. \"config\", excluding the suffix")
+	fs.StringVar(&configName, "config-name", config.FileName, "alias of -cn")
+	fs.String("metastore-backend", "", "the backend of the meta store, overrides manager.metastore.backend")
+	fs.String("metastore-path", "", "the path of the meta store, overrides manager.metastore.path")
+	fs.Int("http-port", 0, "the port of the HTTP listener, overrides manager.http.port")
+	fs.String("log-level", "", "the log level, one of debug, info, warn and error, overrides log.level")
+	fs.String("swagger-ui-path", "", "the directory of the Swagger UI, overrides manager.swagger.ui_path")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	_ = fs.Parse(args) // exit directly if failed
+
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+	v.SetEnvPrefix(config.EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	v.AddConfigPath(configPath)
+	v.SetConfigName(configName)
+	v.SetConfigType(config.FileFormat)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Configuration.Cause(err, "fail to read the configuration file")
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			v.Set(key, f.Value.String())
+		}
+	})
+
+	decoder := func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = config.FileFormat
+	}
+	cfg := &Configuration{Configuration: new(config.Configuration), PrintConfig: *printConfig}
+	if err := v.Unmarshal(cfg.Configuration, decoder); err != nil {
+		return nil, errors.Configuration.Cause(err, "fail to unmarshal the configuration file")
+	}
+	// UnmarshalKey doesn't merge nested keys from different sources, so we unmarshal all settings again
+	manager := struct {
+		ManagerOptions *ManagerOptions `yaml:"manager"`
+	}{&cfg.ManagerOptions}
+	if err := v.Unmarshal(&manager, decoder); err != nil {
+		return nil, errors.Configuration.Cause(err, "fail to unmarshal the options of the manager")
+	}
+	cfg.ManagerOptions.Health.setDefaults()
+	return cfg, nil
+}
+
+// YAML returns the effective configuration used by the manager, secrets will be masked.
+func (c *Configuration) YAML() ([]byte, error) {
+	effective := struct {
+		Manager    ManagerOptions           `yaml:"manager"`
+		MessageBus config.MessageBusOptions `yaml:"msgbus"`
+		Log        config.LogOptions        `yaml:"log"`
+	}{
+		Manager:    c.ManagerOptions,
+		MessageBus: c.MessageBus,
+		Log:        c.LogOptions,
+	}
+	if effective.MessageBus.MQTT.Password != "" {
+		effective.MessageBus.MQTT.Password = maskedPassword
+	}
+	if effective.Manager.Northbound.MQTT.Password != "" {
+		effective.Manager.Northbound.MQTT.Password = maskedPassword
+	}
+	return yaml.Marshal(effective)
+}
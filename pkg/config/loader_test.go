@@ -0,0 +1,74 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+manager:
+  http:
+    port: 8080
+  metastore:
+    path: /var/lib/metastore
+  northbound:
+    mqtt:
+      password: secret
+msgbus:
+  mqtt:
+    password: secret
+log:
+  level: debug
+`
+
+func TestNewConfigurationPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "manager.yaml"), []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"EDS_MANAGER_HTTP_PORT":       "9090",
+		"EDS_MANAGER_SWAGGER_UI_PATH": "/srv/swagger",
+	} {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Unsetenv(key)
+	}
+
+	cfg, err := NewConfiguration("manager", []string{"-cp", dir, "-cn", "manager", "-log-level", "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flags > environment variables > the configuration file > defaults
+	if cfg.LogOptions.Level != "warn" {
+		t.Errorf("log level = %s, want the one of the flag", cfg.LogOptions.Level)
+	}
+	if cfg.ManagerOptions.HTTP.Port != 9090 || cfg.ManagerOptions.Swagger.UIPath != "/srv/swagger" {
+		t.Errorf("http port = %d and swagger = %s, want the ones of the environment variables",
+			cfg.ManagerOptions.HTTP.Port, cfg.ManagerOptions.Swagger.UIPath)
+	}
+	if cfg.ManagerOptions.MetaStore.Path != "/var/lib/metastore" {
+		t.Errorf("meta store path = %s, want the one of the file", cfg.ManagerOptions.MetaStore.Path)
+	}
+	if cfg.ManagerOptions.MetaStore.Backend != MetaStoreBackendFile || cfg.ManagerOptions.Health.DriverHeartbeatDegradedSecond == 0 {
+		t.Errorf("options = %+v, want the defaults", cfg.ManagerOptions)
+	}
+
+	data, e := cfg.YAML()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if strings.Contains(string(data), "secret") || !strings.Contains(string(data), maskedPassword) {
+		t.Errorf("the printed configuration should mask the passwords:\n%s", data)
+	}
+}
+
+func TestNewConfigurationWithoutFile(t *testing.T) {
+	if _, err := NewConfiguration("manager", []string{"-cp", t.TempDir()}); err == nil {
+		t.Error("the configuration is loaded without the file, want an error")
+	}
+}
@@ -0,0 +1,168 @@
+package health
+
+import (
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"runtime"
+	"time"
+)
+
+type Status = string
+
+const (
+	StatusHealthy   Status = "healthy"
+	StatusDegraded  Status = "degraded"
+	StatusUnhealthy Status = "unhealthy"
+)
+
+// worse returns the worse one of two statuses.
+func worse(a, b Status) Status {
+	rank := map[Status]int{StatusHealthy: 0, StatusDegraded: 1, StatusUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+type Report struct {
+	Status     Status          `json:"status"`
+	Timestamp  time.Time       `json:"timestamp"`
+	MessageBus ComponentReport `json:"msgbus"`
+	MetaStore  MetaStoreReport `json:"metastore"`
+	Drivers    []DriverReport  `json:"drivers"`
+	Runtime    RuntimeReport   `json:"runtime"`
+}
+
+type ComponentReport struct {
+	Status Status `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type MetaStoreReport struct {
+	ComponentReport
+	LatencyMillisecond int64 `json:"latency_millisecond"`
+}
+
+type DriverReport struct {
+	ComponentReport
+	ProtocolID         string    `json:"protocol_id"`
+	Online             bool      `json:"online"` // whether the driver is still in the protocol cache
+	LastHeartbeat      time.Time `json:"last_heartbeat"`
+	HeartbeatAgeSecond float64   `json:"heartbeat_age_second"`
+}
+
+type RuntimeReport struct {
+	ComponentReport
+	Goroutines    int   `json:"goroutines"`
+	Subscriptions int64 `json:"subscriptions"`
+}
+
+// Checker checks all dependencies of the device manager.
+type Checker struct {
+	MessageBus interface {
+		IsConnected() bool
+	}
+	MetaStore     metastore.MetaStore
+	ProtocolCache *cache.Cache
+	Heartbeats    *Heartbeats
+	Subscriptions func() int64
+	Listening     func() bool // whether the manager has subscribed to drivers and all listeners are up
+	Thresholds    config.HealthOptions
+}
+
+// Ready returns true if the manager is able to serve requests.
+func (c *Checker) Ready() (bool, string) {
+	if !c.Listening() {
+		return false, "the subscription of the message bus or the listeners are not up yet"
+	}
+	if !c.MessageBus.IsConnected() {
+		return false, "the message bus is disconnected"
+	}
+	return true, ""
+}
+
+func (c *Checker) Check() *Report {
+	report := &Report{
+		Timestamp:  time.Now(),
+		MessageBus: c.checkMessageBus(),
+		MetaStore:  c.checkMetaStore(),
+		Drivers:    c.checkDrivers(),
+		Runtime:    c.checkRuntime(),
+	}
+
+	status := worse(report.MessageBus.Status, report.MetaStore.Status)
+	status = worse(status, report.Runtime.Status)
+	for _, driver := range report.Drivers {
+		status = worse(status, driver.Status)
+	}
+	report.Status = status
+	return report
+}
+
+func (c *Checker) checkMessageBus() ComponentReport {
+	if !c.MessageBus.IsConnected() {
+		return ComponentReport{Status: StatusUnhealthy, Detail: "the message bus is disconnected"}
+	}
+	return ComponentReport{Status: StatusHealthy}
+}
+
+func (c *Checker) checkMetaStore() MetaStoreReport {
+	start := time.Now()
+	err := c.MetaStore.HealthCheck()
+	latency := time.Since(start)
+
+	report := MetaStoreReport{
+		ComponentReport:    ComponentReport{Status: StatusHealthy},
+		LatencyMillisecond: latency.Milliseconds(),
+	}
+	if err != nil {
+		report.Status, report.Detail = StatusUnhealthy, err.Error()
+	} else if threshold := time.Duration(c.Thresholds.MetaStoreLatencyDegradedMillisecond) * time.Millisecond; latency > threshold {
+		report.Status, report.Detail = StatusDegraded, "the latency of the meta store exceeds "+threshold.String()
+	}
+	return report
+}
+
+func (c *Checker) checkDrivers() []DriverReport {
+	degraded := time.Duration(c.Thresholds.DriverHeartbeatDegradedSecond) * time.Second
+	unhealthy := time.Duration(c.Thresholds.DriverHeartbeatUnhealthySecond) * time.Second
+
+	reports := make([]DriverReport, 0)
+	for _, beat := range c.Heartbeats.List() {
+		_, online := c.ProtocolCache.Get(beat.ProtocolID)
+		age := beat.Age()
+		report := DriverReport{
+			ComponentReport:    ComponentReport{Status: StatusHealthy},
+			ProtocolID:         beat.ProtocolID,
+			Online:             online,
+			LastHeartbeat:      beat.Time,
+			HeartbeatAgeSecond: age.Seconds(),
+		}
+		switch {
+		case age > unhealthy:
+			report.Status, report.Detail = StatusUnhealthy, "no heartbeat in "+unhealthy.String()
+		case age > degraded:
+			report.Status, report.Detail = StatusDegraded, "no heartbeat in "+degraded.String()
+		case !online:
+			report.Status, report.Detail = StatusDegraded, "the driver has been evicted from the protocol cache"
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func (c *Checker) checkRuntime() RuntimeReport {
+	report := RuntimeReport{
+		ComponentReport: ComponentReport{Status: StatusHealthy},
+		Goroutines:      runtime.NumGoroutine(),
+		Subscriptions:   c.Subscriptions(),
+	}
+	switch {
+	case report.Goroutines > c.Thresholds.GoroutinesUnhealthy:
+		report.Status, report.Detail = StatusUnhealthy, "too many goroutines"
+	case report.Goroutines > c.Thresholds.GoroutinesDegraded:
+		report.Status, report.Detail = StatusDegraded, "too many goroutines"
+	}
+	return report
+}
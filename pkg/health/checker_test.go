@@ -0,0 +1,103 @@
+package health
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"testing"
+	"time"
+)
+
+type fakeBus struct {
+	connected bool
+}
+
+func (b *fakeBus) IsConnected() bool {
+	return b.connected
+}
+
+type fakeStore struct {
+	metastore.MetaStore
+
+	err error
+}
+
+func (s *fakeStore) HealthCheck() error {
+	return s.err
+}
+
+func newTestChecker() (*Checker, *fakeBus, *fakeStore) {
+	bus, store := &fakeBus{connected: true}, new(fakeStore)
+	return &Checker{
+		MessageBus:    bus,
+		MetaStore:     store,
+		ProtocolCache: cache.New(cache.NoExpiration, cache.NoExpiration),
+		Heartbeats:    NewHeartbeats(),
+		Subscriptions: func() int64 { return 0 },
+		Listening:     func() bool { return true },
+		Thresholds: config.HealthOptions{
+			DriverHeartbeatDegradedSecond:       30,
+			DriverHeartbeatUnhealthySecond:      120,
+			MetaStoreLatencyDegradedMillisecond: 1000,
+			GoroutinesDegraded:                  100000,
+			GoroutinesUnhealthy:                 1000000,
+		},
+	}, bus, store
+}
+
+func TestCheckerReady(t *testing.T) {
+	checker, bus, _ := newTestChecker()
+	if ready, reason := checker.Ready(); !ready {
+		t.Errorf("the checker is not ready, because %s", reason)
+	}
+
+	bus.connected = false
+	if ready, _ := checker.Ready(); ready {
+		t.Error("the checker should not be ready if the message bus is disconnected")
+	}
+	bus.connected = true
+	checker.Listening = func() bool { return false }
+	if ready, _ := checker.Ready(); ready {
+		t.Error("the checker should not be ready if the listeners are not up")
+	}
+}
+
+func TestCheckerCheck(t *testing.T) {
+	checker, bus, store := newTestChecker()
+	if report := checker.Check(); report.Status != StatusHealthy {
+		t.Errorf("status = %s, want %s", report.Status, StatusHealthy)
+	}
+
+	// a driver is degraded if it is evicted from the protocol cache or its heartbeat is late
+	checker.Heartbeats.Beat("modbus", 10*time.Second)
+	checker.ProtocolCache.Set("opcua", struct{}{}, cache.NoExpiration)
+	checker.Heartbeats.beats["opcua"] = Heartbeat{ProtocolID: "opcua", Time: time.Now().Add(-time.Minute)}
+	report := checker.Check()
+	if report.Status != StatusDegraded || len(report.Drivers) != 2 {
+		t.Fatalf("report = %+v, want 2 degraded drivers", report)
+	}
+	for _, driver := range report.Drivers {
+		if driver.Status != StatusDegraded {
+			t.Errorf("the driver[%s] is %s, want %s", driver.ProtocolID, driver.Status, StatusDegraded)
+		}
+	}
+	if report.Drivers[0].ProtocolID != "modbus" || report.Drivers[0].Online {
+		t.Errorf("the first driver = %+v, want the evicted modbus", report.Drivers[0])
+	}
+
+	checker.Heartbeats.beats["opcua"] = Heartbeat{ProtocolID: "opcua", Time: time.Now().Add(-time.Hour)}
+	if report = checker.Check(); report.Status != StatusUnhealthy {
+		t.Errorf("status = %s, want %s if a driver is lost", report.Status, StatusUnhealthy)
+	}
+
+	checker.Heartbeats = NewHeartbeats()
+	store.err = errors.New("disk is full")
+	if report = checker.Check(); report.Status != StatusUnhealthy || report.MetaStore.Detail != "disk is full" {
+		t.Errorf("report = %+v, want the meta store unhealthy", report)
+	}
+	store.err, bus.connected = nil, false
+	if report = checker.Check(); report.Status != StatusUnhealthy || report.MessageBus.Status != StatusUnhealthy {
+		t.Errorf("report = %+v, want the message bus unhealthy", report)
+	}
+}
@@ -0,0 +1,59 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// DeviceState is the last status reported by the driver for a device.
+type DeviceState struct {
+	State  string    `json:"state"`
+	Detail string    `json:"detail"`
+	Time   time.Time `json:"time"`
+}
+
+// DeviceStateChange is a transition of the state, or the detail, of a device reported by the driver.
+type DeviceStateChange struct {
+	DeviceID  string    `json:"device_id"`
+	ProductID string    `json:"product_id"`
+	State     string    `json:"state"`
+	Previous  string    `json:"previous,omitempty"` // empty if the state is unknown since the manager starts
+	Detail    string    `json:"detail,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// DeviceStates records the last status of each device, only the state is persisted by the meta store,
+// so the detail, e.g. why the device is in exception, is kept here.
+type DeviceStates struct {
+	mu     sync.RWMutex
+	states map[string]DeviceState // device ID -> state
+}
+
+func NewDeviceStates() *DeviceStates {
+	return &DeviceStates{states: make(map[string]DeviceState)}
+}
+
+// Set records the state of the device, and returns the previous one if the state or the detail is changed.
+func (s *DeviceStates) Set(deviceID, state, detail string) (previous DeviceState, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.states[deviceID]
+	s.states[deviceID] = DeviceState{State: state, Detail: detail, Time: time.Now()}
+	return previous, !ok || previous.State != state || previous.Detail != detail
+}
+
+func (s *DeviceStates) Get(deviceID string) (DeviceState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state, ok := s.states[deviceID]
+	return state, ok
+}
+
+func (s *DeviceStates) Delete(deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.states, deviceID)
+}
@@ -0,0 +1,35 @@
+package health
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+)
+
+func TestDeviceStatesSet(t *testing.T) {
+	states := NewDeviceStates()
+	for _, c := range []struct {
+		state, detail string
+		previous      string
+		changed       bool
+	}{
+		{models.DeviceStateConnected, "", "", true},
+		{models.DeviceStateConnected, "", models.DeviceStateConnected, false},
+		{models.DeviceStateException, "timeout", models.DeviceStateConnected, true},
+		{models.DeviceStateException, "CRC error", models.DeviceStateException, true},
+		{models.DeviceStateException, "CRC error", models.DeviceStateException, false},
+	} {
+		previous, changed := states.Set("d1", c.state, c.detail)
+		if previous.State != c.previous || changed != c.changed {
+			t.Errorf("%s/%s: previous = %s and changed = %t, want %s and %t",
+				c.state, c.detail, previous.State, changed, c.previous, c.changed)
+		}
+	}
+	if state, ok := states.Get("d1"); !ok || state.Detail != "CRC error" {
+		t.Errorf("the state = %+v, want the last detail kept", state)
+	}
+
+	states.Delete("d1")
+	if _, changed := states.Set("d1", models.DeviceStateException, "CRC error"); !changed {
+		t.Error("the state of a deleted device should be a change")
+	}
+}
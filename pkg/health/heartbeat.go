@@ -0,0 +1,56 @@
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Heartbeat is the last health check reported by a driver.
+type Heartbeat struct {
+	ProtocolID string        `json:"protocol_id"`
+	Time       time.Time     `json:"time"`
+	Interval   time.Duration `json:"-"`
+}
+
+// Age returns the duration since the heartbeat.
+func (h Heartbeat) Age() time.Duration {
+	return time.Since(h.Time)
+}
+
+// Heartbeats records the last heartbeat of each driver, it keeps the records of drivers
+// which have been evicted from the protocol cache, so we can still tell how long they have been lost.
+type Heartbeats struct {
+	mu    sync.RWMutex
+	beats map[string]Heartbeat // protocol ID -> heartbeat
+}
+
+func NewHeartbeats() *Heartbeats {
+	return &Heartbeats{beats: make(map[string]Heartbeat)}
+}
+
+func (h *Heartbeats) Beat(protocolID string, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.beats[protocolID] = Heartbeat{
+		ProtocolID: protocolID,
+		Time:       time.Now(),
+		Interval:   interval,
+	}
+}
+
+// List returns all heartbeats sorted by the protocol ID.
+func (h *Heartbeats) List() []Heartbeat {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	beats := make([]Heartbeat, 0, len(h.beats))
+	for _, beat := range h.beats {
+		beats = append(beats, beat)
+	}
+	sort.Slice(beats, func(i, j int) bool {
+		return beats[i].ProtocolID < beats[j].ProtocolID
+	})
+	return beats
+}
@@ -0,0 +1,66 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-std/models"
+)
+
+// The reasons why a device is not ready to serve data operations.
+var (
+	ErrDriverOffline      = errors.New("driver offline")
+	ErrDeviceDisconnected = errors.New("device disconnected")
+	ErrDeviceException    = errors.New("device in exception")
+)
+
+// NotReadyError means the device is not ready to serve data operations, its reason is one of ErrDriverOffline,
+// ErrDeviceDisconnected and ErrDeviceException, and its detail is the one reported by the driver, if any.
+type NotReadyError struct {
+	Reason  error
+	Message string
+	Detail  string
+}
+
+func (e *NotReadyError) Error() string {
+	if e.Detail == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Detail
+}
+
+func (e *NotReadyError) Unwrap() error {
+	return e.Reason
+}
+
+// Ready verifies that the driver of the protocol is online and the device is able to serve data operations,
+// so that the operation fails fast rather than waiting for the timeout of the message bus. Only connected and
+// reconnecting devices are ready, an empty or unknown status is treated as disconnected. The states are
+// optional, they provide the detail of the exception.
+func Ready(protocols *cache.Cache, states *DeviceStates, protocolID string, device *models.Device) error {
+	if _, ok := protocols.Get(protocolID); !ok {
+		return &NotReadyError{Reason: ErrDriverOffline,
+			Message: fmt.Sprintf("the driver of the protocol[%s] is offline", protocolID)}
+	}
+	switch device.DeviceStatus {
+	case models.DeviceStateConnected, models.DeviceStateReconnecting:
+		return nil
+	case models.DeviceStateException:
+		err := &NotReadyError{Reason: ErrDeviceException,
+			Message: fmt.Sprintf("the device[%s] is in exception", device.ID)}
+		if states != nil {
+			// the detail is reported along with the state, so it is stale if the state is changed since then
+			if state, ok := states.Get(device.ID); ok && state.State == device.DeviceStatus {
+				err.Detail = state.Detail
+			}
+		}
+		return err
+	case models.DeviceStateDisconnected:
+		return &NotReadyError{Reason: ErrDeviceDisconnected,
+			Message: fmt.Sprintf("the device[%s] is disconnected", device.ID)}
+	default:
+		// the driver never reports the status of the device, so it is not connected yet
+		return &NotReadyError{Reason: ErrDeviceDisconnected,
+			Message: fmt.Sprintf("the status[%s] of the device[%s] is unknown", device.DeviceStatus, device.ID)}
+	}
+}
@@ -0,0 +1,56 @@
+package health
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	protocols := cache.New(cache.NoExpiration, cache.NoExpiration)
+	protocols.Set("modbus", struct{}{}, cache.NoExpiration)
+	states := NewDeviceStates()
+	states.Set("d1", models.DeviceStateException, "timeout")
+
+	for _, c := range []struct {
+		protocolID string
+		status     string
+		want       error
+	}{
+		{"opcua", models.DeviceStateConnected, ErrDriverOffline},
+		{"modbus", models.DeviceStateConnected, nil},
+		{"modbus", models.DeviceStateReconnecting, nil},
+		{"modbus", models.DeviceStateDisconnected, ErrDeviceDisconnected},
+		{"modbus", models.DeviceStateException, ErrDeviceException},
+		{"modbus", "", ErrDeviceDisconnected},
+		{"modbus", "unknown", ErrDeviceDisconnected},
+	} {
+		err := Ready(protocols, states, c.protocolID, &models.Device{ID: "d1", DeviceStatus: c.status})
+		if !errors.Is(err, c.want) || (err == nil) != (c.want == nil) {
+			t.Errorf("%s/%q: got %v, want %v", c.protocolID, c.status, err, c.want)
+		}
+	}
+}
+
+func TestReadyDetail(t *testing.T) {
+	protocols := cache.New(cache.NoExpiration, cache.NoExpiration)
+	protocols.Set("modbus", struct{}{}, cache.NoExpiration)
+	states := NewDeviceStates()
+	device := &models.Device{ID: "d1", DeviceStatus: models.DeviceStateException}
+
+	states.Set("d1", models.DeviceStateException, "timeout")
+	var notReady *NotReadyError
+	if err := Ready(protocols, states, "modbus", device); !errors.As(err, &notReady) || notReady.Detail != "timeout" {
+		t.Errorf("got %v, want the detail reported by the driver", err)
+	}
+
+	// the detail of another state is stale
+	states.Set("d1", models.DeviceStateConnected, "")
+	if err := Ready(protocols, states, "modbus", device); !errors.As(err, &notReady) || notReady.Detail != "" {
+		t.Errorf("got %v, want no detail", err)
+	}
+	if err := Ready(protocols, nil, "modbus", device); !errors.Is(err, ErrDeviceException) {
+		t.Errorf("got %v without states, want %v", err, ErrDeviceException)
+	}
+}
@@ -2,24 +2,34 @@ package manager
 
 import (
 	"context"
-	"fmt"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	api "github.com/thingio/edge-device-manager/pkg/api/http"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/health"
 	"github.com/thingio/edge-device-manager/pkg/metastore"
-	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-manager/pkg/northbound"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-manager/pkg/webhook"
 	"github.com/thingio/edge-device-std/logger"
 	bus "github.com/thingio/edge-device-std/msgbus"
 	"github.com/thingio/edge-device-std/operations"
-	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// shutdownTimeout is the maximum duration to drain in-flight requests and WebSocket sessions.
+	shutdownTimeout = 30 * time.Second
+)
+
 func NewDeviceManager(ctx context.Context, cancel context.CancelFunc,
-	metaStore metastore.MetaStore) (*DeviceManager, error) {
+	cfg *config.Configuration, metaStore metastore.MetaStore) (*DeviceManager, error) {
 	m := &DeviceManager{
+		cfg:       cfg,
 		metaStore: metaStore,
 
 		ctx:    ctx,
@@ -31,26 +41,40 @@ func NewDeviceManager(ctx context.Context, cancel context.CancelFunc,
 
 type DeviceManager struct {
 	// caches
-	protocols *cache.Cache
+	protocols  *cache.Cache
+	heartbeats *health.Heartbeats
+	devices    *health.DeviceStates
 
 	// operation clients
-	mc        operations.ManagerClient
-	ms        operations.ManagerService
+	mb        bus.MessageBus
+	mc        *instrumentedManagerClient
+	ms        *countedManagerService
+	hub       *subscription.Hub
+	webhooks  *webhook.Dispatcher
 	metaStore metastore.MetaStore
 
+	// bridge connects to the northbound broker, all of them are nil if it is not configured
+	bridge    *northbound.Bridge
+	forwarder *northbound.Forwarder
+	commander *northbound.Commander
+	edgeNode  *northbound.EdgeNode
+
+	// HTTP server and its WebSocket sessions hijacked from it
+	server   *server
+	sessions *sync.WaitGroup
+
+	// subscribed indicates whether the subscription of drivers' statuses is established
+	subscribed int32
+
 	// lifetime control variables for the device driver
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *logger.Logger
-	cfg    *config.Configuration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	monitors sync.WaitGroup // goroutines holding subscriptions of the message bus
+	logger   *logger.Logger
+	cfg      *config.Configuration
 }
 
 func (m *DeviceManager) Initialize() error {
-	if cfg, err := config.NewConfiguration(); err != nil {
-		return err
-	} else {
-		m.cfg = cfg
-	}
 	if lg, err := logger.NewLogger(&m.cfg.LogOptions); err != nil {
 		return err
 	} else {
@@ -63,6 +87,9 @@ func (m *DeviceManager) Initialize() error {
 	if err := m.initializeCaches(); err != nil {
 		return err
 	}
+	if err := m.initializeNorthbound(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -71,17 +98,20 @@ func (m *DeviceManager) initializeOperations() error {
 	if err != nil {
 		return errors.Wrap(err, "fail to initialize the message bus")
 	}
+	m.mb = mb
 
 	mc, err := operations.NewManagerClient(mb, m.logger)
 	if err != nil {
 		return errors.Wrap(err, "fail to new an operations client")
 	}
-	m.mc = mc
+	m.mc = &instrumentedManagerClient{ManagerClient: mc}
 	ms, err := operations.NewManagerService(mb, m.logger)
 	if err != nil {
 		return errors.Wrap(err, "fail to new an operations service")
 	}
-	m.ms = ms
+	m.ms = &countedManagerService{ManagerService: ms}
+	m.hub = subscription.NewHub(m.ms)
+	m.webhooks = webhook.NewDispatcher(m.ctx, m.metaStore, m.hub, m.logger)
 
 	return nil
 }
@@ -92,32 +122,130 @@ func (m *DeviceManager) initializeCaches() error {
 	protocols := cache.New(driverExpiration, driverExpiration)
 	protocols.OnEvicted(m.unregisterDriver)
 	m.protocols = protocols
+	m.heartbeats = health.NewHeartbeats()
+	m.devices = health.NewDeviceStates()
 
 	return nil
 }
 
-func (m *DeviceManager) serve() chan error {
-	api.MountAllModules(m.protocols, m.metaStore, m.mc, m.ms)
-	errs := make(chan error)
-	go func() {
-		addr := fmt.Sprintf(":%d", m.cfg.ManagerOptions.HTTP.Port)
-		m.logger.Infof("the HTTP server's address is %s", addr)
-		if err := http.ListenAndServe(addr, restful.DefaultContainer); err != nil {
-			errs <- err
-		}
-	}()
+func (m *DeviceManager) serve() error {
+	m.sessions = new(sync.WaitGroup)
+	checker := &health.Checker{
+		MessageBus:    m.mb,
+		MetaStore:     m.metaStore,
+		ProtocolCache: m.protocols,
+		Heartbeats:    m.heartbeats,
+		Subscriptions: m.ms.Active,
+		Listening:     m.Ready,
+		Thresholds:    m.cfg.ManagerOptions.Health,
+	}
+	registry, err := metrics.NewRegistry(newFleetCollector(m))
+	if err != nil {
+		return errors.Wrap(err, "fail to register metrics")
+	}
+	api.MountAllModules(&api.Dependencies{
+		Context:         m.ctx,
+		Sessions:        m.sessions,
+		ProtocolCache:   m.protocols,
+		DeviceStates:    m.devices,
+		MetaStore:       m.metaStore,
+		OperationClient: m.mc,
+		Subscriptions:   m.hub,
+		Webhooks:        m.webhooks,
+		HealthChecker:   checker,
+		MetricsGatherer: registry,
+		SwaggerUIRoot:   m.cfg.ManagerOptions.Swagger.UIPath,
+	})
+
+	srv, err := newServer(restful.DefaultContainer, &m.cfg.ManagerOptions, m.logger)
+	if err != nil {
+		return errors.Wrap(err, "fail to initialize the HTTP server")
+	}
+	m.server = srv
+	if err = srv.Start(); err != nil {
+		return errors.Wrap(err, "fail to start the HTTP server")
+	}
 	return nil
 }
 
 func (m *DeviceManager) Serve() error {
-	go m.monitoringDrivers()
+	if err := m.monitoringDrivers(); err != nil {
+		return err
+	}
+	m.monitors.Add(1)
+	go func() {
+		defer m.monitors.Done()
+		m.webhooks.Run()
+	}()
+	m.startNorthbound()
+	if err := m.serve(); err != nil {
+		m.cancel()
+		m.monitors.Wait()
+		m.stopNorthbound()
+		return err
+	}
 
-	errs := m.serve()
+	var err error
 	select {
-	case err := <-errs:
-		panic(err)
+	case err = <-m.server.Errs():
+		m.logger.WithError(err).Errorf("the HTTP server stops unexpectedly, the device manager is shutting down")
+		m.cancel()
 	case <-m.ctx.Done():
-		os.Exit(1)
+		m.logger.Infof("the device manager is shutting down")
+	}
+	if e := m.shutdown(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Ready returns true once both the subscription of the message bus and all listeners are up.
+func (m *DeviceManager) Ready() bool {
+	return atomic.LoadInt32(&m.subscribed) == 1 && m.server != nil && m.server.Listening()
+}
+
+// shutdown stops accepting new requests, drains in-flight requests and WebSocket sessions
+// with a deadline, stops all subscriptions of the message bus and flushes the meta store.
+func (m *DeviceManager) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// WebSocket sessions watch m.ctx, so they are sending close frames concurrently
+	if err := m.server.Shutdown(ctx); err != nil {
+		m.logger.WithError(err).Errorf("fail to drain in-flight HTTP requests")
+	}
+	if !waitOrTimeout(ctx, m.sessions) {
+		m.logger.Errorf("fail to close all WebSocket sessions in %s", shutdownTimeout)
 	}
+	if !waitOrTimeout(ctx, &m.monitors) {
+		m.logger.Errorf("fail to stop all subscriptions of the message bus in %s", shutdownTimeout)
+	}
+	m.stopNorthbound()
+
+	// drivers are not told that the manager is going away, because the meta operations of edge-device-std
+	// have no such message, and they needn't be: drivers keep serving their devices, and their statuses are
+	// received again once the manager is back.
+	if err := m.metaStore.Close(); err != nil {
+		return errors.Wrap(err, "fail to flush the meta store")
+	}
+	if err := m.mb.Disconnect(); err != nil {
+		return errors.Wrap(err, "fail to disconnect from the message bus")
+	}
+	m.logger.Infof("the device manager has been shut down")
 	return nil
 }
+
+// waitOrTimeout waits for the WaitGroup, and returns false if the ctx is done before that.
+func waitOrTimeout(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
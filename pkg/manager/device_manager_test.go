@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"context"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	stdconfig "github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/logger"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T) *logger.Logger {
+	t.Helper()
+	lg, err := logger.NewLogger(&stdconfig.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lg
+}
+
+func unixClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+func TestWaitOrTimeout(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if waitOrTimeout(ctx, &wg) {
+		t.Error("the WaitGroup is not done, but waited")
+	}
+
+	wg.Done()
+	if !waitOrTimeout(context.Background(), &wg) {
+		t.Error("the WaitGroup is done, but not waited")
+	}
+}
+
+func TestShutdownDrainsInflightRequests(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "manager.sock")
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s, err := newServer(handler, &config.ManagerOptions{Unix: config.UnixOptions{Path: socket}}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := unixClient(socket).Get("http://manager/")
+		if err != nil {
+			t.Error(err)
+			statuses <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err = <-shutdown:
+		t.Fatalf("the server is shut down with the in-flight request, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s.Listening() {
+		t.Error("the server should stop listening once it is shutting down")
+	}
+
+	close(release)
+	if status := <-statuses; status != http.StatusNoContent {
+		t.Errorf("the in-flight request got %d, want %d", status, http.StatusNoContent)
+	}
+	if err = <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
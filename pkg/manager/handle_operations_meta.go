@@ -1,17 +1,30 @@
 package manager
 
 import (
-	"fmt"
 	"github.com/pkg/errors"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
 	"github.com/thingio/edge-device-std/models"
+	"sync/atomic"
 	"time"
 )
 
-func (m *DeviceManager) monitoringDrivers() {
+// monitoringDrivers subscribes to the statuses of drivers, and then handles them in the background.
+func (m *DeviceManager) monitoringDrivers() error {
 	bus, stop, err := m.ms.SubscribeDriverStatus()
 	if err != nil {
-		panic(errors.Wrap(err, "fail to subscribe to the statuses of drivers"))
+		return errors.Wrap(err, "fail to subscribe to the statuses of drivers")
 	}
+	atomic.StoreInt32(&m.subscribed, 1)
+
+	m.monitors.Add(1)
+	go m.handleDriverStatuses(bus, stop)
+	return nil
+}
+
+func (m *DeviceManager) handleDriverStatuses(bus <-chan interface{}, stop func()) {
+	defer m.monitors.Done()
 
 	for {
 		select {
@@ -26,7 +39,7 @@ func (m *DeviceManager) monitoringDrivers() {
 				break
 			}
 			if status.Hello {
-				if err = m.initDriver(protocol.ID); err != nil {
+				if err := m.initDriver(protocol.ID); err != nil {
 					m.logger.WithError(err).Errorf("fail to initialize the protocol driver[%s]", protocol.ID)
 					break
 				}
@@ -34,8 +47,10 @@ func (m *DeviceManager) monitoringDrivers() {
 
 			m.protocols.Set(protocol.ID, protocol,
 				time.Duration(status.HealthCheckIntervalSecond+1)*time.Second) // set or reset the cache
+			m.heartbeats.Beat(protocol.ID, time.Duration(status.HealthCheckIntervalSecond)*time.Second)
 			m.logger.Debugf("the protocol driver[%s]'s status now is %s", protocol.ID, status.State)
 		case <-m.ctx.Done():
+			atomic.StoreInt32(&m.subscribed, 0)
 			stop()
 			return
 		}
@@ -43,35 +58,27 @@ func (m *DeviceManager) monitoringDrivers() {
 }
 
 func (m *DeviceManager) initDriver(protocolID string) error {
-	products, err := m.metaStore.ListProducts(protocolID)
+	products, onlineDevices, err := metastore.DriverMetas(m.metaStore, protocolID)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("fail to get products for the protocol[%s]", protocolID))
+		return err
 	}
-	onlineDevices := make([]*models.Device, 0)
-	for _, product := range products {
-		devices, err := m.metaStore.ListDevices(product.ID)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("fail to get devices for the product[%s]", product.ID))
-		}
-		for _, device := range devices {
-			switch device.DeviceStatus {
-			case models.DeviceStateReconnecting, models.DeviceStateConnected:
-				onlineDevices = append(onlineDevices, device)
-			case models.DeviceStateException:
-				m.logger.Debugf("the device[%s] is disconnected for some exception, try to reconnect it")
-				onlineDevices = append(onlineDevices, device)
-			}
+	for _, device := range onlineDevices {
+		if device.DeviceStatus == models.DeviceStateException {
+			m.logger.Debugf("the device[%s] is disconnected for some exception, try to reconnect it", device.ID)
 		}
 	}
 	if err = m.mc.InitDriver(protocolID, products, onlineDevices); err != nil {
 		return err
 	}
 
+	m.monitors.Add(1)
 	go m.monitoringDevices(protocolID)
 	return nil
 }
 
 func (m *DeviceManager) monitoringDevices(protocolID string) {
+	defer m.monitors.Done()
+
 	bus, stop, err := m.ms.SubscribeDeviceStatus(protocolID)
 	if err != nil {
 		m.logger.WithError(err).Errorf("fail to subscribe to the statuses of devices for the driver[%s]", protocolID)
@@ -89,6 +96,11 @@ func (m *DeviceManager) monitoringDevices(protocolID string) {
 			}
 
 			device := status.Device
+			if previous, changed := m.devices.Set(device.ID, status.State, status.StateDetail); changed {
+				m.hub.Publish(subscription.Topic{DeviceID: device.ID, Kind: subscription.KindStatus},
+					&health.DeviceStateChange{DeviceID: device.ID, ProductID: device.ProductID, State: status.State,
+						Previous: previous.State, Detail: status.StateDetail, Time: time.Now()})
+			}
 			if device.DeviceStatus == status.State {
 				break
 			}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"context"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"testing"
+	"time"
+)
+
+// fakeStatusService hands out the bus of the statuses of devices reported by drivers.
+type fakeStatusService struct {
+	operations.ManagerService
+
+	bus chan interface{}
+}
+
+func (s *fakeStatusService) SubscribeDeviceStatus(protocolID string) (<-chan interface{}, func(), error) {
+	return s.bus, func() {}, nil
+}
+
+func TestMonitoringDevicesPublishesChanges(t *testing.T) {
+	store, err := metastore.NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateProduct(&models.Product{ID: "p1", Name: "P1", Protocol: "modbus"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateDevice(&models.Device{ID: "d1", Name: "D1", ProductID: "p1",
+		DeviceStatus: models.DeviceStateConnected}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service := &fakeStatusService{bus: make(chan interface{})}
+	m := &DeviceManager{
+		ms:        &countedManagerService{ManagerService: service},
+		devices:   health.NewDeviceStates(),
+		metaStore: store,
+		ctx:       ctx,
+		logger:    newTestLogger(t),
+	}
+	m.hub = subscription.NewHub(m.ms)
+	changes, stop, err := m.hub.Subscribe(subscription.Topic{DeviceID: subscription.AllDevices, Kind: subscription.KindStatus}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	m.monitors.Add(1)
+	go m.monitoringDevices("modbus")
+
+	report := func(state, detail string) {
+		device, err := store.GetDevice("d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.bus <- &models.DeviceStatus{Device: device, State: state, StateDetail: detail}
+	}
+	expect := func(state, previous, detail string) {
+		t.Helper()
+		select {
+		case data := <-changes:
+			change := data.(*health.DeviceStateChange)
+			if change.DeviceID != "d1" || change.ProductID != "p1" || change.State != state ||
+				change.Previous != previous || change.Detail != detail {
+				t.Errorf("the change = %+v, want %s from %q with %q", change, state, previous, detail)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the change to %s is not published", state)
+		}
+	}
+
+	report(models.DeviceStateException, "timeout")
+	expect(models.DeviceStateException, "", "timeout")
+	report(models.DeviceStateException, "timeout")
+	report(models.DeviceStateException, "CRC error") // a change of the detail alone is published as well
+	expect(models.DeviceStateException, models.DeviceStateException, "CRC error")
+	report(models.DeviceStateConnected, "")
+	expect(models.DeviceStateConnected, models.DeviceStateException, "")
+
+	cancel()
+	m.monitors.Wait()
+	select {
+	case data := <-changes:
+		t.Errorf("the unchanged status is published as %+v", data)
+	default:
+	}
+	if state, _ := m.devices.Get("d1"); state.State != models.DeviceStateConnected {
+		t.Errorf("the recorded state = %s, want %s", state.State, models.DeviceStateConnected)
+	}
+	if device, err := store.GetDevice("d1"); err != nil || device.DeviceStatus != models.DeviceStateConnected {
+		t.Errorf("the stored device = %+v and %v, want its status updated", device, err)
+	}
+	if n := m.ms.Active(); n != 0 {
+		t.Errorf("%d subscriptions are active, want 0", n)
+	}
+}
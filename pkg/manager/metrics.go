@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"time"
+)
+
+const (
+	operationInitDriver = "InitDriver"
+	operationRead       = "Read"
+	operationHardRead   = "HardRead"
+	operationWrite      = "Write"
+	operationCall       = "Call"
+)
+
+// instrumentedManagerClient observes the latency and errors of operations sent to drivers.
+type instrumentedManagerClient struct {
+	operations.ManagerClient
+}
+
+func (c *instrumentedManagerClient) InitDriver(protocolID string, products []*models.Product,
+	devices []*models.Device) (err error) {
+	defer metrics.ObserveOperation(protocolID, operationInitDriver, time.Now(), &err)
+	return c.ManagerClient.InitDriver(protocolID, products, devices)
+}
+
+func (c *instrumentedManagerClient) Read(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (props map[models.ProductPropertyID]*models.DeviceData, err error) {
+	defer metrics.ObserveOperation(protocolID, operationRead, time.Now(), &err)
+	return c.ManagerClient.Read(protocolID, productID, deviceID, propertyID)
+}
+
+func (c *instrumentedManagerClient) HardRead(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (props map[models.ProductPropertyID]*models.DeviceData, err error) {
+	defer metrics.ObserveOperation(protocolID, operationHardRead, time.Now(), &err)
+	return c.ManagerClient.HardRead(protocolID, productID, deviceID, propertyID)
+}
+
+func (c *instrumentedManagerClient) Write(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID, props map[models.ProductPropertyID]*models.DeviceData) (err error) {
+	defer metrics.ObserveOperation(protocolID, operationWrite, time.Now(), &err)
+	return c.ManagerClient.Write(protocolID, productID, deviceID, propertyID, props)
+}
+
+func (c *instrumentedManagerClient) Call(protocolID, productID, deviceID string, methodID models.ProductMethodID,
+	ins map[string]*models.DeviceData) (outs map[string]*models.DeviceData, err error) {
+	defer metrics.ObserveOperation(protocolID, operationCall, time.Now(), &err)
+	return c.ManagerClient.Call(protocolID, productID, deviceID, methodID, ins)
+}
+
+// fleetCollector collects the statuses of devices and drivers when being scraped.
+type fleetCollector struct {
+	m *DeviceManager
+
+	devices      *prometheus.Desc
+	heartbeatAge *prometheus.Desc
+}
+
+func newFleetCollector(m *DeviceManager) *fleetCollector {
+	return &fleetCollector{
+		m: m,
+		devices: prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", "devices"),
+			"The number of devices, partitioned by product and device status.",
+			[]string{"product", "status"}, nil),
+		heartbeatAge: prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "driver", "heartbeat_age_seconds"),
+			"The duration since the last heartbeat of each driver.",
+			[]string{"protocol"}, nil),
+	}
+}
+
+func (c *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.devices
+	ch <- c.heartbeatAge
+}
+
+// Collect counts the devices of all products, including the ones whose drivers have never sent heartbeats,
+// since the devices of the offline drivers are the ones worth watching.
+func (c *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, beat := range c.m.heartbeats.List() {
+		ch <- prometheus.MustNewConstMetric(c.heartbeatAge, prometheus.GaugeValue, beat.Age().Seconds(), beat.ProtocolID)
+	}
+
+	products, _, err := c.m.metaStore.SearchProducts(nil, nil)
+	if err != nil {
+		c.m.logger.WithError(err).Errorf("fail to collect products")
+		return
+	}
+	for _, product := range products {
+		devices, err := c.m.metaStore.ListDevices(product.ID)
+		if err != nil {
+			c.m.logger.WithError(err).Errorf("fail to collect devices for the product[%s]", product.ID)
+			continue
+		}
+		counts := make(map[models.State]int)
+		for _, device := range devices {
+			counts[device.DeviceStatus]++
+		}
+		for status, count := range counts {
+			ch <- prometheus.MustNewConstMetric(c.devices, prometheus.GaugeValue, float64(count), product.ID, status)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package manager
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-std/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFleetCollector(t *testing.T) {
+	store, err := metastore.NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateProduct(&models.Product{ID: "p1", Protocol: "modbus"}); err != nil {
+		t.Fatal(err)
+	}
+	for id, status := range map[string]string{
+		"d1": models.DeviceStateConnected,
+		"d2": models.DeviceStateConnected,
+		"d3": models.DeviceStateDisconnected,
+	} {
+		if err = store.CreateDevice(&models.Device{ID: id, ProductID: "p1", DeviceStatus: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &DeviceManager{metaStore: store, heartbeats: health.NewHeartbeats(), logger: newTestLogger(t)}
+	collector := newFleetCollector(m)
+
+	// the devices are counted even though the driver of the product has never sent heartbeats
+	expected := `
+# HELP edge_device_manager_devices The number of devices, partitioned by product and device status.
+# TYPE edge_device_manager_devices gauge
+edge_device_manager_devices{product="p1",status="connected"} 2
+edge_device_manager_devices{product="p1",status="disconnected"} 1
+`
+	if err = testutil.CollectAndCompare(collector, strings.NewReader(expected), "edge_device_manager_devices"); err != nil {
+		t.Error(err)
+	}
+
+	m.heartbeats.Beat("modbus", 10*time.Second)
+	if n := testutil.CollectAndCount(collector, "edge_device_manager_driver_heartbeat_age_seconds"); n != 1 {
+		t.Errorf("%d heartbeat ages are collected, want 1", n)
+	}
+}
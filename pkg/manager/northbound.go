@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thingio/edge-device-manager/pkg/northbound"
+)
+
+// initializeNorthbound connects to the northbound broker if it is configured.
+func (m *DeviceManager) initializeNorthbound() error {
+	opts := &m.cfg.ManagerOptions.Northbound
+	if !opts.Enabled() {
+		return nil
+	}
+	bridge, err := northbound.NewBridge(opts, m.logger)
+	if err != nil {
+		return errors.Wrap(err, "fail to initialize the northbound bridge")
+	}
+	m.bridge = bridge
+	if len(opts.Forward.Routes) != 0 {
+		forwarder, err := northbound.NewForwarder(m.ctx, bridge, m.hub, m.metaStore, &opts.Forward, m.logger)
+		if err != nil {
+			return errors.Wrap(err, "fail to initialize the northbound forwarder")
+		}
+		m.forwarder = forwarder
+	}
+	if opts.Commands.Enabled() {
+		commander, err := northbound.NewCommander(m.ctx, bridge, m.mc, m.metaStore, m.protocols,
+			m.devices, &opts.Commands, m.logger)
+		if err != nil {
+			return errors.Wrap(err, "fail to initialize the northbound commander")
+		}
+		m.commander = commander
+	}
+	if opts.Sparkplug.Enabled() {
+		edgeNode, err := northbound.NewEdgeNode(m.ctx, bridge, m.hub, m.metaStore, m.mc, m.protocols,
+			m.devices, opts.Commands.Allow, &opts.Sparkplug, m.logger)
+		if err != nil {
+			return errors.Wrap(err, "fail to initialize the Sparkplug edge node")
+		}
+		m.edgeNode = edgeNode
+	}
+	return nil
+}
+
+// startNorthbound connects to the northbound broker in the background, starts forwarding devices,
+// accepting commands and serving as a Sparkplug edge node.
+func (m *DeviceManager) startNorthbound() {
+	if m.bridge == nil {
+		return
+	}
+	m.bridge.Connect()
+	if m.forwarder != nil {
+		m.monitors.Add(1)
+		go func() {
+			defer m.monitors.Done()
+			m.forwarder.Run()
+		}()
+	}
+	if m.commander != nil {
+		m.monitors.Add(1)
+		go func() {
+			defer m.monitors.Done()
+			m.commander.Run()
+		}()
+	}
+	if m.edgeNode != nil {
+		m.monitors.Add(1)
+		go func() {
+			defer m.monitors.Done()
+			m.edgeNode.Run()
+		}()
+	}
+}
+
+// stopNorthbound disconnects from the northbound broker, it should be called after the forwarder,
+// the commander and the edge node stop.
+func (m *DeviceManager) stopNorthbound() {
+	if m.bridge != nil {
+		m.bridge.Disconnect()
+	}
+}
@@ -0,0 +1,168 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-std/logger"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	listenerTypeHTTP  = "HTTP"
+	listenerTypeHTTPS = "HTTPS"
+	listenerTypeUnix  = "Unix"
+)
+
+// listener describes an endpoint where the server accepts requests.
+type listener struct {
+	typ      string
+	network  string
+	address  string
+	certPath string
+	keyPath  string
+
+	server *http.Server
+	ln     net.Listener
+}
+
+func (l *listener) String() string {
+	return fmt.Sprintf("%s(%s)", l.typ, l.address)
+}
+
+// server manages the lifecycle of all listeners serving the same HTTP handler.
+type server struct {
+	listeners []*listener
+
+	errs      chan error
+	wg        sync.WaitGroup
+	listening int32
+	logger    *logger.Logger
+}
+
+func newServer(handler http.Handler, opts *config.ManagerOptions, lg *logger.Logger) (*server, error) {
+	listeners := make([]*listener, 0)
+	if opts.HTTP.Port != 0 {
+		listeners = append(listeners, &listener{
+			typ:     listenerTypeHTTP,
+			network: "tcp",
+			address: fmt.Sprintf(":%d", opts.HTTP.Port),
+		})
+	}
+	if opts.HTTPS.Port != 0 {
+		if opts.HTTPS.CertPath == "" || opts.HTTPS.KeyPath == "" {
+			return nil, errors.New("the certificate and the key are required by the HTTPS listener")
+		}
+		listeners = append(listeners, &listener{
+			typ:      listenerTypeHTTPS,
+			network:  "tcp",
+			address:  fmt.Sprintf(":%d", opts.HTTPS.Port),
+			certPath: opts.HTTPS.CertPath,
+			keyPath:  opts.HTTPS.KeyPath,
+		})
+	}
+	if opts.Unix.Path != "" {
+		listeners = append(listeners, &listener{
+			typ:     listenerTypeUnix,
+			network: "unix",
+			address: opts.Unix.Path,
+		})
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("at least one listener of HTTP, HTTPS or Unix socket is required")
+	}
+
+	for _, l := range listeners {
+		l.server = &http.Server{Handler: handler}
+	}
+	return &server{
+		listeners: listeners,
+		errs:      make(chan error, len(listeners)),
+		logger:    lg,
+	}, nil
+}
+
+// Start binds all listeners synchronously, so an error such as port-in-use will be returned directly,
+// and then serves requests in the background. Errors occurred during serving are reported by Errs.
+func (s *server) Start() error {
+	for _, l := range s.listeners {
+		if l.typ == listenerTypeUnix {
+			// remove the socket file left by the last process which is not shut down gracefully
+			if err := os.Remove(l.address); err != nil && !os.IsNotExist(err) {
+				s.close()
+				return errors.Wrapf(err, "fail to remove the stale socket %s", l.address)
+			}
+		}
+		ln, err := net.Listen(l.network, l.address)
+		if err != nil {
+			s.close()
+			return errors.Wrapf(err, "fail to listen on %s", l)
+		}
+		l.ln = ln
+	}
+
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go func(l *listener) {
+			defer s.wg.Done()
+
+			s.logger.Infof("the %s server's address is %s", l.typ, l.address)
+			var err error
+			if l.typ == listenerTypeHTTPS {
+				err = l.server.ServeTLS(l.ln, l.certPath, l.keyPath)
+			} else {
+				err = l.server.Serve(l.ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				s.errs <- errors.Wrapf(err, "fail to serve on %s", l)
+			}
+		}(l)
+	}
+	atomic.StoreInt32(&s.listening, 1)
+	return nil
+}
+
+// Errs returns a channel reporting errors which stop any listener unexpectedly.
+func (s *server) Errs() <-chan error {
+	return s.errs
+}
+
+// Listening returns true if all listeners are accepting requests.
+func (s *server) Listening() bool {
+	return atomic.LoadInt32(&s.listening) == 1
+}
+
+// Shutdown stops accepting new requests and waits for in-flight requests until the ctx is done.
+func (s *server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.listening, 0)
+
+	var errs []error
+	for _, l := range s.listeners {
+		if l.ln == nil {
+			continue
+		}
+		if err := l.server.Shutdown(ctx); err != nil {
+			errs = append(errs, errors.Wrapf(err, "fail to shut down %s", l))
+		}
+	}
+	s.wg.Wait()
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// close closes all bound listeners directly, it is only used when the server fails to start.
+func (s *server) close() {
+	for _, l := range s.listeners {
+		if l.ln != nil {
+			_ = l.ln.Close()
+			l.ln = nil
+		}
+	}
+}
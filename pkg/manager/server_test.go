@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"context"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewServerValidatesListeners(t *testing.T) {
+	lg := newTestLogger(t)
+	for _, opts := range []*config.ManagerOptions{
+		{},
+		{HTTPS: config.HTTPSOptions{Port: 8443}},
+	} {
+		if _, err := newServer(http.NotFoundHandler(), opts, lg); err == nil {
+			t.Errorf("%+v: the server is created, want an error", opts)
+		}
+	}
+}
+
+func TestServerStartReportsBindErrors(t *testing.T) {
+	occupied, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+	port := occupied.Addr().(*net.TCPAddr).Port
+
+	socket := filepath.Join(t.TempDir(), "manager.sock")
+	s, err := newServer(http.NotFoundHandler(), &config.ManagerOptions{
+		HTTP: config.HTTPOptions{Port: port},
+		Unix: config.UnixOptions{Path: socket},
+	}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err == nil {
+		t.Fatal("the server is started on an occupied port, want an error")
+	}
+	if s.Listening() {
+		t.Error("the server should not be listening")
+	}
+}
+
+func TestServerRemovesStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "manager.sock")
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	s, err := newServer(handler, &config.ManagerOptions{Unix: config.UnixOptions{Path: socket}}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = s.Shutdown(context.Background())
+	}()
+	if !s.Listening() {
+		t.Error("the server should be listening")
+	}
+
+	resp, err := unixClient(socket).Get("http://manager/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("body = %q, want ok", body)
+	}
+}
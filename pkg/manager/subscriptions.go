@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"sync"
+	"sync/atomic"
+)
+
+// countedManagerService counts the active subscriptions of the message bus.
+type countedManagerService struct {
+	operations.ManagerService
+
+	active int64
+}
+
+func (s *countedManagerService) SubscribeDriverStatus() (<-chan interface{}, func(), error) {
+	return s.count(s.ManagerService.SubscribeDriverStatus())
+}
+
+func (s *countedManagerService) SubscribeDeviceStatus(protocolID string) (<-chan interface{}, func(), error) {
+	return s.count(s.ManagerService.SubscribeDeviceStatus(protocolID))
+}
+
+func (s *countedManagerService) SubscribeDeviceProps(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (<-chan interface{}, func(), error) {
+	return s.count(s.ManagerService.SubscribeDeviceProps(protocolID, productID, deviceID, propertyID))
+}
+
+func (s *countedManagerService) SubscribeDeviceEvent(protocolID, productID, deviceID string,
+	eventID models.ProductEventID) (<-chan interface{}, func(), error) {
+	return s.count(s.ManagerService.SubscribeDeviceEvent(protocolID, productID, deviceID, eventID))
+}
+
+// Active returns the number of subscriptions which are not stopped yet.
+func (s *countedManagerService) Active() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+func (s *countedManagerService) count(bus <-chan interface{}, stop func(), err error) (<-chan interface{}, func(), error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	atomic.AddInt64(&s.active, 1)
+
+	var once sync.Once // stopping twice will close the bus twice
+	return bus, func() {
+		once.Do(func() {
+			atomic.AddInt64(&s.active, -1)
+			stop()
+		})
+	}, nil
+}
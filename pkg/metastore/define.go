@@ -1,21 +1,77 @@
 package metastore
 
 import (
+	"errors"
+	"fmt"
+	"github.com/thingio/edge-device-manager/pkg/config"
 	"github.com/thingio/edge-device-std/models"
 )
 
+func NewMetaStore(opts *config.MetaStoreOptions) (MetaStore, error) {
+	switch opts.Backend {
+	case config.MetaStoreBackendFile:
+		return NewFileMetaStore(opts.Path)
+	default:
+		return nil, fmt.Errorf("unsupported meta store backend: %s", opts.Backend)
+	}
+}
+
+var (
+	// ErrNotFound is returned if the meta to get, update or delete doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned if the meta to create already exists.
+	ErrConflict = errors.New("already exists")
+)
+
+// MetaStore stores products, devices, groups and webhooks, the errors returned wrap ErrNotFound or ErrConflict
+// if the meta doesn't exist or already exists.
 type MetaStore interface {
 	ListProducts(protocolID string) ([]*models.Product, error)
-	// CreateProduct doesn't verify the duplication of the product, so it's up to the upper business.
+	// PageProducts lists products sorted and paged by the opts, and returns the continue token of the next page,
+	// the token will be empty if there are no more products.
+	PageProducts(protocolID string, opts *ListOptions) (products []*models.Product, next string, err error)
+	// SearchProducts is the same as PageProducts, but lists products matching the query across all protocols.
+	SearchProducts(query *Query, opts *ListOptions) (products []*models.Product, next string, err error)
+	// CreateProduct returns ErrConflict if the product already exists.
 	CreateProduct(product *models.Product) error
 	DeleteProduct(productID string) error
 	UpdateProduct(product *models.Product) error
 	GetProduct(productID string) (*models.Product, error)
+	GetProductLabels(productID string) (*Labels, error)
+	// UpdateProductLabels replaces all labels and tags of the product.
+	UpdateProductLabels(productID string, labels *Labels) error
 
 	ListDevices(productID string) ([]*models.Device, error)
-	// CreateDevice doesn't verify the duplication of the device, so it's up to the upper business.
+	// PageDevices lists devices sorted and paged by the opts, and returns the continue token of the next page,
+	// the token will be empty if there are no more devices.
+	PageDevices(productID string, opts *ListOptions) (devices []*models.Device, next string, err error)
+	// SearchDevices is the same as PageDevices, but lists devices matching the query across all products.
+	SearchDevices(query *Query, opts *ListOptions) (devices []*models.Device, next string, err error)
+	// CreateDevice returns ErrConflict if the device already exists.
 	CreateDevice(device *models.Device) error
 	DeleteDevice(deviceID string) error
 	UpdateDevice(device *models.Device) error
 	GetDevice(deviceID string) (*models.Device, error)
+	GetDeviceLabels(deviceID string) (*Labels, error)
+	// UpdateDeviceLabels replaces all labels and tags of the device.
+	UpdateDeviceLabels(deviceID string, labels *Labels) error
+
+	ListGroups() ([]*Group, error)
+	// CreateGroup returns ErrConflict if the group already exists.
+	CreateGroup(group *Group) error
+	DeleteGroup(groupID string) error
+	UpdateGroup(group *Group) error
+	GetGroup(groupID string) (*Group, error)
+
+	ListWebhooks() ([]*Webhook, error)
+	// CreateWebhook returns ErrConflict if the webhook already exists.
+	CreateWebhook(webhook *Webhook) error
+	DeleteWebhook(webhookID string) error
+	UpdateWebhook(webhook *Webhook) error
+	GetWebhook(webhookID string) (*Webhook, error)
+
+	// HealthCheck verifies whether the meta store is readable and writable.
+	HealthCheck() error
+	// Close flushes all pending changes into the underlying storage and releases its resources.
+	Close() error
 }
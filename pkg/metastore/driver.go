@@ -0,0 +1,30 @@
+package metastore
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+)
+
+// DriverMetas returns the products of the protocol and the devices the driver of the protocol should connect,
+// i.e. the devices which are reconnecting, connected or disconnected for some exception,
+// they are what the driver is initialized with.
+func DriverMetas(store MetaStore, protocolID string) ([]*models.Product, []*models.Device, error) {
+	products, err := store.ListProducts(protocolID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to get products for the protocol[%s]: %w", protocolID, err)
+	}
+	onlineDevices := make([]*models.Device, 0)
+	for _, product := range products {
+		devices, err := store.ListDevices(product.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to get devices for the product[%s]: %w", product.ID, err)
+		}
+		for _, device := range devices {
+			switch device.DeviceStatus {
+			case models.DeviceStateReconnecting, models.DeviceStateConnected, models.DeviceStateException:
+				onlineDevices = append(onlineDevices, device)
+			}
+		}
+	}
+	return products, onlineDevices, nil
+}
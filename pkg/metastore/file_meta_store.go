@@ -2,6 +2,7 @@ package metastore
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/thingio/edge-device-std/models"
 	"gopkg.in/yaml.v2"
@@ -9,24 +10,30 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	DefaultFileMetaStorePath = "etc/resources"
 	productsPath             = "products"
 	devicesPath              = "devices"
+	groupsPath               = "groups"
+	webhooksPath             = "webhooks"
 
 	fileMode os.FileMode = 0664 // not 0x664
+	dirMode  os.FileMode = 0775
 )
 
 func NewFileMetaStore(root string) (MetaStore, error) {
-	if _, err := os.Open(root); err != nil {
-		if os.IsNotExist(err) {
-			if err = os.MkdirAll(root, fileMode); err != nil {
-				return nil, fmt.Errorf("try to create meta store %s, got %s", root, err.Error())
-			}
-		} else {
-			return nil, fmt.Errorf("invalid path: %s, because %s", root, err.Error())
+	if _, err := os.Stat(root); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("invalid path: %s, because %s", root, err.Error())
+	}
+	for _, dir := range []string{productsPath, devicesPath, groupsPath, webhooksPath} {
+		if err := os.MkdirAll(filepath.Join(root, dir), dirMode); err != nil {
+			return nil, fmt.Errorf("try to create meta store %s, got %s", root, err.Error())
 		}
 	}
 	return &fileMetaStore{
@@ -34,7 +41,10 @@ func NewFileMetaStore(root string) (MetaStore, error) {
 	}, nil
 }
 
+// fileMetaStore stores each meta in a JSON file, the mutex serializes the read-modify-write of files,
+// e.g. updating the status and the labels of a device at the same time, and keeps readers from partial files.
 type fileMetaStore struct {
+	mu   sync.RWMutex
 	root string
 }
 
@@ -52,7 +62,7 @@ func (s *fileMetaStore) loadProducts(root string, protocolID string) ([]*models.
 			return nil
 		}
 		var product *models.Product
-		product, err = loadProduct(path)
+		product, err = s.loadProduct(path)
 		if err != nil {
 			return err
 		}
@@ -66,31 +76,99 @@ func (s *fileMetaStore) loadProducts(root string, protocolID string) ([]*models.
 	}
 	return products, nil
 }
+func (s *fileMetaStore) PageProducts(protocolID string, opts *ListOptions) ([]*models.Product, string, error) {
+	return s.SearchProducts(new(Query).And(FieldProtocol, OperatorEqual, protocolID), opts)
+}
+func (s *fileMetaStore) SearchProducts(query *Query, opts *ListOptions) ([]*models.Product, string, error) {
+	if query == nil {
+		query = new(Query)
+	}
+	if err := query.Validate(ProductFields...); err != nil {
+		return nil, "", err
+	}
+
+	products := make([]*models.Product, 0)
+	entries := make([]*entry, 0)
+	if err := filepath.Walk(filepath.Join(s.root, productsPath), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		product, md := new(models.Product), new(metadata)
+		if err = s.read(path, product, md); err != nil {
+			return err
+		}
+		if !query.Match(productField(product), &md.Labels) {
+			return nil
+		}
+		products = append(products, product)
+		entries = append(entries, &entry{id: product.ID, name: product.Name, created: md.CreatedAt})
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+
+	indexes, next, err := page(entries, opts, SortByID, SortByName, SortByCreated)
+	if err != nil {
+		return nil, "", err
+	}
+	paged := make([]*models.Product, len(indexes))
+	for i, index := range indexes {
+		paged[i] = products[index]
+	}
+	return paged, next, nil
+}
+func productField(product *models.Product) func(field string) string {
+	return func(field string) string {
+		switch field {
+		case FieldID:
+			return product.ID
+		case FieldName:
+			return product.Name
+		case FieldProtocol:
+			return product.Protocol
+		default:
+			return ""
+		}
+	}
+}
 func (s *fileMetaStore) GetProduct(productID string) (*models.Product, error) {
 	path := filepath.Join(s.root, productsPath, fmt.Sprintf("%s.json", productID))
-	return loadProduct(path)
+	return s.loadProduct(path)
 }
-func loadProduct(path string) (*models.Product, error) {
+func (s *fileMetaStore) loadProduct(path string) (*models.Product, error) {
 	product := new(models.Product)
-	if err := load(path, product); err != nil {
+	if err := s.read(path, product); err != nil {
 		return nil, err
 	}
 	return product, nil
 }
 
+func (s *fileMetaStore) GetProductLabels(productID string) (*Labels, error) {
+	path := filepath.Join(s.root, productsPath, fmt.Sprintf("%s.json", productID))
+	return s.loadLabels(path, new(models.Product))
+}
+
+func (s *fileMetaStore) UpdateProductLabels(productID string, labels *Labels) error {
+	path := filepath.Join(s.root, productsPath, fmt.Sprintf("%s.json", productID))
+	return s.updateLabels(path, new(models.Product), labels)
+}
+
 func (s *fileMetaStore) CreateProduct(product *models.Product) error {
 	path := filepath.Join(s.root, productsPath, fmt.Sprintf("%s.json", product.ID))
-	return save(path, product)
+	return s.save(path, product)
 }
 
 func (s *fileMetaStore) DeleteProduct(productID string) error {
 	path := filepath.Join(s.root, productsPath, fmt.Sprintf("%s.json", productID))
-	return remove(path)
+	return s.remove(path)
 }
 
 func (s *fileMetaStore) UpdateProduct(product *models.Product) error {
 	path := filepath.Join(s.root, productsPath, fmt.Sprintf("%s.json", product.ID))
-	return update(path, product)
+	return s.update(path, product)
 }
 
 func (s *fileMetaStore) ListDevices(productID string) ([]*models.Device, error) {
@@ -107,7 +185,7 @@ func (s *fileMetaStore) loadDevices(root string, productID string) ([]*models.De
 			return nil
 		}
 		var device *models.Device
-		device, err = loadDevice(path)
+		device, err = s.loadDevice(path)
 		if err != nil {
 			return err
 		}
@@ -121,56 +199,360 @@ func (s *fileMetaStore) loadDevices(root string, productID string) ([]*models.De
 	}
 	return devices, nil
 }
+func (s *fileMetaStore) PageDevices(productID string, opts *ListOptions) ([]*models.Device, string, error) {
+	return s.SearchDevices(new(Query).And(FieldProduct, OperatorEqual, productID), opts)
+}
+func (s *fileMetaStore) SearchDevices(query *Query, opts *ListOptions) ([]*models.Device, string, error) {
+	if query == nil {
+		query = new(Query)
+	}
+	if err := query.Validate(DeviceFields...); err != nil {
+		return nil, "", err
+	}
+	protocols := make(map[string]string) // product ID -> protocol ID
+	if query.Uses(FieldProtocol) {
+		products, _, err := s.SearchProducts(nil, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, product := range products {
+			protocols[product.ID] = product.Protocol
+		}
+	}
+
+	devices := make([]*models.Device, 0)
+	entries := make([]*entry, 0)
+	if err := filepath.Walk(filepath.Join(s.root, devicesPath), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		device, md := new(models.Device), new(metadata)
+		if err = s.read(path, device, md); err != nil {
+			return err
+		}
+		if !query.Match(deviceField(device, protocols), &md.Labels) {
+			return nil
+		}
+		devices = append(devices, device)
+		entries = append(entries, &entry{id: device.ID, name: device.Name, status: device.DeviceStatus, created: md.CreatedAt})
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+
+	indexes, next, err := page(entries, opts, SortByID, SortByName, SortByStatus, SortByCreated)
+	if err != nil {
+		return nil, "", err
+	}
+	paged := make([]*models.Device, len(indexes))
+	for i, index := range indexes {
+		paged[i] = devices[index]
+	}
+	return paged, next, nil
+}
+func deviceField(device *models.Device, protocols map[string]string) func(field string) string {
+	return func(field string) string {
+		switch field {
+		case FieldID:
+			return device.ID
+		case FieldName:
+			return device.Name
+		case FieldStatus:
+			return device.DeviceStatus
+		case FieldCategory:
+			return device.Category
+		case FieldProduct:
+			return device.ProductID
+		case FieldProtocol:
+			return protocols[device.ProductID]
+		default:
+			return ""
+		}
+	}
+}
 func (s *fileMetaStore) GetDevice(deviceID string) (*models.Device, error) {
 	path := filepath.Join(s.root, devicesPath, fmt.Sprintf("%s.json", deviceID))
-	return loadDevice(path)
+	return s.loadDevice(path)
 }
-func loadDevice(path string) (*models.Device, error) {
+func (s *fileMetaStore) loadDevice(path string) (*models.Device, error) {
 	device := new(models.Device)
-	if err := load(path, device); err != nil {
+	if err := s.read(path, device); err != nil {
 		return nil, err
 	}
 	return device, nil
 }
 
+func (s *fileMetaStore) GetDeviceLabels(deviceID string) (*Labels, error) {
+	path := filepath.Join(s.root, devicesPath, fmt.Sprintf("%s.json", deviceID))
+	return s.loadLabels(path, new(models.Device))
+}
+
+func (s *fileMetaStore) UpdateDeviceLabels(deviceID string, labels *Labels) error {
+	path := filepath.Join(s.root, devicesPath, fmt.Sprintf("%s.json", deviceID))
+	return s.updateLabels(path, new(models.Device), labels)
+}
+
 func (s *fileMetaStore) CreateDevice(device *models.Device) error {
 	path := filepath.Join(s.root, devicesPath, fmt.Sprintf("%s.json", device.ID))
-	return save(path, device)
+	return s.save(path, device)
 }
 
 func (s *fileMetaStore) UpdateDevice(device *models.Device) error {
 	path := filepath.Join(s.root, devicesPath, fmt.Sprintf("%s.json", device.ID))
-	return update(path, device)
+	return s.update(path, device)
 }
 
 func (s *fileMetaStore) DeleteDevice(deviceID string) error {
 	path := filepath.Join(s.root, devicesPath, fmt.Sprintf("%s.json", deviceID))
-	return remove(path)
+	return s.remove(path)
+}
+
+func (s *fileMetaStore) ListGroups() ([]*Group, error) {
+	groups := make([]*Group, 0)
+	if err := filepath.Walk(filepath.Join(s.root, groupsPath), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		group := new(Group)
+		if err = s.read(path, group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+	return groups, nil
+}
+
+func (s *fileMetaStore) GetGroup(groupID string) (*Group, error) {
+	path := filepath.Join(s.root, groupsPath, fmt.Sprintf("%s.json", groupID))
+	group := new(Group)
+	if err := s.read(path, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (s *fileMetaStore) CreateGroup(group *Group) error {
+	path := filepath.Join(s.root, groupsPath, fmt.Sprintf("%s.json", group.ID))
+	return s.save(path, group)
+}
+
+func (s *fileMetaStore) UpdateGroup(group *Group) error {
+	path := filepath.Join(s.root, groupsPath, fmt.Sprintf("%s.json", group.ID))
+	return s.update(path, group)
+}
+
+func (s *fileMetaStore) DeleteGroup(groupID string) error {
+	path := filepath.Join(s.root, groupsPath, fmt.Sprintf("%s.json", groupID))
+	return s.remove(path)
+}
+
+func (s *fileMetaStore) ListWebhooks() ([]*Webhook, error) {
+	webhooks := make([]*Webhook, 0)
+	if err := filepath.Walk(filepath.Join(s.root, webhooksPath), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		webhook := new(Webhook)
+		if err = s.read(path, webhook); err != nil {
+			return err
+		}
+		webhooks = append(webhooks, webhook)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks, nil
+}
+
+func (s *fileMetaStore) GetWebhook(webhookID string) (*Webhook, error) {
+	path := filepath.Join(s.root, webhooksPath, fmt.Sprintf("%s.json", webhookID))
+	webhook := new(Webhook)
+	if err := s.read(path, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *fileMetaStore) CreateWebhook(webhook *Webhook) error {
+	path := filepath.Join(s.root, webhooksPath, fmt.Sprintf("%s.json", webhook.ID))
+	return s.save(path, webhook)
+}
+
+func (s *fileMetaStore) UpdateWebhook(webhook *Webhook) error {
+	path := filepath.Join(s.root, webhooksPath, fmt.Sprintf("%s.json", webhook.ID))
+	return s.update(path, webhook)
+}
+
+func (s *fileMetaStore) DeleteWebhook(webhookID string) error {
+	path := filepath.Join(s.root, webhooksPath, fmt.Sprintf("%s.json", webhookID))
+	return s.remove(path)
 }
 
-func save(path string, meta interface{}) error {
-	data, err := json.Marshal(meta)
+// HealthCheck writes a probe file into the root, and then reads and removes it.
+func (s *fileMetaStore) HealthCheck() error {
+	probe, err := ioutil.TempFile(s.root, ".health-*")
+	if err != nil {
+		return fmt.Errorf("the meta store %s is not writable, got %s", s.root, err.Error())
+	}
+	path := probe.Name()
+	defer func() {
+		_ = os.Remove(path)
+	}()
+	data := []byte(probe.Name())
+	_, err = probe.Write(data)
+	if e := probe.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("the meta store %s is not writable, got %s", s.root, err.Error())
+	}
+
+	if read, err := ioutil.ReadFile(path); err != nil {
+		return fmt.Errorf("the meta store %s is not readable, got %s", s.root, err.Error())
+	} else if string(read) != string(data) {
+		return fmt.Errorf("the meta store %s is corrupted, the probe file is not read as written", s.root)
+	}
+	return nil
+}
+
+// Close does nothing, because every change is written into the file synchronously.
+func (s *fileMetaStore) Close() error {
+	return nil
+}
+
+// metadata is stored along with the meta in the same file, but it is invisible to the meta.
+type metadata struct {
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+	Labels    `yaml:",inline"`
+}
+
+func (s *fileMetaStore) save(path string, meta interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%w: %s", ErrConflict, metaName(path))
+	}
+	data, err := marshal(meta, &metadata{CreatedAt: time.Now()})
 	if err != nil {
 		return fmt.Errorf("fail to marshal the meta configuration, got %s", err.Error())
 	}
 	return ioutil.WriteFile(path, data, fileMode)
 }
 
-func remove(path string) error {
-	return os.Remove(path)
+func (s *fileMetaStore) remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, metaName(path))
+		}
+		return err
+	}
+	return nil
 }
 
-func update(path string, meta interface{}) error {
-	data, err := json.Marshal(meta)
+func (s *fileMetaStore) update(path string, meta interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	md := new(metadata)
+	if err := load(path, md); errors.Is(err, ErrNotFound) {
+		return err
+	} else if err != nil || md.CreatedAt.IsZero() {
+		md.CreatedAt = time.Now()
+	}
+	data, err := marshal(meta, md)
 	if err != nil {
 		return err
 	}
 	return ioutil.WriteFile(path, data, fileMode)
 }
 
-func load(path string, meta interface{}) error {
+// loadLabels loads the labels of the meta stored in the path, the meta is used to verify the file only.
+func (s *fileMetaStore) loadLabels(path string, meta interface{}) (*Labels, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	md := new(metadata)
+	if err := load(path, meta, md); err != nil {
+		return nil, err
+	}
+	return &md.Labels, nil
+}
+
+// updateLabels replaces the labels of the meta stored in the path, and keeps the meta unchanged.
+func (s *fileMetaStore) updateLabels(path string, meta interface{}, labels *Labels) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	md := new(metadata)
+	if err := load(path, meta, md); err != nil {
+		return err
+	}
+	md.Labels = *labels
+	data, err := marshal(meta, md)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, fileMode)
+}
+
+// marshal merges fields of the meta and its metadata into one JSON object.
+func marshal(meta interface{}, md *metadata) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	for _, v := range []interface{}{meta, md} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// metaName names the meta stored in the path without leaking the root, e.g. devices/pump-01.
+func metaName(path string) string {
+	name := filepath.Base(path)
+	return filepath.Base(filepath.Dir(path)) + "/" + strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// read is the same as load, but waits for the file being written.
+func (s *fileMetaStore) read(path string, metas ...interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return load(path, metas...)
+}
+
+// load unmarshals the file into all metas, it is used to load the meta and its metadata at the same time.
+func load(path string, metas ...interface{}) error {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, metaName(path))
+		}
 		return fmt.Errorf("fail to load the meta configurtion stored in %s, got %s",
 			path, err.Error())
 	}
@@ -185,8 +567,10 @@ func load(path string, meta interface{}) error {
 		return fmt.Errorf("invalid meta config extension %s, only supporting: json / yaml / yml", ext)
 	}
 
-	if err := unmarshaller(data, meta); err != nil {
-		return fmt.Errorf("fail to unmarshal the device config, got %s", err.Error())
+	for _, meta := range metas {
+		if err := unmarshaller(data, meta); err != nil {
+			return fmt.Errorf("fail to unmarshal the device config, got %s", err.Error())
+		}
 	}
 	return nil
 }
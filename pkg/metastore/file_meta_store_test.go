@@ -0,0 +1,109 @@
+package metastore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"sync"
+	"testing"
+)
+
+func newTestStore(t *testing.T) MetaStore {
+	t.Helper()
+	store, err := NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFileMetaStoreDevice(t *testing.T) {
+	store := newTestStore(t)
+	device := &models.Device{ID: "d1", Name: "pump", ProductID: "p1", DeviceStatus: models.DeviceStateDisconnected}
+	if err := store.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateDevice(device); !errors.Is(err, ErrConflict) {
+		t.Errorf("creating twice got %v, want %v", err, ErrConflict)
+	}
+	if err := store.UpdateDeviceLabels("d1", &Labels{Labels: map[string]string{"site": "a"}, Tags: []string{"critical"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// updating the device keeps its labels
+	device.DeviceStatus = models.DeviceStateConnected
+	if err := store.UpdateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetDevice("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeviceStatus != models.DeviceStateConnected {
+		t.Errorf("status = %s, want %s", got.DeviceStatus, models.DeviceStateConnected)
+	}
+	labels, err := store.GetDeviceLabels("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels.Labels["site"] != "a" || !labels.HasTags("critical") {
+		t.Errorf("labels = %+v, want them kept", labels)
+	}
+
+	if err = store.DeleteDevice("d1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err = range []error{
+		store.DeleteDevice("d1"),
+		store.UpdateDevice(device),
+		store.UpdateDeviceLabels("d1", new(Labels)),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("operating the deleted device got %v, want %v", err, ErrNotFound)
+		}
+	}
+}
+
+func TestFileMetaStoreConcurrentUpdates(t *testing.T) {
+	store := newTestStore(t)
+	device := &models.Device{ID: "d1", ProductID: "p1", DeviceStatus: models.DeviceStateConnected}
+	if err := store.CreateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*n)
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			errs <- store.UpdateDevice(&models.Device{ID: "d1", ProductID: "p1", DeviceStatus: models.DeviceStateConnected})
+		}()
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.UpdateDeviceLabels("d1", &Labels{Labels: map[string]string{"seq": fmt.Sprint(i)}})
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := store.GetDevice("d1")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the labels written last are never lost by the concurrent updates of the device
+	labels, err := store.GetDeviceLabels("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := labels.Labels["seq"]; !ok {
+		t.Errorf("labels = %+v, want the label written by the last update", labels)
+	}
+}
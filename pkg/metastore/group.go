@@ -0,0 +1,54 @@
+package metastore
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidGroup = errors.New("invalid group")
+)
+
+// Group organizes devices into a tree of assets, e.g. site -> building -> line -> device.
+// A device is a member of the group if it is listed in Devices statically,
+// or its labels satisfy the Selector dynamically.
+type Group struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Desc     string `json:"desc"`
+	Kind     string `json:"kind"`                // e.g. site, building, area or line, only for display
+	ParentID string `json:"parent_id,omitempty"` // the group is a root if it is empty
+
+	Devices  []string `json:"devices,omitempty"`  // IDs of static members
+	Selector string   `json:"selector,omitempty"` // the label selector of dynamic members
+}
+
+// Validate verifies the group itself, it doesn't verify whether its parent and members exist.
+func (g *Group) Validate() error {
+	if g.ID == "" {
+		return fmt.Errorf("%w: the group's ID is required", ErrInvalidGroup)
+	}
+	if g.ParentID == g.ID {
+		return fmt.Errorf("%w: the group[%s] could not be the parent of itself", ErrInvalidGroup, g.ID)
+	}
+	if _, err := ParseSelector(g.Selector); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidGroup, err.Error())
+	}
+	devices := make([]string, 0, len(g.Devices))
+	for _, device := range g.Devices {
+		if !contains(devices, device) {
+			devices = append(devices, device)
+		}
+	}
+	g.Devices = devices
+	return nil
+}
+
+// MemberQuery returns the query of dynamic members, it returns nil if the group has no dynamic members.
+func (g *Group) MemberQuery() *Query {
+	selector, err := ParseSelector(g.Selector)
+	if err != nil || selector.Empty() {
+		return nil
+	}
+	return new(Query).WithLabels(selector)
+}
@@ -0,0 +1,230 @@
+package metastore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	SelectorOperatorEqual        = "="
+	SelectorOperatorDoubleEqual  = "=="
+	SelectorOperatorNotEqual     = "!="
+	SelectorOperatorIn           = "in"
+	SelectorOperatorNotIn        = "notin"
+	SelectorOperatorExists       = "exists"
+	SelectorOperatorDoesNotExist = "!"
+
+	requirementSeparator = ","
+	tagsSeparator        = ","
+)
+
+var (
+	ErrInvalidLabels   = errors.New("invalid labels")
+	ErrInvalidSelector = errors.New("invalid label selector")
+
+	labelKeyPattern   = regexp.MustCompile(`^([a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?/)?[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?)?$`)
+	tagPattern        = regexp.MustCompile(`^[^,\s]+$`)
+)
+
+// Labels are key/value pairs and free-form tags attached to a product or a device, they are understood
+// by the manager only and never sent to drivers, e.g. {"site": "shanghai", "line": "l3"} and ["critical"].
+type Labels struct {
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Tags   []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// Validate verifies the format of labels and tags, and then removes duplicated tags.
+func (l *Labels) Validate() error {
+	for key, value := range l.Labels {
+		if len(key) > 253 || !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("%w: the key '%s' should consist of alphanumerics, '-', '_' or '.', "+
+				"and could be prefixed by a domain and '/'", ErrInvalidLabels, key)
+		}
+		if len(value) > 63 || !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("%w: the value '%s' of the key '%s' should consist of alphanumerics, '-', '_' or '.'",
+				ErrInvalidLabels, value, key)
+		}
+	}
+	tags := make([]string, 0, len(l.Tags))
+	for _, tag := range l.Tags {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("%w: the tag '%s' should not be empty or contain ',' and spaces", ErrInvalidLabels, tag)
+		}
+		if !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	l.Tags = tags
+	return nil
+}
+
+// HasTags returns true if the labels are tagged by all the tags.
+func (l *Labels) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		if !contains(l.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTags parses comma separated tags, e.g. "critical,outdoor".
+func ParseTags(tags string) []string {
+	parsed := make([]string, 0)
+	for _, tag := range strings.Split(tags, tagsSeparator) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			parsed = append(parsed, tag)
+		}
+	}
+	return parsed
+}
+
+// Requirement is a condition of a label selector.
+type Requirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+func (r *Requirement) matches(labels map[string]string) bool {
+	value, exists := labels[r.Key]
+	switch r.Operator {
+	case SelectorOperatorExists:
+		return exists
+	case SelectorOperatorDoesNotExist:
+		return !exists
+	case SelectorOperatorEqual, SelectorOperatorDoubleEqual, SelectorOperatorIn:
+		return exists && contains(r.Values, value)
+	case SelectorOperatorNotEqual, SelectorOperatorNotIn:
+		return !exists || !contains(r.Values, value)
+	default:
+		return false
+	}
+}
+
+func (r *Requirement) String() string {
+	switch r.Operator {
+	case SelectorOperatorExists:
+		return r.Key
+	case SelectorOperatorDoesNotExist:
+		return "!" + r.Key
+	case SelectorOperatorIn, SelectorOperatorNotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	default:
+		return r.Key + r.Operator + r.Values[0]
+	}
+}
+
+// Selector selects labels like the label selector of Kubernetes, a selector matches the labels
+// only if all its requirements are satisfied, an empty selector matches everything.
+type Selector struct {
+	Requirements []*Requirement
+}
+
+// ParseSelector parses a selector like "site=shanghai,line in (l1,l2),env!=test,critical,!deprecated".
+func ParseSelector(selector string) (*Selector, error) {
+	s := new(Selector)
+	for _, requirement := range splitRequirements(selector) {
+		if requirement = strings.TrimSpace(requirement); requirement == "" {
+			continue
+		}
+		r, err := parseRequirement(requirement)
+		if err != nil {
+			return nil, err
+		}
+		if !labelKeyPattern.MatchString(r.Key) {
+			return nil, fmt.Errorf("%w: invalid key '%s' in the requirement '%s'", ErrInvalidSelector, r.Key, requirement)
+		}
+		s.Requirements = append(s.Requirements, r)
+	}
+	return s, nil
+}
+
+// splitRequirements splits the selector by commas, excepting those in the parentheses of 'in' and 'notin'.
+func splitRequirements(selector string) []string {
+	requirements := make([]string, 0)
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				requirements = append(requirements, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(requirements, selector[start:])
+}
+
+func parseRequirement(requirement string) (*Requirement, error) {
+	if strings.HasPrefix(requirement, "!") && !strings.ContainsAny(requirement, "=( ") {
+		return &Requirement{Key: strings.TrimSpace(requirement[1:]), Operator: SelectorOperatorDoesNotExist}, nil
+	}
+	for _, op := range []string{SelectorOperatorNotEqual, SelectorOperatorDoubleEqual, SelectorOperatorEqual} {
+		if idx := strings.Index(requirement, op); idx >= 0 {
+			key, value := strings.TrimSpace(requirement[:idx]), strings.TrimSpace(requirement[idx+len(op):])
+			if !labelValuePattern.MatchString(value) {
+				return nil, fmt.Errorf("%w: invalid value '%s' in the requirement '%s'", ErrInvalidSelector, value, requirement)
+			}
+			return &Requirement{Key: key, Operator: op, Values: []string{value}}, nil
+		}
+	}
+	if fields := strings.Fields(requirement); len(fields) >= 2 &&
+		(fields[1] == SelectorOperatorIn || fields[1] == SelectorOperatorNotIn) {
+		set := strings.TrimSpace(strings.Join(fields[2:], ""))
+		if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+			return nil, fmt.Errorf("%w: the values of the requirement '%s' should be enclosed by parentheses",
+				ErrInvalidSelector, requirement)
+		}
+		values := make([]string, 0)
+		for _, value := range strings.Split(set[1:len(set)-1], ",") {
+			if value = strings.TrimSpace(value); !labelValuePattern.MatchString(value) {
+				return nil, fmt.Errorf("%w: invalid value '%s' in the requirement '%s'", ErrInvalidSelector, value, requirement)
+			}
+			values = append(values, value)
+		}
+		return &Requirement{Key: fields[0], Operator: fields[1], Values: values}, nil
+	}
+	if strings.ContainsAny(requirement, " ()") {
+		return nil, fmt.Errorf("%w: unknown requirement '%s'", ErrInvalidSelector, requirement)
+	}
+	return &Requirement{Key: requirement, Operator: SelectorOperatorExists}, nil
+}
+
+// Matches returns true if the labels satisfy all requirements of the selector.
+func (s *Selector) Matches(labels map[string]string) bool {
+	if s == nil {
+		return true
+	}
+	for _, r := range s.Requirements {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Empty returns true if the selector has no requirements.
+func (s *Selector) Empty() bool {
+	return s == nil || len(s.Requirements) == 0
+}
+
+func (s *Selector) String() string {
+	if s == nil {
+		return ""
+	}
+	requirements := make([]string, len(s.Requirements))
+	for i, r := range s.Requirements {
+		requirements[i] = r.String()
+	}
+	return strings.Join(requirements, requirementSeparator)
+}
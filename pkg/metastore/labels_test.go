@@ -0,0 +1,78 @@
+package metastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("site=shanghai, line in (l1, l2),env!=test,critical,!deprecated,tier notin (t3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := selector.String(), "site=shanghai,line in (l1,l2),env!=test,critical,!deprecated,tier notin (t3)"; got != want {
+		t.Errorf("selector = %s, want %s", got, want)
+	}
+
+	for _, c := range []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"site": "shanghai", "line": "l1", "critical": ""}, true},
+		{map[string]string{"site": "shanghai", "line": "l2", "critical": "", "env": "prod", "tier": "t1"}, true},
+		{map[string]string{"site": "beijing", "line": "l1", "critical": ""}, false},
+		{map[string]string{"site": "shanghai", "line": "l3", "critical": ""}, false},
+		{map[string]string{"site": "shanghai", "line": "l1", "critical": "", "env": "test"}, false},
+		{map[string]string{"site": "shanghai", "line": "l1"}, false},
+		{map[string]string{"site": "shanghai", "line": "l1", "critical": "", "deprecated": "true"}, false},
+		{map[string]string{"site": "shanghai", "line": "l1", "critical": "", "tier": "t3"}, false},
+	} {
+		if got := selector.Matches(c.labels); got != c.want {
+			t.Errorf("%v: matches = %t, want %t", c.labels, got, c.want)
+		}
+	}
+
+	empty, err := ParseSelector("")
+	if err != nil || !empty.Empty() || !empty.Matches(nil) {
+		t.Errorf("an empty selector should match everything, got %v", err)
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{"site=shang hai", "line in l1", "line in (l1,l/2)", "-site=a", "site ~ a"} {
+		if _, err := ParseSelector(selector); !errors.Is(err, ErrInvalidSelector) {
+			t.Errorf("%q: got %v, want %v", selector, err, ErrInvalidSelector)
+		}
+	}
+}
+
+func TestLabelsValidate(t *testing.T) {
+	labels := &Labels{Labels: map[string]string{"example.com/site": "shanghai"}, Tags: []string{"outdoor", "critical", "outdoor"}}
+	if err := labels.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"critical", "outdoor"}; !reflect.DeepEqual(labels.Tags, want) {
+		t.Errorf("tags = %v, want %v", labels.Tags, want)
+	}
+	if !labels.HasTags("critical", "outdoor") || labels.HasTags("critical", "indoor") {
+		t.Errorf("HasTags of %v is wrong", labels.Tags)
+	}
+
+	for _, invalid := range []*Labels{
+		{Labels: map[string]string{"-site": "a"}},
+		{Labels: map[string]string{"site": "a b"}},
+		{Tags: []string{"a,b"}},
+		{Tags: []string{""}},
+	} {
+		if err := invalid.Validate(); !errors.Is(err, ErrInvalidLabels) {
+			t.Errorf("%+v: got %v, want %v", invalid, err, ErrInvalidLabels)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	if got, want := ParseTags(" critical,,outdoor "), []string{"critical", "outdoor"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package metastore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	SortByID      = "id"
+	SortByName    = "name"
+	SortByStatus  = "status" // only available for devices
+	SortByCreated = "created"
+)
+
+var (
+	ErrInvalidListOptions = errors.New("invalid list options")
+)
+
+// ListOptions describes how to sort and page the listed metas.
+type ListOptions struct {
+	// Limit is the maximum number of metas in a page, 0 means no limit.
+	Limit int
+	// Continue is the token returned by the last page, the listing starts from the beginning if it is empty.
+	Continue string
+	// SortBy is one of SortByID, SortByName, SortByStatus and SortByCreated, SortByID is used if it is empty.
+	SortBy     string
+	Descending bool
+}
+
+// continueToken marks the last meta of a page, so the next page keeps consistent
+// even though some metas are created or deleted between two pages.
+type continueToken struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d"`
+	Key        string `json:"k"`
+	ID         string `json:"i"`
+}
+
+func (t *continueToken) encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContinueToken(token string) (*continueToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed continue token", ErrInvalidListOptions)
+	}
+	t := new(continueToken)
+	if err = json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("%w: malformed continue token", ErrInvalidListOptions)
+	}
+	return t, nil
+}
+
+// entry contains all fields of a meta which can be sorted by.
+type entry struct {
+	id      string
+	name    string
+	status  string
+	created time.Time
+}
+
+func (e *entry) key(sortBy string) string {
+	switch sortBy {
+	case SortByName:
+		return e.name
+	case SortByStatus:
+		return e.status
+	case SortByCreated:
+		return fmt.Sprintf("%020d", e.created.UnixNano())
+	default:
+		return e.id
+	}
+}
+
+// page sorts the entries and returns the indexes of entries in the requested page,
+// the next token will be empty if there are no more entries.
+func page(entries []*entry, opts *ListOptions, sortable ...string) (indexes []int, next string, err error) {
+	if opts == nil {
+		opts = new(ListOptions)
+	}
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = SortByID
+	}
+	if !contains(sortable, sortBy) {
+		return nil, "", fmt.Errorf("%w: unsupported sort field %s, only supporting %v",
+			ErrInvalidListOptions, sortBy, sortable)
+	}
+	if opts.Limit < 0 {
+		return nil, "", fmt.Errorf("%w: the limit must not be negative", ErrInvalidListOptions)
+	}
+
+	less := func(a, b *entry) bool {
+		ka, kb := a.key(sortBy), b.key(sortBy)
+		if ka != kb {
+			return (ka < kb) != opts.Descending
+		}
+		return (a.id < b.id) != opts.Descending // the ID is unique, it makes the order stable
+	}
+	indexes = make([]int, len(entries))
+	for i := range entries {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return less(entries[indexes[i]], entries[indexes[j]])
+	})
+
+	if opts.Continue != "" {
+		token, err := decodeContinueToken(opts.Continue)
+		if err != nil {
+			return nil, "", err
+		}
+		if token.SortBy != sortBy || token.Descending != opts.Descending {
+			return nil, "", fmt.Errorf("%w: the continue token is issued for another sort", ErrInvalidListOptions)
+		}
+		// find the first entry after the last one of the previous page
+		start := sort.Search(len(indexes), func(i int) bool {
+			e := entries[indexes[i]]
+			if k := e.key(sortBy); k != token.Key {
+				return (k > token.Key) != opts.Descending
+			}
+			if e.id == token.ID {
+				return false
+			}
+			return (e.id > token.ID) != opts.Descending
+		})
+		indexes = indexes[start:]
+	}
+
+	if opts.Limit > 0 && len(indexes) > opts.Limit {
+		indexes = indexes[:opts.Limit]
+		last := entries[indexes[len(indexes)-1]]
+		next = (&continueToken{
+			SortBy:     sortBy,
+			Descending: opts.Descending,
+			Key:        last.key(sortBy),
+			ID:         last.id,
+		}).encode()
+	}
+	return indexes, next, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
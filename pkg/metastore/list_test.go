@@ -0,0 +1,100 @@
+package metastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ids(entries []*entry, indexes []int) []string {
+	s := make([]string, len(indexes))
+	for i, index := range indexes {
+		s[i] = entries[index].id
+	}
+	return s
+}
+
+// pageAll lists all entries page by page, and returns the IDs of each page.
+func pageAll(t *testing.T, entries []*entry, opts *ListOptions) [][]string {
+	t.Helper()
+	pages := make([][]string, 0)
+	for {
+		indexes, next, err := page(entries, opts, SortByID, SortByName, SortByCreated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, ids(entries, indexes))
+		if next == "" {
+			return pages
+		}
+		opts.Continue = next
+	}
+}
+
+func TestPage(t *testing.T) {
+	now := time.Now()
+	entries := []*entry{
+		{id: "d3", name: "pump", created: now.Add(3 * time.Second)},
+		{id: "d1", name: "valve", created: now.Add(2 * time.Second)},
+		{id: "d2", name: "pump", created: now.Add(time.Second)},
+		{id: "d4", name: "fan", created: now},
+	}
+	for _, c := range []struct {
+		opts *ListOptions
+		want [][]string
+	}{
+		{&ListOptions{}, [][]string{{"d1", "d2", "d3", "d4"}}},
+		{&ListOptions{Limit: 3}, [][]string{{"d1", "d2", "d3"}, {"d4"}}},
+		{&ListOptions{Limit: 2, SortBy: SortByName}, [][]string{{"d4", "d2"}, {"d3", "d1"}}},
+		{&ListOptions{Limit: 2, SortBy: SortByName, Descending: true}, [][]string{{"d1", "d3"}, {"d2", "d4"}}},
+		{&ListOptions{Limit: 3, SortBy: SortByCreated, Descending: true}, [][]string{{"d3", "d1", "d2"}, {"d4"}}},
+		{&ListOptions{Limit: 4}, [][]string{{"d1", "d2", "d3", "d4"}}},
+	} {
+		opts := *c.opts
+		if got := pageAll(t, entries, &opts); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: pages = %v, want %v", *c.opts, got, c.want)
+		}
+	}
+}
+
+func TestPageIsConsistentAcrossChanges(t *testing.T) {
+	entries := []*entry{{id: "d1"}, {id: "d2"}, {id: "d3"}, {id: "d4"}}
+	indexes, next, err := page(entries, &ListOptions{Limit: 2}, SortByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(entries, indexes); !reflect.DeepEqual(got, []string{"d1", "d2"}) {
+		t.Fatalf("the first page = %v", got)
+	}
+
+	// the last entry of the previous page is deleted, and another entry is created before it
+	entries = []*entry{{id: "d0"}, {id: "d1"}, {id: "d3"}, {id: "d4"}}
+	indexes, next, err = page(entries, &ListOptions{Limit: 2, Continue: next}, SortByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(entries, indexes); !reflect.DeepEqual(got, []string{"d3", "d4"}) || next != "" {
+		t.Errorf("the second page = %v and next = %q, want [d3 d4] without next", got, next)
+	}
+}
+
+func TestPageErrors(t *testing.T) {
+	entries := []*entry{{id: "d1"}, {id: "d2"}}
+	_, next, err := page(entries, &ListOptions{Limit: 1}, SortByID, SortByName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*ListOptions{
+		{SortBy: SortByStatus},
+		{Limit: -1},
+		{Continue: "not a token"},
+		{Continue: "bm90IGpzb24"},
+		{Continue: next, SortBy: SortByName},
+		{Continue: next, Descending: true},
+	} {
+		if _, _, err = page(entries, opts, SortByID, SortByName); !errors.Is(err, ErrInvalidListOptions) {
+			t.Errorf("%+v: got %v, want %v", opts, err, ErrInvalidListOptions)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package metastore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	FieldID       = "id"
+	FieldName     = "name"
+	FieldStatus   = "status"   // only available for devices
+	FieldCategory = "category" // only available for devices
+	FieldProduct  = "product"  // only available for devices
+	FieldProtocol = "protocol"
+
+	OperatorEqual    = "="
+	OperatorNotEqual = "!="
+	OperatorGlob     = "~=" // matches the value with wildcards, '*' matches any characters and '?' matches one character
+
+	conditionSeparator = ","
+	valueSeparator     = "|"
+)
+
+var (
+	ErrInvalidQuery = errors.New("invalid query")
+
+	ProductFields = []string{FieldID, FieldName, FieldProtocol}
+	DeviceFields  = []string{FieldID, FieldName, FieldStatus, FieldCategory, FieldProduct, FieldProtocol}
+)
+
+// Condition matches a field with any of its values.
+type Condition struct {
+	Field    string
+	Operator string
+	Values   []string
+
+	globs []*regexp.Regexp
+}
+
+func (c *Condition) match(value string) bool {
+	switch c.Operator {
+	case OperatorNotEqual:
+		return !contains(c.Values, value)
+	case OperatorGlob:
+		for _, glob := range c.globs {
+			if glob.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return contains(c.Values, value)
+	}
+}
+
+// Query consists of conditions, a label selector and tags,
+// a meta matches the query only if it matches all of them.
+type Query struct {
+	Conditions []*Condition
+	Selector   *Selector
+	Tags       []string
+}
+
+// ParseQuery parses a query like "status=connected|reconnecting,product=foo,name~=pump*",
+// conditions are separated by ',' and alternative values of a condition are separated by '|'.
+func ParseQuery(query string) (*Query, error) {
+	q := new(Query)
+	if strings.TrimSpace(query) == "" {
+		return q, nil
+	}
+	for _, condition := range strings.Split(query, conditionSeparator) {
+		idx := strings.Index(condition, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%w: the condition '%s' should be like 'field=value'", ErrInvalidQuery, condition)
+		}
+		field, operator := condition[:idx], OperatorEqual
+		switch {
+		case strings.HasSuffix(field, "!"):
+			field, operator = strings.TrimSuffix(field, "!"), OperatorNotEqual
+		case strings.HasSuffix(field, "~"):
+			field, operator = strings.TrimSuffix(field, "~"), OperatorGlob
+		}
+		values := strings.Split(condition[idx+1:], valueSeparator)
+		q.And(strings.TrimSpace(field), operator, values...)
+	}
+	return q, nil
+}
+
+// And appends a new condition into the query.
+func (q *Query) And(field, operator string, values ...string) *Query {
+	c := &Condition{Field: field, Operator: operator, Values: values}
+	if operator == OperatorGlob {
+		for _, value := range values {
+			pattern := regexp.QuoteMeta(value)
+			pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+			pattern = strings.ReplaceAll(pattern, `\?`, ".")
+			c.globs = append(c.globs, regexp.MustCompile("^"+pattern+"$"))
+		}
+	}
+	q.Conditions = append(q.Conditions, c)
+	return q
+}
+
+// WithLabels makes the query match the metas whose labels satisfy the selector and are tagged by all tags.
+func (q *Query) WithLabels(selector *Selector, tags ...string) *Query {
+	q.Selector, q.Tags = selector, tags
+	return q
+}
+
+// Validate verifies whether all fields in the query are available.
+func (q *Query) Validate(fields ...string) error {
+	for _, c := range q.Conditions {
+		if !contains(fields, c.Field) {
+			return fmt.Errorf("%w: unsupported field %s, only supporting %v", ErrInvalidQuery, c.Field, fields)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the meta, whose fields are got by the function, matches all conditions,
+// and its labels satisfy the selector and tags.
+func (q *Query) Match(get func(field string) string, labels *Labels) bool {
+	for _, c := range q.Conditions {
+		if !c.match(get(c.Field)) {
+			return false
+		}
+	}
+	return q.Selector.Matches(labels.Labels) && labels.HasTags(q.Tags...)
+}
+
+// Empty returns true if the query matches all metas.
+func (q *Query) Empty() bool {
+	return len(q.Conditions) == 0 && q.Selector.Empty() && len(q.Tags) == 0
+}
+
+// Uses returns true if any condition of the query uses the field.
+func (q *Query) Uses(field string) bool {
+	for _, c := range q.Conditions {
+		if c.Field == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package metastore
+
+import (
+	"errors"
+	"github.com/thingio/edge-device-std/models"
+	"reflect"
+	"testing"
+)
+
+func TestQueryMatch(t *testing.T) {
+	fields := map[string]string{FieldName: "pump-01", FieldStatus: "connected", FieldProduct: "p1"}
+	get := func(field string) string { return fields[field] }
+	labels := &Labels{Labels: map[string]string{"site": "shanghai"}, Tags: []string{"critical"}}
+
+	for _, c := range []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"status=connected|reconnecting", true},
+		{"status=disconnected", false},
+		{"status!=disconnected,product=p1", true},
+		{"status!=connected", false},
+		{"name~=pump*", true},
+		{"name~=pump-0?", true},
+		{"name~=valve*|*-01", true},
+		{"name~=pump", false},
+		{"name~=pump.01", false}, // '.' is not a wildcard
+	} {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Fatalf("%q: %v", c.query, err)
+		}
+		if got := q.Match(get, labels); got != c.want {
+			t.Errorf("%q: match = %t, want %t", c.query, got, c.want)
+		}
+	}
+
+	selector, err := ParseSelector("site=beijing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new(Query).WithLabels(selector).Match(get, labels) {
+		t.Error("the query should not match the labels not satisfying the selector")
+	}
+	if new(Query).WithLabels(nil, "critical", "outdoor").Match(get, labels) {
+		t.Error("the query should not match the labels missing a tag")
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{"status", "=connected", "status=connected,"} {
+		if _, err := ParseQuery(query); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: got %v, want %v", query, err, ErrInvalidQuery)
+		}
+	}
+	q, err := ParseQuery("status=connected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Validate(ProductFields...); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("products have no status, got %v", err)
+	}
+	if !q.Uses(FieldStatus) || q.Uses(FieldProtocol) || q.Empty() {
+		t.Errorf("the query %+v uses the status only", q)
+	}
+}
+
+func TestSearchDevicesAcrossProducts(t *testing.T) {
+	store := newTestStore(t)
+	for _, product := range []*models.Product{{ID: "p1", Protocol: "modbus"}, {ID: "p2", Protocol: "opcua"}} {
+		if err := store.CreateProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, device := range []*models.Device{
+		{ID: "d1", Name: "pump-01", ProductID: "p1", DeviceStatus: models.DeviceStateConnected},
+		{ID: "d2", Name: "pump-02", ProductID: "p2", DeviceStatus: models.DeviceStateConnected},
+		{ID: "d3", Name: "valve-01", ProductID: "p2", DeviceStatus: models.DeviceStateDisconnected},
+	} {
+		if err := store.CreateDevice(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"d1", "d2", "d3"}},
+		{"name~=pump*", []string{"d1", "d2"}},
+		{"protocol=opcua", []string{"d2", "d3"}},
+		{"protocol=opcua,status=connected", []string{"d2"}},
+	} {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices, next, err := store.SearchDevices(q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(devices))
+		for i, device := range devices {
+			got[i] = device.ID
+		}
+		if !reflect.DeepEqual(got, c.want) || next != "" {
+			t.Errorf("%q: devices = %v, want %v", c.query, got, c.want)
+		}
+	}
+
+	q, _ := ParseQuery("category=camera")
+	if _, _, err := store.SearchProducts(q, nil); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("products have no category, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package metastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+const (
+	// WebhookSourceEvents delivers the events reported by devices, including alarms.
+	WebhookSourceEvents = "events"
+	// WebhookSourceStatus delivers the changes of the statuses of devices.
+	WebhookSourceStatus = "status"
+
+	defaultWebhookMaxAttempts = 5
+	maxWebhookMaxAttempts     = 20
+	defaultWebhookTimeout     = 10 * time.Second
+)
+
+var (
+	ErrInvalidWebhook = errors.New("invalid webhook")
+)
+
+// Webhook calls back the URL when something happens on devices matching its filter.
+type Webhook struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	// Sources are WebhookSourceEvents and WebhookSourceStatus, all sources are delivered if it is empty.
+	Sources []string      `json:"sources,omitempty"`
+	Filter  WebhookFilter `json:"filter"`
+
+	// Template is a Go text/template rendering the payload from the delivery, e.g. '{"device": "{{.DeviceID}}"}',
+	// the delivery is marshalled as JSON if it is empty. The function 'json' marshals a value as JSON.
+	Template    string            `json:"template,omitempty"`
+	ContentType string            `json:"content_type,omitempty"` // "application/json" by default
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	// Secret signs the payload by HMAC-SHA256, the signature is not sent if it is empty.
+	Secret string `json:"secret,omitempty"`
+
+	// MaxAttempts is the number of attempts before the delivery is moved into the dead letters.
+	MaxAttempts   int  `json:"max_attempts,omitempty"`
+	TimeoutSecond int  `json:"timeout_second,omitempty"`
+	Disabled      bool `json:"disabled,omitempty"`
+}
+
+// WebhookFilter selects what to be delivered, an empty field matches anything.
+type WebhookFilter struct {
+	Devices  []string                `json:"devices,omitempty"`
+	Products []string                `json:"products,omitempty"`
+	Events   []models.ProductEventID `json:"events,omitempty"`
+	States   []string                `json:"states,omitempty"` // only applied to the statuses
+}
+
+// Validate verifies the webhook and fills the defaults, it doesn't verify whether the devices and products exist.
+func (w *Webhook) Validate() error {
+	if w.ID == "" {
+		return fmt.Errorf("%w: the webhook's ID is required", ErrInvalidWebhook)
+	}
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: the url %q should be an absolute HTTP(S) URL", ErrInvalidWebhook, w.URL)
+	}
+	for _, source := range w.Sources {
+		if source != WebhookSourceEvents && source != WebhookSourceStatus {
+			return fmt.Errorf("%w: unsupported source %s, only supporting %s and %s",
+				ErrInvalidWebhook, source, WebhookSourceEvents, WebhookSourceStatus)
+		}
+	}
+	if _, err := w.ParseTemplate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidWebhook, err.Error())
+	}
+	if w.MaxAttempts < 0 || w.MaxAttempts > maxWebhookMaxAttempts {
+		return fmt.Errorf("%w: the max_attempts should be in [1, %d]", ErrInvalidWebhook, maxWebhookMaxAttempts)
+	}
+	if w.MaxAttempts == 0 {
+		w.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if w.TimeoutSecond < 0 {
+		return fmt.Errorf("%w: the timeout_second should be positive", ErrInvalidWebhook)
+	}
+	if w.Name == "" {
+		w.Name = w.ID
+	}
+	return nil
+}
+
+// Subscribes returns true if the source is delivered by the webhook.
+func (w *Webhook) Subscribes(source string) bool {
+	return len(w.Sources) == 0 || contains(w.Sources, source)
+}
+
+// Timeout returns the timeout of each attempt.
+func (w *Webhook) Timeout() time.Duration {
+	if w.TimeoutSecond == 0 {
+		return defaultWebhookTimeout
+	}
+	return time.Duration(w.TimeoutSecond) * time.Second
+}
+
+// ParseTemplate returns nil if the webhook has no template.
+func (w *Webhook) ParseTemplate() (*template.Template, error) {
+	if w.Template == "" {
+		return nil, nil
+	}
+	return template.New(w.ID).Funcs(WebhookTemplateFuncs).Parse(w.Template)
+}
+
+// WebhookTemplateFuncs are the functions available in the templates of webhooks.
+var WebhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Match returns true if the device, its product and the event or the state are selected by the filter.
+func (f *WebhookFilter) Match(deviceID, productID string, eventID models.ProductEventID, state string) bool {
+	if len(f.Devices) != 0 && !contains(f.Devices, deviceID) {
+		return false
+	}
+	if len(f.Products) != 0 && !contains(f.Products, productID) {
+		return false
+	}
+	if eventID != "" && len(f.Events) != 0 && !contains(f.Events, eventID) {
+		return false
+	}
+	if state != "" && len(f.States) != 0 && !contains(f.States, state) {
+		return false
+	}
+	return true
+}
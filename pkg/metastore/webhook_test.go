@@ -0,0 +1,61 @@
+package metastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	webhook := &Webhook{ID: "w1", URL: "https://mes.local/callback"}
+	if err := webhook.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if webhook.Name != "w1" || webhook.MaxAttempts != defaultWebhookMaxAttempts || webhook.Timeout() != defaultWebhookTimeout {
+		t.Errorf("the webhook = %+v, want the defaults filled", webhook)
+	}
+
+	for _, c := range []struct {
+		name    string
+		webhook *Webhook
+	}{
+		{"missing ID", &Webhook{URL: "http://mes.local"}},
+		{"relative URL", &Webhook{ID: "w1", URL: "/callback"}},
+		{"unsupported scheme", &Webhook{ID: "w1", URL: "ftp://mes.local"}},
+		{"unsupported source", &Webhook{ID: "w1", URL: "http://mes.local", Sources: []string{"properties"}}},
+		{"invalid template", &Webhook{ID: "w1", URL: "http://mes.local", Template: "{{.DeviceID"}},
+		{"too many attempts", &Webhook{ID: "w1", URL: "http://mes.local", MaxAttempts: maxWebhookMaxAttempts + 1}},
+		{"negative timeout", &Webhook{ID: "w1", URL: "http://mes.local", TimeoutSecond: -1}},
+	} {
+		if err := c.webhook.Validate(); !errors.Is(err, ErrInvalidWebhook) {
+			t.Errorf("%s: got %v, want %v", c.name, err, ErrInvalidWebhook)
+		}
+	}
+}
+
+func TestWebhookFilterMatch(t *testing.T) {
+	f := &WebhookFilter{Products: []string{"p1"}, Events: []string{"alarm"}, States: []string{"exception"}}
+	for _, c := range []struct {
+		deviceID, productID, eventID, state string
+		want                                bool
+	}{
+		{"d1", "p1", "alarm", "", true},
+		{"d1", "p1", "info", "", false},
+		{"d1", "p2", "alarm", "", false},
+		{"d1", "p1", "", "exception", true},
+		{"d1", "p1", "", "connected", false},
+		// the device is selected regardless of its events and states when the topics are resolved
+		{"d1", "p1", "", "", true},
+	} {
+		if got := f.Match(c.deviceID, c.productID, c.eventID, c.state); got != c.want {
+			t.Errorf("%+v: got %t, want %t", c, got, c.want)
+		}
+	}
+
+	webhook := &Webhook{Sources: []string{WebhookSourceStatus}}
+	if webhook.Subscribes(WebhookSourceEvents) || !webhook.Subscribes(WebhookSourceStatus) {
+		t.Error("only the status should be subscribed")
+	}
+	if webhook.Sources = nil; !webhook.Subscribes(WebhookSourceEvents) {
+		t.Error("all sources should be subscribed if none is specified")
+	}
+}
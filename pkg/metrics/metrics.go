@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"strconv"
+	"time"
+)
+
+const (
+	Namespace = "edge_device_manager"
+
+	WebhookResultDelivered = "delivered"
+	WebhookResultRetried   = "retried"
+	WebhookResultDead      = "dead"
+
+	NorthboundResultPublished = "published"
+	NorthboundResultBuffered  = "buffered"
+	NorthboundResultDropped   = "dropped"
+	NorthboundResultSucceeded = "succeeded"
+	NorthboundResultFailed    = "failed"
+	NorthboundResultRejected  = "rejected"
+
+	routeUnmatched = "unmatched"
+)
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "The number of HTTP requests handled, partitioned by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "The latency of HTTP requests, partitioned by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "operation",
+		Name:      "duration_seconds",
+		Help:      "The latency of operations sent to drivers, partitioned by protocol and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"protocol", "operation"})
+	OperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "operation",
+		Name:      "errors_total",
+		Help:      "The number of failed operations sent to drivers, partitioned by protocol and operation.",
+	}, []string{"protocol", "operation"})
+
+	WebSocketSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "websocket",
+		Name:      "sessions",
+		Help:      "The number of active WebSocket sessions.",
+	})
+
+	StreamSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "stream",
+		Name:      "subscribers",
+		Help:      "The number of active subscribers of device streams, sharing the subscriptions of the message bus.",
+	})
+	StreamDroppedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "stream",
+		Name:      "dropped_messages_total",
+		Help:      "The number of messages dropped because the subscribers don't consume them in time.",
+	})
+
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "webhook",
+		Name:      "deliveries_total",
+		Help:      "The number of deliveries to webhooks, partitioned by result, i.e. delivered, retried or dead.",
+	}, []string{"result"})
+
+	NorthboundMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "northbound",
+		Name:      "messages_total",
+		Help:      "The number of messages forwarded to the northbound broker, partitioned by result, i.e. published, buffered or dropped.",
+	}, []string{"result"})
+	NorthboundCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "northbound",
+		Name:      "commands_total",
+		Help:      "The number of commands from the northbound broker, partitioned by result, i.e. succeeded, failed or rejected.",
+	}, []string{"result"})
+)
+
+// NewRegistry returns a registry including the runtime metrics, the metrics defined above and the given collectors.
+func NewRegistry(cs ...prometheus.Collector) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	cs = append(cs,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPRequestDuration,
+		OperationDuration, OperationErrors,
+		WebSocketSessions, StreamSubscribers, StreamDroppedMessages,
+		WebhookDeliveries, NorthboundMessages, NorthboundCommands,
+	)
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// HTTPFilter observes all requests handled by the container.
+func HTTPFilter(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	start := time.Now()
+	chain.ProcessFilter(request, response)
+
+	method := request.Request.Method
+	route := request.SelectedRoutePath()
+	if route == "" {
+		route = routeUnmatched
+	}
+	HTTPRequests.WithLabelValues(method, route, strconv.Itoa(response.StatusCode())).Inc()
+	HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+}
+
+// ObserveOperation observes an operation sent to the driver, it is used like:
+//
+//	defer ObserveOperation(protocolID, "Read", time.Now(), &err)
+func ObserveOperation(protocolID, operation string, start time.Time, err *error) {
+	OperationDuration.WithLabelValues(protocolID, operation).Observe(time.Since(start).Seconds())
+	if err != nil && *err != nil {
+		OperationErrors.WithLabelValues(protocolID, operation).Inc()
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPFilter(t *testing.T) {
+	ws := new(restful.WebService)
+	ws.Path("/api/v1/devices")
+	ws.Route(ws.GET("/{device-id}").To(func(request *restful.Request, response *restful.Response) {
+		response.WriteHeader(http.StatusNoContent)
+	}))
+	container := restful.NewContainer()
+	container.Filter(HTTPFilter)
+	container.Add(ws)
+
+	route := "/api/v1/devices/{device-id}"
+	before := testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, route, "204"))
+	for _, id := range []string{"d1", "d2"} {
+		container.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/devices/"+id, nil))
+	}
+	// requests are partitioned by the route template rather than the path
+	if got := testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, route, "204")) - before; got != 2 {
+		t.Errorf("%v requests are counted, want 2", got)
+	}
+}
+
+func TestObserveOperation(t *testing.T) {
+	observe := func(err error) {
+		defer ObserveOperation("modbus", "Read", time.Now(), &err)
+	}
+	before := testutil.ToFloat64(OperationErrors.WithLabelValues("modbus", "Read"))
+	observe(nil)
+	observe(errors.New("timeout"))
+	if got := testutil.ToFloat64(OperationErrors.WithLabelValues("modbus", "Read")) - before; got != 1 {
+		t.Errorf("%v errors are counted, want 1", got)
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	extra := prometheus.NewCounter(prometheus.CounterOpts{Namespace: Namespace, Name: "extra_total", Help: "extra"})
+	if _, err := NewRegistry(extra); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRegistry(extra, extra); err == nil {
+		t.Error("a collector is registered twice, want an error")
+	}
+}
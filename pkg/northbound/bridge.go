@@ -0,0 +1,160 @@
+package northbound
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-std/logger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenTimeout = 5 * time.Second
+	// disconnectQuiesce is how long to wait for the messages in flight when disconnecting, in milliseconds.
+	disconnectQuiesce = 2000
+)
+
+// Bridge is the connection to the northbound broker, it reconnects automatically once the connection
+// is lost, and notifies the handlers registered by OnConnect every time it is (re)connected.
+//
+// It doesn't share the message bus with drivers, because the northbound broker is usually
+// another one, e.g. the one of the cloud, with its own credentials and topic scheme.
+type Bridge struct {
+	client       mqtt.Client
+	options      *mqtt.ClientOptions
+	will         func() *Will // nil if there is no will
+	tokenTimeout time.Duration
+	logger       *logger.Logger
+
+	mu         sync.Mutex
+	onConnects []func()
+}
+
+func NewBridge(opts *config.NorthboundOptions, lg *logger.Logger) (*Bridge, error) {
+	b := &Bridge{
+		tokenTimeout: time.Duration(opts.MQTT.TokenTimeoutMillisecond) * time.Millisecond,
+		logger:       lg,
+	}
+	if b.tokenTimeout <= 0 {
+		b.tokenTimeout = defaultTokenTimeout
+	}
+
+	clientID := opts.ClientID
+	if clientID == "" {
+		clientID = "edge-device-manager-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	co := mqtt.NewClientOptions().
+		AddBroker(opts.MQTT.GetBroker()).
+		SetClientID(clientID).
+		SetUsername(opts.MQTT.Username).
+		SetPassword(opts.MQTT.Password).
+		SetCleanSession(opts.MQTT.CleanSession).
+		SetKeepAlive(time.Minute).
+		SetAutoReconnect(true).
+		SetConnectRetry(true). // the broker may be unreachable when the manager starts
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(b.onConnectionLost).
+		SetReconnectingHandler(b.onReconnecting)
+	if opts.MQTT.ConnectTimoutMillisecond > 0 {
+		co.SetConnectTimeout(time.Duration(opts.MQTT.ConnectTimoutMillisecond) * time.Millisecond)
+	}
+	if opts.MQTT.WithTLS {
+		tlsConfig, err := opts.MQTT.NewTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		co.SetTLSConfig(tlsConfig)
+	}
+	b.options = co
+	b.client = mqtt.NewClient(co)
+	lg.Infof("the ID of client for the northbound broker is %s, connecting to %s", clientID, opts.MQTT.GetBroker())
+	return b, nil
+}
+
+// Will is the message published by the broker once the connection is lost without disconnecting.
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// SetWill registers the provider of the will, which is called before every attempt to reconnect, so that
+// the will could differ between connections. It must be called before Connect.
+func (b *Bridge) SetWill(provider func() *Will) {
+	b.will = provider
+	w := provider()
+	b.options.SetBinaryWill(w.Topic, w.Payload, w.QoS, w.Retain)
+	b.client = mqtt.NewClient(b.options)
+}
+
+// Connect connects to the broker in the background, it doesn't wait for the connection to be established.
+func (b *Bridge) Connect() {
+	b.client.Connect()
+}
+
+func (b *Bridge) Disconnect() {
+	b.client.Disconnect(disconnectQuiesce)
+}
+
+// Connected returns true if the connection is established right now, rather than reconnecting.
+func (b *Bridge) Connected() bool {
+	return b.client.IsConnectionOpen()
+}
+
+// OnConnect registers the handler called in a new goroutine every time the connection is (re)established.
+func (b *Bridge) OnConnect(handler func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.onConnects = append(b.onConnects, handler)
+	if b.Connected() {
+		go handler()
+	}
+}
+
+// Publish publishes the payload and waits for it to be acknowledged for QoS 1 and 2.
+func (b *Bridge) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if !b.Connected() {
+		return fmt.Errorf("the northbound broker is not connected")
+	}
+	return b.wait(b.client.Publish(topic, qos, retain, payload))
+}
+
+// Subscribe subscribes the topic, the subscription is restored by the client after reconnecting
+// only if the session is not clean, so the callers should subscribe again in OnConnect.
+func (b *Bridge) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) error {
+	return b.wait(b.client.Subscribe(topic, qos, func(_ mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	}))
+}
+
+func (b *Bridge) wait(token mqtt.Token) error {
+	if !token.WaitTimeout(b.tokenTimeout) {
+		return fmt.Errorf("the northbound broker doesn't acknowledge in %s", b.tokenTimeout)
+	}
+	return token.Error()
+}
+
+func (b *Bridge) onConnect(_ mqtt.Client) {
+	b.logger.Infof("the connection with the northbound broker has been established")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, handler := range b.onConnects {
+		go handler()
+	}
+}
+
+func (b *Bridge) onConnectionLost(_ mqtt.Client, err error) {
+	b.logger.WithError(err).Errorf("the connection with the northbound broker has lost, trying to reconnect")
+}
+
+func (b *Bridge) onReconnecting(_ mqtt.Client, co *mqtt.ClientOptions) {
+	if b.will != nil {
+		w := b.will()
+		co.SetBinaryWill(w.Topic, w.Payload, w.QoS, w.Retain)
+	}
+}
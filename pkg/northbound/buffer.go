@@ -0,0 +1,242 @@
+package northbound
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentSuffix = ".jsonl"
+	// segmentSize is the size of a segment to be rotated, the oldest segment is dropped as a whole
+	// if the buffer is full, and it is removed once all its records are replayed.
+	segmentSize = 4 * 1024 * 1024
+
+	fileMode os.FileMode = 0664
+	dirMode  os.FileMode = 0775
+)
+
+// record is a message to be published to the northbound broker.
+type record struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload []byte `json:"payload"`
+}
+
+// buffer keeps the records which could not be published, in segment files of JSON lines named by their sequences.
+// The records are kept across restarts, and they are replayed at least once, i.e. the records of a segment
+// may be published again if the replay is interrupted.
+type buffer struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []uint64 // sequences of segments, from the oldest to the latest
+	sizes    map[uint64]int64
+	writer   *os.File // the latest segment, nil if it is not opened yet
+}
+
+func newBuffer(dir string, maxBytes int64) (*buffer, error) {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, fmt.Errorf("fail to create the buffer %s, got %s", dir, err.Error())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	b := &buffer{dir: dir, maxBytes: maxBytes, sizes: make(map[uint64]int64)}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentSuffix) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		b.segments = append(b.segments, sequence)
+		b.sizes[sequence] = info.Size()
+	}
+	sort.Slice(b.segments, func(i, j int) bool {
+		return b.segments[i] < b.segments[j]
+	})
+	return b, nil
+}
+
+// Empty returns true if there are no records to be replayed.
+func (b *buffer) Empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.segments) == 0
+}
+
+// Append appends the record into the latest segment, and drops the oldest segments if the buffer is full.
+// It returns the number of records dropped.
+func (b *buffer) Append(r *record) (int, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	data = append(data, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writer == nil || b.sizes[b.latest()]+int64(len(data)) > segmentSize {
+		if err = b.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = b.writer.Write(data); err != nil {
+		return 0, err
+	}
+	b.sizes[b.latest()] += int64(len(data))
+	return b.trim()
+}
+
+// Oldest returns the records of the oldest segment and its sequence, which should be removed by Remove
+// once they are replayed. The latest segment is closed, so that no more records are appended into it.
+func (b *buffer) Oldest() ([]*record, uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.segments) == 0 {
+		return nil, 0, nil
+	}
+	sequence := b.segments[0]
+	if len(b.segments) == 1 && b.writer != nil {
+		_ = b.writer.Close()
+		b.writer = nil
+	}
+	f, err := os.Open(b.path(sequence))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	records := make([]*record, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), segmentSize)
+	for scanner.Scan() {
+		r := new(record)
+		if err = json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue // the last line may be truncated by a crash
+		}
+		records = append(records, r)
+	}
+	return records, sequence, scanner.Err()
+}
+
+// Remove removes the segment replayed, it does nothing if the segment is already dropped.
+func (b *buffer) Remove(sequence uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.segments) == 0 || b.segments[0] != sequence {
+		return nil
+	}
+	return b.drop()
+}
+
+// rotate opens a new segment as the latest one.
+func (b *buffer) rotate() error {
+	if b.writer != nil {
+		_ = b.writer.Close()
+		b.writer = nil
+	}
+	sequence := uint64(1)
+	if len(b.segments) != 0 {
+		sequence = b.latest() + 1
+	}
+	f, err := os.OpenFile(b.path(sequence), os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		return err
+	}
+	b.writer = f
+	b.segments = append(b.segments, sequence)
+	b.sizes[sequence] = 0
+	return nil
+}
+
+// trim drops the oldest segments until the buffer is not full, the latest segment is never dropped.
+func (b *buffer) trim() (int, error) {
+	dropped := 0
+	for len(b.segments) > 1 && b.size() > b.maxBytes {
+		n, err := b.count(b.segments[0])
+		if err != nil {
+			return dropped, err
+		}
+		if err = b.drop(); err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
+
+// drop removes the oldest segment.
+func (b *buffer) drop() error {
+	sequence := b.segments[0]
+	if err := os.Remove(b.path(sequence)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b.segments = b.segments[1:]
+	delete(b.sizes, sequence)
+	return nil
+}
+
+// count returns the number of records of the segment.
+func (b *buffer) count(sequence uint64) (int, error) {
+	f, err := os.Open(b.path(sequence))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), segmentSize)
+	for scanner.Scan() {
+		n++
+	}
+	return n, scanner.Err()
+}
+
+func (b *buffer) size() int64 {
+	var size int64
+	for _, s := range b.sizes {
+		size += s
+	}
+	return size
+}
+
+func (b *buffer) latest() uint64 {
+	return b.segments[len(b.segments)-1]
+}
+
+func (b *buffer) path(sequence uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", sequence, segmentSuffix))
+}
+
+func (b *buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writer == nil {
+		return nil
+	}
+	err := b.writer.Close()
+	b.writer = nil
+	return err
+}
@@ -0,0 +1,130 @@
+package northbound
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func appendRecords(t *testing.T, b *buffer, topics ...string) int {
+	t.Helper()
+	dropped := 0
+	for _, topic := range topics {
+		n, err := b.Append(&record{Topic: topic, QoS: 1, Payload: []byte(`"` + topic + `"`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped += n
+	}
+	return dropped
+}
+
+func oldest(t *testing.T, b *buffer) ([]string, uint64) {
+	t.Helper()
+	records, sequence, err := b.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	for _, r := range records {
+		if string(r.Payload) != `"`+r.Topic+`"` || r.QoS != 1 {
+			t.Errorf("the record = %+v, want it kept as appended", r)
+		}
+		topics = append(topics, r.Topic)
+	}
+	return topics, sequence
+}
+
+func TestBufferKeepsRecordsAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	b, err := newBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Empty() {
+		t.Fatal("a new buffer should be empty")
+	}
+	appendRecords(t, b, "a", "b")
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are appended into a new segment after restarting
+	b, err = newBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	appendRecords(t, b, "c")
+	for _, want := range [][]string{{"a", "b"}, {"c"}} {
+		topics, sequence := oldest(t, b)
+		if !reflect.DeepEqual(topics, want) {
+			t.Errorf("replayed %v, want %v", topics, want)
+		}
+		if err = b.Remove(sequence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !b.Empty() {
+		t.Error("the buffer should be empty once all segments are replayed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files are left, want none", len(entries))
+	}
+
+	// the latest segment is closed once it is replayed, so the new records are appended into another one
+	appendRecords(t, b, "d")
+	_, sequence := oldest(t, b)
+	appendRecords(t, b, "e")
+	if err = b.Remove(sequence); err != nil {
+		t.Fatal(err)
+	}
+	if topics, _ := oldest(t, b); !reflect.DeepEqual(topics, []string{"e"}) {
+		t.Errorf("replayed %v, want the record appended during the replay", topics)
+	}
+}
+
+func TestBufferDropsOldestSegments(t *testing.T) {
+	dir := t.TempDir()
+	b, err := newBuffer(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the latest segment is never dropped even though the buffer is full
+	if dropped := appendRecords(t, b, "a", "b"); dropped != 0 {
+		t.Errorf("%d records are dropped from the only segment, want none", dropped)
+	}
+	_ = b.Close()
+
+	if b, err = newBuffer(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if dropped := appendRecords(t, b, "c"); dropped != 2 {
+		t.Errorf("%d records are dropped, want the 2 of the oldest segment", dropped)
+	}
+	if topics, _ := oldest(t, b); !reflect.DeepEqual(topics, []string{"c"}) {
+		t.Errorf("replayed %v, want only the latest segment", topics)
+	}
+	// removing a segment which is already dropped does nothing
+	if err = b.Remove(1); err != nil || b.Empty() {
+		t.Errorf("got %v, want the latest segment kept", err)
+	}
+}
+
+func TestBufferSkipsTruncatedRecords(t *testing.T) {
+	dir := t.TempDir()
+	b, err := newBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	appendRecords(t, b, "a")
+	// a crash while appending leaves a truncated line
+	if _, err = b.writer.WriteString(`{"topic": "b", "pay`); err != nil {
+		t.Fatal(err)
+	}
+	if topics, _ := oldest(t, b); !reflect.DeepEqual(topics, []string{"a"}) {
+		t.Errorf("replayed %v, want the truncated record skipped", topics)
+	}
+}
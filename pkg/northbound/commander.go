@@ -0,0 +1,297 @@
+package northbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OperationRead     = "read"
+	OperationHardRead = "hard-read"
+	OperationWrite    = "write"
+	OperationCall     = "call"
+
+	defaultMaxConcurrentCommands = 16
+)
+
+// Command is the payload of a command from the northbound broker.
+type Command struct {
+	// ID correlates the reply with the command, it is echoed as is.
+	ID        string `json:"id"`
+	DeviceID  string `json:"device_id"`
+	Operation string `json:"operation"`
+	// PropertyID is the property to read or write, "*" means all properties to read, or the ones in Data to write.
+	PropertyID models.ProductPropertyID `json:"property_id,omitempty"`
+	MethodID   models.ProductMethodID   `json:"method_id,omitempty"`
+	// Data are the values to write, or the inputs of the method to call.
+	Data map[string]*models.DeviceData `json:"data,omitempty"`
+}
+
+// Reply is the result of a command, its status is the HTTP status code of the equivalent request.
+type Reply struct {
+	ID        string                        `json:"id"`
+	DeviceID  string                        `json:"device_id"`
+	Operation string                        `json:"operation"`
+	Status    int                           `json:"status"`
+	Data      map[string]*models.DeviceData `json:"data,omitempty"` // the properties read or the outputs of the method
+	Error     *problem.Problem              `json:"error,omitempty"`
+	Time      time.Time                     `json:"time"`
+}
+
+// Commander executes the commands subscribed from the northbound broker on devices, and publishes the replies.
+// The commands are executed concurrently, so the replies may be published out of order. A command is rejected
+// unless it is allowed by any rule, so nothing is allowed if no rules are configured.
+type Commander struct {
+	ctx       context.Context
+	bridge    *Bridge
+	client    operations.DataManagerClient
+	metaStore metastore.MetaStore
+	protocols *cache.Cache
+	states    *health.DeviceStates
+	opts      *config.CommandOptions
+	logger    *logger.Logger
+
+	sem     chan struct{}
+	mu      sync.Mutex
+	closed  bool // no more commands are accepted after the ctx is done, guarded by mu
+	running sync.WaitGroup
+}
+
+func NewCommander(ctx context.Context, bridge *Bridge, client operations.DataManagerClient,
+	metaStore metastore.MetaStore, protocols *cache.Cache, states *health.DeviceStates,
+	opts *config.CommandOptions, lg *logger.Logger) (*Commander, error) {
+	if opts.ReplyTopic == "" {
+		return nil, fmt.Errorf("the reply topic is required")
+	}
+	if strings.ContainsAny(opts.ReplyTopic, "+#") {
+		return nil, fmt.Errorf("the reply topic %q should not contain wildcards", opts.ReplyTopic)
+	}
+	if opts.QoS < 0 || opts.QoS > 2 {
+		return nil, fmt.Errorf("the qos should be 0, 1 or 2")
+	}
+	for i, rule := range opts.Allow {
+		for _, operation := range rule.Operations {
+			switch operation {
+			case OperationRead, OperationHardRead, OperationWrite, OperationCall:
+			default:
+				return nil, fmt.Errorf("invalid rule[%d] of northbound commands, unsupported operation %s", i, operation)
+			}
+		}
+	}
+	maxConcurrent := opts.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentCommands
+	}
+	c := &Commander{
+		ctx:       ctx,
+		bridge:    bridge,
+		client:    client,
+		metaStore: metaStore,
+		protocols: protocols,
+		states:    states,
+		opts:      opts,
+		logger:    lg,
+		sem:       make(chan struct{}, maxConcurrent),
+	}
+	bridge.OnConnect(c.subscribe)
+	return c, nil
+}
+
+// Run waits until the ctx is done, and then waits for the commands in execution.
+func (c *Commander) Run() {
+	<-c.ctx.Done()
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.running.Wait()
+}
+
+// subscribe subscribes the commands every time the broker is (re)connected, since the subscription
+// is lost if the session is clean.
+func (c *Commander) subscribe() {
+	if err := c.bridge.Subscribe(c.opts.Topic, byte(c.opts.QoS), c.receive); err != nil {
+		c.logger.WithError(err).Errorf("fail to subscribe the northbound commands of the topic[%s]", c.opts.Topic)
+		return
+	}
+	c.logger.Infof("the northbound commands of the topic[%s] are subscribed", c.opts.Topic)
+}
+
+// receive executes the command in a new goroutine, it blocks the client if too many commands are executing.
+func (c *Commander) receive(topic string, payload []byte) {
+	select {
+	case c.sem <- struct{}{}:
+	case <-c.ctx.Done():
+		return
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		<-c.sem
+		return
+	}
+	c.running.Add(1)
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			<-c.sem
+			c.running.Done()
+		}()
+		c.handle(topic, payload)
+	}()
+}
+
+func (c *Commander) handle(topic string, payload []byte) {
+	cmd := new(Command)
+	if err := json.Unmarshal(payload, cmd); err != nil {
+		// the command could not be correlated, so there is nobody to reply
+		c.logger.WithError(err).Warnf("drop the malformed northbound command of the topic[%s]", topic)
+		metrics.NorthboundCommands.WithLabelValues(metrics.NorthboundResultRejected).Inc()
+		return
+	}
+	reply := &Reply{ID: cmd.ID, DeviceID: cmd.DeviceID, Operation: cmd.Operation, Status: http.StatusOK}
+	productID, data, err := c.execute(cmd)
+	reply.Time = time.Now()
+	if err != nil {
+		reply.Status, reply.Error = problem.Of(err)
+		result := metrics.NorthboundResultFailed
+		var pe *problem.Error
+		if errors.As(err, &pe) && (pe.Code == problem.CodeForbidden || pe.Code == problem.CodeBadRequest) {
+			result = metrics.NorthboundResultRejected
+		}
+		metrics.NorthboundCommands.WithLabelValues(result).Inc()
+	} else {
+		reply.Data = data
+		metrics.NorthboundCommands.WithLabelValues(metrics.NorthboundResultSucceeded).Inc()
+	}
+	c.reply(cmd, productID, reply)
+}
+
+// execute executes the command, and returns the product of the device along with the result.
+func (c *Commander) execute(cmd *Command) (string, map[string]*models.DeviceData, error) {
+	if cmd.DeviceID == "" {
+		return "", nil, problem.BadRequest(nil, "the device_id of the command is required")
+	}
+	switch cmd.Operation {
+	case OperationRead, OperationHardRead, OperationWrite:
+		if cmd.PropertyID == "" {
+			return "", nil, problem.BadRequest(nil, "the property_id of the command is required")
+		}
+	case OperationCall:
+		if cmd.MethodID == "" {
+			return "", nil, problem.BadRequest(nil, "the method_id of the command is required")
+		}
+	default:
+		return "", nil, problem.BadRequest(nil, "unsupported operation %q, only supporting %s, %s, %s and %s",
+			cmd.Operation, OperationRead, OperationHardRead, OperationWrite, OperationCall)
+	}
+
+	device, err := c.metaStore.GetDevice(cmd.DeviceID)
+	if err != nil {
+		return "", nil, problem.Wrap(err, "fail to get the device[%s]", cmd.DeviceID)
+	}
+	product, err := c.metaStore.GetProduct(device.ProductID)
+	if err != nil {
+		return device.ProductID, nil, problem.Wrap(err, "fail to get the product[%s]", device.ProductID)
+	}
+	if !allowed(c.opts.Allow, cmd, device.ProductID) {
+		return device.ProductID, nil, problem.Forbidden(nil, "the operation %s on the device[%s] is not allowed",
+			cmd.Operation, cmd.DeviceID)
+	}
+	if err = health.Ready(c.protocols, c.states, product.Protocol, device); err != nil {
+		return device.ProductID, nil, err
+	}
+
+	var data map[string]*models.DeviceData
+	switch cmd.Operation {
+	case OperationRead:
+		data, err = c.client.Read(product.Protocol, device.ProductID, device.ID, cmd.PropertyID)
+	case OperationHardRead:
+		data, err = c.client.HardRead(product.Protocol, device.ProductID, device.ID, cmd.PropertyID)
+	case OperationWrite:
+		err = c.client.Write(product.Protocol, device.ProductID, device.ID, cmd.PropertyID, cmd.Data)
+	case OperationCall:
+		data, err = c.client.Call(product.Protocol, device.ProductID, device.ID, cmd.MethodID, cmd.Data)
+	}
+	if err != nil {
+		return device.ProductID, nil, problem.Wrap(err, "fail to %s the device[%s]", cmd.Operation, cmd.DeviceID)
+	}
+	return device.ProductID, data, nil
+}
+
+// allowed returns true if any rule matches the command, it is shared by the commands of the Sparkplug edge node.
+func allowed(rules []config.CommandRule, cmd *Command, productID string) bool {
+	for _, rule := range rules {
+		if matchRule(&rule, cmd, productID) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRule(rule *config.CommandRule, cmd *Command, productID string) bool {
+	if !matchAny(rule.Products, productID) || !matchAny(rule.Devices, cmd.DeviceID) ||
+		!matchAny(rule.Operations, cmd.Operation) {
+		return false
+	}
+	switch cmd.Operation {
+	case OperationCall:
+		return matchAny(rule.Methods, cmd.MethodID)
+	case OperationWrite:
+		if cmd.PropertyID != models.DeviceDataMultiPropsID {
+			return matchAny(rule.Properties, cmd.PropertyID)
+		}
+		// all properties written at once must be allowed
+		for propertyID := range cmd.Data {
+			if !matchAny(rule.Properties, propertyID) {
+				return false
+			}
+		}
+		return true
+	default:
+		// reading all properties at once is only allowed if the rule doesn't restrict the properties
+		return matchAny(rule.Properties, cmd.PropertyID)
+	}
+}
+
+// reply publishes the reply to the reply topic configured, the topic is never chosen by the sender of the
+// command, so that the commands could not be used to publish to arbitrary topics of the broker.
+func (c *Commander) reply(cmd *Command, productID string, reply *Reply) {
+	topic := strings.NewReplacer(
+		PlaceholderProduct, topicEscaper.Replace(productID),
+		PlaceholderDevice, topicEscaper.Replace(cmd.DeviceID),
+	).Replace(c.opts.ReplyTopic)
+	if strings.ContainsAny(topic, "+#") {
+		c.logger.Warnf("the reply of the northbound command[%s] is dropped, since the reply topic %q is invalid",
+			cmd.ID, topic)
+		return
+	}
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		c.logger.WithError(err).Errorf("fail to marshal the reply of the northbound command[%s]", cmd.ID)
+		return
+	}
+	if err = c.bridge.Publish(topic, byte(c.opts.QoS), false, payload); err != nil {
+		c.logger.WithError(err).Errorf("fail to publish the reply of the northbound command[%s]", cmd.ID)
+	}
+}
+
+// matchAny returns true if the values are empty or contain the value.
+func matchAny(values []string, value string) bool {
+	return len(values) == 0 || contains(values, value)
+}
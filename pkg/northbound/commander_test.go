@@ -0,0 +1,244 @@
+package northbound
+
+import (
+	"context"
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/api/http/problem"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	edgeerrors "github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevices is the client of the drivers, which records the operations executed on devices.
+type fakeDevices struct {
+	operations.DataManagerClient
+
+	mu    sync.Mutex
+	calls []string // "{operation} {device-id}/{property-id or method-id} {data sorted by names}"
+	fail  error
+}
+
+func (d *fakeDevices) record(operation, deviceID, id string, data map[string]*models.DeviceData) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var names []string
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d.calls = append(d.calls, strings.TrimSpace(operation+" "+deviceID+"/"+id+" "+strings.Join(names, ",")))
+	return d.fail
+}
+
+func (d *fakeDevices) Read(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	if err := d.record(OperationRead, deviceID, propertyID, nil); err != nil {
+		return nil, err
+	}
+	return map[models.ProductPropertyID]*models.DeviceData{propertyID: {Name: propertyID, Value: 10}}, nil
+}
+
+func (d *fakeDevices) Write(protocolID, productID, deviceID string, propertyID models.ProductPropertyID,
+	props map[models.ProductPropertyID]*models.DeviceData) error {
+	return d.record(OperationWrite, deviceID, propertyID, props)
+}
+
+func (d *fakeDevices) Call(protocolID, productID, deviceID string, methodID models.ProductMethodID,
+	ins map[string]*models.DeviceData) (map[string]*models.DeviceData, error) {
+	if err := d.record(OperationCall, deviceID, methodID, ins); err != nil {
+		return nil, err
+	}
+	return map[string]*models.DeviceData{"ok": {Name: "ok", Value: true}}, nil
+}
+
+func (d *fakeDevices) executed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.calls...)
+}
+
+// fakeMessage is a message delivered by the northbound broker.
+type fakeMessage struct {
+	mqtt.Message
+
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Topic() string {
+	return m.topic
+}
+
+func (m *fakeMessage) Payload() []byte {
+	return m.payload
+}
+
+// newTestCommander returns a commander whose commands could be executed on the connected device d1,
+// while the device d2 is disconnected.
+func newTestCommander(t *testing.T, ctx context.Context, broker *fakeBroker,
+	rules ...config.CommandRule) (*Commander, *fakeDevices) {
+	t.Helper()
+	store := newTestStore(t)
+	device, err := store.GetDevice("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.DeviceStatus = models.DeviceStateConnected
+	if err = store.UpdateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	protocols := cache.New(cache.NoExpiration, cache.NoExpiration)
+	protocols.SetDefault("modbus", struct{}{})
+
+	devices := new(fakeDevices)
+	c, err := NewCommander(ctx, newTestBridge(t, broker), devices, store, protocols, nil,
+		&config.CommandOptions{Topic: "site/commands/+", ReplyTopic: "site/replies/{product}/{device}", QoS: 1,
+			Allow: rules}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, devices
+}
+
+// execute handles the command, and returns the reply published.
+func execute(t *testing.T, c *Commander, broker *fakeBroker, cmd string) (string, *Reply) {
+	t.Helper()
+	n := len(broker.waitPublished(t, 0))
+	c.handle("site/commands/test", []byte(cmd))
+	published := broker.waitPublished(t, n+1)[n]
+	i := strings.IndexByte(published, ' ')
+	reply := new(Reply)
+	if err := json.Unmarshal([]byte(published[i+1:]), reply); err != nil {
+		t.Fatal(err)
+	}
+	return published[:i], reply
+}
+
+func TestCommanderExecutesAllowedCommands(t *testing.T) {
+	broker := &fakeBroker{connected: true}
+	c, devices := newTestCommander(t, context.Background(), broker,
+		config.CommandRule{Products: []string{"p1"}, Operations: []string{OperationRead, OperationWrite},
+			Properties: []string{"speed", "temp"}},
+		config.CommandRule{Devices: []string{"d1"}, Operations: []string{OperationCall}, Methods: []string{"reset"}})
+
+	topic, reply := execute(t, c, broker, `{"id": "c1", "device_id": "d1", "operation": "read", "property_id": "speed"}`)
+	if topic != "site/replies/p1/d1" {
+		t.Errorf("replied to %s, want the topic of the device", topic)
+	}
+	if reply.ID != "c1" || reply.DeviceID != "d1" || reply.Operation != OperationRead || reply.Status != http.StatusOK ||
+		reply.Data["speed"] == nil || reply.Error != nil {
+		t.Errorf("the reply = %+v, want the property read", reply)
+	}
+
+	_, reply = execute(t, c, broker, `{"id": "c2", "device_id": "d1", "operation": "write", "property_id": "*",
+		"data": {"speed": {"value": 20}, "temp": {"value": 30}}}`)
+	if reply.ID != "c2" || reply.Status != http.StatusOK {
+		t.Errorf("the reply = %+v, want all properties written", reply)
+	}
+	_, reply = execute(t, c, broker, `{"id": "c3", "device_id": "d1", "operation": "call", "method_id": "reset",
+		"data": {"delay": {"value": 1}}}`)
+	if reply.ID != "c3" || reply.Status != http.StatusOK || reply.Data["ok"] == nil {
+		t.Errorf("the reply = %+v, want the outputs of the method", reply)
+	}
+
+	want := []string{"read d1/speed", "write d1/* speed,temp", "call d1/reset delay"}
+	if got := devices.executed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("executed %v, want %v", got, want)
+	}
+}
+
+func TestCommanderRejectsCommands(t *testing.T) {
+	broker := &fakeBroker{connected: true}
+	c, devices := newTestCommander(t, context.Background(), broker,
+		config.CommandRule{Products: []string{"p1"}, Operations: []string{OperationRead, OperationWrite},
+			Properties: []string{"speed", "temp"}},
+		config.CommandRule{Devices: []string{"d1"}, Operations: []string{OperationCall}, Methods: []string{"reset"}})
+
+	for _, cmd := range []struct {
+		payload string
+		status  int
+		code    string
+	}{
+		{`{"device_id": "d1", "operation": "hard-read", "property_id": "speed"}`, http.StatusForbidden, problem.CodeForbidden},
+		// reading all properties at once is not allowed since the rule restricts the properties
+		{`{"device_id": "d1", "operation": "read", "property_id": "*"}`, http.StatusForbidden, problem.CodeForbidden},
+		{`{"device_id": "d1", "operation": "write", "property_id": "*", "data": {"speed": {"value": 1}, "mode": {"value": 2}}}`,
+			http.StatusForbidden, problem.CodeForbidden},
+		{`{"device_id": "d1", "operation": "call", "method_id": "reboot"}`, http.StatusForbidden, problem.CodeForbidden},
+		{`{"device_id": "d2", "operation": "call", "method_id": "reset"}`, http.StatusForbidden, problem.CodeForbidden},
+		{`{"device_id": "d2", "operation": "read", "property_id": "speed"}`, http.StatusConflict, problem.CodeDeviceDisconnected},
+		{`{"device_id": "d9", "operation": "read", "property_id": "speed"}`, http.StatusNotFound, problem.CodeNotFound},
+		{`{"device_id": "d1", "operation": "read"}`, http.StatusBadRequest, problem.CodeBadRequest},
+		{`{"device_id": "d1", "operation": "delete", "property_id": "speed"}`, http.StatusBadRequest, problem.CodeBadRequest},
+	} {
+		_, reply := execute(t, c, broker, cmd.payload)
+		if reply.Status != cmd.status || reply.Error == nil || reply.Error.Code != cmd.code {
+			t.Errorf("%s: the reply = %+v, want %d %s", cmd.payload, reply, cmd.status, cmd.code)
+		}
+	}
+	if got := devices.executed(); len(got) != 0 {
+		t.Errorf("executed %v, want no commands rejected to be executed", got)
+	}
+
+	devices.fail = edgeerrors.NewCommonEdgeError(edgeerrors.Driver, "fail to read", nil)
+	_, reply := execute(t, c, broker, `{"device_id": "d1", "operation": "read", "property_id": "speed"}`)
+	if reply.Status != http.StatusBadGateway || reply.Error == nil || reply.Error.Code != problem.CodeDriverError {
+		t.Errorf("the reply = %+v, want the error of the driver", reply)
+	}
+}
+
+func TestCommanderRejectsAllWithoutRules(t *testing.T) {
+	broker := &fakeBroker{connected: true}
+	c, _ := newTestCommander(t, context.Background(), broker)
+	_, reply := execute(t, c, broker, `{"device_id": "d1", "operation": "read", "property_id": "speed"}`)
+	if reply.Status != http.StatusForbidden {
+		t.Errorf("the reply = %+v, want nothing allowed without rules", reply)
+	}
+}
+
+func TestCommanderSubscribesCommands(t *testing.T) {
+	broker := &fakeBroker{connected: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	c, devices := newTestCommander(t, ctx, broker, config.CommandRule{Operations: []string{OperationRead}})
+	done := make(chan struct{})
+	go func() {
+		c.Run()
+		close(done)
+	}()
+
+	var handler mqtt.MessageHandler
+	for deadline := time.Now().Add(time.Second); handler == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the commands are not subscribed once the broker is connected")
+		}
+		broker.mu.Lock()
+		handler = broker.handlers["site/commands/+"]
+		broker.mu.Unlock()
+	}
+	// the malformed command could not be correlated, so it is dropped without a reply
+	handler(nil, &fakeMessage{topic: "site/commands/a", payload: []byte(`{"id": `)})
+	handler(nil, &fakeMessage{topic: "site/commands/a",
+		payload: []byte(`{"id": "c1", "device_id": "d1", "operation": "read", "property_id": "temp"}`)})
+	if published := broker.waitPublished(t, 1); len(published) != 1 || !strings.Contains(published[0], `"id":"c1"`) {
+		t.Errorf("published %v, want only the reply of c1", published)
+	}
+
+	cancel()
+	<-done
+	// no more commands are executed once the commander is stopped
+	handler(nil, &fakeMessage{topic: "site/commands/a",
+		payload: []byte(`{"id": "c2", "device_id": "d1", "operation": "read", "property_id": "temp"}`)})
+	if got := devices.executed(); !reflect.DeepEqual(got, []string{"read d1/temp"}) {
+		t.Errorf("executed %v, want only c1", got)
+	}
+}
@@ -0,0 +1,450 @@
+package northbound
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJSON  = "json"
+	FormatValue = "value"
+
+	PlaceholderProtocol = "{protocol}"
+	PlaceholderProduct  = "{product}"
+	PlaceholderDevice   = "{device}"
+	PlaceholderSource   = "{source}"
+	PlaceholderProperty = "{property}"
+	PlaceholderEvent    = "{event}"
+
+	// outSize is the number of records waiting to be published or buffered, the devices are not
+	// forwarded in time if the broker acknowledges slowly, and the messages are dropped by the Hub.
+	outSize = 1000
+	// resyncInterval is the interval to subscribe the devices created or deleted since then.
+	resyncInterval = time.Minute
+	// replayInterval is the interval to retry replaying the buffer if the replay is interrupted.
+	replayInterval = 10 * time.Second
+)
+
+// topicEscaper replaces the characters which could not be a part of a topic level.
+var topicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// Message is the payload of the format "json".
+type Message struct {
+	DeviceID   string                   `json:"device_id"`
+	ProductID  string                   `json:"product_id"`
+	Source     string                   `json:"source"`
+	EventID    models.ProductEventID    `json:"event_id,omitempty"`
+	PropertyID models.ProductPropertyID `json:"property_id,omitempty"`
+	Time       time.Time                `json:"time"`
+	Data       interface{}              `json:"data"`
+}
+
+// Forwarder republishes the properties, the events and the statuses of devices to the northbound broker
+// by the routes configured. The devices are subscribed from the Hub, so the subscriptions of the message
+// bus are shared with the other subscribers, e.g. WebSocket sessions and webhooks.
+//
+// The records are published one by one in order. They are buffered on the disk while the broker is
+// unreachable, and replayed in order once it is reconnected, before the new ones.
+type Forwarder struct {
+	ctx       context.Context
+	bridge    *Bridge
+	hub       *subscription.Hub
+	metaStore metastore.MetaStore
+	routes    []*route
+	buffer    *buffer // nil if the records are dropped while the broker is unreachable
+	logger    *logger.Logger
+
+	feeds   map[subscription.Topic]func() // topic -> stop, only accessed by Run
+	pumps   sync.WaitGroup
+	out     chan *record
+	replays chan struct{}
+}
+
+type route struct {
+	config.ForwardRoute
+	perProperty bool
+}
+
+// source is where the messages of a topic come from.
+type source struct {
+	protocolID string
+	productID  string
+	deviceID   string
+}
+
+func NewForwarder(ctx context.Context, bridge *Bridge, hub *subscription.Hub, metaStore metastore.MetaStore,
+	opts *config.ForwardOptions, lg *logger.Logger) (*Forwarder, error) {
+	f := &Forwarder{
+		ctx:       ctx,
+		bridge:    bridge,
+		hub:       hub,
+		metaStore: metaStore,
+		logger:    lg,
+		feeds:     make(map[subscription.Topic]func()),
+		out:       make(chan *record, outSize),
+		replays:   make(chan struct{}, 1),
+	}
+	for i, r := range opts.Routes {
+		if err := validateRoute(&r); err != nil {
+			return nil, fmt.Errorf("invalid route[%d] of the northbound forwarder, %s", i, err.Error())
+		}
+		f.routes = append(f.routes, &route{ForwardRoute: r, perProperty: strings.Contains(r.Topic, PlaceholderProperty)})
+	}
+	if opts.BufferPath != "" {
+		b, err := newBuffer(opts.BufferPath, int64(opts.BufferMaxMegabytes)*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		f.buffer = b
+	}
+	bridge.OnConnect(f.replay)
+	return f, nil
+}
+
+func validateRoute(r *config.ForwardRoute) error {
+	switch r.Source {
+	case subscription.KindProperties, subscription.KindEvents:
+	case subscription.KindStatus:
+		if strings.Contains(r.Topic, PlaceholderProperty) {
+			return fmt.Errorf("the placeholder %s is not available for the source %s", PlaceholderProperty, r.Source)
+		}
+	default:
+		return fmt.Errorf("unsupported source %s, only supporting %s, %s and %s", r.Source,
+			subscription.KindProperties, subscription.KindEvents, subscription.KindStatus)
+	}
+	if r.Topic == "" || strings.ContainsAny(r.Topic, "+#") {
+		return fmt.Errorf("the topic %q should be a non-empty topic without wildcards", r.Topic)
+	}
+	if strings.Contains(r.Topic, PlaceholderEvent) && r.Source != subscription.KindEvents {
+		return fmt.Errorf("the placeholder %s is only available for the source %s", PlaceholderEvent, subscription.KindEvents)
+	}
+	if r.Format == "" {
+		r.Format = FormatJSON
+	} else if r.Format != FormatJSON && r.Format != FormatValue {
+		return fmt.Errorf("unsupported format %s, only supporting %s and %s", r.Format, FormatJSON, FormatValue)
+	}
+	if r.QoS < 0 || r.QoS > 2 {
+		return fmt.Errorf("the qos should be 0, 1 or 2")
+	}
+	return nil
+}
+
+// Run forwards the devices until the ctx is done, the records not published yet are buffered then.
+func (f *Forwarder) Run() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.send()
+	}()
+
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := f.reconcile(); err != nil {
+			f.logger.WithError(err).Errorf("fail to reconcile the subscriptions of the northbound forwarder")
+		}
+		select {
+		case <-ticker.C:
+		case <-f.ctx.Done():
+			for topic, stop := range f.feeds {
+				stop()
+				delete(f.feeds, topic)
+			}
+			f.pumps.Wait()
+			<-done
+			f.flush()
+			return
+		}
+	}
+}
+
+// reconcile subscribes the topics needed by the routes, and stops the ones not needed any more.
+func (f *Forwarder) reconcile() error {
+	topics, err := f.resolveTopics()
+	if err != nil {
+		return err
+	}
+	for topic, stop := range f.feeds {
+		if _, ok := topics[topic]; !ok {
+			stop()
+			delete(f.feeds, topic)
+		}
+	}
+	for topic, src := range topics {
+		if _, ok := f.feeds[topic]; ok {
+			continue
+		}
+		bus, stop, err := f.hub.Subscribe(topic, src.protocolID, src.productID)
+		if err != nil {
+			f.logger.WithError(err).Errorf("fail to subscribe the topic[%s] for the northbound forwarder", topic)
+			continue
+		}
+		f.feeds[topic] = stop
+		f.pumps.Add(1)
+		go f.pump(topic, src, bus)
+	}
+	return nil
+}
+
+func (f *Forwarder) resolveTopics() (map[subscription.Topic]*source, error) {
+	topics := make(map[subscription.Topic]*source)
+	var devices []*models.Device
+	products := make(map[string]*models.Product)
+	for _, r := range f.routes {
+		if r.Source == subscription.KindStatus {
+			topics[subscription.Topic{DeviceID: subscription.AllDevices, Kind: subscription.KindStatus}] = &source{}
+			continue
+		}
+		if devices == nil {
+			var err error
+			if devices, _, err = f.metaStore.SearchDevices(nil, nil); err != nil {
+				return nil, err
+			}
+		}
+		for _, device := range devices {
+			if !r.match(device.ID, device.ProductID) {
+				continue
+			}
+			product, ok := products[device.ProductID]
+			if !ok {
+				var err error
+				if product, err = f.metaStore.GetProduct(device.ProductID); err != nil {
+					f.logger.WithError(err).Errorf("fail to get the product[%s] of the device[%s] for "+
+						"the northbound forwarder", device.ProductID, device.ID)
+					continue
+				}
+				products[device.ProductID] = product
+			}
+			src := &source{protocolID: product.Protocol, productID: product.ID, deviceID: device.ID}
+			if r.Source == subscription.KindProperties {
+				topics[subscription.Topic{DeviceID: device.ID, Kind: subscription.KindProperties}] = src
+				continue
+			}
+			for _, event := range product.Events {
+				topics[subscription.Topic{DeviceID: device.ID, Kind: subscription.KindEvents, EventID: event.Id}] = src
+			}
+		}
+	}
+	return topics, nil
+}
+
+// pump renders the messages of the topic by the routes matched until it is stopped.
+func (f *Forwarder) pump(topic subscription.Topic, src *source, bus <-chan interface{}) {
+	defer f.pumps.Done()
+	for data := range bus {
+		m := &Message{DeviceID: src.deviceID, ProductID: src.productID, Source: topic.Kind,
+			EventID: topic.EventID, Time: time.Now(), Data: data}
+		protocolID := src.protocolID
+		if change, ok := data.(*health.DeviceStateChange); ok {
+			m.DeviceID, m.ProductID, m.Time = change.DeviceID, change.ProductID, change.Time
+			protocolID = ""
+		}
+		for _, r := range f.routes {
+			if r.Source != topic.Kind || !r.match(m.DeviceID, m.ProductID) {
+				continue
+			}
+			records, err := r.render(protocolID, m)
+			if err != nil {
+				f.logger.WithError(err).Errorf("fail to render the message of the topic[%s] for the northbound "+
+					"forwarder", topic)
+				continue
+			}
+			for _, rec := range records {
+				select {
+				case f.out <- rec:
+				case <-f.ctx.Done():
+				}
+			}
+		}
+	}
+}
+
+// send publishes the records one by one, and replays the buffer once the broker is reconnected.
+func (f *Forwarder) send() {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec := <-f.out:
+			f.publish(rec)
+		case <-f.replays:
+			f.drain()
+		case <-ticker.C:
+			f.drain()
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// publish publishes the record directly if nothing is buffered, otherwise it is buffered after the others.
+func (f *Forwarder) publish(rec *record) {
+	if f.buffer == nil || f.buffer.Empty() {
+		err := f.bridge.Publish(rec.Topic, rec.QoS, rec.Retain, rec.Payload)
+		if err == nil {
+			metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultPublished).Inc()
+			return
+		}
+		if f.buffer == nil {
+			metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultDropped).Inc()
+			return
+		}
+	}
+	f.bury(rec)
+}
+
+func (f *Forwarder) bury(rec *record) {
+	dropped, err := f.buffer.Append(rec)
+	if err != nil {
+		f.logger.WithError(err).Errorf("fail to buffer the message of the topic[%s] for the northbound broker",
+			rec.Topic)
+		metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultDropped).Inc()
+		return
+	}
+	metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultBuffered).Inc()
+	if dropped != 0 {
+		f.logger.Warnf("the buffer of the northbound broker is full, %d oldest messages are dropped", dropped)
+		metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultDropped).Add(float64(dropped))
+	}
+}
+
+// replay notifies the sender to replay the buffer, it is called once the broker is (re)connected.
+func (f *Forwarder) replay() {
+	select {
+	case f.replays <- struct{}{}:
+	default:
+	}
+}
+
+// drain replays the buffer segment by segment while the broker is connected.
+func (f *Forwarder) drain() {
+	if f.buffer == nil {
+		return
+	}
+	for f.bridge.Connected() && f.ctx.Err() == nil {
+		records, sequence, err := f.buffer.Oldest()
+		if err != nil {
+			f.logger.WithError(err).Errorf("fail to read the buffer of the northbound broker")
+			return
+		}
+		if sequence == 0 {
+			return
+		}
+		for _, rec := range records {
+			if err = f.bridge.Publish(rec.Topic, rec.QoS, rec.Retain, rec.Payload); err != nil {
+				f.logger.WithError(err).Warnf("fail to replay the buffer of the northbound broker, retry later")
+				return
+			}
+			metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultPublished).Inc()
+		}
+		if err = f.buffer.Remove(sequence); err != nil {
+			f.logger.WithError(err).Errorf("fail to remove the segment replayed of the northbound buffer")
+			return
+		}
+	}
+}
+
+// flush buffers the records not published yet when the forwarder is stopped.
+func (f *Forwarder) flush() {
+	if f.buffer == nil {
+		return
+	}
+	for {
+		select {
+		case rec := <-f.out:
+			f.bury(rec)
+		default:
+			if err := f.buffer.Close(); err != nil {
+				f.logger.WithError(err).Errorf("fail to close the buffer of the northbound broker")
+			}
+			return
+		}
+	}
+}
+
+func (r *route) match(deviceID, productID string) bool {
+	if len(r.Devices) == 0 && len(r.Products) == 0 {
+		return true
+	}
+	return contains(r.Devices, deviceID) || contains(r.Products, productID)
+}
+
+// render returns the records of the message, there is a record for each property if the topic is per property.
+func (r *route) render(protocolID string, m *Message) ([]*record, error) {
+	replacer := []string{
+		PlaceholderProtocol, topicEscaper.Replace(protocolID),
+		PlaceholderProduct, topicEscaper.Replace(m.ProductID),
+		PlaceholderDevice, topicEscaper.Replace(m.DeviceID),
+		PlaceholderSource, m.Source,
+		PlaceholderEvent, topicEscaper.Replace(m.EventID),
+	}
+	props, ok := m.Data.(map[models.ProductPropertyID]*models.DeviceData)
+	if !r.perProperty || !ok {
+		payload, err := r.payload(m)
+		if err != nil {
+			return nil, err
+		}
+		topic := strings.NewReplacer(replacer...).Replace(r.Topic)
+		return []*record{{Topic: topic, QoS: byte(r.QoS), Retain: r.Retain, Payload: payload}}, nil
+	}
+
+	ids := make([]models.ProductPropertyID, 0, len(props))
+	for id := range props {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	records := make([]*record, 0, len(props))
+	for _, id := range ids {
+		pm := *m
+		pm.PropertyID, pm.Data = id, props[id]
+		payload, err := r.payload(&pm)
+		if err != nil {
+			return nil, err
+		}
+		topic := strings.NewReplacer(append(replacer, PlaceholderProperty, topicEscaper.Replace(id))...).Replace(r.Topic)
+		records = append(records, &record{Topic: topic, QoS: byte(r.QoS), Retain: r.Retain, Payload: payload})
+	}
+	return records, nil
+}
+
+// payload marshals the message, or only its value(s) if the format is "value".
+func (r *route) payload(m *Message) ([]byte, error) {
+	if r.Format == FormatJSON {
+		return json.Marshal(m)
+	}
+	switch data := m.Data.(type) {
+	case *models.DeviceData:
+		return json.Marshal(data.Value)
+	case map[models.ProductPropertyID]*models.DeviceData:
+		values := make(map[models.ProductPropertyID]interface{}, len(data))
+		for id, value := range data {
+			values[id] = value.Value
+		}
+		return json.Marshal(values)
+	case *health.DeviceStateChange:
+		return json.Marshal(data.State)
+	default:
+		return json.Marshal(data)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package northbound
+
+import (
+	"context"
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	stdconfig "github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is the client of the northbound broker, which records the messages published while it is connected.
+type fakeBroker struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	connected bool
+	published []string // "{topic} {payload}"
+	handlers  map[string]mqtt.MessageHandler
+}
+
+func (c *fakeBroker) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, topic+" "+string(payload.([]byte)))
+	return new(doneToken)
+}
+
+func (c *fakeBroker) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[string]mqtt.MessageHandler)
+	}
+	c.handlers[topic] = callback
+	return new(doneToken)
+}
+
+func (c *fakeBroker) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = connected
+}
+
+// waitPublished waits for n messages to be published, and returns all of them.
+func (c *fakeBroker) waitPublished(t *testing.T, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		published := append([]string{}, c.published...)
+		c.mu.Unlock()
+		if len(published) >= n {
+			return published
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages are published, want %d", len(published), n)
+		}
+	}
+}
+
+// doneToken is a token which is completed successfully.
+type doneToken struct {
+	mqtt.Token
+}
+
+func (t *doneToken) Wait() bool {
+	return true
+}
+
+func (t *doneToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *doneToken) Error() error {
+	return nil
+}
+
+func newTestLogger(t *testing.T) *logger.Logger {
+	t.Helper()
+	lg, err := logger.NewLogger(&stdconfig.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lg
+}
+
+func newTestBridge(t *testing.T, broker *fakeBroker) *Bridge {
+	return &Bridge{client: broker, tokenTimeout: time.Second, logger: newTestLogger(t)}
+}
+
+func newTestStore(t *testing.T) metastore.MetaStore {
+	t.Helper()
+	store, err := metastore.NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateProduct(&models.Product{ID: "p1", Name: "P1", Protocol: "modbus"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"d1", "d2"} {
+		if err = store.CreateDevice(&models.Device{ID: id, Name: id, ProductID: "p1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestRouteRender(t *testing.T) {
+	props := map[models.ProductPropertyID]*models.DeviceData{
+		"temp":  {Name: "temp", Value: 20.5},
+		"speed": {Name: "speed", Value: 10},
+	}
+	m := &Message{DeviceID: "d/1", ProductID: "p1", Source: subscription.KindProperties, Data: props}
+	for _, c := range []struct {
+		route config.ForwardRoute
+		want  []string
+	}{
+		{config.ForwardRoute{Source: "properties", Topic: "site/{protocol}/{product}/{device}/{property}", Format: FormatValue},
+			[]string{"site/modbus/p1/d_1/speed 10", "site/modbus/p1/d_1/temp 20.5"}},
+		{config.ForwardRoute{Source: "properties", Topic: "site/{device}/{source}", Format: FormatValue},
+			[]string{`site/d_1/properties {"speed":10,"temp":20.5}`}},
+	} {
+		r := &route{ForwardRoute: c.route, perProperty: strings.Contains(c.route.Topic, PlaceholderProperty)}
+		records, err := r.render("modbus", m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rec := range records {
+			got = append(got, rec.Topic+" "+string(rec.Payload))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: rendered %v, want %v", c.route.Topic, got, c.want)
+		}
+	}
+
+	r := &route{ForwardRoute: config.ForwardRoute{Source: "properties", Topic: "site/{device}/{property}", Format: FormatJSON},
+		perProperty: true}
+	records, err := r.render("modbus", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Message)
+	if err = json.Unmarshal(records[0].Payload, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.DeviceID != "d/1" || decoded.PropertyID != "speed" || decoded.Source != subscription.KindProperties {
+		t.Errorf("the message = %+v, want the property speed of the device", decoded)
+	}
+}
+
+func TestValidateRoute(t *testing.T) {
+	for _, r := range []config.ForwardRoute{
+		{Source: "methods", Topic: "site/{device}"},
+		{Source: "status", Topic: "site/{device}/{property}"},
+		{Source: "properties", Topic: "site/{device}/{event}"},
+		{Source: "properties", Topic: "site/+/{device}"},
+		{Source: "properties", Topic: ""},
+		{Source: "properties", Topic: "site/{device}", Format: "xml"},
+		{Source: "properties", Topic: "site/{device}", QoS: 3},
+	} {
+		if err := validateRoute(&r); err == nil {
+			t.Errorf("the route %+v should be rejected", r)
+		}
+	}
+	r := config.ForwardRoute{Source: "events", Topic: "site/{device}/{event}"}
+	if err := validateRoute(&r); err != nil || r.Format != FormatJSON {
+		t.Errorf("got %v and the format %q, want the route valid with the default format", err, r.Format)
+	}
+}
+
+func TestForwarderBuffersWhileDisconnected(t *testing.T) {
+	broker := new(fakeBroker)
+	hub := subscription.NewHub(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := NewForwarder(ctx, newTestBridge(t, broker), hub, newTestStore(t), &config.ForwardOptions{
+		Routes:     []config.ForwardRoute{{Source: "status", Topic: "site/{product}/{device}/status", Format: FormatValue}},
+		BufferPath: t.TempDir(), BufferMaxMegabytes: 1,
+	}, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		f.Run()
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for deadline := time.Now().Add(time.Second); hub.Active() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the statuses are not subscribed")
+		}
+	}
+	publish := func(deviceID, state string) {
+		hub.Publish(subscription.Topic{DeviceID: deviceID, Kind: subscription.KindStatus},
+			&health.DeviceStateChange{DeviceID: deviceID, ProductID: "p1", State: state})
+	}
+
+	publish("d1", models.DeviceStateDisconnected)
+	publish("d2", models.DeviceStateException)
+	for deadline := time.Now().Add(time.Second); f.buffer.Empty(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the messages are not buffered while the broker is disconnected")
+		}
+	}
+
+	// the buffered messages are replayed in order once the broker is reconnected, before the new ones
+	broker.setConnected(true)
+	f.replay()
+	publish("d1", models.DeviceStateConnected)
+	want := []string{
+		`site/p1/d1/status "disconnected"`,
+		`site/p1/d2/status "exception"`,
+		`site/p1/d1/status "connected"`,
+	}
+	if got := broker.waitPublished(t, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+	// the replayed segment is removed right after it is published
+	for deadline := time.Now().Add(time.Second); !f.buffer.Empty(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the buffer should be empty once it is replayed")
+		}
+	}
+}
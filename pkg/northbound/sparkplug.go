@@ -0,0 +1,529 @@
+package northbound
+
+import (
+	"context"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/config"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SparkplugNamespace = "spBv1.0"
+
+	MessageTypeNBIRTH = "NBIRTH"
+	MessageTypeNDEATH = "NDEATH"
+	MessageTypeDBIRTH = "DBIRTH"
+	MessageTypeDDEATH = "DDEATH"
+	MessageTypeDDATA  = "DDATA"
+	MessageTypeNCMD   = "NCMD"
+	MessageTypeDCMD   = "DCMD"
+
+	MetricBdSeq       = "bdSeq"
+	MetricNodeRebirth = "Node Control/Rebirth"
+
+	// sequenceModulus is the modulus of both the sequence numbers and the birth/death sequence numbers.
+	sequenceModulus = 256
+)
+
+// EdgeNode is a Sparkplug B edge node, whose devices are the devices of the manager selected. It shares
+// the connection of the Bridge, whose will is the NDEATH of the edge node.
+//
+// Once the broker is (re)connected, the NBIRTH is published along with the DBIRTH of each device alive,
+// i.e. connected or in exception, whose metrics are the properties of its product. The reported properties
+// are published as DDATA, the DDEATH is published once the device is disconnected and the DBIRTH once it is
+// connected again. The metrics of DCMD are written to the device if the write is allowed by the rules of the
+// northbound commands and the device is ready, and a NCMD of "Node Control/Rebirth" publishes all births again.
+type EdgeNode struct {
+	ctx       context.Context
+	bridge    *Bridge
+	hub       *subscription.Hub
+	metaStore metastore.MetaStore
+	client    operations.DataManagerClient
+	protocols *cache.Cache
+	states    *health.DeviceStates
+	rules     []config.CommandRule // the rules allowing the DCMD
+	opts      *config.SparkplugOptions
+	logger    *logger.Logger
+
+	feeds map[subscription.Topic]func() // topic -> stop, only accessed by Run
+	pumps sync.WaitGroup
+
+	mu      sync.Mutex // guards the fields below and serializes the messages published
+	bdSeq   uint64
+	willed  bool   // the will has been provided at least once
+	seq     uint64 // the sequence number of the next message
+	online  bool   // the NBIRTH of the current connection has been published
+	closed  bool
+	devices map[string]*sparkplugDevice // Sparkplug device ID -> device
+}
+
+type sparkplugDevice struct {
+	device  *models.Device
+	product *models.Product
+	values  map[models.ProductPropertyID]*models.DeviceData // the latest values, published in the DBIRTH
+	alive   bool
+	born    bool // the DBIRTH has been published in the current connection
+}
+
+func NewEdgeNode(ctx context.Context, bridge *Bridge, hub *subscription.Hub, metaStore metastore.MetaStore,
+	client operations.DataManagerClient, protocols *cache.Cache, states *health.DeviceStates,
+	rules []config.CommandRule, opts *config.SparkplugOptions, lg *logger.Logger) (*EdgeNode, error) {
+	if strings.ContainsAny(opts.GroupID, "/+#") || strings.ContainsAny(opts.EdgeNodeID, "/+#") {
+		return nil, fmt.Errorf("the group ID and the edge node ID should not contain '/', '+' or '#'")
+	}
+	n := &EdgeNode{
+		ctx:       ctx,
+		bridge:    bridge,
+		hub:       hub,
+		metaStore: metaStore,
+		client:    client,
+		protocols: protocols,
+		states:    states,
+		rules:     rules,
+		opts:      opts,
+		logger:    lg,
+		feeds:     make(map[subscription.Topic]func()),
+		devices:   make(map[string]*sparkplugDevice),
+	}
+	bridge.SetWill(n.will)
+	bridge.OnConnect(n.birth)
+	return n, nil
+}
+
+// Run keeps the devices of the edge node consistent with the ones in the meta store until the ctx is done,
+// and then publishes the NDEATH, since the will is not published if the connection is closed normally.
+func (n *EdgeNode) Run() {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := n.reconcile(); err != nil {
+			n.logger.WithError(err).Errorf("fail to reconcile the devices of the Sparkplug edge node")
+		}
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			for topic, stop := range n.feeds {
+				stop()
+				delete(n.feeds, topic)
+			}
+			n.pumps.Wait()
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.online {
+				n.publish(MessageTypeNDEATH, "", n.death())
+			}
+			n.online, n.closed = false, true
+			return
+		}
+	}
+}
+
+// reconcile subscribes the properties of the devices selected and the statuses of all devices, publishes
+// the DBIRTH of the new devices and the DDEATH of the removed ones.
+func (n *EdgeNode) reconcile() error {
+	devices, _, err := n.metaStore.SearchDevices(nil, nil)
+	if err != nil {
+		return err
+	}
+	topics := map[subscription.Topic]*source{
+		{DeviceID: subscription.AllDevices, Kind: subscription.KindStatus}: {},
+	}
+	selected := make(map[string]*sparkplugDevice)
+	products := make(map[string]*models.Product)
+	for _, device := range devices {
+		if (len(n.opts.Devices) != 0 || len(n.opts.Products) != 0) &&
+			!contains(n.opts.Devices, device.ID) && !contains(n.opts.Products, device.ProductID) {
+			continue
+		}
+		product, ok := products[device.ProductID]
+		if !ok {
+			if product, err = n.metaStore.GetProduct(device.ProductID); err != nil {
+				n.logger.WithError(err).Errorf("fail to get the product[%s] of the device[%s] for the Sparkplug "+
+					"edge node", device.ProductID, device.ID)
+				continue
+			}
+			products[device.ProductID] = product
+		}
+		selected[topicEscaper.Replace(device.ID)] = &sparkplugDevice{device: device, product: product,
+			values: make(map[models.ProductPropertyID]*models.DeviceData), alive: alive(device.DeviceStatus)}
+		topics[subscription.Topic{DeviceID: device.ID, Kind: subscription.KindProperties}] =
+			&source{protocolID: product.Protocol, productID: product.ID, deviceID: device.ID}
+	}
+	n.reconcileDevices(selected)
+
+	for topic, stop := range n.feeds {
+		if _, ok := topics[topic]; !ok {
+			stop()
+			delete(n.feeds, topic)
+		}
+	}
+	for topic, src := range topics {
+		if _, ok := n.feeds[topic]; ok {
+			continue
+		}
+		bus, stop, err := n.hub.Subscribe(topic, src.protocolID, src.productID)
+		if err != nil {
+			n.logger.WithError(err).Errorf("fail to subscribe the topic[%s] for the Sparkplug edge node", topic)
+			continue
+		}
+		n.feeds[topic] = stop
+		n.pumps.Add(1)
+		go n.pump(src.deviceID, bus)
+	}
+	return nil
+}
+
+func (n *EdgeNode) reconcileDevices(selected map[string]*sparkplugDevice) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for id, d := range n.devices {
+		if _, ok := selected[id]; !ok {
+			if d.born {
+				n.publish(MessageTypeDDEATH, id, &Payload{Timestamp: millis(time.Now())})
+			}
+			delete(n.devices, id)
+		}
+	}
+	for id, s := range selected {
+		d, ok := n.devices[id]
+		if !ok {
+			n.devices[id] = s
+			if n.online && s.alive {
+				n.publishDeviceBirth(id, s)
+			}
+			continue
+		}
+		// the DBIRTH is published again if the properties are changed, since it declares the metrics
+		if !reflect.DeepEqual(d.product.Properties, s.product.Properties) {
+			d.product = s.product
+			if d.born {
+				n.publishDeviceBirth(id, d)
+			}
+		}
+		d.device = s.device
+	}
+}
+
+// pump publishes the properties of the device, or the statuses of all devices if the device is empty,
+// until it is stopped.
+func (n *EdgeNode) pump(deviceID string, bus <-chan interface{}) {
+	defer n.pumps.Done()
+	for data := range bus {
+		switch data := data.(type) {
+		case map[models.ProductPropertyID]*models.DeviceData:
+			n.report(deviceID, data)
+		case *health.DeviceStateChange:
+			n.changeState(data)
+		}
+	}
+}
+
+// report publishes the DDATA of the properties declared by the product of the device.
+func (n *EdgeNode) report(deviceID string, props map[models.ProductPropertyID]*models.DeviceData) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := topicEscaper.Replace(deviceID)
+	d, ok := n.devices[id]
+	if !ok {
+		return
+	}
+	for propertyID, value := range props {
+		d.values[propertyID] = value
+	}
+	if !d.born {
+		return
+	}
+	payload := &Payload{Timestamp: millis(time.Now())}
+	for _, prop := range d.product.Properties {
+		if value, ok := props[prop.Id]; ok {
+			payload.Metrics = append(payload.Metrics, metricOf(prop, value))
+		}
+	}
+	if len(payload.Metrics) != 0 {
+		n.publish(MessageTypeDDATA, id, payload)
+	}
+}
+
+func (n *EdgeNode) changeState(change *health.DeviceStateChange) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := topicEscaper.Replace(change.DeviceID)
+	d, ok := n.devices[id]
+	if !ok {
+		return
+	}
+	d.alive = alive(change.State)
+	switch {
+	case d.alive && !d.born && n.online:
+		n.publishDeviceBirth(id, d)
+	case !d.alive && d.born:
+		n.publish(MessageTypeDDEATH, id, &Payload{Timestamp: millis(change.Time)})
+		d.born = false
+	}
+}
+
+// will returns the NDEATH as the will, it is called before every attempt to connect, so that the bdSeq
+// is increased for each connection, and the births of the previous connection are invalidated.
+func (n *EdgeNode) will() *Will {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.willed {
+		n.bdSeq = (n.bdSeq + 1) % sequenceModulus
+	}
+	n.willed, n.online = true, false
+	for _, d := range n.devices {
+		d.born = false
+	}
+	payload, _ := n.death().Marshal() // the bdSeq is always valid
+	return &Will{Topic: n.topic(MessageTypeNDEATH, ""), Payload: payload, QoS: 1}
+}
+
+// birth subscribes the commands and publishes the births, it is called once the broker is (re)connected.
+func (n *EdgeNode) birth() {
+	for _, topic := range []string{n.topic(MessageTypeNCMD, ""), n.topic(MessageTypeDCMD, "+")} {
+		if err := n.bridge.Subscribe(topic, 1, n.command); err != nil {
+			n.logger.WithError(err).Errorf("fail to subscribe the topic[%s] of the Sparkplug edge node", topic)
+		}
+	}
+	n.rebirth()
+}
+
+// rebirth publishes the NBIRTH and the DBIRTH of each device alive, the sequence number starts from 0.
+func (n *EdgeNode) rebirth() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.seq = 0
+	n.online = n.publish(MessageTypeNBIRTH, "", &Payload{Timestamp: millis(time.Now()), Metrics: []*Metric{
+		{Name: MetricBdSeq, DataType: DataTypeUInt64, Value: n.bdSeq},
+		{Name: MetricNodeRebirth, DataType: DataTypeBoolean, Value: false},
+	}})
+	if !n.online {
+		return
+	}
+	ids := make([]string, 0, len(n.devices))
+	for id := range n.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if d := n.devices[id]; d.alive {
+			n.publishDeviceBirth(id, d)
+		}
+	}
+}
+
+// command handles the NCMD and DCMD, it blocks the client until the properties are written,
+// so that the commands are executed in order.
+func (n *EdgeNode) command(topic string, b []byte) {
+	payload, err := UnmarshalPayload(b)
+	if err != nil {
+		n.logger.WithError(err).Warnf("drop the malformed Sparkplug command of the topic[%s]", topic)
+		return
+	}
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 {
+		return
+	}
+	switch levels[2] {
+	case MessageTypeNCMD:
+		for _, m := range payload.Metrics {
+			if m.Name == MetricNodeRebirth && m.Value == true {
+				n.rebirth()
+			}
+		}
+	case MessageTypeDCMD:
+		if len(levels) != 5 {
+			return
+		}
+		if err = n.write(levels[4], payload.Metrics); err != nil {
+			n.logger.WithError(err).Errorf("fail to execute the Sparkplug command of the topic[%s]", topic)
+		}
+	}
+}
+
+// write writes the metrics into the properties of the device, the metrics which are not writable
+// properties of its product are ignored. The command is rejected as a whole unless the write is allowed
+// by the rules, the same as a northbound command, and the device is ready.
+func (n *EdgeNode) write(id string, values []*Metric) error {
+	n.mu.Lock()
+	d, ok := n.devices[id]
+	n.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown device %s", id)
+	}
+	// the status of the device is refreshed only on reconciling, so the one in the meta store is used
+	device, err := n.metaStore.GetDevice(d.device.ID)
+	if err != nil {
+		return err
+	}
+
+	props := make(map[models.ProductPropertyID]*models.DeviceData)
+	for _, m := range values {
+		prop := findProperty(d.product, m.Name)
+		if prop == nil || !prop.Writeable {
+			n.logger.Warnf("ignore the metric %s of the Sparkplug command, since it is not a writable property "+
+				"of the device[%s]", m.Name, device.ID)
+			continue
+		}
+		value, err := valueOf(prop, m.Value)
+		if err != nil {
+			return fmt.Errorf("invalid metric %s, %s", m.Name, err.Error())
+		}
+		props[prop.Id] = &models.DeviceData{Name: prop.Id, Type: prop.FieldType, Value: value, Ts: time.Now()}
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	cmd := &Command{DeviceID: device.ID, Operation: OperationWrite, PropertyID: models.DeviceDataMultiPropsID,
+		Data: props}
+	if len(props) == 1 {
+		for propertyID := range props {
+			cmd.PropertyID = propertyID
+		}
+	}
+	if !allowed(n.rules, cmd, device.ProductID) {
+		metrics.NorthboundCommands.WithLabelValues(metrics.NorthboundResultRejected).Inc()
+		return fmt.Errorf("the operation %s on the device[%s] is not allowed", cmd.Operation, device.ID)
+	}
+	if err = health.Ready(n.protocols, n.states, d.product.Protocol, device); err != nil {
+		metrics.NorthboundCommands.WithLabelValues(metrics.NorthboundResultFailed).Inc()
+		return err
+	}
+	if err = n.client.Write(d.product.Protocol, d.product.ID, device.ID, cmd.PropertyID, props); err != nil {
+		metrics.NorthboundCommands.WithLabelValues(metrics.NorthboundResultFailed).Inc()
+		return err
+	}
+	metrics.NorthboundCommands.WithLabelValues(metrics.NorthboundResultSucceeded).Inc()
+	return nil
+}
+
+// publishDeviceBirth publishes the DBIRTH declaring all properties of the product, the caller must hold the lock.
+func (n *EdgeNode) publishDeviceBirth(id string, d *sparkplugDevice) {
+	payload := &Payload{Timestamp: millis(time.Now())}
+	for _, prop := range d.product.Properties {
+		payload.Metrics = append(payload.Metrics, metricOf(prop, d.values[prop.Id]))
+	}
+	d.born = n.publish(MessageTypeDBIRTH, id, payload)
+}
+
+// publish publishes the message with the next sequence number except NDEATH, the caller must hold the lock.
+func (n *EdgeNode) publish(messageType, deviceID string, payload *Payload) bool {
+	if messageType != MessageTypeNDEATH {
+		seq := n.seq
+		payload.Seq = &seq
+		n.seq = (n.seq + 1) % sequenceModulus
+	}
+	b, errs := payload.Marshal()
+	for _, err := range errs {
+		n.logger.WithError(err).Warnf("publish the metric as null in the Sparkplug %s of the device[%s]",
+			messageType, deviceID)
+	}
+	if err := n.bridge.Publish(n.topic(messageType, deviceID), 0, false, b); err != nil {
+		n.logger.WithError(err).Warnf("fail to publish the Sparkplug %s of the device[%s]", messageType, deviceID)
+		metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultDropped).Inc()
+		return false
+	}
+	metrics.NorthboundMessages.WithLabelValues(metrics.NorthboundResultPublished).Inc()
+	return true
+}
+
+// death returns the payload of NDEATH, the caller must hold the lock.
+func (n *EdgeNode) death() *Payload {
+	return &Payload{Timestamp: millis(time.Now()), Metrics: []*Metric{
+		{Name: MetricBdSeq, DataType: DataTypeUInt64, Value: n.bdSeq},
+	}}
+}
+
+func (n *EdgeNode) topic(messageType, deviceID string) string {
+	topic := strings.Join([]string{SparkplugNamespace, n.opts.GroupID, messageType, n.opts.EdgeNodeID}, "/")
+	if deviceID != "" {
+		topic += "/" + deviceID
+	}
+	return topic
+}
+
+// alive returns true if the device could serve data operations.
+func alive(state string) bool {
+	return state == models.DeviceStateConnected || state == models.DeviceStateException
+}
+
+func findProperty(product *models.Product, id models.ProductPropertyID) *models.ProductProperty {
+	for _, prop := range product.Properties {
+		if prop.Id == id {
+			return prop
+		}
+	}
+	return nil
+}
+
+// dataTypeOf maps the field type of the property to the data type of the metric.
+func dataTypeOf(fieldType string) uint32 {
+	switch fieldType {
+	case models.PropertyValueTypeInt:
+		return DataTypeInt64
+	case models.PropertyValueTypeUint:
+		return DataTypeUInt64
+	case models.PropertyValueTypeFloat:
+		return DataTypeDouble
+	case models.PropertyValueTypeBool:
+		return DataTypeBoolean
+	default:
+		return DataTypeString
+	}
+}
+
+// metricOf returns the metric of the property, its value is null if the value is not reported yet.
+func metricOf(prop *models.ProductProperty, value *models.DeviceData) *Metric {
+	m := &Metric{Name: prop.Id, DataType: dataTypeOf(prop.FieldType)}
+	if value != nil {
+		m.Value = value.Value
+		if !value.Ts.IsZero() {
+			m.Timestamp = millis(value.Ts)
+		}
+	}
+	return m
+}
+
+// valueOf converts the value of the metric to the field type of the property.
+func valueOf(prop *models.ProductProperty, value interface{}) (interface{}, error) {
+	switch prop.FieldType {
+	case models.PropertyValueTypeInt:
+		v, err := toUint64(value)
+		return int64(v), err
+	case models.PropertyValueTypeUint:
+		return toUint64(value)
+	case models.PropertyValueTypeFloat:
+		return toFloat64(value)
+	case models.PropertyValueTypeBool:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("%v is not a bool", value)
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+func millis(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
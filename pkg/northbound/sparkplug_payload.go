@@ -0,0 +1,296 @@
+package northbound
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// The data types of Sparkplug B metrics, only the scalar ones are supported.
+const (
+	DataTypeInt8    uint32 = 1
+	DataTypeInt16   uint32 = 2
+	DataTypeInt32   uint32 = 3
+	DataTypeInt64   uint32 = 4
+	DataTypeUInt8   uint32 = 5
+	DataTypeUInt16  uint32 = 6
+	DataTypeUInt32  uint32 = 7
+	DataTypeUInt64  uint32 = 8
+	DataTypeFloat   uint32 = 9
+	DataTypeDouble  uint32 = 10
+	DataTypeBoolean uint32 = 11
+	DataTypeString  uint32 = 12
+	DataTypeText    uint32 = 14
+)
+
+// The numbers of the fields of the Payload and the Metric messages in sparkplug_b.proto.
+const (
+	fieldPayloadTimestamp protowire.Number = 1
+	fieldPayloadMetrics   protowire.Number = 2
+	fieldPayloadSeq       protowire.Number = 3
+
+	fieldMetricName         protowire.Number = 1
+	fieldMetricTimestamp    protowire.Number = 3
+	fieldMetricDataType     protowire.Number = 4
+	fieldMetricIsNull       protowire.Number = 7
+	fieldMetricIntValue     protowire.Number = 10
+	fieldMetricLongValue    protowire.Number = 11
+	fieldMetricFloatValue   protowire.Number = 12
+	fieldMetricDoubleValue  protowire.Number = 13
+	fieldMetricBooleanValue protowire.Number = 14
+	fieldMetricStringValue  protowire.Number = 15
+)
+
+// Payload is the subset of the Sparkplug B payload used by the edge node, it is encoded by hand
+// rather than generated, since only a few scalar fields are needed.
+type Payload struct {
+	Timestamp uint64 // milliseconds since the epoch
+	Metrics   []*Metric
+	Seq       *uint64 // nil for NDEATH, which has no sequence number
+}
+
+// Metric is a named value, its value is an int64, an uint64, a float64, a bool or a string according to
+// the data type, and nil if it is null.
+type Metric struct {
+	Name      string
+	Timestamp uint64
+	DataType  uint32
+	Value     interface{}
+}
+
+// Marshal encodes the payload in the protobuf wire format. A metric whose value could not be encoded as
+// its data type is encoded as null, so that one bad value doesn't drop the whole message, and the errors
+// of such metrics are returned along with the payload.
+func (p *Payload) Marshal() ([]byte, []error) {
+	var b []byte
+	var errs []error
+	b = protowire.AppendTag(b, fieldPayloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Timestamp)
+	for _, m := range p.Metrics {
+		mb, err := m.marshal()
+		if err != nil {
+			errs = append(errs, err)
+			null := *m
+			null.Value = nil
+			mb, _ = null.marshal() // a null value is always encoded
+		}
+		b = protowire.AppendTag(b, fieldPayloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	if p.Seq != nil {
+		b = protowire.AppendTag(b, fieldPayloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, *p.Seq)
+	}
+	return b, errs
+}
+
+func (m *Metric) marshal() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, fieldMetricName, protowire.BytesType)
+	b = protowire.AppendString(b, m.Name)
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, fieldMetricTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Timestamp)
+	}
+	b = protowire.AppendTag(b, fieldMetricDataType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.DataType))
+	if m.Value == nil {
+		b = protowire.AppendTag(b, fieldMetricIsNull, protowire.VarintType)
+		return protowire.AppendVarint(b, 1), nil
+	}
+
+	switch m.DataType {
+	case DataTypeInt8, DataTypeInt16, DataTypeInt32, DataTypeUInt8, DataTypeUInt16, DataTypeUInt32:
+		v, err := toUint64(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of the metric %s, %s", m.Name, err.Error())
+		}
+		// the signed integers are encoded in two's complement
+		b = protowire.AppendTag(b, fieldMetricIntValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(v)))
+	case DataTypeInt64, DataTypeUInt64:
+		v, err := toUint64(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of the metric %s, %s", m.Name, err.Error())
+		}
+		b = protowire.AppendTag(b, fieldMetricLongValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case DataTypeFloat:
+		v, err := toFloat64(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of the metric %s, %s", m.Name, err.Error())
+		}
+		b = protowire.AppendTag(b, fieldMetricFloatValue, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(float32(v)))
+	case DataTypeDouble:
+		v, err := toFloat64(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of the metric %s, %s", m.Name, err.Error())
+		}
+		b = protowire.AppendTag(b, fieldMetricDoubleValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case DataTypeBoolean:
+		v, ok := m.Value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid value of the metric %s, %v is not a bool", m.Name, m.Value)
+		}
+		b = protowire.AppendTag(b, fieldMetricBooleanValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case DataTypeString, DataTypeText:
+		b = protowire.AppendTag(b, fieldMetricStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, fmt.Sprint(m.Value))
+	default:
+		return nil, fmt.Errorf("unsupported data type %d of the metric %s", m.DataType, m.Name)
+	}
+	return b, nil
+}
+
+// UnmarshalPayload decodes the payload, the fields unsupported are skipped.
+func UnmarshalPayload(b []byte) (*Payload, error) {
+	p := new(Payload)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldPayloadTimestamp && typ == protowire.VarintType:
+			p.Timestamp, n = protowire.ConsumeVarint(b)
+		case num == fieldPayloadSeq && typ == protowire.VarintType:
+			var seq uint64
+			seq, n = protowire.ConsumeVarint(b)
+			p.Seq = &seq
+		case num == fieldPayloadMetrics && typ == protowire.BytesType:
+			var mb []byte
+			if mb, n = protowire.ConsumeBytes(b); n >= 0 {
+				m, err := unmarshalMetric(mb)
+				if err != nil {
+					return nil, err
+				}
+				p.Metrics = append(p.Metrics, m)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return p, nil
+}
+
+func unmarshalMetric(b []byte) (*Metric, error) {
+	m := new(Metric)
+	var isNull bool
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		switch {
+		case num == fieldMetricName && typ == protowire.BytesType:
+			m.Name, n = protowire.ConsumeString(b)
+		case num == fieldMetricTimestamp && typ == protowire.VarintType:
+			m.Timestamp, n = protowire.ConsumeVarint(b)
+		case num == fieldMetricDataType && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.DataType = uint32(v)
+		case num == fieldMetricIsNull && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			isNull = protowire.DecodeBool(v)
+		case (num == fieldMetricIntValue || num == fieldMetricLongValue || num == fieldMetricBooleanValue) &&
+			typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.Value = v // converted by the data type below
+		case num == fieldMetricFloatValue && typ == protowire.Fixed32Type:
+			var f uint32
+			f, n = protowire.ConsumeFixed32(b)
+			m.Value = float64(math.Float32frombits(f))
+		case num == fieldMetricDoubleValue && typ == protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+			m.Value = math.Float64frombits(v)
+		case num == fieldMetricStringValue && typ == protowire.BytesType:
+			m.Value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if isNull {
+		m.Value = nil
+		return m, nil
+	}
+	if v, ok := m.Value.(uint64); ok {
+		switch m.DataType {
+		case DataTypeInt8:
+			m.Value = int64(int8(v))
+		case DataTypeInt16:
+			m.Value = int64(int16(v))
+		case DataTypeInt32:
+			m.Value = int64(int32(v))
+		case DataTypeInt64:
+			m.Value = int64(v)
+		case DataTypeBoolean:
+			m.Value = protowire.DecodeBool(v)
+		}
+	}
+	return m, nil
+}
+
+// toUint64 converts the number to an uint64, the negative integers are converted in two's complement.
+func toUint64(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case int:
+		return uint64(v), nil
+	case int8:
+		return uint64(v), nil
+	case int16:
+		return uint64(v), nil
+	case int32:
+		return uint64(v), nil
+	case int64:
+		return uint64(v), nil
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case float32:
+		return uint64(int64(v)), nil
+	case float64: // numbers decoded from JSON
+		return uint64(int64(v)), nil
+	default:
+		return 0, fmt.Errorf("%v is not an integer", value)
+	}
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	default:
+		u, err := toUint64(value)
+		if err != nil {
+			return 0, fmt.Errorf("%v is not a number", value)
+		}
+		switch value.(type) {
+		case uint, uint8, uint16, uint32, uint64:
+			return float64(u), nil
+		}
+		return float64(int64(u)), nil
+	}
+}
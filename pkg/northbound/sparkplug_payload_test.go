@@ -0,0 +1,234 @@
+package northbound
+
+import (
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// sparkplugPayload returns the descriptor of the Payload message in sparkplug_b.proto, only the fields of
+// the Payload and the Metric are declared, the nested messages, e.g. the metadata, are omitted.
+func sparkplugPayload(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type,
+		label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number),
+			Type: typ.Enum(), Label: label.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("sparkplug_b.proto"),
+		Package: proto.String("org.eclipse.tahu.protobuf"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Payload"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("timestamp", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+				field("metrics", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated,
+					".org.eclipse.tahu.protobuf.Payload.Metric"),
+				field("seq", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+				field("uuid", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+				field("body", 5, descriptorpb.FieldDescriptorProto_TYPE_BYTES, optional, ""),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Metric"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("alias", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+					field("timestamp", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+					field("datatype", 4, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional, ""),
+					field("is_historical", 5, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional, ""),
+					field("is_transient", 6, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional, ""),
+					field("is_null", 7, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional, ""),
+					field("int_value", 10, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional, ""),
+					field("long_value", 11, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+					field("float_value", 12, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, optional, ""),
+					field("double_value", 13, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+					field("boolean_value", 14, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional, ""),
+					field("string_value", 15, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("bytes_value", 16, descriptorpb.FieldDescriptorProto_TYPE_BYTES, optional, ""),
+				},
+			}},
+		}},
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatalf("fail to build the descriptor of sparkplug_b.proto: %s", err.Error())
+	}
+	return fd.Messages().ByName("Payload")
+}
+
+// metricFields returns the fields set in the metric, keyed by the field name.
+func metricFields(m protoreflect.Message) map[string]interface{} {
+	fields := make(map[string]interface{})
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fields[string(fd.Name())] = v.Interface()
+		return true
+	})
+	return fields
+}
+
+func TestPayloadMarshal(t *testing.T) {
+	seq := uint64(7)
+	payload := &Payload{Timestamp: 1600000000000, Seq: &seq, Metrics: []*Metric{
+		{Name: "temperature", Timestamp: 1600000000001, DataType: DataTypeDouble, Value: 21.5},
+		{Name: "offset", DataType: DataTypeInt32, Value: -5},
+		{Name: "counter", DataType: DataTypeUInt64, Value: uint64(math.MaxUint64)},
+		{Name: "ratio", DataType: DataTypeFloat, Value: float64(0.25)},
+		{Name: "enabled", DataType: DataTypeBoolean, Value: true},
+		{Name: "mode", DataType: DataTypeString, Value: "auto"},
+		{Name: "setpoint", DataType: DataTypeInt64, Value: nil},
+	}}
+	b, errs := payload.Marshal()
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	desc := sparkplugPayload(t)
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		t.Fatalf("fail to unmarshal the payload by sparkplug_b.proto: %s", err.Error())
+	}
+	if got := msg.Get(desc.Fields().ByName("timestamp")).Uint(); got != payload.Timestamp {
+		t.Errorf("timestamp = %d, want %d", got, payload.Timestamp)
+	}
+	if got := msg.Get(desc.Fields().ByName("seq")).Uint(); got != seq {
+		t.Errorf("seq = %d, want %d", got, seq)
+	}
+	want := []map[string]interface{}{
+		{"name": "temperature", "timestamp": uint64(1600000000001), "datatype": DataTypeDouble, "double_value": 21.5},
+		{"name": "offset", "datatype": DataTypeInt32, "int_value": uint32(0xFFFFFFFB)},
+		{"name": "counter", "datatype": DataTypeUInt64, "long_value": uint64(math.MaxUint64)},
+		{"name": "ratio", "datatype": DataTypeFloat, "float_value": float32(0.25)},
+		{"name": "enabled", "datatype": DataTypeBoolean, "boolean_value": true},
+		{"name": "mode", "datatype": DataTypeString, "string_value": "auto"},
+		{"name": "setpoint", "datatype": DataTypeInt64, "is_null": true},
+	}
+	metrics := msg.Get(desc.Fields().ByName("metrics")).List()
+	if metrics.Len() != len(want) {
+		t.Fatalf("%d metrics are encoded, want %d", metrics.Len(), len(want))
+	}
+	for i := range want {
+		if got := metricFields(metrics.Get(i).Message()); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("metric[%d] = %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestPayloadMarshalInvalidValue(t *testing.T) {
+	payload := &Payload{Timestamp: 1, Metrics: []*Metric{
+		{Name: "speed", DataType: DataTypeInt64, Value: "fast"},
+		{Name: "enabled", DataType: DataTypeBoolean, Value: true},
+	}}
+	b, errs := payload.Marshal()
+	if len(errs) != 1 {
+		t.Fatalf("%d errors are returned, want 1", len(errs))
+	}
+	decoded, err := UnmarshalPayload(b)
+	if err != nil {
+		t.Fatalf("fail to unmarshal the payload: %s", err.Error())
+	}
+	want := []*Metric{
+		{Name: "speed", DataType: DataTypeInt64, Value: nil},
+		{Name: "enabled", DataType: DataTypeBoolean, Value: true},
+	}
+	if !reflect.DeepEqual(decoded.Metrics, want) {
+		t.Errorf("metrics = %v, want the invalid one to be null and the others to be kept", decoded.Metrics)
+	}
+}
+
+func TestUnmarshalPayload(t *testing.T) {
+	desc := sparkplugPayload(t)
+	metricDesc := desc.Fields().ByName("metrics").Message()
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(desc.Fields().ByName("timestamp"), protoreflect.ValueOfUint64(1600000000000))
+	msg.Set(desc.Fields().ByName("seq"), protoreflect.ValueOfUint64(3))
+	msg.Set(desc.Fields().ByName("uuid"), protoreflect.ValueOfString("unsupported"))
+	metrics := msg.Mutable(desc.Fields().ByName("metrics")).List()
+	for _, fields := range []map[string]interface{}{
+		{"name": "Node Control/Rebirth", "datatype": DataTypeBoolean, "boolean_value": true},
+		{"name": "offset", "alias": uint64(2), "datatype": DataTypeInt8, "int_value": uint32(0xFFFFFFFE)},
+		{"name": "level", "datatype": DataTypeInt16, "int_value": uint32(300)},
+		{"name": "total", "timestamp": uint64(1600000000002), "datatype": DataTypeInt64,
+			"long_value": uint64(0xFFFFFFFFFFFFFFFF)},
+		{"name": "counter", "datatype": DataTypeUInt32, "int_value": uint32(4000000000)},
+		{"name": "ratio", "datatype": DataTypeFloat, "float_value": float32(0.5)},
+		{"name": "temperature", "datatype": DataTypeDouble, "double_value": -1.25},
+		{"name": "mode", "datatype": DataTypeText, "string_value": "manual"},
+		{"name": "setpoint", "datatype": DataTypeDouble, "is_null": true},
+	} {
+		m := dynamicpb.NewMessage(metricDesc)
+		for name, value := range fields {
+			m.Set(metricDesc.Fields().ByName(protoreflect.Name(name)), protoreflect.ValueOf(value))
+		}
+		metrics.Append(protoreflect.ValueOfMessage(m))
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		t.Fatalf("fail to marshal the payload by sparkplug_b.proto: %s", err.Error())
+	}
+
+	payload, err := UnmarshalPayload(b)
+	if err != nil {
+		t.Fatalf("fail to unmarshal the payload: %s", err.Error())
+	}
+	if payload.Timestamp != 1600000000000 || payload.Seq == nil || *payload.Seq != 3 {
+		t.Errorf("timestamp = %d, seq = %v, want 1600000000000 and 3", payload.Timestamp, payload.Seq)
+	}
+	want := []*Metric{
+		{Name: "Node Control/Rebirth", DataType: DataTypeBoolean, Value: true},
+		{Name: "offset", DataType: DataTypeInt8, Value: int64(-2)},
+		{Name: "level", DataType: DataTypeInt16, Value: int64(300)},
+		{Name: "total", Timestamp: 1600000000002, DataType: DataTypeInt64, Value: int64(-1)},
+		{Name: "counter", DataType: DataTypeUInt32, Value: uint64(4000000000)},
+		{Name: "ratio", DataType: DataTypeFloat, Value: float64(0.5)},
+		{Name: "temperature", DataType: DataTypeDouble, Value: -1.25},
+		{Name: "mode", DataType: DataTypeText, Value: "manual"},
+		{Name: "setpoint", DataType: DataTypeDouble, Value: nil},
+	}
+	if len(payload.Metrics) != len(want) {
+		t.Fatalf("%d metrics are decoded, want %d", len(payload.Metrics), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(payload.Metrics[i], want[i]) {
+			t.Errorf("metric[%d] = %+v, want %+v", i, payload.Metrics[i], want[i])
+		}
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	seq := uint64(255)
+	payload := &Payload{Timestamp: 42, Seq: &seq, Metrics: []*Metric{
+		{Name: "bdSeq", DataType: DataTypeUInt64, Value: uint64(9)},
+		{Name: "offset", DataType: DataTypeInt32, Value: int64(-100)},
+		{Name: "enabled", DataType: DataTypeBoolean, Value: false},
+		{Name: "note", DataType: DataTypeString, Value: ""},
+	}}
+	b, errs := payload.Marshal()
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	decoded, err := UnmarshalPayload(b)
+	if err != nil {
+		t.Fatalf("fail to unmarshal the payload: %s", err.Error())
+	}
+	want := &Payload{Timestamp: 42, Seq: &seq, Metrics: []*Metric{
+		{Name: "bdSeq", DataType: DataTypeUInt64, Value: uint64(9)},
+		{Name: "offset", DataType: DataTypeInt32, Value: int64(-100)},
+		{Name: "enabled", DataType: DataTypeBoolean, Value: false},
+		{Name: "note", DataType: DataTypeString, Value: ""},
+	}}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("payload = %+v, want %+v", decoded, want)
+	}
+}
@@ -2,14 +2,19 @@ package startup
 
 import (
 	"context"
+	"github.com/thingio/edge-device-manager/pkg/config"
 	"github.com/thingio/edge-device-manager/pkg/manager"
 	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"os/signal"
+	"syscall"
 )
 
-func Startup(metaStore metastore.MetaStore) {
-	ctx, cancel := context.WithCancel(context.Background())
+func Startup(cfg *config.Configuration, metaStore metastore.MetaStore) {
+	// the context will be cancelled once SIGINT or SIGTERM is received, e.g. `docker stop`
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-	dm, err := manager.NewDeviceManager(ctx, cancel, metaStore)
+	dm, err := manager.NewDeviceManager(ctx, cancel, cfg, metaStore)
 	if err != nil {
 		panic(err)
 	}
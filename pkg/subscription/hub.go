@@ -0,0 +1,304 @@
+package subscription
+
+import (
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KindProperties = "properties"
+	KindEvents     = "events"
+	KindStatus     = "status"
+
+	// AllDevices is the device ID of the topic of the statuses of all devices, i.e. "devices/*/status".
+	AllDevices = "*"
+
+	// bufferSize is the number of messages buffered for each subscriber, the messages are dropped
+	// rather than blocking the others if a subscriber doesn't consume them in time.
+	bufferSize = 100
+	// historySize is the number of the latest messages kept for each topic to be replayed,
+	// it is not larger than bufferSize so that the replayed messages are never dropped.
+	historySize = 100
+	// historyRetention is how long the history of a topic is kept after its last message.
+	historyRetention = 5 * time.Minute
+)
+
+// Message is a message of a topic with an identifier, which is used to resume the subscription.
+type Message struct {
+	ID    string
+	Topic Topic
+	Data  interface{}
+}
+
+// Topic identifies a stream of a device, whose string form is "devices/{device-id}/properties",
+// "devices/{device-id}/events/{event-id}" or "devices/{device-id}/status", and "devices/*/status"
+// identifies the statuses of all devices.
+type Topic struct {
+	DeviceID string                `json:"device_id"`
+	Kind     string                `json:"kind"`
+	EventID  models.ProductEventID `json:"event_id,omitempty"`
+}
+
+func (t Topic) String() string {
+	if t.Kind == KindEvents {
+		return fmt.Sprintf("devices/%s/%s/%s", t.DeviceID, t.Kind, t.EventID)
+	}
+	return fmt.Sprintf("devices/%s/%s", t.DeviceID, t.Kind)
+}
+
+func ParseTopic(topic string) (Topic, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[0] != "devices" || parts[1] == "" {
+		return Topic{}, fmt.Errorf("invalid topic %s, it should be devices/{device-id}/{kind}", topic)
+	}
+	t := Topic{DeviceID: parts[1], Kind: parts[2]}
+	if t.DeviceID == AllDevices && t.Kind != KindStatus {
+		return Topic{}, fmt.Errorf("invalid topic %s, only the statuses could be subscribed for all devices", topic)
+	}
+	switch {
+	case t.Kind == KindProperties && len(parts) == 3, t.Kind == KindStatus && len(parts) == 3:
+	case t.Kind == KindEvents && len(parts) == 4 && parts[3] != "":
+		t.EventID = parts[3]
+	default:
+		return Topic{}, fmt.Errorf("invalid topic %s, only supporting devices/{device-id}/%s, "+
+			"devices/{device-id}/%s/{event-id} and devices/{device-id}/%s", topic, KindProperties, KindEvents, KindStatus)
+	}
+	return t, nil
+}
+
+// Hub shares the subscriptions of the message bus among all subscribers of the same topic.
+// It is necessary because the ManagerService unsubscribes the topic of the message bus when
+// any of its subscriptions is stopped, which breaks the other subscriptions of the same topic.
+//
+// The statuses of devices are not subscribed by the Hub, because the manager already subscribes
+// them for each driver, and they are published into the Hub by the manager.
+//
+// The latest messages of each topic are kept for a while, so that a subscriber could resume
+// from the last message it received, e.g. by the Last-Event-ID of Server-Sent Events.
+type Hub struct {
+	service operations.ManagerService
+	// epoch distinguishes the identifiers of messages from the ones before the manager restarts
+	epoch     string
+	sequence  uint64
+	histories *cache.Cache // topic -> []*Message
+
+	mu    sync.Mutex
+	feeds map[Topic]*feed
+}
+
+// feed is a subscription of the message bus and its subscribers.
+type feed struct {
+	stop        func()                    // nil if the messages are published by the manager
+	subscribers map[chan interface{}]bool // bus -> whether to deliver *Message rather than the data
+	// stopping is closed once the subscription of the message bus is stopped, it is nil unless the last
+	// subscriber is gone. The feed is kept until then, so that the topic is not subscribed again meanwhile,
+	// since stopping the old subscription unsubscribes the topic of the message bus, including the new one.
+	stopping chan struct{}
+}
+
+func NewHub(service operations.ManagerService) *Hub {
+	return &Hub{
+		service:   service,
+		epoch:     operations.NewReqID(),
+		histories: cache.New(historyRetention, historyRetention),
+		feeds:     make(map[Topic]*feed),
+	}
+}
+
+// Subscribe returns a bus of the messages of the topic and a function to stop the subscription.
+// The protocol and the product of the device are only used to subscribe the message bus
+// if there is no other subscriber of the same topic.
+func (h *Hub) Subscribe(topic Topic, protocolID, productID string) (<-chan interface{}, func(), error) {
+	return h.subscribe(topic, protocolID, productID, false, "")
+}
+
+// Resume is the same as Subscribe, except that the messages are delivered as *Message, and the messages
+// kept after the one identified by lastID are delivered first. The kept messages are not replayed if
+// lastID is empty, or it is not found, e.g. it is too old or it is issued before the manager restarts.
+func (h *Hub) Resume(topic Topic, protocolID, productID, lastID string) (<-chan interface{}, func(), error) {
+	return h.subscribe(topic, protocolID, productID, true, lastID)
+}
+
+func (h *Hub) subscribe(topic Topic, protocolID, productID string,
+	tagged bool, lastID string) (<-chan interface{}, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, ok := h.feeds[topic]
+	for ok && f.stopping != nil {
+		stopping := f.stopping
+		h.mu.Unlock()
+		<-stopping
+		h.mu.Lock()
+		f, ok = h.feeds[topic]
+	}
+	if !ok {
+		f = &feed{subscribers: make(map[chan interface{}]bool)}
+		var bus <-chan interface{}
+		var err error
+		switch topic.Kind {
+		case KindProperties:
+			bus, f.stop, err = h.service.SubscribeDeviceProps(protocolID, productID, topic.DeviceID,
+				models.DeviceDataMultiPropsID)
+		case KindEvents:
+			bus, f.stop, err = h.service.SubscribeDeviceEvent(protocolID, productID, topic.DeviceID, topic.EventID)
+		case KindStatus:
+		default:
+			return nil, nil, fmt.Errorf("unsupported kind %s of the topic", topic.Kind)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		h.feeds[topic] = f
+		if bus != nil {
+			go h.pump(topic, f, bus)
+		}
+	}
+
+	bus := make(chan interface{}, bufferSize)
+	if lastID != "" {
+		for _, message := range h.replay(topic, lastID) {
+			bus <- message
+		}
+	}
+	f.subscribers[bus] = tagged
+	metrics.StreamSubscribers.Inc()
+
+	var once sync.Once
+	return bus, func() {
+		once.Do(func() {
+			h.unsubscribe(topic, f, bus)
+		})
+	}, nil
+}
+
+// unsubscribe removes the bus from the feed, and stops the feed if it is the last subscriber. The feed is
+// stopped after unlocking, since stopping may wait for the message bus, which blocks the other topics, and
+// the subscribers of the same topic wait until it is stopped, see feed.stopping.
+func (h *Hub) unsubscribe(topic Topic, f *feed, bus chan interface{}) {
+	h.mu.Lock()
+	delete(f.subscribers, bus)
+	close(bus)
+	metrics.StreamSubscribers.Dec()
+	if len(f.subscribers) != 0 {
+		h.mu.Unlock()
+		return
+	}
+	if f.stop == nil {
+		delete(h.feeds, topic)
+		h.mu.Unlock()
+		return
+	}
+	f.stopping = make(chan struct{})
+	h.mu.Unlock()
+
+	f.stop()
+
+	h.mu.Lock()
+	delete(h.feeds, topic)
+	close(f.stopping)
+	h.mu.Unlock()
+}
+
+// Publish delivers the message to the subscribers of the topic, it is used for the topics
+// which are not subscribed by the Hub, e.g. the statuses of devices. The statuses are also
+// delivered to the subscribers of the statuses of all devices.
+func (h *Hub) Publish(topic Topic, message interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if f, ok := h.feeds[topic]; ok {
+		h.deliver(topic, f, message)
+	}
+	if topic.Kind == KindStatus && topic.DeviceID != AllDevices {
+		all := Topic{DeviceID: AllDevices, Kind: KindStatus}
+		if f, ok := h.feeds[all]; ok {
+			h.deliver(all, f, message)
+		}
+	}
+}
+
+// pump delivers the messages of the message bus until the feed is stopped.
+func (h *Hub) pump(topic Topic, f *feed, bus <-chan interface{}) {
+	for message := range bus {
+		h.mu.Lock()
+		h.deliver(topic, f, message)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) deliver(topic Topic, f *feed, data interface{}) {
+	h.sequence++
+	message := &Message{ID: fmt.Sprintf("%s-%d", h.epoch, h.sequence), Topic: topic, Data: data}
+	h.record(message)
+	for bus, tagged := range f.subscribers {
+		var m interface{} = data
+		if tagged {
+			m = message
+		}
+		select {
+		case bus <- m:
+		default:
+			metrics.StreamDroppedMessages.Inc()
+		}
+	}
+}
+
+// record keeps the message in the history of its topic, and refreshes the retention of the history.
+func (h *Hub) record(message *Message) {
+	var history []*Message
+	if v, ok := h.histories.Get(message.Topic.String()); ok {
+		history = v.([]*Message)
+	}
+	if len(history) >= historySize {
+		history = append(history[:0:0], history[len(history)-historySize+1:]...)
+	}
+	h.histories.SetDefault(message.Topic.String(), append(history, message))
+}
+
+// replay returns the kept messages of the topic after the one identified by lastID.
+func (h *Hub) replay(topic Topic, lastID string) []*Message {
+	i := strings.LastIndex(lastID, "-")
+	if i < 0 || lastID[:i] != h.epoch {
+		return nil
+	}
+	last, err := strconv.ParseUint(lastID[i+1:], 10, 64)
+	if err != nil {
+		return nil
+	}
+	v, ok := h.histories.Get(topic.String())
+	if !ok {
+		return nil
+	}
+	history := v.([]*Message)
+	for j, message := range history {
+		if message.ID == lastID {
+			return history[j+1:]
+		}
+	}
+	if len(history) != 0 && last < h.sequenceOf(history[0]) {
+		// some messages after the last one are lost, replay all kept ones rather than nothing
+		return history
+	}
+	return nil
+}
+
+func (h *Hub) sequenceOf(message *Message) uint64 {
+	sequence, _ := strconv.ParseUint(message.ID[strings.LastIndex(message.ID, "-")+1:], 10, 64)
+	return sequence
+}
+
+// Active returns the number of the topics subscribed by now.
+func (h *Hub) Active() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.feeds)
+}
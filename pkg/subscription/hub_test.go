@@ -0,0 +1,247 @@
+package subscription
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService records the subscriptions of the message bus, its stop blocks until the gate is closed if any.
+type fakeService struct {
+	operations.ManagerService
+
+	mu     sync.Mutex
+	events []string // "subscribe" and "stop" in order
+	buses  []chan interface{}
+	gate   chan struct{}
+}
+
+func (s *fakeService) SubscribeDeviceProps(protocolID, productID, deviceID string,
+	propertyID models.ProductPropertyID) (<-chan interface{}, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, "subscribe")
+	bus := make(chan interface{}, 10)
+	s.buses = append(s.buses, bus)
+	gate := s.gate
+	return bus, func() {
+		if gate != nil {
+			<-gate
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.events = append(s.events, "stop")
+		close(bus)
+	}, nil
+}
+
+func (s *fakeService) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.events...)
+}
+
+func receive(t *testing.T, bus <-chan interface{}) interface{} {
+	t.Helper()
+	select {
+	case m := <-bus:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no message is received")
+		return nil
+	}
+}
+
+func TestHubSharesSubscription(t *testing.T) {
+	service := new(fakeService)
+	hub := NewHub(service)
+	topic := Topic{DeviceID: "d1", Kind: KindProperties}
+
+	bus1, stop1, err := hub.Subscribe(topic, "p", "pd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus2, stop2, err := hub.Subscribe(topic, "p", "pd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := service.recorded(); !reflect.DeepEqual(got, []string{"subscribe"}) {
+		t.Fatalf("events = %v, want the message bus to be subscribed once", got)
+	}
+
+	service.buses[0] <- "v1"
+	if got := receive(t, bus1); got != "v1" {
+		t.Errorf("the first subscriber receives %v, want v1", got)
+	}
+	if got := receive(t, bus2); got != "v1" {
+		t.Errorf("the second subscriber receives %v, want v1", got)
+	}
+
+	stop1()
+	stop1() // stopping twice is harmless
+	if got := service.recorded(); !reflect.DeepEqual(got, []string{"subscribe"}) {
+		t.Fatalf("events = %v, want the message bus to be kept for the other subscriber", got)
+	}
+	if _, ok := <-bus1; ok {
+		t.Error("the bus of the stopped subscriber should be closed")
+	}
+	stop2()
+	if got := service.recorded(); !reflect.DeepEqual(got, []string{"subscribe", "stop"}) {
+		t.Fatalf("events = %v, want the message bus to be stopped with the last subscriber", got)
+	}
+	if n := hub.Active(); n != 0 {
+		t.Errorf("%d topics are active, want 0", n)
+	}
+}
+
+func TestHubResubscribeWaitsForStop(t *testing.T) {
+	service := &fakeService{gate: make(chan struct{})}
+	hub := NewHub(service)
+	topic := Topic{DeviceID: "d1", Kind: KindProperties}
+
+	_, stop, err := hub.Subscribe(topic, "p", "pd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	subscribed := make(chan (<-chan interface{}))
+	go func() {
+		time.Sleep(20 * time.Millisecond) // let the stop begin first
+		bus, _, err := hub.Subscribe(topic, "p", "pd")
+		if err != nil {
+			t.Error(err)
+		}
+		subscribed <- bus
+	}()
+
+	select {
+	case <-subscribed:
+		t.Fatal("the topic is subscribed again before the old subscription is stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(service.gate)
+	<-stopped
+	bus := <-subscribed
+
+	if got := service.recorded(); !reflect.DeepEqual(got, []string{"subscribe", "stop", "subscribe"}) {
+		t.Fatalf("events = %v, want the new subscription after the old one is stopped", got)
+	}
+	service.buses[1] <- "v2"
+	if got := receive(t, bus); got != "v2" {
+		t.Errorf("the new subscriber receives %v, want v2", got)
+	}
+}
+
+func TestHubPublishStatus(t *testing.T) {
+	hub := NewHub(new(fakeService))
+	one := Topic{DeviceID: "d1", Kind: KindStatus}
+	all := Topic{DeviceID: AllDevices, Kind: KindStatus}
+
+	bus1, stop1, err := hub.Subscribe(one, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop1()
+	busAll, stopAll, err := hub.Subscribe(all, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopAll()
+
+	hub.Publish(one, "connected")
+	if got := receive(t, bus1); got != "connected" {
+		t.Errorf("the subscriber of the device receives %v, want connected", got)
+	}
+	if got := receive(t, busAll); got != "connected" {
+		t.Errorf("the subscriber of all devices receives %v, want connected", got)
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	hub := NewHub(new(fakeService))
+	topic := Topic{DeviceID: "d1", Kind: KindStatus}
+
+	bus, stop, err := hub.Resume(topic, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, status := range []string{"connected", "disconnected", "reconnecting"} {
+		hub.Publish(topic, status)
+		message := receive(t, bus).(*Message)
+		if message.Topic != topic || message.Data != status {
+			t.Fatalf("received %+v, want the tagged %s", message, status)
+		}
+		ids = append(ids, message.ID)
+	}
+	stop()
+
+	// the history is kept after the last subscriber is gone
+	bus, stop, err = hub.Resume(topic, "", "", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	for _, want := range ids[1:] {
+		if message := receive(t, bus).(*Message); message.ID != want {
+			t.Errorf("replayed %s, want %s", message.ID, want)
+		}
+	}
+	hub.Publish(topic, "connected")
+	if message := receive(t, bus).(*Message); message.Data != "connected" {
+		t.Errorf("received %+v, want the live message after the replayed ones", message)
+	}
+
+	for _, lastID := range []string{ids[2] + "0", "another-epoch-1", "garbage"} {
+		bus, stop, err := hub.Resume(topic, "", "", lastID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(bus); n != 0 {
+			t.Errorf("%s: %d messages are replayed, want none", lastID, n)
+		}
+		stop()
+	}
+}
+
+func TestHubReplaysAllKeptMessagesIfSomeAreLost(t *testing.T) {
+	hub := NewHub(new(fakeService))
+	topic := Topic{DeviceID: "d1", Kind: KindStatus}
+	bus, stop, err := hub.Resume(topic, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Publish(topic, 0)
+	first := receive(t, bus).(*Message)
+	stop()
+	// the messages are kept only if the topic is subscribed
+	_, stop, err = hub.Subscribe(topic, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= historySize; i++ {
+		hub.Publish(topic, i)
+	}
+	stop()
+
+	// the message after the first one has been dropped from the history
+	bus, stop, err = hub.Resume(topic, "", "", first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if n := len(bus); n != historySize {
+		t.Fatalf("%d messages are replayed, want %d", n, historySize)
+	}
+	if message := receive(t, bus).(*Message); message.Data != 1 {
+		t.Errorf("the oldest replayed message is %v, want 1", message.Data)
+	}
+}
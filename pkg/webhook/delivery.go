@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderWebhookID = "X-Webhook-ID"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// HeaderSignature is "sha256=" followed by the hex of HMAC-SHA256("{timestamp}.{payload}") with the secret.
+	HeaderSignature = "X-Webhook-Signature"
+
+	defaultContentType = "application/json"
+
+	initialBackoff = time.Second
+	maxBackoff     = 5 * time.Minute
+	// maxResponseSize limits the size of the response body read, which is only read to reuse the connection.
+	maxResponseSize = 64 * 1024
+)
+
+// work sends the deliveries of the hook one by one until it is stopped.
+func (d *Dispatcher) work(h *hook) {
+	defer d.workers.Done()
+	for {
+		select {
+		case delivery := <-h.queue:
+			d.deliver(h, delivery)
+		case <-h.stop:
+			return
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver sends the delivery, and retries it with exponential backoff if the webhook doesn't respond,
+// or responds 408, 429 or 5xx. It is moved into the dead letters if it still fails after all attempts.
+func (d *Dispatcher) deliver(h *hook, delivery *Delivery) {
+	backoff := initialBackoff
+	for attempts := 1; ; attempts++ {
+		webhook := h.webhook()
+		code, retryable, err := d.post(webhook, delivery)
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookResultDelivered).Inc()
+			return
+		}
+		if !retryable || attempts >= webhook.MaxAttempts {
+			d.logger.WithError(err).Warnf("fail to deliver %s to the webhook[%s] after %d attempts",
+				delivery.ID, webhook.ID, attempts)
+			d.mu.Lock()
+			d.bury(webhook.ID, &DeadLetter{Delivery: delivery, Attempts: attempts, StatusCode: code,
+				Error: err.Error(), Time: time.Now()})
+			d.mu.Unlock()
+			return
+		}
+
+		metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookResultRetried).Inc()
+		timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))) // with jitter
+		select {
+		case <-timer.C:
+		case <-h.stop:
+			timer.Stop()
+			return
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post sends the delivery once, and returns the status code responded and whether it is worth retrying.
+func (d *Dispatcher) post(webhook *metastore.Webhook, delivery *Delivery) (int, bool, error) {
+	payload, err := render(webhook, delivery)
+	if err != nil {
+		return 0, false, fmt.Errorf("fail to render the payload, got %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, webhook.Timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, false, err
+	}
+
+	contentType := webhook.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range webhook.Headers {
+		req.Header.Set(key, value)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(HeaderWebhookID, webhook.ID)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if webhook.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retryable := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500
+	return resp.StatusCode, retryable, fmt.Errorf("the webhook responds %s", resp.Status)
+}
+
+// Sign returns the signature of the payload sent at the timestamp, which is sent in the header X-Webhook-Signature.
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// render renders the delivery by the template of the webhook, or marshals it as JSON if there is no template.
+func render(webhook *metastore.Webhook, delivery *Delivery) ([]byte, error) {
+	tmpl, err := webhook.ParseTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == nil {
+		return json.Marshal(delivery)
+	}
+	buf := new(bytes.Buffer)
+	if err = tmpl.Execute(buf, delivery); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,366 @@
+package webhook
+
+import (
+	"context"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/metrics"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queueSize is the number of deliveries buffered for each webhook, the deliveries are moved into
+	// the dead letters directly if the webhook falls behind so much.
+	queueSize = 1000
+	// deadLettersSize is the number of the latest dead letters kept for each webhook.
+	deadLettersSize = 1000
+	// resyncInterval is the interval to subscribe the events of the devices created or deleted since then.
+	resyncInterval = time.Minute
+)
+
+// Delivery is what happens on a device, it is marshalled as JSON, or rendered by the template of the webhook.
+type Delivery struct {
+	ID        string                `json:"id"`
+	WebhookID string                `json:"webhook_id"`
+	Source    string                `json:"source"`
+	DeviceID  string                `json:"device_id"`
+	ProductID string                `json:"product_id"`
+	EventID   models.ProductEventID `json:"event_id,omitempty"`
+	Time      time.Time             `json:"time"`
+	Data      interface{}           `json:"data"`
+}
+
+// DeadLetter is a delivery which still fails after all attempts.
+type DeadLetter struct {
+	Delivery   *Delivery `json:"delivery"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"` // 0 if the webhook doesn't respond
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// Dispatcher delivers the events and the statuses of devices to the webhooks stored in the meta store.
+// The events are subscribed from the Hub for each device and event selected by any webhook, so that the
+// subscriptions of the message bus are shared with the other subscribers, and the statuses are subscribed
+// for all devices once.
+//
+// The deliveries of a webhook are sent one by one in order, and retried with exponential backoff. The ones
+// failed after all attempts are kept in memory as dead letters, which could be redelivered.
+type Dispatcher struct {
+	ctx       context.Context
+	metaStore metastore.MetaStore
+	hub       *subscription.Hub
+	client    *http.Client
+	logger    *logger.Logger
+
+	reconciling sync.Mutex                    // serializes reconcile
+	closed      bool                          // no more subscriptions after shutdown, guarded by reconciling
+	feeds       map[subscription.Topic]func() // topic -> stop, only accessed by reconcile
+	pumps       sync.WaitGroup                // goroutines dispatching messages of feeds
+
+	mu      sync.RWMutex
+	hooks   map[string]*hook         // webhook ID -> hook, only the enabled ones
+	letters map[string][]*DeadLetter // webhook ID -> dead letters
+	workers sync.WaitGroup           // goroutines sending deliveries of hooks
+}
+
+// hook is an enabled webhook and the queue of its deliveries.
+type hook struct {
+	config atomic.Value // *metastore.Webhook, replaced once the webhook is updated
+	queue  chan *Delivery
+	stop   chan struct{}
+}
+
+func (h *hook) webhook() *metastore.Webhook {
+	return h.config.Load().(*metastore.Webhook)
+}
+
+func NewDispatcher(ctx context.Context, metaStore metastore.MetaStore,
+	hub *subscription.Hub, lg *logger.Logger) *Dispatcher {
+	return &Dispatcher{
+		ctx:       ctx,
+		metaStore: metaStore,
+		hub:       hub,
+		client:    &http.Client{},
+		logger:    lg,
+		feeds:     make(map[subscription.Topic]func()),
+		hooks:     make(map[string]*hook),
+		letters:   make(map[string][]*DeadLetter),
+	}
+}
+
+// Run keeps the subscriptions and the hooks consistent with the webhooks until the ctx is done,
+// and then stops all of them.
+func (d *Dispatcher) Run() {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.reconcile(); err != nil {
+			d.logger.WithError(err).Errorf("fail to reconcile the subscriptions of webhooks")
+		}
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			d.shutdown()
+			return
+		}
+	}
+}
+
+// Reload applies the changes of webhooks right now, rather than waiting for the next resync.
+func (d *Dispatcher) Reload() error {
+	return d.reconcile()
+}
+
+func (d *Dispatcher) reconcile() error {
+	d.reconciling.Lock()
+	defer d.reconciling.Unlock()
+	if d.closed {
+		return nil
+	}
+
+	webhooks, err := d.metaStore.ListWebhooks()
+	if err != nil {
+		return err
+	}
+	d.reconcileHooks(webhooks)
+
+	topics, err := d.resolveTopics(webhooks)
+	if err != nil {
+		return err
+	}
+	for topic, stop := range d.feeds {
+		if _, ok := topics[topic]; !ok {
+			stop()
+			delete(d.feeds, topic)
+		}
+	}
+	for topic, product := range topics {
+		if _, ok := d.feeds[topic]; ok {
+			continue
+		}
+		var protocolID, productID string
+		if product != nil {
+			protocolID, productID = product.Protocol, product.ID
+		}
+		bus, stop, err := d.hub.Subscribe(topic, protocolID, productID)
+		if err != nil {
+			d.logger.WithError(err).Errorf("fail to subscribe the topic[%s] for webhooks", topic)
+			continue
+		}
+		d.feeds[topic] = stop
+		d.pumps.Add(1)
+		go d.pump(topic, productID, bus)
+	}
+	return nil
+}
+
+// reconcileHooks starts the hooks of the webhooks enabled, updates the changed ones and stops the others.
+func (d *Dispatcher) reconcileHooks(webhooks []*metastore.Webhook) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	enabled := make(map[string]bool, len(webhooks))
+	for _, webhook := range webhooks {
+		if webhook.Disabled {
+			continue
+		}
+		enabled[webhook.ID] = true
+		if h, ok := d.hooks[webhook.ID]; ok {
+			if !reflect.DeepEqual(h.webhook(), webhook) {
+				h.config.Store(webhook)
+			}
+			continue
+		}
+		h := &hook{queue: make(chan *Delivery, queueSize), stop: make(chan struct{})}
+		h.config.Store(webhook)
+		d.hooks[webhook.ID] = h
+		d.workers.Add(1)
+		go d.work(h)
+	}
+	for id, h := range d.hooks {
+		if !enabled[id] {
+			close(h.stop)
+			delete(d.hooks, id)
+		}
+	}
+	for id := range d.letters {
+		if !containsWebhook(webhooks, id) {
+			delete(d.letters, id)
+		}
+	}
+}
+
+// resolveTopics returns the topics needed by the webhooks, along with the products of their devices.
+func (d *Dispatcher) resolveTopics(webhooks []*metastore.Webhook) (map[subscription.Topic]*models.Product, error) {
+	topics := make(map[subscription.Topic]*models.Product)
+	var devices []*models.Device
+	products := make(map[string]*models.Product)
+	for _, webhook := range webhooks {
+		if webhook.Disabled {
+			continue
+		}
+		if webhook.Subscribes(metastore.WebhookSourceStatus) {
+			topics[subscription.Topic{DeviceID: subscription.AllDevices, Kind: subscription.KindStatus}] = nil
+		}
+		if !webhook.Subscribes(metastore.WebhookSourceEvents) {
+			continue
+		}
+		if devices == nil {
+			var err error
+			if devices, _, err = d.metaStore.SearchDevices(nil, nil); err != nil {
+				return nil, err
+			}
+		}
+		for _, device := range devices {
+			if !webhook.Filter.Match(device.ID, device.ProductID, "", "") {
+				continue
+			}
+			product, ok := products[device.ProductID]
+			if !ok {
+				var err error
+				if product, err = d.metaStore.GetProduct(device.ProductID); err != nil {
+					d.logger.WithError(err).Errorf("fail to get the product[%s] of the device[%s] for webhooks",
+						device.ProductID, device.ID)
+					continue
+				}
+				products[device.ProductID] = product
+			}
+			for _, event := range product.Events {
+				if webhook.Filter.Match(device.ID, device.ProductID, event.Id, "") {
+					topics[subscription.Topic{DeviceID: device.ID, Kind: subscription.KindEvents, EventID: event.Id}] = product
+				}
+			}
+		}
+	}
+	return topics, nil
+}
+
+// pump dispatches the messages of the topic until it is stopped.
+func (d *Dispatcher) pump(topic subscription.Topic, productID string, bus <-chan interface{}) {
+	defer d.pumps.Done()
+	for data := range bus {
+		delivery := &Delivery{DeviceID: topic.DeviceID, ProductID: productID, Time: time.Now(), Data: data}
+		var state string
+		switch topic.Kind {
+		case subscription.KindStatus:
+			change, ok := data.(*health.DeviceStateChange)
+			if !ok {
+				continue
+			}
+			delivery.Source = metastore.WebhookSourceStatus
+			delivery.DeviceID, delivery.ProductID, delivery.Time = change.DeviceID, change.ProductID, change.Time
+			state = change.State
+		case subscription.KindEvents:
+			delivery.Source = metastore.WebhookSourceEvents
+			delivery.EventID = topic.EventID
+		}
+		d.dispatch(delivery, state)
+	}
+}
+
+// dispatch enqueues a copy of the delivery for each webhook matched.
+func (d *Dispatcher) dispatch(delivery *Delivery, state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, h := range d.hooks {
+		webhook := h.webhook()
+		if !webhook.Subscribes(delivery.Source) ||
+			!webhook.Filter.Match(delivery.DeviceID, delivery.ProductID, delivery.EventID, state) {
+			continue
+		}
+		copied := *delivery
+		copied.ID, copied.WebhookID = operations.NewReqID(), id
+		select {
+		case h.queue <- &copied:
+		default:
+			d.bury(id, &DeadLetter{Delivery: &copied, Error: "the queue of the webhook is full", Time: time.Now()})
+		}
+	}
+}
+
+// bury keeps the dead letter, the caller must hold the lock.
+func (d *Dispatcher) bury(webhookID string, letter *DeadLetter) {
+	metrics.WebhookDeliveries.WithLabelValues(metrics.WebhookResultDead).Inc()
+	letters := d.letters[webhookID]
+	if len(letters) >= deadLettersSize {
+		letters = append(letters[:0:0], letters[len(letters)-deadLettersSize+1:]...)
+	}
+	d.letters[webhookID] = append(letters, letter)
+}
+
+// DeadLetters returns the dead letters of the webhook, from the oldest to the latest.
+func (d *Dispatcher) DeadLetters(webhookID string) []*DeadLetter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return append(make([]*DeadLetter, 0, len(d.letters[webhookID])), d.letters[webhookID]...)
+}
+
+// Redeliver enqueues the dead letters of the webhook again, and returns the number of them.
+// It returns false if the webhook is not enabled.
+func (d *Dispatcher) Redeliver(webhookID string) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.hooks[webhookID]
+	if !ok {
+		return 0, false
+	}
+	letters := d.letters[webhookID]
+	delete(d.letters, webhookID)
+	for _, letter := range letters {
+		select {
+		case h.queue <- letter.Delivery:
+		default:
+			d.bury(webhookID, letter)
+		}
+	}
+	return len(letters), true
+}
+
+// ClearDeadLetters drops the dead letters of the webhook.
+func (d *Dispatcher) ClearDeadLetters(webhookID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.letters, webhookID)
+}
+
+// shutdown stops all subscriptions and hooks, the deliveries not sent yet are dropped.
+func (d *Dispatcher) shutdown() {
+	d.reconciling.Lock()
+	d.closed = true
+	for topic, stop := range d.feeds {
+		stop()
+		delete(d.feeds, topic)
+	}
+	d.reconciling.Unlock()
+	d.pumps.Wait()
+
+	d.mu.Lock()
+	for id, h := range d.hooks {
+		close(h.stop)
+		delete(d.hooks, id)
+	}
+	d.mu.Unlock()
+	d.workers.Wait()
+}
+
+func containsWebhook(webhooks []*metastore.Webhook, id string) bool {
+	for _, webhook := range webhooks {
+		if webhook.ID == id {
+			return true
+		}
+	}
+	return false
+}
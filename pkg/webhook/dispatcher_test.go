@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/thingio/edge-device-manager/pkg/health"
+	"github.com/thingio/edge-device-manager/pkg/metastore"
+	"github.com/thingio/edge-device-manager/pkg/subscription"
+	stdconfig "github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService hands out a bus of the events for each subscription of the message bus.
+type fakeService struct {
+	operations.ManagerService
+
+	mu    sync.Mutex
+	buses map[string]chan interface{} // "{device-id}/{event-id}" -> bus
+}
+
+func (s *fakeService) SubscribeDeviceEvent(protocolID, productID, deviceID string,
+	eventID models.ProductEventID) (<-chan interface{}, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bus := make(chan interface{}, 10)
+	s.buses[deviceID+"/"+eventID] = bus
+	return bus, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.buses, deviceID+"/"+eventID)
+		close(bus)
+	}, nil
+}
+
+func (s *fakeService) subscribed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make([]string, 0, len(s.buses))
+	for topic := range s.buses {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// receiver records the requests sent to the webhook, and responds the statuses in order, and then 200.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests chan *received
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, string) {
+	rc := &receiver{statuses: statuses, requests: make(chan *received, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rc.requests <- &received{header: r.Header, body: body}
+		rc.mu.Lock()
+		status := http.StatusOK
+		if len(rc.statuses) != 0 {
+			status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+		}
+		rc.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return rc, server.URL
+}
+
+func (rc *receiver) receive(t *testing.T) *received {
+	t.Helper()
+	select {
+	case r := <-rc.requests:
+		return r
+	case <-time.After(3 * time.Second):
+		t.Fatal("the webhook is not called")
+		return nil
+	}
+}
+
+// newTestDispatcher returns a running dispatcher of the webhooks, the device d1 and d2 of the product p1
+// are stored along with them.
+func newTestDispatcher(t *testing.T, webhooks ...*metastore.Webhook) (*Dispatcher, *fakeService) {
+	t.Helper()
+	store, err := metastore.NewFileMetaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateProduct(&models.Product{ID: "p1", Name: "P1", Protocol: "modbus",
+		Events: []*models.ProductEvent{{Id: "alarm"}, {Id: "info"}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"d1", "d2"} {
+		if err = store.CreateDevice(&models.Device{ID: id, Name: id, ProductID: "p1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, webhook := range webhooks {
+		if err = webhook.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.CreateWebhook(webhook); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lg, err := logger.NewLogger(&stdconfig.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	service := &fakeService{buses: make(map[string]chan interface{})}
+	d := NewDispatcher(ctx, store, subscription.NewHub(service), lg)
+	done := make(chan struct{})
+	go func() {
+		d.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	if err = d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	return d, service
+}
+
+func publishStatus(d *Dispatcher, deviceID, state string) {
+	d.hub.Publish(subscription.Topic{DeviceID: deviceID, Kind: subscription.KindStatus},
+		&health.DeviceStateChange{DeviceID: deviceID, ProductID: "p1", State: state, Time: time.Now()})
+}
+
+func TestDispatcherSubscribesSelectedEvents(t *testing.T) {
+	rc, url := newReceiver(t)
+	_, service := newTestDispatcher(t, &metastore.Webhook{ID: "w1", URL: url,
+		Sources: []string{metastore.WebhookSourceEvents},
+		Filter:  metastore.WebhookFilter{Devices: []string{"d1"}, Events: []models.ProductEventID{"alarm"}}})
+
+	if got := service.subscribed(); len(got) != 1 || got[0] != "d1/alarm" {
+		t.Fatalf("subscribed %v, want only the selected event of the selected device", got)
+	}
+	service.mu.Lock()
+	service.buses["d1/alarm"] <- map[string]interface{}{"level": "high"}
+	service.mu.Unlock()
+
+	delivery := new(Delivery)
+	if err := json.Unmarshal(rc.receive(t).body, delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.WebhookID != "w1" || delivery.Source != metastore.WebhookSourceEvents || delivery.DeviceID != "d1" ||
+		delivery.ProductID != "p1" || delivery.EventID != "alarm" || delivery.ID == "" {
+		t.Errorf("the delivery = %+v, want the alarm of d1", delivery)
+	}
+}
+
+func TestDispatcherRendersAndSigns(t *testing.T) {
+	rc, url := newReceiver(t)
+	d, _ := newTestDispatcher(t, &metastore.Webhook{ID: "w1", URL: url, Secret: "s3cret",
+		Sources:     []string{metastore.WebhookSourceStatus},
+		Filter:      metastore.WebhookFilter{States: []string{models.DeviceStateException}},
+		Template:    `{"device": "{{.DeviceID}}", "state": {{json .Data.State}}}`,
+		ContentType: "application/vnd.mes+json",
+		Headers:     map[string]string{"Authorization": "Bearer token"}})
+
+	publishStatus(d, "d1", models.DeviceStateConnected) // filtered out by the states
+	publishStatus(d, "d2", models.DeviceStateException)
+	r := rc.receive(t)
+	if string(r.body) != `{"device": "d2", "state": "exception"}` {
+		t.Errorf("the payload = %s, want it rendered by the template", r.body)
+	}
+	if r.header.Get("Content-Type") != "application/vnd.mes+json" || r.header.Get("Authorization") != "Bearer token" ||
+		r.header.Get(HeaderWebhookID) != "w1" || r.header.Get(HeaderDelivery) == "" {
+		t.Errorf("the headers = %v, want the configured ones with the webhook and the delivery", r.header)
+	}
+	if want := Sign("s3cret", r.header.Get(HeaderTimestamp), r.body); r.header.Get(HeaderSignature) != want {
+		t.Errorf("the signature = %s, want %s", r.header.Get(HeaderSignature), want)
+	}
+	select {
+	case r = <-rc.requests:
+		t.Errorf("the filtered status is delivered as %s", r.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	rc, url := newReceiver(t, http.StatusServiceUnavailable)
+	d, _ := newTestDispatcher(t, &metastore.Webhook{ID: "w1", URL: url, MaxAttempts: 2})
+
+	publishStatus(d, "d1", models.DeviceStateException)
+	first, second := rc.receive(t), rc.receive(t)
+	if first.header.Get(HeaderDelivery) != second.header.Get(HeaderDelivery) {
+		t.Errorf("the retry is the delivery %s, want %s", second.header.Get(HeaderDelivery), first.header.Get(HeaderDelivery))
+	}
+	if letters := d.DeadLetters("w1"); len(letters) != 0 {
+		t.Errorf("%d dead letters, want none once the retry succeeds", len(letters))
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	// the client error is not retried, and the server error is retried until all attempts fail
+	rc, url := newReceiver(t, http.StatusBadRequest, http.StatusInternalServerError, http.StatusInternalServerError)
+	d, _ := newTestDispatcher(t, &metastore.Webhook{ID: "w1", URL: url, MaxAttempts: 2})
+
+	publishStatus(d, "d1", models.DeviceStateException)
+	rc.receive(t)
+	publishStatus(d, "d2", models.DeviceStateException)
+	rc.receive(t)
+	rc.receive(t)
+
+	var letters []*DeadLetter
+	for deadline := time.Now().Add(time.Second); len(letters) < 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dead letters, want 2", len(letters))
+		}
+		letters = d.DeadLetters("w1")
+	}
+	if l := letters[0]; l.Delivery.DeviceID != "d1" || l.Attempts != 1 || l.StatusCode != http.StatusBadRequest {
+		t.Errorf("the first dead letter = %+v after %d attempts, want d1 with 400 at once", l.Delivery, l.Attempts)
+	}
+	if l := letters[1]; l.Delivery.DeviceID != "d2" || l.Attempts != 2 || l.StatusCode != http.StatusInternalServerError {
+		t.Errorf("the second dead letter = %+v after %d attempts, want d2 with 500 after all attempts", l.Delivery, l.Attempts)
+	}
+
+	if n, ok := d.Redeliver("w1"); n != 2 || !ok {
+		t.Fatalf("redelivered %d and %t, want 2 and true", n, ok)
+	}
+	for _, want := range []string{letters[0].Delivery.ID, letters[1].Delivery.ID} {
+		if got := rc.receive(t).header.Get(HeaderDelivery); got != want {
+			t.Errorf("redelivered %s, want %s", got, want)
+		}
+	}
+	if letters = d.DeadLetters("w1"); len(letters) != 0 {
+		t.Errorf("%d dead letters after redelivering, want none", len(letters))
+	}
+	if _, ok := d.Redeliver("missing"); ok {
+		t.Error("the dead letters of an unknown webhook should not be redelivered")
+	}
+}